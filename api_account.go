@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AccountHandler returns the authenticated account's metadata and usage statistics.
+func AccountHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use GET against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "account.get")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(account)
+}
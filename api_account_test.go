@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAccountHandler(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/account", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("user", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"user": {Name: "user", TotalRuntime: 123456789, TotalJobs: 12},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	AccountHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+
+	var response map[string]interface{}
+	out := w.Body.Bytes()
+	if err := json.Unmarshal(out, &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	}
+	t.Logf("Response body:\n%s", out)
+
+	if name := response["name"]; name != "user" {
+		t.Errorf("Unexpected account name: [%v]", name)
+	}
+	if runtime, ok := response["total_runtime"]; !ok || runtime != float64(123456789) {
+		t.Errorf("Unexpected total runtime: [%v]", runtime)
+	}
+	if jobs, ok := response["total_jobs"]; !ok || jobs != float64(12) {
+		t.Errorf("Unexpected total jobs: [%v]", jobs)
+	}
+}
+
+func TestAccountHandlerUnauthenticated(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/account", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	c := &Context{
+		Storage:     NullStorage{},
+		AuthService: NullAuthService{},
+	}
+
+	AccountHandler(c, w, r)
+
+	hasError(t, w, http.StatusUnauthorized, APIError{
+		Code:    CodeCredentialsMissing,
+		Message: "You must authenticate.",
+		Retry:   false,
+	})
+}
@@ -0,0 +1,625 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AdminAccountResourceHandler dispatches administrative actions on the account named by the request
+// path, as in POST /v1/admin/accounts/:name/suspend.
+func AdminAccountResourceHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/unsuspend"):
+		AdminAccountUnsuspendHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/suspend"):
+		AdminAccountSuspendHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/credits"):
+		AdminAccountCreditsHandler(c, w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// AdminAccountSuspendHandler allows an administrator to suspend an account, preventing it from
+// authenticating without deleting it, as in POST /v1/admin/accounts/:name/suspend.
+func AdminAccountSuspendHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	setAccountSuspended(c, w, r, true)
+}
+
+// AdminAccountUnsuspendHandler allows an administrator to reinstate a suspended account, as in
+// POST /v1/admin/accounts/:name/unsuspend.
+func AdminAccountUnsuspendHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	setAccountSuspended(c, w, r, false)
+}
+
+func setAccountSuspended(c *Context, w http.ResponseWriter, r *http.Request, suspended bool) {
+	action, suffix := "account.unsuspend", "/unsuspend"
+	if suspended {
+		action, suffix = "account.suspend", "/suspend"
+	}
+
+	admin, name, ok := adminPathAccountAction(c, w, r, action, suffix)
+	if !ok {
+		return
+	}
+
+	if err := c.UpdateAccountSuspended(name, suspended); err != nil {
+		reportAccountUpdateError(admin, name, err, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account":   name,
+		"admin":     admin.Name,
+		"suspended": suspended,
+	}).Info("Account suspension updated.")
+
+	OKResponse(w)
+}
+
+// AccountUpdateHandler allows an administrator to change the settings of an existing account. An
+// "expires_at" form parameter sets the time at which the account expires; an empty value removes
+// the expiration.
+func AccountUpdateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	admin, name, ok := adminAccountAction(c, w, r, "account.update")
+	if !ok {
+		return
+	}
+
+	if rawExpiresAt, present := r.PostForm["expires_at"]; present {
+		var expiresAt *StoredTime
+		if raw := rawExpiresAt[0]; raw != "" {
+			parsed, err := ParseStoredTime(raw)
+			if err != nil {
+				APIError{
+					Code:    CodeInvalidAccountForm,
+					Message: fmt.Sprintf("Unable to parse expiration time [%s]: %v", raw, err),
+					Hint:    fmt.Sprintf("Please specify expires_at as a UTC timestamp in the format [%s].", timeFormat),
+					Retry:   false,
+				}.Log(admin).Report(http.StatusBadRequest, w)
+				return
+			}
+			expiresAt = &parsed
+		}
+
+		if err := c.UpdateAccountExpiry(name, expiresAt); err != nil {
+			reportAccountUpdateError(admin, name, err, w)
+			return
+		}
+
+		RequestLog(w).WithFields(log.Fields{
+			"account":    name,
+			"admin":      admin.Name,
+			"expires at": expiresAt,
+		}).Info("Account expiration updated.")
+	}
+
+	OKResponse(w)
+}
+
+// AdminAccountCreditsHandler allows an administrator to add credits to, or (with a negative
+// "amount") subtract credits from, an account, as in POST /v1/admin/accounts/:name/credits.
+func AdminAccountCreditsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	admin, name, ok := adminPathAccountAction(c, w, r, "account.credits", "/credits")
+	if !ok {
+		return
+	}
+
+	rawAmount := r.PostFormValue("amount")
+	amount, err := strconv.ParseInt(rawAmount, 10, 64)
+	if err != nil {
+		APIError{
+			Code:    CodeInvalidAccountForm,
+			Message: fmt.Sprintf("Unable to parse credit amount [%s]: %v", rawAmount, err),
+			Hint:    "Please specify the number of credits to add or subtract as an integral amount.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	if err := c.AdjustAccountCredits(name, amount); err != nil {
+		reportAccountUpdateError(admin, name, err, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account": name,
+		"admin":   admin.Name,
+		"amount":  amount,
+	}).Info("Account credits adjusted.")
+
+	OKResponse(w)
+}
+
+// AccountCreateHandler allows an administrator to create a new account with an API key. The request
+// body is a JSON object with "name" and "api_key" elements, and an optional "expires_at" timestamp
+// that creates a time-limited account.
+func AccountCreateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		Name      string      `json:"name"`
+		APIKey    string      `json:"api_key"`
+		ExpiresAt *StoredTime `json:"expires_at"`
+	}
+
+	if r.Method != "POST" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use POST against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "account.create")
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		APIError{
+			Code:    CodeInvalidAccountForm,
+			Message: fmt.Sprintf("Unable to parse account payload as JSON: %v", err),
+			Hint:    "Please supply valid JSON in your request.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+	if req.Name == "" || req.APIKey == "" {
+		APIError{
+			Code:    CodeInvalidAccountForm,
+			Message: "An account name and API key are required.",
+			Hint:    `Specify the new account as {"name": "...", "api_key": "..."}.`,
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	account := Account{Name: req.Name, ExpiresAt: req.ExpiresAt}
+	err = c.CreateAccount(account, req.APIKey)
+	if err == ErrAccountExists {
+		APIError{
+			Code:    CodeAccountExists,
+			Message: fmt.Sprintf("An account named [%s] already exists.", req.Name),
+			Hint:    "Choose a different account name.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		APIError{
+			Code:    CodeStorageError,
+			Message: fmt.Sprintf("Unable to create account [%s]: %v", req.Name, err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(admin).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account":    req.Name,
+		"admin":      admin.Name,
+		"expires at": req.ExpiresAt,
+	}).Info("Account created.")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(account)
+}
+
+// AccountResourceHandler dispatches requests that act on the account named by the request path:
+// PUT /v1/accounts/:name/quota sets its quotas, and DELETE /v1/accounts/:name deactivates it.
+func AccountResourceHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/quota") {
+		AccountQuotaHandler(c, w, r)
+		return
+	}
+	AccountDeleteHandler(c, w, r)
+}
+
+// AccountQuotaHandler allows an administrator to set the quotas of the account named by the request
+// path, as in PUT /v1/accounts/:name/quota. The request body is a JSON object with "max_queued_jobs"
+// and "max_concurrent_jobs" elements. Zero removes the account's own limit.
+func AccountQuotaHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		MaxQueuedJobs     int `json:"max_queued_jobs"`
+		MaxConcurrentJobs int `json:"max_concurrent_jobs"`
+	}
+
+	if r.Method != "PUT" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use PUT against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "account.quota")
+
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/accounts/"), "/quota")
+	if name == "" {
+		APIError{
+			Code:    CodeAccountNotFound,
+			Message: "No account name was provided.",
+			Hint:    "Specify the account as /v1/accounts/:name/quota.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		APIError{
+			Code:    CodeInvalidAccountForm,
+			Message: fmt.Sprintf("Unable to parse quota payload as JSON: %v", err),
+			Hint:    "Please supply valid JSON in your request.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+	if req.MaxQueuedJobs < 0 || req.MaxConcurrentJobs < 0 {
+		APIError{
+			Code:    CodeInvalidAccountForm,
+			Message: fmt.Sprintf("Invalid negative quota: queued [%d], concurrent [%d]", req.MaxQueuedJobs, req.MaxConcurrentJobs),
+			Hint:    "Please specify non-negative quotas, or zero for no limit.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	if err := c.UpdateAccountQuota(name, req.MaxQueuedJobs, req.MaxConcurrentJobs); err != nil {
+		reportAccountUpdateError(admin, name, err, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account":             name,
+		"admin":               admin.Name,
+		"max queued jobs":     req.MaxQueuedJobs,
+		"max concurrent jobs": req.MaxConcurrentJobs,
+	}).Info("Account quota updated.")
+
+	OKResponse(w)
+}
+
+// AccountDeleteHandler allows an administrator to deactivate the account named by the request path,
+// as in DELETE /v1/accounts/:name. A deactivated account may no longer authenticate, but it and its
+// jobs are kept.
+func AccountDeleteHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use DELETE against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "account.delete")
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/accounts/")
+	if name == "" {
+		APIError{
+			Code:    CodeAccountNotFound,
+			Message: "No account name was provided.",
+			Hint:    "Specify the account to deactivate as /v1/accounts/:name.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+	if name == c.AdminName {
+		APIError{
+			Code:    CodeInvalidAccountForm,
+			Message: fmt.Sprintf("The account [%s] is the configured administrator.", name),
+			Hint:    "The configured administrator can't be deactivated.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	if err := c.UpdateAccountActive(name, false); err != nil {
+		reportAccountUpdateError(admin, name, err, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account": name,
+		"admin":   admin.Name,
+	}).Info("Account deactivated.")
+
+	OKResponse(w)
+}
+
+// adminAccountAction performs the common preamble for administrative POSTs that act on a single
+// named account: it verifies the request method, authenticates an administrator, records action in
+// the audit log, and extracts the target account name from the form body.
+func adminAccountAction(c *Context, w http.ResponseWriter, r *http.Request, action string) (*Account, string, bool) {
+	admin, ok := authorizeAdminAction(c, w, r, action)
+	if !ok {
+		return nil, "", false
+	}
+
+	name := r.PostFormValue("name")
+	if name == "" {
+		APIError{
+			Code:    CodeAccountNotFound,
+			Message: "No account name was provided.",
+			Hint:    `Specify the account to act on as a "name" form parameter.`,
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return nil, "", false
+	}
+
+	return admin, name, true
+}
+
+// adminPathAccountAction is adminAccountAction for administrative POSTs that name their target
+// account in the request path, as in /v1/admin/accounts/:name followed by suffix.
+func adminPathAccountAction(c *Context, w http.ResponseWriter, r *http.Request, action, suffix string) (*Account, string, bool) {
+	admin, ok := authorizeAdminAction(c, w, r, action)
+	if !ok {
+		return nil, "", false
+	}
+
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/admin/accounts/"), suffix)
+	if name == "" || strings.Contains(name, "/") {
+		APIError{
+			Code:    CodeAccountNotFound,
+			Message: "No account name was provided.",
+			Hint:    fmt.Sprintf("Specify the account as /v1/admin/accounts/:name%s.", suffix),
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return nil, "", false
+	}
+
+	return admin, name, true
+}
+
+// authorizeAdminAction ensures that a request is a POST from an administrator, records it in the
+// audit log as an action, and parses its form. It reports an error and returns false otherwise.
+func authorizeAdminAction(c *Context, w http.ResponseWriter, r *http.Request, action string) (*Account, bool) {
+	if r.Method != "POST" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use POST against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return nil, false
+	}
+
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return nil, false
+	}
+	c.Audit.Record(r, admin, action)
+
+	if err := r.ParseForm(); err != nil {
+		APIError{
+			Code:    CodeUnableToParseQuery,
+			Message: fmt.Sprintf("Unable to parse form body: %v", err),
+			Hint:    "Please use valid form encoding in your request.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusBadRequest, w)
+		return nil, false
+	}
+
+	return admin, true
+}
+
+// reportAccountUpdateError reports a failure to update an account, distinguishing a missing account
+// from a storage failure.
+func reportAccountUpdateError(admin *Account, name string, err error, w http.ResponseWriter) {
+	if err == ErrNotFound {
+		APIError{
+			Code:    CodeAccountNotFound,
+			Message: fmt.Sprintf("Unable to find an account named [%s].", name),
+			Hint:    "Double-check the account name.",
+			Retry:   false,
+		}.Log(admin).Report(http.StatusNotFound, w)
+		return
+	}
+
+	APIError{
+		Code:    CodeAccountUpdateFailure,
+		Message: fmt.Sprintf("Unable to update account [%s]: %v", name, err),
+		Hint:    "This is probably a storage error on our end.",
+		Retry:   true,
+	}.Log(admin).Report(http.StatusInternalServerError, w)
+}
+
+// QueueDepthHandler reports the number of jobs in each status across every account, along with the
+// creation time of the oldest job that's still waiting in the queue.
+func QueueDepthHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "admin.queue_depth")
+
+	depths, err := c.GetQueueDepths()
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to count jobs: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(admin).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	// JIDs are assigned in order, so the queued job with the lowest JID has been waiting longest.
+	oldest, err := c.ListJobs(JobQuery{Statuses: []string{StatusQueued}, Limit: 1})
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to find the oldest queued job: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(admin).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	var response struct {
+		Depths         map[string]int64 `json:"depths"`
+		OldestQueuedAt *StoredTime      `json:"oldest_queued_at"`
+	}
+	response.Depths = make(map[string]int64, len(validStatus))
+	for status := range validStatus {
+		response.Depths[status] = depths[status]
+	}
+	if len(oldest) > 0 {
+		response.OldestQueuedAt = &oldest[0].CreatedAt
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// SchemaVersionHandler reports the current version of the storage schema, and how many migrations
+// must be applied to bring it up to date. Only administrators may use it.
+func SchemaVersionHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "admin.schema_version")
+
+	current, err := c.SchemaVersion()
+	if err != nil {
+		APIError{
+			Code:    CodeSchemaVersionFailure,
+			Message: fmt.Sprintf("Unable to read the schema version: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(admin).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	latest := LatestSchemaVersion()
+	pending := latest - current
+	if pending < 0 {
+		pending = 0
+	}
+
+	response := struct {
+		CurrentVersion    int `json:"current_version"`
+		LatestVersion     int `json:"latest_version"`
+		PendingMigrations int `json:"pending_migrations"`
+	}{current, latest, pending}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// MigrateHandler starts applying pending schema migrations in the background when it receives a
+// POST to /v1/admin/migrate, and reports on a migration's progress when it receives a GET to
+// /v1/admin/migrate/{id}. Only administrators may use it.
+func MigrateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/v1/admin/migrate"), "/")
+
+	if (id == "" && r.Method != "POST") || (id != "" && r.Method != "GET") {
+		hint := "Use POST against this endpoint."
+		if id != "" {
+			hint = "Use GET against this endpoint."
+		}
+
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    hint,
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "admin.migrate")
+
+	if id != "" {
+		migration, ok := c.Migrations.Get(id)
+		if !ok {
+			APIError{
+				Code:    CodeMigrationNotFound,
+				Message: fmt.Sprintf("No migration with ID [%s] has been started by this server.", id),
+				Retry:   false,
+			}.Log(admin).Report(http.StatusNotFound, w)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(migration)
+		return
+	}
+
+	migration, err := c.Migrations.Start(c, nil)
+	if err == ErrMigrationInProgress {
+		APIError{
+			Code:    CodeMigrationInProgress,
+			Message: "A schema migration is already in progress.",
+			Hint:    "Wait for the running migration to finish.",
+			Retry:   true,
+		}.Log(admin).Report(http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		APIError{
+			Code:    CodeMigrationFailure,
+			Message: fmt.Sprintf("Unable to start a schema migration: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(admin).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account":   admin.Name,
+		"migration": migration.ID,
+	}).Info("Schema migration started.")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(migration)
+}
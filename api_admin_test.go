@@ -0,0 +1,720 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// AccountStorage is a fake Storage implementation that keeps accounts in memory.
+type AccountStorage struct {
+	NullStorage
+
+	Accounts map[string]*Account
+}
+
+func (storage *AccountStorage) GetAccount(name string) (*Account, error) {
+	if account, ok := storage.Accounts[name]; ok {
+		copied := *account
+		return &copied, nil
+	}
+	return &Account{Name: name}, nil
+}
+
+func (storage *AccountStorage) GetAPIKeyHash(name string) (string, error) {
+	if account, ok := storage.Accounts[name]; ok {
+		return account.APIKeyHash, nil
+	}
+	return "", ErrNotFound
+}
+
+func (storage *AccountStorage) CreateAccount(account Account, apiKey string) error {
+	if _, ok := storage.Accounts[account.Name]; ok {
+		return ErrAccountExists
+	}
+	account.APIKeyHash = HashAPIKey(apiKey)
+	storage.Accounts[account.Name] = &account
+	return nil
+}
+
+func (storage *AccountStorage) UpdateAccountSuspended(name string, suspended bool) error {
+	account, ok := storage.Accounts[name]
+	if !ok {
+		return ErrNotFound
+	}
+	account.Suspended = suspended
+	return nil
+}
+
+func (storage *AccountStorage) UpdateAccountActive(name string, active bool) error {
+	account, ok := storage.Accounts[name]
+	if !ok {
+		return ErrNotFound
+	}
+	account.Active = &active
+	return nil
+}
+
+func (storage *AccountStorage) UpdateAccountQuota(name string, maxQueuedJobs, maxConcurrentJobs int) error {
+	account, ok := storage.Accounts[name]
+	if !ok {
+		return ErrNotFound
+	}
+	account.MaxQueuedJobs = maxQueuedJobs
+	account.MaxConcurrentJobs = maxConcurrentJobs
+	return nil
+}
+
+func (storage *AccountStorage) UpdateAccountExpiry(name string, expiresAt *StoredTime) error {
+	account, ok := storage.Accounts[name]
+	if !ok {
+		return ErrNotFound
+	}
+	account.ExpiresAt = expiresAt
+	return nil
+}
+
+func (storage *AccountStorage) AdjustAccountCredits(name string, delta int64) error {
+	account, ok := storage.Accounts[name]
+	if !ok {
+		return ErrNotFound
+	}
+	account.Credits += delta
+	return nil
+}
+
+func adminAccountRequest(t *testing.T, path, body, username string, handler ContextHandler) (*httptest.ResponseRecorder, *AccountStorage) {
+	s := &AccountStorage{
+		Accounts: map[string]*Account{
+			"admin": {Name: "admin", Admin: true},
+			"user":  {Name: "user"},
+		},
+	}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage:     s,
+		AuthService: TrustingAuthService{},
+	}
+
+	return serveRequest(t, c, handler, username, "POST", path, body), s
+}
+
+func TestSuspendAccount(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/accounts/user/suspend", "", "admin", AdminAccountResourceHandler)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if !s.Accounts["user"].Suspended {
+		t.Error("Expected the account to be suspended")
+	}
+}
+
+func TestUnsuspendAccount(t *testing.T) {
+	r, err := http.NewRequest("POST", "https://localhost/v1/admin/accounts/user/unsuspend", strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &AccountStorage{
+		Accounts: map[string]*Account{
+			"user": {Name: "user", Suspended: true},
+		},
+	}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	AdminAccountResourceHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Accounts["user"].Suspended {
+		t.Error("Expected the account to be reinstated")
+	}
+}
+
+func TestSuspendAccountWithoutName(t *testing.T) {
+	w, _ := adminAccountRequest(t, "/v1/admin/accounts//suspend", "", "admin", AdminAccountResourceHandler)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeAccountNotFound,
+		Message: "No account name was provided.",
+		Retry:   false,
+	})
+}
+
+func TestAdminAccountResourceHandlerUnknownAction(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/accounts/user/delete", "", "admin", AdminAccountResourceHandler)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Accounts["user"] == nil {
+		t.Error("Expected the account to be left alone")
+	}
+}
+
+func TestSuspendUnknownAccount(t *testing.T) {
+	w, _ := adminAccountRequest(t, "/v1/admin/accounts/nobody/suspend", "", "admin", AdminAccountResourceHandler)
+
+	hasError(t, w, http.StatusNotFound, APIError{
+		Code:    CodeAccountNotFound,
+		Message: "Unable to find an account named [nobody].",
+		Retry:   false,
+	})
+}
+
+func TestSuspendAccountRequiresAdmin(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/accounts/admin/suspend", "", "user", AdminAccountResourceHandler)
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] is not an administrator.",
+		Retry:   false,
+	})
+	if s.Accounts["admin"].Suspended {
+		t.Error("Expected a non-administrator to be unable to suspend an account")
+	}
+}
+
+func TestUpdateAccountExpiry(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/account/update",
+		"name=user&expires_at=2030-01-02+03:04:05.000", "admin", AccountUpdateHandler)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+
+	expiresAt := s.Accounts["user"].ExpiresAt
+	if expiresAt == nil {
+		t.Fatal("Expected the account's expiration time to be set")
+	}
+	if expected := "2030-01-02 03:04:05.000"; expiresAt.String() != expected {
+		t.Errorf("Expected expiration time [%s], got [%s]", expected, expiresAt)
+	}
+}
+
+func TestClearAccountExpiry(t *testing.T) {
+	r, err := http.NewRequest("POST", "https://localhost/v1/admin/account/update", strings.NewReader("name=user&expires_at="))
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	expiresAt := StoreTime(time.Now())
+	s := &AccountStorage{
+		Accounts: map[string]*Account{
+			"user": {Name: "user", ExpiresAt: &expiresAt},
+		},
+	}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	AccountUpdateHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Accounts["user"].ExpiresAt != nil {
+		t.Errorf("Expected the account's expiration time to be cleared, but was [%s]", s.Accounts["user"].ExpiresAt)
+	}
+}
+
+func TestUpdateAccountInvalidExpiry(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/account/update",
+		"name=user&expires_at=tomorrow", "admin", AccountUpdateHandler)
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Accounts["user"].ExpiresAt != nil {
+		t.Error("Expected the account's expiration time to be unchanged")
+	}
+}
+
+func TestAdjustAccountCredits(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/accounts/user/credits",
+		"amount=500", "admin", AdminAccountResourceHandler)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if credits := s.Accounts["user"].Credits; credits != 500 {
+		t.Errorf("Expected the account to have 500 credits, got [%d]", credits)
+	}
+}
+
+func TestAdjustAccountCreditsRequiresAdmin(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/admin/accounts/user/credits",
+		"amount=500", "user", AdminAccountResourceHandler)
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if credits := s.Accounts["user"].Credits; credits != 0 {
+		t.Errorf("Expected the account's credits to be unchanged, got [%d]", credits)
+	}
+}
+
+func TestCreateAccount(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/accounts", `{"name":"newbie","api_key":"s3cret"}`, "admin", AccountCreateHandler)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	account, ok := s.Accounts["newbie"]
+	if !ok {
+		t.Fatal("Expected the account to be created")
+	}
+	if account.APIKeyHash != HashAPIKey("s3cret") {
+		t.Errorf("Expected the API key's hash to be stored, got [%s]", account.APIKeyHash)
+	}
+	if strings.Contains(w.Body.String(), "s3cret") || strings.Contains(w.Body.String(), account.APIKeyHash) {
+		t.Errorf("Expected the API key to be left out of the response, got [%s]", w.Body.String())
+	}
+}
+
+func TestCreateAccountWithExpiry(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/accounts",
+		`{"name":"newbie","api_key":"s3cret","expires_at":"2030-01-02 03:04:05.000"}`, "admin", AccountCreateHandler)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	expected, _ := ParseStoredTime("2030-01-02 03:04:05.000")
+	if expiresAt := s.Accounts["newbie"].ExpiresAt; expiresAt == nil || *expiresAt != expected {
+		t.Errorf("Expected the account to expire at [%v], got [%v]", expected, expiresAt)
+	}
+}
+
+func TestCreateAccountRequiresAdmin(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/accounts", `{"name":"newbie","api_key":"s3cret"}`, "user", AccountCreateHandler)
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] is not an administrator.",
+		Retry:   false,
+	})
+	if _, ok := s.Accounts["newbie"]; ok {
+		t.Error("Expected the account not to be created")
+	}
+}
+
+func TestCreateAccountDuplicateName(t *testing.T) {
+	w, s := adminAccountRequest(t, "/v1/accounts", `{"name":"user","api_key":"s3cret"}`, "admin", AccountCreateHandler)
+
+	hasError(t, w, http.StatusConflict, APIError{
+		Code:    CodeAccountExists,
+		Message: "An account named [user] already exists.",
+		Retry:   false,
+	})
+	if s.Accounts["user"].APIKeyHash != "" {
+		t.Error("Expected the existing account to be left alone")
+	}
+}
+
+func TestCreateAccountMissingKey(t *testing.T) {
+	w, _ := adminAccountRequest(t, "/v1/accounts", `{"name":"newbie"}`, "admin", AccountCreateHandler)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeInvalidAccountForm,
+		Message: "An account name and API key are required.",
+		Retry:   false,
+	})
+}
+
+func accountDeleteContext() (*Context, *AccountStorage) {
+	s := &AccountStorage{
+		Accounts: map[string]*Account{
+			"admin": {Name: "admin", Admin: true},
+			"user":  {Name: "user"},
+		},
+	}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage:     s,
+		AuthService: TrustingAuthService{},
+	}
+	return c, s
+}
+
+func TestDeleteAccount(t *testing.T) {
+	c, s := accountDeleteContext()
+
+	w := serveRequest(t, c, AccountDeleteHandler, "admin", "DELETE", "/v1/accounts/"+"user", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if s.Accounts["user"].IsActive() {
+		t.Fatal("Expected the account to be deactivated")
+	}
+
+	// The deactivated account's credentials are rejected from now on.
+	r, err := http.NewRequest("GET", "https://localhost/v1/account", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("user", "12345")
+	w = httptest.NewRecorder()
+
+	AccountHandler(c, w, r)
+
+	hasError(t, w, http.StatusUnauthorized, APIError{
+		Code:    CodeAccountDeactivated,
+		Message: "The account [user] has been deactivated.",
+		Retry:   false,
+	})
+}
+
+func TestDeleteAccountRequiresAdmin(t *testing.T) {
+	c, s := accountDeleteContext()
+
+	w := serveRequest(t, c, AccountDeleteHandler, "user", "DELETE", "/v1/accounts/"+"admin", "")
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] is not an administrator.",
+		Retry:   false,
+	})
+	if !s.Accounts["admin"].IsActive() {
+		t.Error("Expected the account to remain active")
+	}
+}
+
+func TestDeleteUnknownAccount(t *testing.T) {
+	c, _ := accountDeleteContext()
+
+	w := serveRequest(t, c, AccountDeleteHandler, "admin", "DELETE", "/v1/accounts/"+"nobody", "")
+
+	hasError(t, w, http.StatusNotFound, APIError{
+		Code:    CodeAccountNotFound,
+		Message: "Unable to find an account named [nobody].",
+		Retry:   false,
+	})
+}
+
+func TestQueueDepth(t *testing.T) {
+	oldest := StoreTime(time.Date(2015, time.March, 14, 9, 26, 0, 0, time.UTC))
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "someone", Status: StatusDone})
+	s.InsertJob(SubmittedJob{Account: "someone", Status: StatusQueued, CreatedAt: oldest})
+	s.InsertJob(SubmittedJob{Account: "other", Status: StatusQueued, CreatedAt: StoreTime(time.Now())})
+	s.InsertJob(SubmittedJob{Account: "other", Status: StatusProcessing})
+
+	r, err := http.NewRequest("GET", "https://localhost/v1/queue", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	QueueDepthHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Depths         map[string]int64 `json:"depths"`
+		OldestQueuedAt *StoredTime      `json:"oldest_queued_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+
+	expected := map[string]int64{StatusQueued: 2, StatusProcessing: 1, StatusDone: 1, StatusError: 0}
+	for status, count := range expected {
+		if response.Depths[status] != count {
+			t.Errorf("Expected [%d] jobs with status [%s], got [%d]", count, status, response.Depths[status])
+		}
+	}
+	if response.OldestQueuedAt == nil || !response.OldestQueuedAt.AsTime().Equal(oldest.AsTime()) {
+		t.Errorf("Expected the oldest queued job to be created at [%s], got [%v]", oldest, response.OldestQueuedAt)
+	}
+}
+
+func TestQueueDepthRequiresAdmin(t *testing.T) {
+	w, _ := adminAccountRequest(t, "/v1/queue", "", "user", QueueDepthHandler)
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] is not an administrator.",
+		Retry:   false,
+	})
+}
+
+// SchemaStorage is a fake Storage implementation at a fixed schema version.
+type SchemaStorage struct {
+	NullStorage
+
+	Version int
+}
+
+func (storage *SchemaStorage) SchemaVersion() (int, error) {
+	return storage.Version, nil
+}
+
+func TestSchemaVersion(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/admin/schema-version", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &SchemaStorage{Version: 1},
+	}
+
+	SchemaVersionHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		CurrentVersion    int `json:"current_version"`
+		LatestVersion     int `json:"latest_version"`
+		PendingMigrations int `json:"pending_migrations"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+
+	latest := LatestSchemaVersion()
+	if response.CurrentVersion != 1 || response.LatestVersion != latest || response.PendingMigrations != latest-1 {
+		t.Errorf("Unexpected schema version report: %+v", response)
+	}
+}
+
+func TestSchemaVersionRequiresAdmin(t *testing.T) {
+	w, _ := adminAccountRequest(t, "/v1/admin/schema-version", "", "user", SchemaVersionHandler)
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] is not an administrator.",
+		Retry:   false,
+	})
+}
+
+// MigrateStorage is a fake Storage implementation that records schema migrations and holds an
+// in-memory migration lock.
+type MigrateStorage struct {
+	NullStorage
+
+	Version    int
+	LockOwner  string
+	Migrations int
+	Release    chan struct{}
+}
+
+func (storage *MigrateStorage) SchemaVersion() (int, error) {
+	return storage.Version, nil
+}
+
+func (storage *MigrateStorage) MigrateSchema() error {
+	<-storage.Release
+	storage.Migrations++
+	storage.Version = LatestSchemaVersion()
+	return nil
+}
+
+func (storage *MigrateStorage) LockMigrations(owner string) (bool, error) {
+	if storage.LockOwner != "" {
+		return false, nil
+	}
+	storage.LockOwner = owner
+	return true, nil
+}
+
+func (storage *MigrateStorage) UnlockMigrations(owner string) error {
+	if storage.LockOwner == owner {
+		storage.LockOwner = ""
+	}
+	return nil
+}
+
+func TestMigrate(t *testing.T) {
+	s := &MigrateStorage{Version: 1, Release: make(chan struct{})}
+	c := &Context{
+		Settings:   Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:    s,
+		Migrations: NewMigrationTracker(),
+	}
+
+	w := serveRequest(t, c, MigrateHandler, "admin", "POST", "/v1/admin/migrate", "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var started Migration
+	if err := json.Unmarshal(w.Body.Bytes(), &started); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if started.ID == "" || started.Status != MigrationRunning {
+		t.Errorf("Unexpected migration: %+v", started)
+	}
+	if started.FromVersion != 1 || started.ToVersion != LatestSchemaVersion() {
+		t.Errorf("Unexpected migration versions: %+v", started)
+	}
+
+	w = serveRequest(t, c, MigrateHandler, "admin", "POST", "/v1/admin/migrate", "")
+	hasError(t, w, http.StatusConflict, APIError{
+		Code:    CodeMigrationInProgress,
+		Message: "A schema migration is already in progress.",
+		Hint:    "Wait for the running migration to finish.",
+		Retry:   true,
+	})
+
+	close(s.Release)
+
+	var progress Migration
+	for i := 0; i < 100; i++ {
+		w = serveRequest(t, c, MigrateHandler, "admin", "GET", "/v1/admin/migrate/"+started.ID, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &progress); err != nil {
+			t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+		}
+		if progress.Status != MigrationRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if progress.Status != MigrationDone {
+		t.Errorf("Expected the migration to finish, but it was %+v", progress)
+	}
+	if s.Migrations != 1 {
+		t.Errorf("Expected one migration run, but there were %d", s.Migrations)
+	}
+}
+
+func TestMigrateSchemaLockedWaitsForLock(t *testing.T) {
+	clock := NewFakeClock()
+	s := &MigrateStorage{Version: 1, LockOwner: "another process", Release: make(chan struct{})}
+	close(s.Release)
+
+	done := make(chan error)
+	go func() {
+		done <- MigrateSchemaLocked(s, clock)
+	}()
+
+	clock.WaitForTimers(1)
+	if s.Migrations != 0 {
+		t.Fatalf("Expected no migration while another process holds the lock, got %d", s.Migrations)
+	}
+	s.UnlockMigrations("another process")
+	clock.Advance(migrationLockPoll)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the migration to run once the lock was released")
+	}
+
+	if s.Migrations != 1 {
+		t.Errorf("Expected one migration run, but there were %d", s.Migrations)
+	}
+	if s.LockOwner != "" {
+		t.Errorf("Expected the lock to be released, but it's held by [%s]", s.LockOwner)
+	}
+}
+
+func TestMigrateNotFound(t *testing.T) {
+	c := &Context{
+		Settings:   Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:    &MigrateStorage{},
+		Migrations: NewMigrationTracker(),
+	}
+
+	w := serveRequest(t, c, MigrateHandler, "admin", "GET", "/v1/admin/migrate/abc123", "")
+
+	hasError(t, w, http.StatusNotFound, APIError{
+		Code:    CodeMigrationNotFound,
+		Message: "No migration with ID [abc123] has been started by this server.",
+		Retry:   false,
+	})
+}
+
+func TestMigrateRequiresAdmin(t *testing.T) {
+	w, _ := adminAccountRequest(t, "/v1/admin/migrate", "", "user", MigrateHandler)
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] is not an administrator.",
+		Retry:   false,
+	})
+}
+
+func TestAccountQuota(t *testing.T) {
+	c, s := accountDeleteContext()
+
+	w := serveRequest(t, c, AccountResourceHandler, "admin", "PUT", "/v1/accounts/"+"user"+"/quota", `{"max_queued_jobs": 100, "max_concurrent_jobs": 5}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if account := s.Accounts["user"]; account.MaxQueuedJobs != 100 || account.MaxConcurrentJobs != 5 {
+		t.Errorf("Unexpected quotas: %+v", account)
+	}
+	if !s.Accounts["user"].IsActive() {
+		t.Error("Expected a quota update not to deactivate the account")
+	}
+}
+
+func TestAccountQuotaRejectsNegativeLimits(t *testing.T) {
+	c, s := accountDeleteContext()
+
+	w := serveRequest(t, c, AccountResourceHandler, "admin", "PUT", "/v1/accounts/"+"user"+"/quota", `{"max_queued_jobs": -1, "max_concurrent_jobs": 5}`)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeInvalidAccountForm,
+		Message: "Invalid negative quota: queued [-1], concurrent [5]",
+		Retry:   false,
+	})
+	if s.Accounts["user"].MaxConcurrentJobs != 0 {
+		t.Errorf("Expected the quotas to be unchanged, got %+v", s.Accounts["user"])
+	}
+}
+
+func TestAccountQuotaUnknownAccount(t *testing.T) {
+	c, _ := accountDeleteContext()
+
+	w := serveRequest(t, c, AccountResourceHandler, "admin", "PUT", "/v1/accounts/"+"nobody"+"/quota", `{"max_queued_jobs": 1}`)
+
+	hasError(t, w, http.StatusNotFound, APIError{
+		Code:    CodeAccountNotFound,
+		Message: "Unable to find an account named [nobody].",
+		Retry:   false,
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// HealthHandler is a liveness probe that reports whether storage and Docker are reachable. It
+// doesn't require authentication.
+func HealthHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	checks := []struct {
+		component string
+		check     func() error
+	}{
+		{"storage", func() error { return c.Storage.Ping() }},
+		{"docker", func() error { return DockerPing(c.Docker) }},
+	}
+
+	for _, each := range checks {
+		if err := each.check(); err != nil {
+			RequestLog(w).WithFields(log.Fields{
+				"component": each.component,
+				"error":     err,
+			}).Error("Health check failed.")
+
+			APIError{
+				Code:    CodeServiceUnavailable,
+				Message: fmt.Sprintf("Unable to reach %s: %v", each.component, err),
+				Retry:   true,
+			}.Report(http.StatusServiceUnavailable, w)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	OKResponse(w)
+}
+
+// ReadyHandler is a readiness probe that succeeds once the job runner has completed its first claim
+// cycle, so that load balancers can hold traffic until the instance is warmed up. It doesn't require
+// authentication.
+func ReadyHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&c.Ready) == 0 {
+		APIError{
+			Code:    CodeServiceUnavailable,
+			Message: "The job runner hasn't completed a claim cycle yet.",
+			Retry:   true,
+		}.Report(http.StatusServiceUnavailable, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	OKResponse(w)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// PingDocker is a fake Docker implementation whose Ping returns a configurable error.
+type PingDocker struct {
+	NullDocker
+
+	Err error
+}
+
+func (d PingDocker) Ping() error {
+	return d.Err
+}
+
+func TestHealthHandler(t *testing.T) {
+	w := serveRequest(t, &Context{Storage: &MemoryStorage{}, Docker: PingDocker{}}, HealthHandler, "", "GET", "/healthz", "")
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if body := w.Body.String(); body != `{"status":"ok"}` {
+		t.Errorf("Unexpected response body: [%s]", body)
+	}
+}
+
+func TestHealthHandlerStorageFailure(t *testing.T) {
+	w := serveRequest(t, &Context{
+		Storage: &MemoryStorage{PingErr: errors.New("no reachable servers")},
+		Docker:  PingDocker{},
+	}, HealthHandler, "", "GET", "/healthz", "")
+
+	hasError(t, w, http.StatusServiceUnavailable, APIError{
+		Code:    CodeServiceUnavailable,
+		Message: "Unable to reach storage: no reachable servers",
+		Retry:   true,
+	})
+}
+
+func TestHealthHandlerDockerFailure(t *testing.T) {
+	w := serveRequest(t, &Context{
+		Storage: &MemoryStorage{},
+		Docker:  PingDocker{Err: errors.New("connection refused")},
+	}, HealthHandler, "", "GET", "/healthz", "")
+
+	hasError(t, w, http.StatusServiceUnavailable, APIError{
+		Code:    CodeServiceUnavailable,
+		Message: "Unable to reach docker: connection refused",
+		Retry:   true,
+	})
+}
+
+func TestReadyHandler(t *testing.T) {
+	c := &Context{Storage: NullStorage{}}
+
+	r, err := http.NewRequest("GET", "https://localhost/readyz", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	ReadyHandler(c, w, r)
+
+	hasError(t, w, http.StatusServiceUnavailable, APIError{
+		Code:    CodeServiceUnavailable,
+		Message: "The job runner hasn't completed a claim cycle yet.",
+		Retry:   true,
+	})
+
+	// A claim cycle that finds no jobs still readies the instance.
+	Claim(c)
+
+	w = httptest.NewRecorder()
+	ReadyHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status after a claim cycle: [%d]", w.Code)
+	}
+}
@@ -3,8 +3,12 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
@@ -18,6 +22,8 @@ func JobHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 		JobListHandler(c, w, r)
 	case "POST":
 		JobSubmitHandler(c, w, r)
+	case "OPTIONS":
+		ReportOptions(w, "GET", "POST", "OPTIONS")
 	default:
 		APIError{
 			Code:    CodeMethodNotSupported,
@@ -32,24 +38,248 @@ func JobHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 func JobSubmitHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 	type Request struct {
 		Jobs []Job `json:"jobs"`
+
+		// RunIDAutoGroup places every job in the request into a single new run, replacing any run IDs
+		// that the jobs specify themselves.
+		RunIDAutoGroup bool `json:"run_id_auto_group"`
 	}
 
 	type Response struct {
 		JIDs []uint64 `json:"jids"`
+
+		// Cached lists the JIDs of previously completed jobs that were returned in place of new jobs
+		// with the same cache key.
+		Cached []uint64 `json:"cached,omitempty"`
+
+		// RunID is the run that was generated for the jobs that were submitted without one.
+		RunID string `json:"run_id,omitempty"`
 	}
 
 	account, err := Authenticate(c, w, r)
 	if err != nil {
-		log.WithFields(log.Fields{
+		RequestLog(w).WithFields(log.Fields{
 			"error": err,
 		}).Error("Authentication failure.")
 		return
 	}
+	c.Audit.Record(r, account, "job.submit")
+
+	useCache := true
+	if raw := r.URL.Query().Get("use_cache"); raw != "" {
+		useCache, err = strconv.ParseBool(raw)
+		if err != nil {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf("Unable to parse use_cache [%s]: %v", raw, err),
+				Hint:    "Please provide true or false as the use_cache parameter.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+	}
 
 	var req Request
-	err = json.NewDecoder(r.Body).Decode(&req)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		job, ok := decodeMultipartJob(c, w, r, account)
+		if !ok {
+			return
+		}
+		req.Jobs = []Job{job}
+	} else if !decodeJobPayload(c, w, r, account, &req) {
+		return
+	}
+
+	// Reject oversized batches before any job is validated or stored.
+	if c.MaxJobsPerRequest > 0 && len(req.Jobs) > c.MaxJobsPerRequest {
+		APIError{
+			Code:    CodeBatchTooLarge,
+			Message: fmt.Sprintf("Too many jobs in one request: [%d]", len(req.Jobs)),
+			Hint:    fmt.Sprintf("Please submit at most %d jobs per request.", c.MaxJobsPerRequest),
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	if req.RunIDAutoGroup {
+		for i := range req.Jobs {
+			req.Jobs[i].RunID = ""
+		}
+	}
+
+	// Reserve each idempotency key before any job is created, so that concurrent retries of the same
+	// request can't both create its jobs. Reservations that never record a job are released again.
+	now := c.clock().Now()
+	expiresAt := now.Add(time.Duration(c.IdempotencyTTL) * time.Second)
+	reserved := make(map[string]bool)
+	defer func() {
+		for key := range reserved {
+			if err := c.ReleaseIdempotencyKey(account.Name, key); err != nil {
+				RequestLog(w).WithFields(log.Fields{
+					"idempotency key": key,
+					"account":         account.Name,
+					"error":           err,
+				}).Error("Unable to release an idempotency key.")
+			}
+		}
+	}()
+
+	// Jobs that are answered by an idempotent replay or a cached result don't create a new job, so
+	// they're settled before the rest are counted against the account.
+	response := Response{JIDs: make([]uint64, len(req.Jobs))}
+	settled := make([]bool, len(req.Jobs))
+	firstWithKey := make(map[string]int)
+	submitted := len(req.Jobs)
+	for index, job := range req.Jobs {
+		if job.IdempotencyKey != "" {
+			// A key that appears more than once in the same request names the same job each time.
+			if _, ok := firstWithKey[job.IdempotencyKey]; ok {
+				settled[index] = true
+				submitted--
+				continue
+			}
+			firstWithKey[job.IdempotencyKey] = index
+
+			record, ok := reserveIdempotencyKey(c, w, account, IdempotencyKey{
+				Account:   account.Name,
+				Key:       job.IdempotencyKey,
+				ExpiresAt: expiresAt,
+			}, now)
+			if !ok {
+				return
+			}
+			if record == nil {
+				reserved[job.IdempotencyKey] = true
+			} else {
+				response.JIDs[index] = record.JID
+				settled[index] = true
+				submitted--
+
+				// Report the run that the original submission generated, so that a retry gets the
+				// same response, and so that any new jobs in this request join that run.
+				if job.RunID == "" && response.RunID == "" {
+					original, err := c.ListJobs(JobQuery{AccountName: account.Name, JIDs: []uint64{record.JID}})
+					if err != nil {
+						APIError{
+							Code:    CodeListFailure,
+							Message: fmt.Sprintf("Unable to look up job [%d].", record.JID),
+							Hint:    "This is probably a storage error on our end.",
+							Retry:   true,
+						}.Log(account).Report(http.StatusInternalServerError, w)
+						return
+					}
+					if len(original) > 0 {
+						response.RunID = original[0].RunID
+					}
+				}
+				continue
+			}
+		}
+
+		if useCache && job.CacheKey != "" {
+			cached, err := c.FindCachedJob(account.Name, job.CacheKey)
+			if err != nil && err != ErrNotFound {
+				APIError{
+					Code:    CodeListFailure,
+					Message: fmt.Sprintf("Unable to look up cached results for [%s].", job.CacheKey),
+					Hint:    "This is probably a storage error on our end.",
+					Retry:   true,
+				}.Log(account).Report(http.StatusInternalServerError, w)
+				return
+			}
+			if err == nil {
+				RequestLog(w).WithFields(log.Fields{
+					"jid":       cached.JID,
+					"cache key": job.CacheKey,
+					"account":   account.Name,
+				}).Info("Returned a cached job.")
+
+				response.JIDs[index] = cached.JID
+				response.Cached = append(response.Cached, cached.JID)
+				settled[index] = true
+				submitted--
+			}
+		}
+	}
+
+	if submitted > 0 && !allowSubmission(c, w, account, submitted) {
+		return
+	}
+
+	for index, job := range req.Jobs {
+		if settled[index] {
+			continue
+		}
+
+		// Jobs that are submitted together without a run ID share a new one.
+		if job.RunID == "" {
+			if response.RunID == "" {
+				if response.RunID, err = newUUID(); err != nil {
+					APIError{
+						Code:    CodeEnqueueFailure,
+						Message: fmt.Sprintf("Unable to generate a run ID: %v", err),
+						Hint:    "This is a problem on our end. Please try again.",
+						Retry:   true,
+					}.Log(account).Report(http.StatusInternalServerError, w)
+					return
+				}
+			}
+			job.RunID = response.RunID
+		}
+
+		jid, ok := submitJob(c, w, account, job)
+		if !ok {
+			return
+		}
+		response.JIDs[index] = jid
+
+		if job.IdempotencyKey != "" {
+			// The job has already been created, so a failure here is logged rather than reported. The
+			// reservation is kept either way, so that a client that retried would be asked to wait
+			// rather than create the duplicate that the key was meant to prevent.
+			delete(reserved, job.IdempotencyKey)
+			err := c.SaveIdempotencyKey(IdempotencyKey{
+				Account:   account.Name,
+				Key:       job.IdempotencyKey,
+				JID:       jid,
+				ExpiresAt: expiresAt,
+			})
+			if err != nil {
+				RequestLog(w).WithFields(log.Fields{
+					"jid":             jid,
+					"idempotency key": job.IdempotencyKey,
+					"account":         account.Name,
+					"error":           err,
+				}).Error("Unable to save an idempotency key.")
+			}
+		}
+	}
+
+	// Jobs whose keys were repeated within this request share the job of the key's first use.
+	for index, job := range req.Jobs {
+		if settled[index] && response.JIDs[index] == 0 {
+			response.JIDs[index] = response.JIDs[firstWithKey[job.IdempotencyKey]]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// decodeJobPayload parses a JSON job submission into v, within the configured size limit. If it
+// can't be parsed, an error is reported and false is returned.
+func decodeJobPayload(c *Context, w http.ResponseWriter, r *http.Request, account *Account, v interface{}) bool {
+	if c.MaxRequestBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, c.MaxRequestBodyBytes)
+	}
+
+	err := json.NewDecoder(r.Body).Decode(v)
+	if isBodyTooLarge(err) {
+		reportPayloadTooLarge(c, w, account)
+		return false
+	}
 	if err != nil {
-		log.WithFields(log.Fields{
+		RequestLog(w).WithFields(log.Fields{
 			"error":   err,
 			"account": account.Name,
 		}).Error("Unable to parse JSON.")
@@ -60,225 +290,1173 @@ func JobSubmitHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 			Hint:    "Please supply valid JSON in your request.",
 			Retry:   false,
 		}.Report(http.StatusBadRequest, w)
+		return false
+	}
+
+	return true
+}
+
+// decodeMultipartJob reads a single job from a multipart/form-data request. The "job" part holds the
+// job as JSON, and an optional "stdin" part holds the raw bytes of its stdin, which take the place of
+// any stdin given in the JSON. An error is reported and false is returned if the request is invalid.
+func decodeMultipartJob(c *Context, w http.ResponseWriter, r *http.Request, account *Account) (Job, bool) {
+	var job Job
+
+	if c.MaxRequestBodyBytes > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, c.MaxRequestBodyBytes)
+	}
+
+	reportInvalid := func(err error) {
+		APIError{
+			Code:    CodeInvalidJobForm,
+			Message: fmt.Sprintf("Unable to parse multipart job payload: %v", err),
+			Hint:    `Please supply a "job" part containing JSON and an optional "stdin" part.`,
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+	}
+
+	reader, err := r.MultipartReader()
+	if err != nil {
+		reportInvalid(err)
+		return job, false
+	}
+
+	var stdin []byte
+	foundJob, foundStdin := false, false
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch part.FormName() {
+			case "job":
+				foundJob = true
+				if err = json.NewDecoder(part).Decode(&job); err != nil && !isBodyTooLarge(err) {
+					APIError{
+						Code:    CodeInvalidJobJSON,
+						Message: fmt.Sprintf("Unable to parse job payload as JSON: %v", err),
+						Hint:    `Please supply valid JSON in the "job" part of your request.`,
+						Retry:   false,
+					}.Log(account).Report(http.StatusBadRequest, w)
+					return job, false
+				}
+			case "stdin":
+				foundStdin = true
+				stdin, err = ioutil.ReadAll(part)
+			}
+		}
+
+		if isBodyTooLarge(err) {
+			reportPayloadTooLarge(c, w, account)
+			return job, false
+		}
+		if err != nil {
+			reportInvalid(err)
+			return job, false
+		}
+	}
+
+	if !foundJob {
+		reportInvalid(fmt.Errorf(`missing the "job" part`))
+		return job, false
+	}
+	if foundStdin {
+		job.Stdin = JobInput(stdin)
+	}
+	return job, true
+}
+
+// reportPayloadTooLarge reports that a job submission exceeded the MaxRequestBodyBytes setting.
+func reportPayloadTooLarge(c *Context, w http.ResponseWriter, account *Account) {
+	APIError{
+		Code:    CodeRequestTooLarge,
+		Message: "Your job payload is too large.",
+		Hint:    fmt.Sprintf("Please keep each request under %d bytes, or submit your jobs in smaller batches.", c.MaxRequestBodyBytes),
+		Retry:   false,
+	}.Log(account).Report(http.StatusRequestEntityTooLarge, w)
+}
+
+// statusTooManyRequests is the HTTP status of a rejected submission from an account that's over its
+// quota or rate limit. net/http only names it as of Go 1.6.
+const statusTooManyRequests = 429
+
+// reserveIdempotencyKey reserves an idempotency key for a job that's about to be submitted. If the
+// key is already held, the record of the job that it created is returned instead. An error is
+// reported and false is returned if the key can't be reserved or replayed.
+func reserveIdempotencyKey(c *Context, w http.ResponseWriter, account *Account, reservation IdempotencyKey, now time.Time) (*IdempotencyKey, bool) {
+	err := c.ReserveIdempotencyKey(reservation, now)
+	if err == nil {
+		return nil, true
+	}
+
+	var record *IdempotencyKey
+	if err == ErrIdempotencyKeyExists {
+		record, err = c.GetIdempotencyKey(account.Name, reservation.Key, now)
+	}
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to look up the idempotency key [%s].", reservation.Key),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return nil, false
+	}
+	if record.JID == 0 {
+		APIError{
+			Code:    CodeIdempotencyKeyInUse,
+			Message: fmt.Sprintf("Another request with the idempotency key [%s] is still being submitted.", reservation.Key),
+			Hint:    "Please retry once that request has completed.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusConflict, w)
+		return nil, false
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"jid":             record.JID,
+		"idempotency key": reservation.Key,
+		"account":         account.Name,
+	}).Info("Returned the job previously submitted with an idempotency key.")
+	return record, true
+}
+
+// allowSubmission reports an error and returns false if an account may not submit count jobs right
+// now, because it's out of credits, would exceed its queued job quota, or has exceeded its submission
+// rate limit. A request for more jobs than the rate limit ever allows at once is rejected outright.
+func allowSubmission(c *Context, w http.ResponseWriter, account *Account, count int) bool {
+	if c.CostPerNanosecond > 0 && account.Credits <= 0 {
+		APIError{
+			Code:    CodeInsufficientCredits,
+			Message: fmt.Sprintf("The account [%s] has no remaining credits.", account.Name),
+			Hint:    "Contact your administrator to purchase more credits.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusPaymentRequired, w)
+		return false
+	}
+
+	// Storage enforces the quota again as each job is inserted. Checking here first refuses a batch
+	// that can't fit before any of it is created.
+	if account.MaxQueuedJobs > 0 {
+		queued, err := c.CountJobs(JobQuery{AccountName: account.Name, Statuses: quotaStatuses})
+		if err != nil {
+			APIError{
+				Code:    CodeStorageError,
+				Message: fmt.Sprintf("Unable to count queued jobs: %v", err),
+				Hint:    "This is probably a storage error on our end.",
+				Retry:   true,
+			}.Log(account).Report(http.StatusInternalServerError, w)
+			return false
+		}
+
+		if queued+count > account.MaxQueuedJobs {
+			reportQuotaExceeded(w, account, queued)
+			return false
+		}
+	}
+
+	if !c.SubmitLimiter.Fits(count) {
+		APIError{
+			Code:    CodeBatchTooLarge,
+			Message: fmt.Sprintf("Too many jobs in one request: [%d]", count),
+			Hint:    fmt.Sprintf("Please submit at most %d jobs at a time.", c.SubmitLimiter.Limit),
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return false
+	}
+
+	if ok, wait := c.SubmitLimiter.Allow(account.Name, count); !ok {
+		retryAfter := int64((wait + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
+
+		APIError{
+			Code:    CodeRateLimited,
+			Message: "You're submitting jobs too quickly.",
+			Hint:    fmt.Sprintf("Please wait %d seconds before submitting more jobs.", retryAfter),
+			Retry:   true,
+		}.Log(account).Report(statusTooManyRequests, w)
+		return false
+	}
+
+	return true
+}
+
+// reportQuotaExceeded reports that an account has too many jobs waiting to run to submit more.
+func reportQuotaExceeded(w http.ResponseWriter, account *Account, queued int) {
+	APIError{
+		Code:    CodeQuotaExceeded,
+		Message: fmt.Sprintf("The account [%s] may have at most %d jobs queued, and has %d.", account.Name, account.MaxQueuedJobs, queued),
+		Hint:    "Please wait for some of your jobs to start before submitting more.",
+		Retry:   true,
+	}.Log(account).Report(statusTooManyRequests, w)
+}
+
+// submitJob validates a single job on behalf of an account and stores it. If the job can't be
+// accepted, an error is reported and false is returned.
+func submitJob(c *Context, w http.ResponseWriter, account *Account, job Job) (uint64, bool) {
+	// Validate the job.
+	job.ApplyDefaults()
+	if err := job.Validate(); err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"account": account.Name,
+			"job":     job,
+			"error":   err,
+		}).Error("Invalid job submitted.")
+
+		err.Report(http.StatusBadRequest, w)
+		return 0, false
+	}
+
+	expanded, expandErr := job.ExpandCommand()
+	if expandErr != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"account": account.Name,
+			"job":     job,
+			"error":   expandErr,
+		}).Error("Unable to expand a job's command.")
+
+		expandErr.Report(http.StatusBadRequest, w)
+		return 0, false
+	}
+
+	if !account.CoreAllowed(job.Core) {
+		APIError{
+			Code:    CodeCoreNotPermitted,
+			Message: fmt.Sprintf("Your account may not submit jobs to the core [%s].", job.Core),
+			Hint:    fmt.Sprintf(`The "core" must be one of the following: %s`, strings.Join(account.AllowedCores, ", ")),
+			Retry:   false,
+		}.Log(account).Report(http.StatusForbidden, w)
+		return 0, false
+	}
+
+	for _, image := range job.Images() {
+		if !account.ImageAllowed(image, c.AllowedImages) {
+			APIError{
+				Code:    CodeImageNotPermitted,
+				Message: fmt.Sprintf("Your account may not submit jobs using the image [%s].", image),
+				Hint:    "Ask your administrator to allow this image for your account.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusForbidden, w)
+			return 0, false
+		}
+	}
+
+	// Reject a duplicate name. Two concurrent submissions with the same name may both be accepted.
+	if c.EnforceUniqueJobNames && job.Name != nil {
+		existing, err := c.GetJobByName(account.Name, *job.Name)
+		if err != nil && err != ErrNotFound {
+			APIError{
+				Code:    CodeListFailure,
+				Message: "Unable to check for jobs with the same name.",
+				Hint:    "This is probably a storage error on our end.",
+				Retry:   true,
+			}.Log(account).Report(http.StatusInternalServerError, w)
+			return 0, false
+		}
+		if existing != nil && !IsCompleted(existing.Status) {
+			APIError{
+				Code:    CodeDuplicateJobName,
+				Message: fmt.Sprintf("The job [%d] is already named [%s].", existing.JID, *job.Name),
+				Hint:    "Wait for that job to complete, or choose a different name.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusConflict, w)
+			return 0, false
+		}
+	}
+
+	// Pack the job into a SubmittedJob and store it. Jobs with a dependency wait outside of the
+	// queue until the runner promotes them.
+	submitted := SubmittedJob{
+		Job:             job,
+		ExpandedCommand: expanded,
+		CreatedAt:       StoreTime(time.Now()),
+		Status:          StatusQueued,
+		Account:         account.Name,
+	}
+	if job.DependsOn != nil {
+		submitted.Status = StatusWaiting
+	}
+	var jid uint64
+	var err error
+	if account.MaxQueuedJobs > 0 {
+		jid, err = c.InsertJobWithinQuota(submitted, account.MaxQueuedJobs)
+	} else {
+		jid, err = c.InsertJob(submitted)
+	}
+	if err == ErrQuotaExceeded {
+		reportQuotaExceeded(w, account, account.MaxQueuedJobs)
+		return 0, false
+	}
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"account": account.Name,
+			"error":   err,
+		}).Error("Unable to enqueue a submitted job.")
+
+		APIError{
+			Code:    CodeEnqueueFailure,
+			Message: "Unable to enqueue your job.",
+			Retry:   true,
+		}.Report(http.StatusServiceUnavailable, w)
+		return 0, false
+	}
+	jobsSubmitted.WithLabelValues(account.Name).Inc()
+
+	RequestLog(w).WithFields(log.Fields{
+		"jid":     jid,
+		"job":     job,
+		"account": account.Name,
+	}).Info("Successfully submitted a job.")
+	return jid, true
+}
+
+// maxWaitTimeout is the longest that JobSubmitAndWaitHandler will wait for a job to complete.
+const maxWaitTimeout = 60 * time.Second
+
+// JobSubmitAndWaitHandler submits a single job and waits for it to complete, polling storage for
+// its status. The completed job is returned inline. If it's still incomplete when the timeout
+// elapses, its current state is returned with a 202 status and "timed_out" set instead.
+func JobSubmitAndWaitHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		Job            Job `json:"job"`
+		PollIntervalMs int `json:"poll_interval_ms"`
+		TimeoutMs      int `json:"timeout_ms"`
+	}
+
+	type Response struct {
+		SubmittedJob
+		TimedOut bool `json:"timed_out"`
+	}
+
+	if r.Method != "POST" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use POST against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "job.submit_and_wait")
+
+	var req Request
+	if !decodeJobPayload(c, w, r, account, &req) {
+		return
+	}
+
+	pollInterval := time.Duration(req.PollIntervalMs) * time.Millisecond
+	if pollInterval == 0 {
+		pollInterval = time.Duration(c.Poll) * time.Millisecond
+	}
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout == 0 {
+		timeout = maxWaitTimeout
+	}
+	if pollInterval <= 0 || timeout < 0 || timeout > maxWaitTimeout {
+		APIError{
+			Code:    CodeInvalidWaitOptions,
+			Message: fmt.Sprintf("Invalid poll interval [%d] or timeout [%d]", req.PollIntervalMs, req.TimeoutMs),
+			Hint:    fmt.Sprintf(`The "poll_interval_ms" must be positive and the "timeout_ms" at most %d.`, maxWaitTimeout/time.Millisecond),
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	if !allowSubmission(c, w, account, 1) {
+		return
+	}
+
+	jid, ok := submitJob(c, w, account, req.Job)
+	if !ok {
+		return
+	}
+
+	deadline := c.clock().After(timeout)
+	for {
+		jobs, err := c.ListJobs(JobQuery{AccountName: account.Name, JIDs: []uint64{jid}})
+		if err != nil || len(jobs) == 0 {
+			APIError{
+				Code:    CodeListFailure,
+				Message: fmt.Sprintf("Unable to load the submitted job [%d].", jid),
+				Hint:    "This is probably a storage error on our end. Your job was submitted.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusInternalServerError, w)
+			return
+		}
+		job := jobs[0]
+
+		if IsCompleted(job.Status) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(Response{SubmittedJob: job})
+			return
+		}
+
+		select {
+		case <-deadline:
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			json.NewEncoder(w).Encode(Response{SubmittedJob: job, TimedOut: true})
+			return
+		case <-c.clock().After(pollInterval):
+		}
+	}
+}
+
+// validateStatuses reports an error and returns false if any of the job statuses in a query are
+// unrecognized.
+func validateStatuses(w http.ResponseWriter, account *Account, statuses []string) bool {
+	for _, status := range statuses {
+		if !validStatus[status] {
+			APIError{
+				Code:    CodeInvalidJobStatus,
+				Message: fmt.Sprintf("Invalid job status [%s]", status),
+				Hint:    fmt.Sprintf("The status must be one of the following: %s", strings.Join(validStatusNames(), ", ")),
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return false
+		}
+	}
+	return true
+}
+
+// JobListHandler provides updated details about one or more jobs currently submitted to the
+// cluster.
+func JobListHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "job.list")
+
+	if err := r.ParseForm(); err != nil {
+		APIError{
+			Code:    CodeUnableToParseQuery,
+			Message: fmt.Sprintf("Unable to parse query parameters: %v", err),
+			Hint:    "You broke Go's URL parsing somehow! Make URLs that suck less.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	q := JobQuery{AccountName: account.Name}
+	if rawJIDs, ok := r.Form["jid"]; ok {
+		jids := make([]uint64, len(rawJIDs))
+		for i, rawJID := range rawJIDs {
+			if jids[i], err = strconv.ParseUint(rawJID, 10, 64); err != nil {
+				APIError{
+					Code:    CodeUnableToParseQuery,
+					Message: fmt.Sprintf("Unable to parse JID [%s]: %v", rawJID, err),
+					Hint:    "Please only use valid JIDs.",
+					Retry:   false,
+				}.Log(account).Report(http.StatusBadRequest, w)
+				return
+			}
+		}
+		q.JIDs = jids
+	}
+	if names, ok := r.Form["name"]; ok {
+		q.Names = names
+	}
+	q.RunID = r.FormValue("run_id")
+
+	var ok bool
+	if q.CreatedSince, ok = parseTimeParam(w, r, account, "since"); !ok {
+		return
+	}
+	if q.CreatedUntil, ok = parseTimeParam(w, r, account, "until"); !ok {
+		return
+	}
+	if !q.CreatedSince.IsZero() && !q.CreatedUntil.IsZero() && q.CreatedSince.After(q.CreatedUntil) {
+		APIError{
+			Code:    CodeUnableToParseQuery,
+			Message: fmt.Sprintf("The since bound [%s] is after the until bound [%s].", r.FormValue("since"), r.FormValue("until")),
+			Hint:    `Please specify a "since" time that's no later than the "until" time.`,
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+	if statuses, ok := r.Form["status"]; ok {
+		if !validateStatuses(w, account, statuses) {
+			return
+		}
+		q.Statuses = statuses
+	}
+	if tags, ok := r.Form["tag"]; ok {
+		q.Tags = make(map[string]string, len(tags))
+		for _, tag := range tags {
+			parts := strings.SplitN(tag, ":", 2)
+			if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], ".$") {
+				APIError{
+					Code:    CodeUnableToParseQuery,
+					Message: fmt.Sprintf("Invalid tag filter [%s]", tag),
+					Hint:    `Tag filters must have the form "key:value", and keys may not contain "." or "$".`,
+					Retry:   false,
+				}.Log(account).Report(http.StatusBadRequest, w)
+				return
+			}
+			q.Tags[parts[0]] = parts[1]
+		}
+	}
+	if rawLimit := r.FormValue("limit"); rawLimit != "" {
+		limit, err := strconv.ParseInt(rawLimit, 10, 0)
+		if err != nil {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf("Unable to parse limit [%s]: %v", rawLimit, err),
+				Hint:    "Please specify a valid integral limit.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+
+		if limit > 9999 {
+			limit = 9999
+		}
+		if limit < 1 {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf("Invalid negative or zero limit [%d]", limit),
+				Hint:    "Please specify a valid, positive integral limit.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+		q.Limit = int(limit)
+	} else {
+		q.Limit = 1000
+	}
+
+	if rawOffset := r.FormValue("offset"); rawOffset != "" {
+		offset, err := strconv.ParseInt(rawOffset, 10, 0)
+		if err != nil || offset < 0 {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf("Invalid offset [%s]", rawOffset),
+				Hint:    "Please specify a valid, non-negative integral offset.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+		q.Offset = int(offset)
+	}
+
+	// Accept the original "before" parameter name as an alias for the upper cursor bound.
+	rawBefore := r.FormValue("before_jid")
+	if rawBefore == "" {
+		rawBefore = r.FormValue("before")
+	}
+	if rawBefore != "" {
+		before, err := strconv.ParseUint(rawBefore, 10, 64)
+		if err != nil {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf(`Unable to parse Before bound [%s]: %v`, rawBefore, err),
+				Hint:    "Please specify a valid integral JID as the upper bound.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+		q.BeforeJID = before
+	}
+
+	// The original "after" parameter is an inclusive lower bound, while "after_jid" is exclusive so
+	// that the last JID of one page can be passed directly to fetch the next.
+	rawAfter, inclusive := r.FormValue("after_jid"), false
+	if rawAfter == "" {
+		rawAfter, inclusive = r.FormValue("after"), true
+	}
+	if rawAfter != "" {
+		after, err := strconv.ParseUint(rawAfter, 10, 64)
+		if err != nil {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf(`Unable to parse After bound [%s]: %v`, rawAfter, err),
+				Hint:    "Please specify a valid integral JID as the lower bound.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+		if inclusive && after > 0 {
+			after--
+		}
+		q.AfterJID = after
+	}
+
+	results, err := c.ListJobs(q)
+	if err != nil {
+		re := APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to list jobs: %v", err),
+			Hint:    "This is most likely a database problem.",
+			Retry:   true,
+		}
+		re.Log(account).Report(http.StatusServiceUnavailable, w)
+		return
+	}
+
+	// The total counts every job that matches the query's filters, ignoring the limit, offset and
+	// cursor bounds, so that clients can paginate.
+	totalQuery := q
+	totalQuery.Limit = 0
+	totalQuery.Offset = 0
+	totalQuery.BeforeJID = 0
+	totalQuery.AfterJID = 0
+
+	total, err := c.CountJobs(totalQuery)
+	if err != nil {
+		re := APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to count jobs: %v", err),
+			Hint:    "This is most likely a database problem.",
+			Retry:   true,
+		}
+		re.Log(account).Report(http.StatusServiceUnavailable, w)
+		return
+	}
+
+	var response struct {
+		Jobs  []SubmittedJob `json:"jobs"`
+		Total int            `json:"total"`
+	}
+	response.Jobs = results
+	response.Total = total
+
+	RequestLog(w).WithFields(log.Fields{
+		"query":        q,
+		"result count": len(results),
+		"total":        total,
+		"account":      account.Name,
+	}).Debug("Successful job query.")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// JobKillHandler allows a user to prematurely terminate a running job.
+func JobKillHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "job.kill")
+
+	if err = r.ParseForm(); err != nil {
+		APIError{
+			Code:    CodeInvalidJobForm,
+			Message: fmt.Sprintf("Unable to parse Job: Kill payload as a POST body: %v", err),
+			Hint:    "Please use valid form encoding in your request.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	jidstr := r.PostFormValue("jid")
+	jid, err := strconv.ParseUint(jidstr, 10, 64)
+	if err != nil {
+		APIError{
+			Code:    CodeInvalidJobForm,
+			Message: fmt.Sprintf("Unable to parse Job: Kill payload as a valid JID: %v", err),
+			Hint:    "Please provide a valid integer job ID to Job: Kill.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	sudo := r.PostFormValue("sudo") == "true"
+
+	query := JobQuery{JIDs: []uint64{jid}}
+	if !sudo {
+		query.AccountName = account.Name
+	}
+
+	jobs, err := c.ListJobs(query)
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: "Unable to list jobs.",
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	if len(jobs) == 0 {
+		APIError{
+			Code:    CodeJobNotFound,
+			Message: fmt.Sprintf("Unable to find a job with ID [%d].", jid),
+			Hint:    "Make sure that the JID is still valid.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusNotFound, w)
+		return
+	}
+	if len(jobs) != 1 {
+		APIError{
+			Code: CodeWTF,
+			Message: fmt.Sprintf(
+				"Job query for JID [%d] on account [%s] returned [%d] results.",
+				jid, account.Name, len(jobs),
+			),
+			Hint:  "Duplicate JID. No clue how that happened.",
+			Retry: false,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	job := &jobs[0]
+
+	if apiErr := requestJobKill(c, job); apiErr != nil {
+		apiErr.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"jid":     job.JID,
+		"account": account.Name,
+		"sudo":    sudo,
+		"running": job.ContainerID != "",
+	}).Info("Job kill requested.")
+
+	OKResponse(w)
+}
+
+// requestJobKill flags a job to be killed. A job that hasn't been claimed by the runner yet is
+// removed from the queue immediately; a running job has its container killed.
+func requestJobKill(c *Context, job *SubmittedJob) *APIError {
+	markKillRequested(job)
+
+	if err := c.UpdateJob(job); err != nil {
+		return &APIError{
+			Code:    CodeJobUpdateFailure,
+			Message: fmt.Sprintf("Unable to request a job kill: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}
+	}
+
+	return killJobContainer(c, job)
+}
+
+// markKillRequested flags a job to be killed, without saving it.
+func markKillRequested(job *SubmittedJob) {
+	job.KillRequested = true
+
+	// If the container ID hasn't been assigned yet, the job most likely isn't running.
+	// If it's already left StatusQueued or StatusWaiting, let the job runner handle the transition to
+	// StatusKilled. Otherwise, set it to StatusKilled ourselves to remove it from the queue.
+	if job.Status == StatusQueued || job.Status == StatusWaiting {
+		job.Status = StatusKilled
+	}
+}
+
+// killJobContainer kills the container of a job that's running, if it has one.
+func killJobContainer(c *Context, job *SubmittedJob) *APIError {
+	if job.ContainerID != "" {
+		if err := c.KillContainer(docker.KillContainerOptions{ID: job.ContainerID}); err != nil {
+			return &APIError{
+				Code:    CodeJobKillFailure,
+				Message: fmt.Sprintf("Unable to kill a running job: %v", err),
+				Hint:    "The container is misbehaving somehow.",
+				Retry:   true,
+			}
+		}
+	}
+
+	return nil
+}
+
+// JobKillAllHandler allows a user to terminate all jobs associated with their account. Admins may
+// kill the jobs of another account by naming it in the "account" form parameter.
+func JobKillAllHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "job.kill_all")
+
+	if err = r.ParseForm(); err != nil {
+		APIError{
+			Code:    CodeInvalidJobForm,
+			Message: fmt.Sprintf("Unable to parse Job: Kill All payload as a POST body: %v", err),
+			Hint:    "Please use valid form encoding in your request.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	target := account.Name
+	if name := r.PostFormValue("account"); name != "" {
+		target = name
+	}
+	if target != account.Name && !account.Admin {
+		APIError{
+			Code:    CodeAdminRequired,
+			Message: fmt.Sprintf("The account [%s] may not kill the jobs of [%s].", account.Name, target),
+			Hint:    "Only administrators may kill another account's jobs.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusForbidden, w)
+		return
+	}
+
+	jobs, err := c.ListJobs(JobQuery{
+		AccountName: target,
+		Statuses:    []string{StatusWaiting, StatusQueued, StatusProcessing},
+	})
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: "Unable to list jobs.",
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	for i := range jobs {
+		if apiErr := requestJobKill(c, &jobs[i]); apiErr != nil {
+			apiErr.Log(account).Report(http.StatusInternalServerError, w)
+			return
+		}
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account": account.Name,
+		"target":  target,
+		"count":   len(jobs),
+	}).Info("All active jobs kill requested.")
+
+	OKResponse(w)
+}
+
+// JobQueueStatsHandler allows a user to view statistics about the jobs that they have submitted.
+func JobQueueStatsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "job.queue_stats")
+
+	counts, err := c.CountJobsByStatus(account.Name)
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to count jobs: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
 		return
 	}
 
-	jids := make([]uint64, len(req.Jobs))
-	for index, job := range req.Jobs {
-		// Validate the job.
-		if err := job.Validate(); err != nil {
-			log.WithFields(log.Fields{
-				"account": account.Name,
-				"job":     job,
-				"error":   err,
-			}).Error("Invalid job submitted.")
-
-			err.Report(http.StatusBadRequest, w)
-			return
-		}
-
-		// Pack the job into a SubmittedJob and store it.
-		submitted := SubmittedJob{
-			Job:       job,
-			CreatedAt: StoreTime(time.Now()),
-			Status:    StatusQueued,
-			Account:   account.Name,
-		}
-		jid, err := c.InsertJob(submitted)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"account": account.Name,
-				"error":   err,
-			}).Error("Unable to enqueue a submitted job.")
+	// Report every status, even those without any jobs.
+	var response struct {
+		Statuses map[string]int `json:"statuses"`
+	}
+	response.Statuses = make(map[string]int, len(validStatus))
+	for status := range validStatus {
+		response.Statuses[status] = counts[status]
+	}
 
-			APIError{
-				Code:    CodeEnqueueFailure,
-				Message: "Unable to enqueue your job.",
-				Retry:   true,
-			}.Report(http.StatusServiceUnavailable, w)
-			return
-		}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
 
-		jids[index] = jid
-		log.WithFields(log.Fields{
-			"jid":     jid,
-			"job":     job,
-			"account": account.Name,
-		}).Info("Successfully submitted a job.")
+// JobLogsHandler returns the stdout and stderr collected from a single job, without the rest of the
+// job document, as in GET /v1/jobs/{jid}/logs.
+func JobLogsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	_, job, ok := loadPathJob(c, w, r, "GET", "/logs")
+	if !ok {
+		return
 	}
 
-	response := Response{JIDs: jids}
+	var response struct {
+		Stdout   string `json:"stdout"`
+		Stderr   string `json:"stderr"`
+		Complete bool   `json:"complete"`
+	}
+	response.Stdout = job.Stdout
+	response.Stderr = job.Stderr
+	response.Complete = IsCompleted(job.Status)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(response)
 }
 
-// JobListHandler provides updated details about one or more jobs currently submitted to the
-// cluster.
-func JobListHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+// parseTimeParam parses the named query parameter as an RFC3339 timestamp. A missing parameter
+// parses as the zero time. If the parameter is malformed, an error is reported and false is returned.
+func parseTimeParam(w http.ResponseWriter, r *http.Request, account *Account, name string) (StoredTime, bool) {
+	raw := r.FormValue(name)
+	if raw == "" {
+		return 0, true
+	}
+
+	parsed, err := time.Parse(time.RFC3339, raw)
+	if err != nil {
+		APIError{
+			Code:    CodeUnableToParseQuery,
+			Message: fmt.Sprintf("Unable to parse %s [%s]: %v", name, raw, err),
+			Hint:    fmt.Sprintf(`Please specify "%s" as an RFC3339 timestamp, like 2015-02-03T04:05:06Z.`, name),
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return 0, false
+	}
+	return StoreTime(parsed), true
+}
+
+// exportBatchSize is the number of jobs that JobExportHandler reads from storage at a time.
+const exportBatchSize = 500
+
+// JobExportHandler streams every job submitted by the authenticated account as newline-delimited
+// JSON, in JID order. Jobs may be filtered by "status" and by a "since" RFC3339 timestamp, which
+// excludes jobs submitted before it.
+func JobExportHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use GET against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
 	account, err := Authenticate(c, w, r)
 	if err != nil {
-		log.WithFields(log.Fields{
+		RequestLog(w).WithFields(log.Fields{
 			"error": err,
 		}).Error("Authentication failure.")
 		return
 	}
+	c.Audit.Record(r, account, "job.export")
 
 	if err := r.ParseForm(); err != nil {
 		APIError{
 			Code:    CodeUnableToParseQuery,
 			Message: fmt.Sprintf("Unable to parse query parameters: %v", err),
-			Hint:    "You broke Go's URL parsing somehow! Make URLs that suck less.",
+			Hint:    "Please use a valid query string.",
 			Retry:   false,
 		}.Log(account).Report(http.StatusBadRequest, w)
 		return
 	}
 
-	q := JobQuery{AccountName: account.Name}
-	if rawJIDs, ok := r.Form["jid"]; ok {
-		jids := make([]uint64, len(rawJIDs))
-		for i, rawJID := range rawJIDs {
-			if jids[i], err = strconv.ParseUint(rawJID, 10, 64); err != nil {
-				APIError{
-					Code:    CodeUnableToParseQuery,
-					Message: fmt.Sprintf("Unable to parse JID [%s]: %v", rawJID, err),
-					Hint:    "Please only use valid JIDs.",
-					Retry:   false,
-				}.Log(account).Report(http.StatusBadRequest, w)
-				return
-			}
-		}
-		q.JIDs = jids
-	}
-	if names, ok := r.Form["name"]; ok {
-		q.Names = names
-	}
+	q := JobQuery{AccountName: account.Name, Limit: exportBatchSize}
 	if statuses, ok := r.Form["status"]; ok {
+		if !validateStatuses(w, account, statuses) {
+			return
+		}
 		q.Statuses = statuses
 	}
-	if rawLimit := r.FormValue("limit"); rawLimit != "" {
-		limit, err := strconv.ParseInt(rawLimit, 10, 0)
+	var ok bool
+	if q.CreatedSince, ok = parseTimeParam(w, r, account, "since"); !ok {
+		return
+	}
+
+	// Without a Content-Length, the response is sent with chunked transfer encoding.
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	exported := 0
+	for {
+		jobs, err := c.ListJobs(q)
 		if err != nil {
-			APIError{
-				Code:    CodeUnableToParseQuery,
-				Message: fmt.Sprintf("Unable to parse limit [%s]: %v", rawLimit, err),
-				Hint:    "Please specify a valid integral limit.",
-				Retry:   false,
-			}.Log(account).Report(http.StatusBadRequest, w)
+			if exported == 0 {
+				APIError{
+					Code:    CodeListFailure,
+					Message: "Unable to list jobs for export.",
+					Hint:    "This is probably a storage error on our end.",
+					Retry:   true,
+				}.Log(account).Report(http.StatusInternalServerError, w)
+				return
+			}
+
+			// The response has already begun, so the export can only be cut short.
+			RequestLog(w).WithFields(log.Fields{
+				"account":  account.Name,
+				"exported": exported,
+				"error":    err,
+			}).Error("Unable to list jobs to continue an export.")
 			return
 		}
 
-		if limit > 9999 {
-			limit = 9999
+		for _, job := range jobs {
+			if err := encoder.Encode(job); err != nil {
+				RequestLog(w).WithFields(log.Fields{
+					"account": account.Name,
+					"jid":     job.JID,
+					"error":   err,
+				}).Error("Unable to write an exported job.")
+				return
+			}
+			exported++
 		}
-		if limit < 1 {
-			APIError{
-				Code:    CodeUnableToParseQuery,
-				Message: fmt.Sprintf("Invalid negative or zero limit [%d]", limit),
-				Hint:    "Please specify a valid, positive integral limit.",
-				Retry:   false,
-			}.Log(account).Report(http.StatusBadRequest, w)
-			return
+		if flusher != nil {
+			flusher.Flush()
 		}
-		q.Limit = int(limit)
-	} else {
-		q.Limit = 1000
-	}
 
-	if rawBefore := r.FormValue("before"); rawBefore != "" {
-		before, err := strconv.ParseUint(rawBefore, 10, 64)
-		if err != nil {
-			APIError{
-				Code:    CodeUnableToParseQuery,
-				Message: fmt.Sprintf(`Unable to parse Before bound [%s]: %v`, rawBefore, err),
-				Hint:    "Please specify a valid integral JID as the lower bound.",
-				Retry:   false,
-			}.Log(account).Report(http.StatusBadRequest, w)
-			return
-		}
-		q.Before = before
-	}
-	if rawAfter := r.FormValue("after"); rawAfter != "" {
-		after, err := strconv.ParseUint(rawAfter, 10, 64)
-		if err != nil {
-			APIError{
-				Code:    CodeUnableToParseQuery,
-				Message: fmt.Sprintf(`Unable to parse After bound [%s]: %v`, rawAfter, err),
-				Hint:    "Please specify a valid integral JID as the upper bound.",
-				Retry:   false,
-			}.Log(account).Report(http.StatusBadRequest, w)
-			return
+		if len(jobs) < exportBatchSize {
+			break
 		}
-		q.After = after
+		q.AfterJID = jobs[len(jobs)-1].JID
 	}
 
-	results, err := c.ListJobs(q)
-	if err != nil {
-		re := APIError{
-			Code:    CodeListFailure,
-			Message: fmt.Sprintf("Unable to list jobs: %v", err),
-			Hint:    "This is most likely a database problem.",
-			Retry:   true,
-		}
-		re.Log(account).Report(http.StatusServiceUnavailable, w)
-		return
+	RequestLog(w).WithFields(log.Fields{
+		"account":  account.Name,
+		"exported": exported,
+	}).Info("Exported jobs.")
+}
+
+// JobOutputHandler dispatches requests for a single job's output, at /v1/jobs/{jid}/stdout,
+// /v1/jobs/{jid}/stderr, /v1/jobs/{jid}/logs, /v1/jobs/{jid}/result and /v1/jobs/{jid}/stream, and
+// requests to retry it at /v1/jobs/{jid}/retry.
+func JobOutputHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/retry"):
+		JobRetryHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/stream"):
+		JobStreamHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/stdout"):
+		JobStdoutHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/stderr"):
+		JobStderrHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/logs"):
+		JobLogsHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/result"):
+		JobResultHandler(c, w, r)
+	default:
+		APIError{
+			Code:    CodeJobNotFound,
+			Message: fmt.Sprintf("No job resource at [%s].", r.URL.Path),
+			Hint:    "Use /v1/jobs/{jid}/stdout, /v1/jobs/{jid}/stderr, /v1/jobs/{jid}/logs, /v1/jobs/{jid}/result, /v1/jobs/{jid}/stream or /v1/jobs/{jid}/retry.",
+			Retry:   false,
+		}.Report(http.StatusNotFound, w)
 	}
+}
 
-	var response struct {
-		Jobs []SubmittedJob `json:"jobs"`
+// JobStdoutHandler returns the stdout collected from a single job as plain text. Output from a
+// running job is as recent as its last flush to storage.
+func JobStdoutHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	writeJobOutput(c, w, r, "/stdout", func(job SubmittedJob) string { return job.Stdout })
+}
+
+// JobStderrHandler returns the stderr collected from a single job as plain text. Output from a
+// running job is as recent as its last flush to storage.
+func JobStderrHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	writeJobOutput(c, w, r, "/stderr", func(job SubmittedJob) string { return job.Stderr })
+}
+
+// writeJobOutput loads the job identified by a /v1/jobs/{jid}{suffix} path and writes one of its
+// output streams as the response body.
+func writeJobOutput(c *Context, w http.ResponseWriter, r *http.Request, suffix string, stream func(SubmittedJob) string) {
+	_, job, ok := loadPathJob(c, w, r, "GET", suffix)
+	if !ok {
+		return
 	}
-	response.Jobs = results
 
-	log.WithFields(log.Fields{
-		"query":        q,
-		"result count": len(results),
-		"account":      account.Name,
-	}).Debug("Successful job query.")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, stream(*job))
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(response)
+// resultContentTypes maps each result type to the Content-Type used to download it.
+var resultContentTypes = map[string]string{
+	ResultBinary: "application/octet-stream",
+	ResultPickle: "application/python-pickle",
 }
 
-// JobKillHandler allows a user to prematurely terminate a running job.
-func JobKillHandler(c *Context, w http.ResponseWriter, r *http.Request) {
-	account, err := Authenticate(c, w, r)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("Authentication failure.")
+// JobResultHandler returns the raw result of a successfully completed job, with a Content-Type that
+// matches its result type. A job that hasn't completed yet is reported with a 202 status.
+func JobResultHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	_, job, ok := loadPathJob(c, w, r, "GET", "/result")
+	if !ok {
 		return
 	}
 
-	if err = r.ParseForm(); err != nil {
+	if !IsCompleted(job.Status) {
+		var response struct {
+			JID    uint64 `json:"jid"`
+			Status string `json:"status"`
+		}
+		response.JID = job.JID
+		response.Status = job.Status
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if job.Status != StatusDone {
 		APIError{
-			Code:    CodeInvalidJobForm,
-			Message: fmt.Sprintf("Unable to parse Job: Kill payload as a POST body: %v", err),
-			Hint:    "Please use valid form encoding in your request.",
+			Code:    CodeJobNoResult,
+			Message: fmt.Sprintf("The job [%d] finished with status [%s] and has no result.", job.JID, job.Status),
+			Hint:    "Check the job's stderr to see what went wrong.",
 			Retry:   false,
-		}.Log(account).Report(http.StatusBadRequest, w)
+		}.Report(http.StatusConflict, w)
 		return
 	}
 
-	jidstr := r.PostFormValue("jid")
-	jid, err := strconv.ParseUint(jidstr, 10, 64)
-	if err != nil {
+	contentType, ok := resultContentTypes[job.ResultType]
+	if !ok {
+		contentType = resultContentTypes[ResultBinary]
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(job.Result)
+}
+
+// loadPathJob loads the job identified by a /v1/jobs/{jid}{suffix} path on behalf of the
+// authenticated account, if the request uses method, and returns both. If the job can't be loaded,
+// an error is reported and false is returned.
+func loadPathJob(c *Context, w http.ResponseWriter, r *http.Request, method, suffix string) (*Account, *SubmittedJob, bool) {
+	if r.Method != method {
 		APIError{
-			Code:    CodeInvalidJobForm,
-			Message: fmt.Sprintf("Unable to parse Job: Kill payload as a valid JID: %v", err),
-			Hint:    "Please provide a valid integer job ID to Job: Kill.",
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    fmt.Sprintf("Use %s against this endpoint.", method),
 			Retry:   false,
-		}.Log(account).Report(http.StatusBadRequest, w)
-		return
+		}.Report(http.StatusMethodNotAllowed, w)
+		return nil, nil, false
 	}
 
-	sudo := r.PostFormValue("sudo") == "true"
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return nil, nil, false
+	}
+	c.Audit.Record(r, account, "job."+strings.TrimPrefix(suffix, "/"))
 
-	query := JobQuery{JIDs: []uint64{jid}}
-	if !sudo {
-		query.AccountName = account.Name
+	rawJID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), suffix)
+	jid, err := strconv.ParseUint(rawJID, 10, 64)
+	if err != nil {
+		APIError{
+			Code:    CodeUnableToParseQuery,
+			Message: fmt.Sprintf("Unable to parse JID [%s]: %v", rawJID, err),
+			Hint:    "Please provide a valid integer job ID in the path.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return nil, nil, false
 	}
 
-	jobs, err := c.ListJobs(query)
+	jobs, err := c.ListJobs(JobQuery{AccountName: account.Name, JIDs: []uint64{jid}})
 	if err != nil {
 		APIError{
 			Code:    CodeListFailure,
@@ -286,87 +1464,90 @@ func JobKillHandler(c *Context, w http.ResponseWriter, r *http.Request) {
 			Hint:    "This is probably a storage error on our end.",
 			Retry:   true,
 		}.Log(account).Report(http.StatusInternalServerError, w)
-		return
+		return nil, nil, false
 	}
-
 	if len(jobs) == 0 {
 		APIError{
 			Code:    CodeJobNotFound,
-			Message: fmt.Sprintf("Unable to find a job with ID [%s].", jid),
+			Message: fmt.Sprintf("Unable to find a job with ID [%d].", jid),
 			Hint:    "Make sure that the JID is still valid.",
 			Retry:   false,
 		}.Log(account).Report(http.StatusNotFound, w)
-		return
-	}
-	if len(jobs) != 1 {
-		APIError{
-			Code: CodeWTF,
-			Message: fmt.Sprintf(
-				"Job query for JID [%s] on account [%s] returned [%d] results.",
-				jid, account.Name, len(jobs),
-			),
-			Hint:  "Duplicate JID. No clue how that happened.",
-			Retry: false,
-		}.Log(account).Report(http.StatusInternalServerError, w)
-		return
+		return nil, nil, false
 	}
 
-	job := &jobs[0]
-
-	job.KillRequested = true
+	return account, &jobs[0], true
+}
 
-	// If the container ID hasn't been assigned yet, the job most likely isn't running.
-	// If it's already left StatusQueued, let the job runner handle the transition to
-	// StatusKilled. Otherwise, set it to StatusKilled ourselves to remove it from the queue.
-	if job.Status == StatusQueued {
-		job.Status = StatusKilled
+// JobRetryHandler resubmits a job that has failed, been killed, timed out or stalled, as in
+// POST /v1/jobs/{jid}/retry. The original job is left as it is; a copy of its description is
+// submitted as a new job with a fresh JID, as if through JobSubmitHandler.
+func JobRetryHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, original, ok := loadPathJob(c, w, r, "POST", "/retry")
+	if !ok {
+		return
 	}
+	jid := original.JID
 
-	err = c.UpdateJob(job)
-	if err != nil {
+	if !IsCompleted(original.Status) || original.Status == StatusDone {
 		APIError{
-			Code:    CodeJobUpdateFailure,
-			Message: fmt.Sprintf("Unable to request a job kill: %v", err),
-			Hint:    "This is probably a storage error on our end.",
-			Retry:   true,
-		}.Log(account).Report(http.StatusInternalServerError, w)
+			Code:    CodeJobNotRetryable,
+			Message: fmt.Sprintf("Job [%d] can't be retried while it's [%s].", jid, original.Status),
+			Hint:    "Only jobs that have finished unsuccessfully may be retried.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusConflict, w)
 		return
 	}
 
-	if job.ContainerID != "" {
-		err = c.KillContainer(docker.KillContainerOptions{ID: job.ContainerID})
-		if err != nil {
-			APIError{
-				Code:    CodeJobKillFailure,
-				Message: fmt.Sprintf("Unable to kill a running job: %v", err),
-				Hint:    "The container is misbehaving somehow.",
-				Retry:   true,
-			}.Log(account).Report(http.StatusInternalServerError, w)
-			return
-		}
+	newJIDs, ok := retryJobs(c, w, account, []SubmittedJob{*original})
+	if !ok {
+		return
+	}
+	newJID := newJIDs[0]
 
-		log.WithFields(log.Fields{
-			"jid":     job.JID,
-			"account": account.Name,
-			"sudo":    sudo,
-		}).Info("Running job killed.")
-	} else {
-		log.WithFields(log.Fields{
-			"jid":     job.JID,
-			"account": account.Name,
-			"sudo":    sudo,
-		}).Info("Job kill requested.")
+	RequestLog(w).WithFields(log.Fields{
+		"jid":      newJID,
+		"retry of": jid,
+		"account":  account.Name,
+	}).Info("Successfully retried a job.")
+
+	var response struct {
+		JID     uint64 `json:"jid"`
+		RetryOf uint64 `json:"retry_of"`
 	}
+	response.JID = newJID
+	response.RetryOf = jid
 
-	OKResponse(w)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
-// JobKillAllHandler allows a user to terminate all jobs associated with their account.
-func JobKillAllHandler(c *Context, w http.ResponseWriter, r *http.Request) {
-	//
-}
+// retryJobs submits a copy of each of an account's unsuccessful jobs as a new job and returns the
+// new JIDs, in the same order. The copies are checked and stored exactly like new submissions, so
+// they're subject to the account's current limits and permissions, and wait for their dependencies
+// like any other job. A copy of a job that depends on another job in originals depends on that job's
+// copy instead. originals must be sorted by JID. If the copies can't be accepted, an error is reported
+// and false is returned.
+func retryJobs(c *Context, w http.ResponseWriter, account *Account, originals []SubmittedJob) ([]uint64, bool) {
+	if !allowSubmission(c, w, account, len(originals)) {
+		return nil, false
+	}
 
-// JobQueueStatsHandler allows a user to view statistics about the jobs that they have submitted.
-func JobQueueStatsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
-	//
+	copies := make(map[uint64]uint64, len(originals))
+	jids := make([]uint64, len(originals))
+	for i, original := range originals {
+		job := original.Job
+		if parent, ok := copies[job.Dependency()]; ok {
+			dependsOn := strconv.FormatUint(parent, 10)
+			job.DependsOn = &dependsOn
+		}
+
+		jid, ok := submitJob(c, w, account, job)
+		if !ok {
+			return nil, false
+		}
+		copies[original.JID] = jid
+		jids[i] = jid
+	}
+	return jids, true
 }
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // JobStorage is a fake Storage implementation that only provides job-relevant storage methods.
@@ -40,6 +47,10 @@ func (storage *JobStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
 
 	results := make([]SubmittedJob, 0, 3)
 	for _, job := range []SubmittedJob{j0, j1, j2} {
+		if !query.inBounds(job.JID) {
+			continue
+		}
+
 		if len(query.JIDs) > 0 {
 			for _, jid := range query.JIDs {
 				if job.JID == jid {
@@ -58,6 +69,15 @@ func (storage *JobStorage) UpdateJob(job *SubmittedJob) error {
 	return nil
 }
 
+func (storage *JobStorage) CountJobs(query JobQuery) (int, error) {
+	return 3, nil
+}
+
+func (storage *JobStorage) CountJobsByStatus(accountName string) (map[string]int, error) {
+	storage.Query = JobQuery{AccountName: accountName}
+	return map[string]int{StatusQueued: 3, StatusProcessing: 1, StatusDone: 7}, nil
+}
+
 func TestJobHandlerBadRequest(t *testing.T) {
 	r, err := http.NewRequest("PUT", "https://localhost/v1/jobs", nil)
 	if err != nil {
@@ -75,6 +95,30 @@ func TestJobHandlerBadRequest(t *testing.T) {
 	})
 }
 
+func TestJobHandlerOptions(t *testing.T) {
+	r, err := http.NewRequest("OPTIONS", "https://localhost/v1/job", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.Header.Set("Origin", "https://app.example.com")
+	r.Header.Set("Access-Control-Request-Method", "POST")
+	w := httptest.NewRecorder()
+	c := &Context{}
+
+	BindContext(c, JobHandler)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if allow := w.HeaderMap.Get("Allow"); allow != "GET, POST, OPTIONS" {
+		t.Errorf("Unexpected Allow header: [%s]", allow)
+	}
+	// Without any allowed origins, no origin may be granted access.
+	if origin := w.HeaderMap.Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Unexpected Access-Control-Allow-Origin header: [%s]", origin)
+	}
+}
+
 func TestSubmitJob(t *testing.T) {
 	body := strings.NewReader(`
 	{
@@ -128,13 +172,13 @@ func TestSubmitJob(t *testing.T) {
 		t.Errorf("Expected submitted job to be in state queued, not [%s]", s.Submitted.Status)
 	}
 
-	if s.Submitted.CreatedAt == 0 {
+	if s.Submitted.CreatedAt.IsZero() {
 		t.Error("Expected the job's CreatedAt time to be populated.")
 	}
-	if s.Submitted.StartedAt != 0 {
+	if !s.Submitted.StartedAt.IsZero() {
 		t.Errorf("Expected the job's StartedAt time to be zero, but was [%s]", s.Submitted.StartedAt)
 	}
-	if s.Submitted.FinishedAt != 0 {
+	if !s.Submitted.FinishedAt.IsZero() {
 		t.Errorf("Expected the job's FinishedAt time to be zero, but was [%s]", s.Submitted.FinishedAt)
 	}
 }
@@ -173,22 +217,73 @@ func TestSubmitJobBadResultSource(t *testing.T) {
 	})
 }
 
-func TestSubmitJobBadResultType(t *testing.T) {
-	body := strings.NewReader(`
-	{
-		"jobs": [{
-			"cmd": "id",
-			"name": "wat",
-			"result_source": "stdout",
-			"result_type": "elsewhere"
-		}]
+// completeAfter configures a MemoryStorage to complete its first job once it's been polled a number
+// of times.
+func completeAfter(s *MemoryStorage, polls int) {
+	s.OnListJobs = func(query JobQuery) {
+		if job, ok := s.Jobs[1]; ok && len(s.Queries) >= polls {
+			job.Status = StatusDone
+			job.Stdout = "finished"
+		}
 	}
-	`)
-	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+}
+
+// multipartRequest builds a multipart/form-data job submission from a map of part names to contents.
+// Parts are written in the order given by names.
+func multipartRequest(t *testing.T, names []string, parts map[string][]byte) *http.Request {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, name := range names {
+		part, err := writer.CreateFormFile(name, name)
+		if err != nil {
+			t.Fatalf("Unable to create the [%s] part: %v", name, err)
+		}
+		part.Write(parts[name])
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("Unable to close the multipart writer: %v", err)
+	}
+
+	r, err := http.NewRequest("POST", "https://localhost/v1/job", &body)
 	if err != nil {
 		t.Fatalf("Unable to create request: %v", err)
 	}
+	r.Header.Set("Content-Type", writer.FormDataContentType())
 	r.SetBasicAuth("admin", "12345")
+	return r
+}
+
+func TestSubmitJobMultipart(t *testing.T) {
+	stdin := []byte{0x00, 0xff, 0x10, '\n', 0x80}
+	r := multipartRequest(t, []string{"stdin", "job"}, map[string][]byte{
+		"job":   []byte(`{"cmd": "wc -c", "result_source": "stdout", "result_type": "binary", "stdin": "ignored"}`),
+		"stdin": stdin,
+	})
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if s.Submitted.Command != "wc -c" {
+		t.Errorf("Expected the job to be decoded from the job part, got command [%s]", s.Submitted.Command)
+	}
+	if !bytes.Equal(s.Submitted.Stdin, stdin) {
+		t.Errorf("Expected stdin %v, got %v", stdin, []byte(s.Submitted.Stdin))
+	}
+}
+
+func TestSubmitJobMultipartMissingJob(t *testing.T) {
+	r := multipartRequest(t, []string{"stdin"}, map[string][]byte{"stdin": []byte("data")})
 	w := httptest.NewRecorder()
 	c := &Context{
 		Settings: Settings{
@@ -201,174 +296,2894 @@ func TestSubmitJobBadResultType(t *testing.T) {
 	JobHandler(c, w, r)
 
 	hasError(t, w, http.StatusBadRequest, APIError{
-		Code:    CodeInvalidResultType,
-		Message: "Invalid result type [elsewhere]",
+		Code:    CodeInvalidJobForm,
+		Message: `Unable to parse multipart job payload: missing the "job" part`,
 		Retry:   false,
 	})
 }
 
-func TestListJobsAll(t *testing.T) {
-	r, err := http.NewRequest("GET", "https://localhost/v1/jobs", nil)
-	if err != nil {
-		t.Fatalf("Unable to create request: %v", err)
-	}
-	r.SetBasicAuth("admin", "12345")
+func TestSubmitJobMultipartInvalidJSON(t *testing.T) {
+	r := multipartRequest(t, []string{"job"}, map[string][]byte{"job": []byte("{nope")})
 	w := httptest.NewRecorder()
-	s := &JobStorage{}
 	c := &Context{
 		Settings: Settings{
 			AdminName: "admin",
 			AdminKey:  "12345",
 		},
-		Storage: s,
+		Storage: &JobStorage{},
 	}
 
 	JobHandler(c, w, r)
 
-	if w.Code != http.StatusOK {
+	if w.Code != http.StatusBadRequest {
 		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
 	}
+	if !strings.Contains(w.Body.String(), CodeInvalidJobJSON) {
+		t.Errorf("Expected a [%s] error, got [%s]", CodeInvalidJobJSON, w.Body.String())
+	}
+}
+
+func TestSubmitAndWait(t *testing.T) {
+	s := &MemoryStorage{}
+	completeAfter(s, 3)
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
 
+	w := serveRequest(t, c, JobSubmitAndWaitHandler, "admin", "POST", "/v1/jobs/submit_and_wait", `{
+		"job": {"cmd": "id", "result_source": "stdout", "result_type": "binary"},
+		"poll_interval_ms": 1,
+		"timeout_ms": 5000
+	}`)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
 	var response struct {
-		Jobs []SubmittedJob `json:"jobs"`
+		JID      uint64 `json:"jid"`
+		Status   string `json:"status"`
+		Stdout   string `json:"stdout"`
+		TimedOut bool   `json:"timed_out"`
 	}
-	out := w.Body.Bytes()
-	if err := json.Unmarshal(out, &response); err != nil {
-		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
 	}
-	t.Logf("Response body:\n%s", out)
+	if response.JID != 1 || response.Status != StatusDone || response.Stdout != "finished" || response.TimedOut {
+		t.Errorf("Unexpected response: %+v", response)
+	}
+	if len(s.Queries) != 4 {
+		t.Errorf("Expected storage to be polled four times, got %d", len(s.Queries))
+	}
+}
 
-	if len(response.Jobs) != 3 {
-		t.Fatalf("Unexpected number of jobs returned: [%d]", len(response.Jobs))
+func TestSubmitAndWaitTimeout(t *testing.T) {
+	clock := NewFakeClock()
+	s := &MemoryStorage{}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+		Clock:    clock,
 	}
-	if cmd0 := response.Jobs[0].Command; cmd0 != `echo "1"` {
-		t.Errorf(`Expected first job to have command 'echo "1"', had [%s]`, cmd0)
+
+	var w *httptest.ResponseRecorder
+	done := make(chan struct{})
+	go func() {
+		w = serveRequest(t, c, JobSubmitAndWaitHandler, "admin", "POST", "/v1/jobs/submit_and_wait", `{
+			"job": {"cmd": "id", "result_source": "stdout", "result_type": "binary"},
+			"poll_interval_ms": 500,
+			"timeout_ms": 2000
+		}`)
+		close(done)
+	}()
+
+	clock.WaitForTimers(2)
+	clock.Advance(2 * time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the request to time out")
 	}
-	if cmd1 := response.Jobs[1].Command; cmd1 != `echo "2"` {
-		t.Errorf(`Expected second job to have command 'echo "2"', had [%s]`, cmd1)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
 	}
-	if cmd2 := response.Jobs[2].Command; cmd2 != `echo "3"` {
-		t.Errorf(`Expected third job to have command 'echo "3"', had [%s]`, cmd2)
+	var response struct {
+		Status   string `json:"status"`
+		TimedOut bool   `json:"timed_out"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if response.Status != StatusQueued || !response.TimedOut {
+		t.Errorf("Unexpected response: %+v", response)
 	}
 }
 
-func jobListQuery(t *testing.T, url string) JobQuery {
-	r, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		t.Fatalf("Unable to create request: %v", err)
-	}
-	r.SetBasicAuth("admin", "12345")
-	w := httptest.NewRecorder()
-	s := &JobStorage{}
+func TestSubmitAndWaitInvalidTimeout(t *testing.T) {
 	c := &Context{
-		Settings: Settings{
-			AdminName: "admin",
-			AdminKey:  "12345",
-		},
-		Storage: s,
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &MemoryStorage{},
 	}
 
-	JobHandler(c, w, r)
+	w := serveRequest(t, c, JobSubmitAndWaitHandler, "admin", "POST", "/v1/jobs/submit_and_wait", `{
+		"job": {"cmd": "id", "result_source": "stdout", "result_type": "binary"},
+		"timeout_ms": 120000
+	}`)
 
-	return s.Query
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeInvalidWaitOptions,
+		Message: "Invalid poll interval [0] or timeout [120000]",
+		Retry:   false,
+	})
 }
 
-func TestListJobsBySingleID(t *testing.T) {
-	q := jobListQuery(t, "https://localhost/v1/jobs?jid=123")
+// uniqueNameJobs is a submission of a single job with a unique name.
+const uniqueNameJobs = `{"jobs": [{"cmd": "id", "name": "nightly", "result_source": "stdout", "result_type": "binary"}]}`
 
-	if len(q.JIDs) != 1 {
-		t.Errorf("Expected a single JID, got [%v]", q.JIDs)
+func TestSubmitJobUniqueName(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", EnforceUniqueJobNames: true},
+		Storage:  s,
 	}
-	if q.JIDs[0] != 123 {
-		t.Errorf("Expected JID to be 123, got [%d]", q.JIDs[0])
+
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", uniqueNameJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
 	}
 
-	if q.Limit != 1000 {
-		t.Errorf("Expected limit to default to 1000, got [%d]", q.Limit)
+	// The name may be reused once the first job has completed.
+	s.Jobs[1].Status = StatusDone
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", uniqueNameJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.Jobs) != 2 {
+		t.Errorf("Expected two jobs to be submitted, got %d", len(s.Jobs))
 	}
 }
 
-func TestListJobsByMultipleIDs(t *testing.T) {
-	q := jobListQuery(t, "https://localhost/v1/jobs?jid=123&jid=456&jid=789")
+func TestSubmitJobDuplicateName(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", EnforceUniqueJobNames: true},
+		Storage:  s,
+	}
 
-	if len(q.JIDs) != 3 {
-		t.Errorf("Expected three JIDs, got [%v]", q.JIDs)
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", uniqueNameJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
 	}
-	for i, expected := range []uint64{123, 456, 789} {
-		if q.JIDs[i] != expected {
-			t.Errorf("Expected [%d] for element %d, got [%d]", expected, i, q.JIDs[i])
-		}
+	w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", uniqueNameJobs)
+
+	hasError(t, w, http.StatusConflict, APIError{
+		Code:    CodeDuplicateJobName,
+		Message: "The job [1] is already named [nightly].",
+		Retry:   false,
+	})
+	if len(s.Jobs) != 1 {
+		t.Errorf("Expected the duplicate not to be stored, but there are %d jobs", len(s.Jobs))
+	}
+
+	// Duplicates are accepted when the policy is off.
+	c.EnforceUniqueJobNames = false
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", uniqueNameJobs); w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
 	}
 }
 
-func TestListJobsBySingleName(t *testing.T) {
-	q := jobListQuery(t, "https://localhost/v1/jobs?name=foo")
+// cacheKeyJobs is a submission of a single job with a cache key.
+const cacheKeyJobs = `{"jobs": [{"cmd": "id", "cache_key": "abc", "result_source": "stdout", "result_type": "binary"}]}`
 
-	if len(q.Names) != 1 {
-		t.Errorf("Expected a single name, got [%v]", q.Names)
+func TestSubmitJobCacheKey(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
 	}
-	if q.Names[0] != "foo" {
-		t.Errorf("Expected JID to be foo, got [%s]", q.Names[0])
+
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", cacheKeyJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if s.Jobs[1].CacheKey != "abc" {
+		t.Errorf("Expected the cache key to be stored, got [%s]", s.Jobs[1].CacheKey)
 	}
-}
 
-func TestListJobsByMultipleNames(t *testing.T) {
-	q := jobListQuery(t, "https://localhost/v1/jobs?name=foo&name=bar")
+	// Incomplete jobs aren't reused.
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", cacheKeyJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.Jobs) != 2 {
+		t.Fatalf("Expected a second job to be submitted, got %d jobs", len(s.Jobs))
+	}
 
-	if len(q.Names) != 2 {
-		t.Errorf("Expected two names, got [%v]", q.Names)
+	s.Jobs[2].Status = StatusDone
+	s.Jobs[2].CacheExpiresAt = StoreTime(time.Now().Add(time.Minute))
+
+	w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", cacheKeyJobs)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
 	}
-	for i, expected := range []string{"foo", "bar"} {
-		if q.Names[i] != expected {
-			t.Errorf("Expected name %d to be [%s], got [%s]", i, expected, q.Names[i])
-		}
+	if expected := `{"jids":[2],"cached":[2]}` + "\n"; w.Body.String() != expected {
+		t.Errorf("Expected the cached job to be returned, got %s", w.Body.String())
+	}
+	if len(s.Jobs) != 2 {
+		t.Errorf("Expected no new job to be submitted, got %d jobs", len(s.Jobs))
 	}
-}
 
-func TestListJobsMaximumLimit(t *testing.T) {
-	q := jobListQuery(t, "https://localhost/v1/jobs?name=foo&limit=99999999")
+	// Cached results may be bypassed on request.
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs?use_cache=false", cacheKeyJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.Jobs) != 3 {
+		t.Errorf("Expected a new job to be submitted, got %d jobs", len(s.Jobs))
+	}
 
-	if q.Limit != 9999 {
-		t.Errorf("Expected handler to clamp limit to 9999, but was %d", q.Limit)
+	// Cached results expire.
+	s.Jobs[2].CacheExpiresAt = StoreTime(time.Now().Add(-time.Minute))
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", cacheKeyJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.Jobs) != 4 {
+		t.Errorf("Expected a new job to be submitted, got %d jobs", len(s.Jobs))
 	}
 }
 
-func TestSubmittedJobContainerName(t *testing.T) {
-	name := "wat"
-	explicitName := SubmittedJob{
-		Job: Job{Name: &name},
-		JID: 1234,
+func TestSubmitJobInvalidUseCache(t *testing.T) {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)},
 	}
-	if containerName := explicitName.ContainerName(); containerName != "job_1234_wat" {
-		t.Errorf("Expected explicit name to be [job_1234_wat], was [%s]", containerName)
+
+	w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs?use_cache=maybe", cacheKeyJobs)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeUnableToParseQuery,
+		Message: `Unable to parse use_cache [maybe]: strconv.ParseBool: parsing "maybe": invalid syntax`,
+		Retry:   false,
+	})
+}
+
+func TestSubmitJobRunID(t *testing.T) {
+	body := strings.NewReader(`{"jobs": [
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary"},
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary", "run_id": "mine"},
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary"}
+	]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
 	}
 
-	anonymous := SubmittedJob{JID: 4321}
-	if containerName := anonymous.ContainerName(); containerName != "job_4321_unnamed" {
-		t.Errorf("Expected anonymous name to be [job_4321_unnamed], was [%s]", containerName)
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		JIDs  []uint64 `json:"jids"`
+		RunID string   `json:"run_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if len(response.RunID) != 36 {
+		t.Fatalf("Expected a generated UUID run ID, got [%s]", response.RunID)
+	}
+
+	expected := []string{response.RunID, "mine", response.RunID}
+	for i, jid := range response.JIDs {
+		if runID := s.Jobs[jid].RunID; runID != expected[i] {
+			t.Errorf("Expected job %d to have run ID [%s], got [%s]", i, expected[i], runID)
+		}
 	}
 }
 
-func TestSubmitJobKill(t *testing.T) {
-	r, err := http.NewRequest("POST", "https://localhost/v1/jobs/kill", strings.NewReader("jid=11"))
-	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+func TestSubmitJobRunIDAutoGroup(t *testing.T) {
+	body := strings.NewReader(`{"run_id_auto_group": true, "jobs": [
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary", "run_id": "mine"},
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary"}
+	]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
 	if err != nil {
 		t.Fatalf("Unable to create request: %v", err)
 	}
 	r.SetBasicAuth("admin", "12345")
 	w := httptest.NewRecorder()
-	s := &JobStorage{}
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
 	c := &Context{
-		Settings: Settings{
-			AdminName: "admin",
-			AdminKey:  "12345",
-		},
-		Storage: s,
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
 	}
 
-	JobKillHandler(c, w, r)
+	JobHandler(c, w, r)
 
-	if !s.Submitted.KillRequested {
-		t.Error("Expected a job kill to be requested")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		JIDs  []uint64 `json:"jids"`
+		RunID string   `json:"run_id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if len(response.RunID) != 36 {
+		t.Fatalf("Expected a generated UUID run ID, got [%s]", response.RunID)
+	}
+
+	for i, jid := range response.JIDs {
+		if runID := s.Jobs[jid].RunID; runID != response.RunID {
+			t.Errorf("Expected job %d to have run ID [%s], got [%s]", i, response.RunID, runID)
+		}
+	}
+}
+
+// idempotentJobs is a submission of a single job with an idempotency key.
+const idempotentJobs = `{"jobs": [{"cmd": "id", "idempotency_key": "retry-me", "result_source": "stdout", "result_type": "binary"}]}`
+
+func TestSubmitJobIdempotencyKey(t *testing.T) {
+	clock := NewFakeClock()
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", IdempotencyTTL: 60},
+		Storage:  s,
+		Clock:    clock,
 	}
+
+	first := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", first.Code, first.Body.String())
+	}
+	retry := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+	if retry.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", retry.Code, retry.Body.String())
+	}
+
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the retry to return %s, got %s", first.Body.String(), retry.Body.String())
+	}
+	if len(s.Jobs) != 1 {
+		t.Errorf("Expected the retry not to create a job, but there are %d jobs", len(s.Jobs))
+	}
+
+	// Keys are forgotten once they expire.
+	clock.Advance(61 * time.Second)
+
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.Jobs) != 2 {
+		t.Errorf("Expected a new job after the key expired, but there are %d jobs", len(s.Jobs))
+	}
+}
+
+func TestSubmitJobIdempotencyKeyInUse(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", IdempotencyTTL: 60},
+		Storage:  s,
+	}
+
+	// Another request has reserved the key, but hasn't created its job yet.
+	s.ReserveIdempotencyKey(IdempotencyKey{
+		Account:   "admin",
+		Key:       "retry-me",
+		ExpiresAt: time.Now().Add(time.Minute),
+	}, time.Now())
+
+	w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+
+	hasError(t, w, http.StatusConflict, APIError{
+		Code:    CodeIdempotencyKeyInUse,
+		Message: "Another request with the idempotency key [retry-me] is still being submitted.",
+		Hint:    "Please retry once that request has completed.",
+		Retry:   true,
+	})
+	if len(s.Jobs) != 0 {
+		t.Errorf("Expected no job to be created, but there are %d jobs", len(s.Jobs))
+	}
+}
+
+func TestSubmitJobIdempotencyKeyReleasedOnFailure(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", IdempotencyTTL: 60},
+		Storage:  s,
+	}
+
+	body := strings.NewReader(`{"jobs": [{"idempotency_key": "retry-me", "result_source": "stdout", "result_type": "binary"}]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Expected the job without a command to be rejected, got [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.IdempotencyKeys) != 0 {
+		t.Errorf("Expected the key to be released, but found %v", s.IdempotencyKeys)
+	}
+
+	// The corrected request may reuse the key.
+	if w := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs); w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if len(s.Jobs) != 1 {
+		t.Errorf("Expected the corrected request to create a job, but there are %d jobs", len(s.Jobs))
+	}
+}
+
+func TestSubmitJobIdempotentReplayIsNotRateLimited(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings:      Settings{AdminName: "admin", AdminKey: "12345", IdempotencyTTL: 60},
+		Storage:       s,
+		SubmitLimiter: NewRateLimiter(1, time.Minute, NewFakeClock()),
+	}
+
+	first := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", first.Code, first.Body.String())
+	}
+	for i := 0; i < 3; i++ {
+		retry := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+		if retry.Code != http.StatusOK {
+			t.Fatalf("Expected retry %d to be replayed, got [%d] %s", i, retry.Code, retry.Body.String())
+		}
+	}
+}
+
+func TestSubmitJobResultPath(t *testing.T) {
+	body := strings.NewReader(`
+	{
+		"jobs": [{
+			"cmd": "id",
+			"result_path": "/tmp/out.txt",
+			"result_type": "binary"
+		}]
+	}
+	`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if s.Submitted.ResultSource != "file:/tmp/out.txt" {
+		t.Errorf("Expected result source [file:/tmp/out.txt], got [%s]", s.Submitted.ResultSource)
+	}
+}
+
+func TestSubmitJobResultPathAndSource(t *testing.T) {
+	body := strings.NewReader(`
+	{
+		"jobs": [{
+			"cmd": "id",
+			"result_source": "stdout",
+			"result_path": "/tmp/out.txt",
+			"result_type": "binary"
+		}]
+	}
+	`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: &JobStorage{},
+	}
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeConflictingResultSource,
+		Message: "Conflicting result source [stdout] and result path [/tmp/out.txt]",
+		Retry:   false,
+	})
+}
+
+func TestSubmitJobExpandsCommand(t *testing.T) {
+	body := strings.NewReader(`
+	{
+		"jobs": [{
+			"cmd": "python analyze.py --input {{.Tags.input_file}}",
+			"tags": {"input_file": "data.csv"},
+			"result_source": "stdout",
+			"result_type": "binary"
+		}]
+	}
+	`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if expected := "python analyze.py --input {{.Tags.input_file}}"; s.Submitted.Command != expected {
+		t.Errorf("Expected the submitted command [%s] to be kept, got [%s]", expected, s.Submitted.Command)
+	}
+	if expected := "python analyze.py --input data.csv"; s.Submitted.ExpandedCommand != expected {
+		t.Errorf("Expected expanded command [%s], got [%s]", expected, s.Submitted.ExpandedCommand)
+	}
+}
+
+func TestSubmitJobUndefinedTag(t *testing.T) {
+	body := strings.NewReader(`
+	{
+		"jobs": [{
+			"cmd": "cat {{.Tags.missing}}",
+			"result_source": "stdout",
+			"result_type": "binary"
+		}]
+	}
+	`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var e struct {
+		Error APIError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if e.Error.Code != CodeTemplateExpansionError {
+		t.Errorf("Unexpected error code: [%s]", e.Error.Code)
+	}
+	if s.Submitted.Command != "" {
+		t.Errorf("Expected the job not to be stored, but got %+v", s.Submitted)
+	}
+}
+
+func TestSubmitJobBadResultType(t *testing.T) {
+	body := strings.NewReader(`
+	{
+		"jobs": [{
+			"cmd": "id",
+			"name": "wat",
+			"result_source": "stdout",
+			"result_type": "elsewhere"
+		}]
+	}
+	`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: &JobStorage{},
+	}
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeInvalidResultType,
+		Message: "Invalid result type [elsewhere]",
+		Retry:   false,
+	})
+}
+
+func coreSubmitRequest(t *testing.T, core string, allowed []string) *httptest.ResponseRecorder {
+	body := `
+	{
+		"jobs": [{
+			"cmd": "id",
+			"core": "` + core + `",
+			"result_source": "stdout",
+			"result_type": "binary"
+		}]
+	}
+	`
+	c := &Context{
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"user": {Name: "user", AllowedCores: allowed},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	return serveRequest(t, c, JobHandler, "user", "POST", "/v1/jobs", body)
+}
+
+func TestSubmitJobUnrestrictedCore(t *testing.T) {
+	w := coreSubmitRequest(t, "f2", nil)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+}
+
+func TestSubmitJobAllowedCore(t *testing.T) {
+	w := coreSubmitRequest(t, "f2", []string{"c1", "f2"})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+}
+
+func TestSubmitJobDisallowedCore(t *testing.T) {
+	w := coreSubmitRequest(t, "f2", []string{"c1"})
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeCoreNotPermitted,
+		Message: "Your account may not submit jobs to the core [f2].",
+		Retry:   false,
+	})
+}
+
+func imageSubmitRequest(t *testing.T, image string, global, allowed []string) *httptest.ResponseRecorder {
+	body := `
+	{
+		"jobs": [{
+			"cmd": "id",
+			"layer": [{"name": "` + image + `"}],
+			"result_source": "stdout",
+			"result_type": "binary"
+		}]
+	}
+	`
+	c := &Context{
+		Settings: Settings{AllowedImages: global},
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"user": {Name: "user", AllowedImages: allowed},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	return serveRequest(t, c, JobHandler, "user", "POST", "/v1/jobs", body)
+}
+
+func TestSubmitJobGloballyAllowedImage(t *testing.T) {
+	w := imageSubmitRequest(t, "runner-py2", []string{"runner-py2"}, []string{"runner-beta"})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+}
+
+func TestSubmitJobAccountAllowedImage(t *testing.T) {
+	w := imageSubmitRequest(t, "runner-beta", []string{"runner-py2"}, []string{"runner-beta"})
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+}
+
+func TestSubmitJobDisallowedImage(t *testing.T) {
+	w := imageSubmitRequest(t, "runner-evil", []string{"runner-py2"}, []string{"runner-beta"})
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeImageNotPermitted,
+		Message: "Your account may not submit jobs using the image [runner-evil].",
+		Retry:   false,
+	})
+}
+
+func creditSubmitRequest(t *testing.T, credits int64) *httptest.ResponseRecorder {
+	body := `{"jobs": [{"cmd": "id", "result_source": "stdout", "result_type": "binary"}]}`
+	c := &Context{
+		Settings: Settings{CostPerNanosecond: 1},
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"user": {Name: "user", Credits: credits},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	return serveRequest(t, c, JobHandler, "user", "POST", "/v1/jobs", body)
+}
+
+func TestSubmitJobWithCredits(t *testing.T) {
+	w := creditSubmitRequest(t, 1000)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+}
+
+func TestSubmitJobWithoutCredits(t *testing.T) {
+	w := creditSubmitRequest(t, 0)
+
+	hasError(t, w, http.StatusPaymentRequired, APIError{
+		Code:    CodeInsufficientCredits,
+		Message: "The account [user] has no remaining credits.",
+		Retry:   false,
+	})
+}
+
+func batchSubmitRequest(t *testing.T, count int) (*httptest.ResponseRecorder, *JobStorage) {
+	jobs := make([]string, count)
+	for i := range jobs {
+		jobs[i] = `{"cmd": "id", "result_source": "stdout", "result_type": "binary"}`
+	}
+	body := `{"jobs": [` + strings.Join(jobs, ",") + `]}`
+
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName:         "admin",
+			AdminKey:          "12345",
+			MaxJobsPerRequest: 100,
+		},
+		Storage: s,
+	}
+
+	return serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", body), s
+}
+
+func TestSubmitJobBatchAtLimit(t *testing.T) {
+	w, s := batchSubmitRequest(t, 100)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Submitted.Account != "admin" {
+		t.Error("Expected jobs to be submitted")
+	}
+}
+
+func TestSubmitJobBatchTooLarge(t *testing.T) {
+	w, s := batchSubmitRequest(t, 101)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeBatchTooLarge,
+		Message: "Too many jobs in one request: [101]",
+		Retry:   false,
+	})
+	if s.Submitted.Account != "" {
+		t.Error("Expected no jobs to be submitted")
+	}
+}
+
+// MemoryStorage is a fake Storage implementation that keeps submitted jobs in memory, keyed by JID.
+// Its zero value is ready to use, and it's safe for concurrent use. Besides storing jobs, it can be
+// configured to fail pings, return stale counts, and report the calls that it receives.
+type MemoryStorage struct {
+	NullStorage
+
+	mutex sync.Mutex
+
+	Jobs    map[uint64]*SubmittedJob
+	LastJID uint64
+
+	// Accounts are returned by GetAccount. Accounts that aren't listed have default settings.
+	Accounts map[string]*Account
+
+	IdempotencyKeys map[string]IdempotencyKey
+
+	// PingErr is returned by Ping.
+	PingErr error
+
+	// StaleCounts makes CountJobs miss every job, as though they had all been submitted concurrently.
+	StaleCounts bool
+
+	// Queries records each query used to list jobs.
+	Queries []JobQuery
+
+	// Updates records a copy of each job as it was updated.
+	Updates []SubmittedJob
+
+	// Skipped records the accounts skipped by each claim, and Claimed the JID of each claimed job.
+	Skipped [][]string
+	Claimed []uint64
+
+	// OnListJobs is called after each query is listed, with the storage locked. It may change Jobs to
+	// simulate other processes, but mustn't call the storage's methods.
+	OnListJobs func(query JobQuery)
+
+	// OnClaimJob is called with each job that's claimed.
+	OnClaimJob func(job SubmittedJob)
+}
+
+func (storage *MemoryStorage) Ping() error {
+	return storage.PingErr
+}
+
+func (storage *MemoryStorage) GetAccount(name string) (*Account, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if account, ok := storage.Accounts[name]; ok {
+		copied := *account
+		return &copied, nil
+	}
+	return &Account{Name: name}, nil
+}
+
+func (storage *MemoryStorage) InsertJob(job SubmittedJob) (uint64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.insertJob(job), nil
+}
+
+func (storage *MemoryStorage) insertJob(job SubmittedJob) uint64 {
+	if storage.Jobs == nil {
+		storage.Jobs = make(map[uint64]*SubmittedJob)
+	}
+	storage.LastJID++
+	job.JID = storage.LastJID
+	storage.Jobs[job.JID] = &job
+	return job.JID
+}
+
+func (storage *MemoryStorage) InsertJobWithinQuota(job SubmittedJob, maxQueued int) (uint64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	queued := 0
+	for _, existing := range storage.Jobs {
+		if existing.Account == job.Account && (existing.Status == StatusWaiting || existing.Status == StatusQueued) {
+			queued++
+		}
+	}
+	if queued >= maxQueued {
+		return 0, ErrQuotaExceeded
+	}
+	return storage.insertJob(job), nil
+}
+
+func (storage *MemoryStorage) GetJobByName(accountName, name string) (*SubmittedJob, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	for jid := storage.LastJID; jid > 0; jid-- {
+		job, ok := storage.Jobs[jid]
+		if ok && job.Account == accountName && job.Name != nil && *job.Name == name {
+			copied := *job
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// Reset discards every stored job, so that a MemoryStorage can be reused between test cases.
+func (storage *MemoryStorage) Reset() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.Jobs = make(map[uint64]*SubmittedJob)
+	storage.LastJID = 0
+	return nil
+}
+
+func (storage *MemoryStorage) FindCachedJob(accountName, cacheKey string) (*SubmittedJob, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	now := StoreTime(time.Now())
+	for jid := storage.LastJID; jid > 0; jid-- {
+		job, ok := storage.Jobs[jid]
+		if !ok || job.Account != accountName || job.CacheKey != cacheKey || job.Status != StatusDone {
+			continue
+		}
+		if job.CacheExpiresAt.IsZero() || job.CacheExpiresAt.After(now) {
+			copied := *job
+			return &copied, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (storage *MemoryStorage) GetIdempotencyKey(accountName, key string, now time.Time) (*IdempotencyKey, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	return storage.getIdempotencyKey(accountName, key, now)
+}
+
+func (storage *MemoryStorage) getIdempotencyKey(accountName, key string, now time.Time) (*IdempotencyKey, error) {
+	record, ok := storage.IdempotencyKeys[accountName+"/"+key]
+	if !ok || !record.ExpiresAt.After(now) {
+		return nil, ErrNotFound
+	}
+	return &record, nil
+}
+
+func (storage *MemoryStorage) ReserveIdempotencyKey(record IdempotencyKey, now time.Time) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if _, err := storage.getIdempotencyKey(record.Account, record.Key, now); err == nil {
+		return ErrIdempotencyKeyExists
+	}
+	storage.saveIdempotencyKey(record)
+	return nil
+}
+
+func (storage *MemoryStorage) SaveIdempotencyKey(record IdempotencyKey) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.saveIdempotencyKey(record)
+	return nil
+}
+
+func (storage *MemoryStorage) saveIdempotencyKey(record IdempotencyKey) {
+	if storage.IdempotencyKeys == nil {
+		storage.IdempotencyKeys = make(map[string]IdempotencyKey)
+	}
+	storage.IdempotencyKeys[record.Account+"/"+record.Key] = record
+}
+
+func (storage *MemoryStorage) ReleaseIdempotencyKey(accountName, key string) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if record, ok := storage.IdempotencyKeys[accountName+"/"+key]; ok && record.JID == 0 {
+		delete(storage.IdempotencyKeys, accountName+"/"+key)
+	}
+	return nil
+}
+
+func (storage *MemoryStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	storage.Queries = append(storage.Queries, query)
+	if storage.OnListJobs != nil {
+		defer storage.OnListJobs(query)
+	}
+
+	var results []SubmittedJob
+	for jid := uint64(1); jid <= storage.LastJID; jid++ {
+		job, ok := storage.Jobs[jid]
+		if !ok || !storage.matches(query, job) {
+			continue
+		}
+		results = append(results, *job)
+	}
+	if query.descending() {
+		reverseJobs(results)
+	}
+
+	if query.Offset >= len(results) {
+		return []SubmittedJob{}, nil
+	}
+	results = results[query.Offset:]
+	if query.Limit > 0 && query.Limit < len(results) {
+		results = results[:query.Limit]
+	}
+	if query.descending() {
+		reverseJobs(results)
+	}
+	return results, nil
+}
+
+func (storage *MemoryStorage) CountJobs(query JobQuery) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	if storage.StaleCounts {
+		return 0, nil
+	}
+
+	count := 0
+	for _, job := range storage.Jobs {
+		if storage.matches(query, job) {
+			count++
+		}
+	}
+	return count, nil
+}
+
+func (storage *MemoryStorage) ListRuns(accountName string, after RunCursor, limit int) ([]RunSummary, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	runs := []RunSummary{}
+	cursor := RunSummary{RunID: after.RunID, CreatedAt: after.CreatedAt}
+	for _, run := range storage.summarizeRuns(accountName) {
+		if byRunCreatedAt([]RunSummary{cursor, run}).Less(0, 1) {
+			runs = append(runs, run)
+		}
+	}
+	sort.Sort(byRunCreatedAt(runs))
+	if len(runs) > limit {
+		runs = runs[:limit]
+	}
+	return runs, nil
+}
+
+func (storage *MemoryStorage) GetRunSummary(accountName, runID string) (RunSummary, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	run, ok := storage.summarizeRuns(accountName)[runID]
+	if !ok {
+		return RunSummary{}, ErrNotFound
+	}
+	return run, nil
+}
+
+func (storage *MemoryStorage) summarizeRuns(accountName string) map[string]RunSummary {
+	byRunID := make(map[string]*RunSummary)
+	for _, job := range storage.Jobs {
+		if job.Account != accountName || job.RunID == "" {
+			continue
+		}
+		run, ok := byRunID[job.RunID]
+		if !ok {
+			run = &RunSummary{RunID: job.RunID}
+			byRunID[job.RunID] = run
+		}
+		run.add(job.Status, 1, job.CreatedAt, job.StartedAt, job.FinishedAt)
+	}
+
+	runs := make(map[string]RunSummary, len(byRunID))
+	for runID, run := range byRunID {
+		run.finish()
+		runs[runID] = *run
+	}
+	return runs
+}
+
+// byRunCreatedAt sorts runs by the millisecond that their first jobs were submitted, then by run ID,
+// as ListRuns does.
+type byRunCreatedAt []RunSummary
+
+func (runs byRunCreatedAt) Len() int      { return len(runs) }
+func (runs byRunCreatedAt) Swap(i, j int) { runs[i], runs[j] = runs[j], runs[i] }
+func (runs byRunCreatedAt) Less(i, j int) bool {
+	first, second := runs[i].CreatedAt.Truncate(time.Millisecond), runs[j].CreatedAt.Truncate(time.Millisecond)
+	if first != second {
+		return first.Before(second)
+	}
+	return runs[i].RunID < runs[j].RunID
+}
+
+func (storage *MemoryStorage) CountJobsByAccount(statuses []string) ([]AccountJobCount, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	var jobs []SubmittedJob
+	for jid := uint64(1); jid <= storage.LastJID; jid++ {
+		if job, ok := storage.Jobs[jid]; ok {
+			jobs = append(jobs, *job)
+		}
+	}
+	return countByAccount(jobs, statuses), nil
+}
+
+// countByAccount counts jobs by account and status the same way that CountJobsByAccount does.
+func countByAccount(jobs []SubmittedJob, statuses []string) []AccountJobCount {
+	byKey := make(map[string]*AccountJobCount)
+	var keys []string
+	for _, job := range jobs {
+		if !containsString(statuses, job.Status) {
+			continue
+		}
+
+		key := job.Account + "\x00" + job.Status
+		count, ok := byKey[key]
+		if !ok {
+			count = &AccountJobCount{Account: job.Account, Status: job.Status, OldestCreatedAt: job.CreatedAt}
+			byKey[key] = count
+			keys = append(keys, key)
+		}
+		count.Count++
+		if job.CreatedAt.Before(count.OldestCreatedAt) {
+			count.OldestCreatedAt = job.CreatedAt
+		}
+	}
+	sort.Strings(keys)
+
+	counts := make([]AccountJobCount, len(keys))
+	for i, key := range keys {
+		counts[i] = *byKey[key]
+	}
+	return counts
+}
+
+func (storage *MemoryStorage) GetQueueDepths() (map[string]int64, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	depths := make(map[string]int64)
+	for _, job := range storage.Jobs {
+		depths[job.Status]++
+	}
+	return depths, nil
+}
+
+// matches returns true if a job satisfies a query's filters and cursor bounds.
+func (storage *MemoryStorage) matches(query JobQuery, job *SubmittedJob) bool {
+	if query.AccountName != "" && job.Account != query.AccountName {
+		return false
+	}
+	if len(query.JIDs) > 0 && !containsJID(query.JIDs, job.JID) {
+		return false
+	}
+	if len(query.Names) > 0 && (job.Name == nil || !containsString(query.Names, *job.Name)) {
+		return false
+	}
+	if len(query.Statuses) > 0 && !containsString(query.Statuses, job.Status) {
+		return false
+	}
+	for key, value := range query.Tags {
+		if actual, ok := job.Tags[key]; !ok || actual != value {
+			return false
+		}
+	}
+	if job.CreatedAt.Before(query.CreatedSince) {
+		return false
+	}
+	if !query.CreatedUntil.IsZero() && job.CreatedAt.After(query.CreatedUntil) {
+		return false
+	}
+	if query.RunID != "" && job.RunID != query.RunID {
+		return false
+	}
+	if !query.ScheduledUntil.IsZero() && job.ScheduledAt.After(query.ScheduledUntil) {
+		return false
+	}
+	return query.inBounds(job.JID)
+}
+
+func (storage *MemoryStorage) UpdateJob(job *SubmittedJob) error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	updated := *job
+	if job.PullProgress != nil {
+		updated.PullProgress = make(map[string]string, len(job.PullProgress))
+		for id, status := range job.PullProgress {
+			updated.PullProgress[id] = status
+		}
+	}
+	if storage.Jobs == nil {
+		storage.Jobs = make(map[uint64]*SubmittedJob)
+	}
+	storage.Jobs[job.JID] = &updated
+	storage.Updates = append(storage.Updates, updated)
+	return nil
+}
+
+// ClaimJob claims the oldest queued job that's due and doesn't belong to a skipped account, as the
+// real implementations do.
+func (storage *MemoryStorage) ClaimJob(skipAccounts []string, now StoredTime) (*SubmittedJob, error) {
+	storage.mutex.Lock()
+	storage.Skipped = append(storage.Skipped, skipAccounts)
+
+	query := JobQuery{Statuses: []string{StatusQueued}, ScheduledUntil: now}
+	var claimed *SubmittedJob
+	for jid := uint64(1); jid <= storage.LastJID; jid++ {
+		job, ok := storage.Jobs[jid]
+		if !ok || !storage.matches(query, job) || containsString(skipAccounts, job.Account) {
+			continue
+		}
+		if claimed == nil || job.CreatedAt.Before(claimed.CreatedAt) {
+			claimed = job
+		}
+	}
+	if claimed == nil {
+		storage.mutex.Unlock()
+		return nil, nil
+	}
+
+	claimed.Status = StatusProcessing
+	storage.Claimed = append(storage.Claimed, claimed.JID)
+	job := *claimed
+	storage.mutex.Unlock()
+
+	if storage.OnClaimJob != nil {
+		storage.OnClaimJob(job)
+	}
+	return &job, nil
+}
+
+// ReclaimJob hands a running job over to runner, as long as it's still running and hasn't been
+// restarted since it was loaded.
+func (storage *MemoryStorage) ReclaimJob(job SubmittedJob, runner string, startedAt StoredTime) (*SubmittedJob, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	stored, ok := storage.Jobs[job.JID]
+	if !ok || stored.Status != StatusProcessing || stored.StartedAt != job.StartedAt {
+		return nil, nil
+	}
+	stored.Runner = runner
+	stored.StartedAt = startedAt
+	reclaimed := *stored
+	return &reclaimed, nil
+}
+
+func (storage *MemoryStorage) CancelJobs(query JobQuery) (int, error) {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+
+	query.Statuses = []string{StatusWaiting, StatusQueued, StatusProcessing}
+	cancelled := 0
+	for _, job := range storage.Jobs {
+		if storage.matches(query, job) {
+			markKillRequested(job)
+			cancelled++
+		}
+	}
+	return cancelled, nil
+}
+
+func containsJID(jids []uint64, jid uint64) bool {
+	for _, each := range jids {
+		if each == jid {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, each := range values {
+		if each == value {
+			return true
+		}
+	}
+	return false
+}
+
+func submitJobJSON(t *testing.T, c *Context, body string) uint64 {
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status [%d]: %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		JIDs []uint64 `json:"jids"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || len(response.JIDs) != 1 {
+		t.Fatalf("Unexpected response body: %s", w.Body.String())
+	}
+	return response.JIDs[0]
+}
+
+func TestSubmitJobWithDependsOn(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	parent := submitJobJSON(t, c, `{"jobs": [{"cmd": "id", "result_source": "stdout", "result_type": "binary"}]}`)
+	child := submitJobJSON(t, c, `{"jobs": [{
+		"cmd": "id",
+		"depends_on": "`+strconv.FormatUint(parent, 10)+`",
+		"result_source": "stdout",
+		"result_type": "binary"
+	}]}`)
+
+	if status := s.Jobs[parent].Status; status != StatusQueued {
+		t.Errorf("Expected the parent job to be queued, but it was [%s]", status)
+	}
+	if status := s.Jobs[child].Status; status != StatusWaiting {
+		t.Errorf("Expected the child job to be waiting, but it was [%s]", status)
+	}
+
+	for _, status := range []string{StatusQueued, StatusProcessing} {
+		s.Jobs[parent].Status = status
+		Promote(c)
+
+		if childStatus := s.Jobs[child].Status; childStatus != StatusWaiting {
+			t.Errorf("Expected the child to wait while its parent is [%s], but it was [%s]", status, childStatus)
+		}
+	}
+
+	s.Jobs[parent].Status = StatusDone
+	Promote(c)
+
+	if status := s.Jobs[child].Status; status != StatusQueued {
+		t.Errorf("Expected the child job to be queued once its parent was done, but it was [%s]", status)
+	}
+}
+
+func TestPromoteFailsJobWithFailedDependency(t *testing.T) {
+	parentJID := "1"
+	s := &MemoryStorage{
+		Jobs: map[uint64]*SubmittedJob{
+			1: {JID: 1, Account: "admin", Status: StatusError},
+			2: {JID: 2, Account: "admin", Status: StatusWaiting, Job: Job{DependsOn: &parentJID}},
+		},
+		LastJID: 2,
+	}
+	c := &Context{Storage: s}
+
+	Promote(c)
+
+	if status := s.Jobs[2].Status; status != StatusError {
+		t.Errorf("Expected the child job to fail with its parent, but it was [%s]", status)
+	}
+}
+
+func TestValidateDependsOn(t *testing.T) {
+	dependency := "not-a-jid"
+	job := Job{
+		Command:      "id",
+		Multicore:    1,
+		DependsOn:    &dependency,
+		ResultSource: "stdout",
+		ResultType:   ResultBinary,
+	}
+
+	err := job.Validate()
+	if err == nil {
+		t.Fatal("Expected an invalid dependency to be rejected")
+	}
+	if err.Code != CodeInvalidDependency {
+		t.Errorf("Unexpected error code: [%s]", err.Code)
+	}
+}
+
+func TestSubmitJobStdin(t *testing.T) {
+	cases := []struct {
+		description string
+		stdin       string
+		expected    string
+	}{
+		{"base64", `"aGVsbG8gd29ybGQK"`, "hello world\n"},
+		{"plain string", `"print('hi there')"`, "print('hi there')"},
+		{"null", `null`, ""},
+	}
+
+	for _, each := range cases {
+		s := &JobStorage{}
+		c := &Context{
+			Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+			Storage:  s,
+		}
+
+		submitJobJSON(t, c, `{"jobs": [{
+			"cmd": "python",
+			"stdin": `+each.stdin+`,
+			"result_source": "stdout",
+			"result_type": "binary"
+		}]}`)
+
+		if string(s.Submitted.Stdin) != each.expected {
+			t.Errorf("Expected %s stdin to be [%q], got [%q]", each.description, each.expected, s.Submitted.Stdin)
+		}
+	}
+}
+
+func TestJobStdinEncodesAsBase64(t *testing.T) {
+	out, err := json.Marshal(Job{Stdin: JobInput("hello world\n")})
+	if err != nil {
+		t.Fatalf("Unable to encode job: %v", err)
+	}
+	if !strings.Contains(string(out), `"stdin":"aGVsbG8gd29ybGQK"`) {
+		t.Errorf("Expected stdin to be encoded as base64: %s", out)
+	}
+}
+
+func TestValidateMaxRetries(t *testing.T) {
+	job := Job{
+		Command:      "id",
+		Multicore:    1,
+		MaxRetries:   retries(-2),
+		ResultSource: "stdout",
+		ResultType:   ResultBinary,
+	}
+
+	err := job.Validate()
+	if err == nil {
+		t.Fatal("Expected a maximum retry count below -1 to be rejected")
+	}
+	if err.Code != CodeInvalidMaxRetries {
+		t.Errorf("Unexpected error code: [%s]", err.Code)
+	}
+
+	job.MaxRetries = retries(UnlimitedRetries)
+	if err := job.Validate(); err != nil {
+		t.Errorf("Expected unlimited retries to be accepted, got [%s]", err.Message)
+	}
+}
+
+func sizedSubmitRequest(t *testing.T, size int) *httptest.ResponseRecorder {
+	prefix := `{"jobs": [{"cmd": "echo `
+	suffix := `", "result_source": "stdout", "result_type": "binary"}]}`
+	body := prefix + strings.Repeat("x", size-len(prefix)-len(suffix)) + suffix
+
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", MaxRequestBodyBytes: 1024},
+		Storage:  &JobStorage{},
+	}
+
+	return serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", body)
+}
+
+func TestSubmitJobBodyAtLimit(t *testing.T) {
+	w := sizedSubmitRequest(t, 1024)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status [%d]: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestSubmitJobBodyTooLarge(t *testing.T) {
+	w := sizedSubmitRequest(t, 1025)
+
+	hasError(t, w, http.StatusRequestEntityTooLarge, APIError{
+		Code:    CodeRequestTooLarge,
+		Message: "Your job payload is too large.",
+	})
+}
+
+func TestListJobsAll(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+
+	var response struct {
+		Jobs []SubmittedJob `json:"jobs"`
+	}
+	out := w.Body.Bytes()
+	if err := json.Unmarshal(out, &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	}
+	t.Logf("Response body:\n%s", out)
+
+	if len(response.Jobs) != 3 {
+		t.Fatalf("Unexpected number of jobs returned: [%d]", len(response.Jobs))
+	}
+	if cmd0 := response.Jobs[0].Command; cmd0 != `echo "1"` {
+		t.Errorf(`Expected first job to have command 'echo "1"', had [%s]`, cmd0)
+	}
+	if cmd1 := response.Jobs[1].Command; cmd1 != `echo "2"` {
+		t.Errorf(`Expected second job to have command 'echo "2"', had [%s]`, cmd1)
+	}
+	if cmd2 := response.Jobs[2].Command; cmd2 != `echo "3"` {
+		t.Errorf(`Expected third job to have command 'echo "3"', had [%s]`, cmd2)
+	}
+}
+
+func TestListJobsTotal(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	for _, job := range []SubmittedJob{
+		{Account: "admin", Status: StatusDone},
+		{Account: "admin", Status: StatusError},
+		{Account: "admin", Status: StatusDone},
+		{Account: "someone", Status: StatusDone},
+		{Account: "admin", Status: StatusDone},
+		{Account: "admin", Status: StatusQueued},
+	} {
+		s.InsertJob(job)
+	}
+
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs?status=done&limit=2", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	JobHandler(c, w, r)
+
+	var response struct {
+		Jobs  []SubmittedJob `json:"jobs"`
+		Total int            `json:"total"`
+	}
+	out := w.Body.Bytes()
+	if err := json.Unmarshal(out, &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	}
+
+	if len(response.Jobs) != 2 || response.Jobs[0].JID != 1 || response.Jobs[1].JID != 3 {
+		t.Errorf("Unexpected page of jobs: %+v", response.Jobs)
+	}
+	if response.Total != 3 {
+		t.Errorf("Expected the total to count the account's done jobs outside of the page, got [%d]", response.Total)
+	}
+}
+
+func jobListQuery(t *testing.T, url string) JobQuery {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	return s.Query
+}
+
+func TestListJobsBySingleID(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?jid=123")
+
+	if len(q.JIDs) != 1 {
+		t.Errorf("Expected a single JID, got [%v]", q.JIDs)
+	}
+	if q.JIDs[0] != 123 {
+		t.Errorf("Expected JID to be 123, got [%d]", q.JIDs[0])
+	}
+
+	if q.Limit != 1000 {
+		t.Errorf("Expected limit to default to 1000, got [%d]", q.Limit)
+	}
+}
+
+func TestListJobsByMultipleIDs(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?jid=123&jid=456&jid=789")
+
+	if len(q.JIDs) != 3 {
+		t.Errorf("Expected three JIDs, got [%v]", q.JIDs)
+	}
+	for i, expected := range []uint64{123, 456, 789} {
+		if q.JIDs[i] != expected {
+			t.Errorf("Expected [%d] for element %d, got [%d]", expected, i, q.JIDs[i])
+		}
+	}
+}
+
+func TestListJobsBySingleName(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?name=foo")
+
+	if len(q.Names) != 1 {
+		t.Errorf("Expected a single name, got [%v]", q.Names)
+	}
+	if q.Names[0] != "foo" {
+		t.Errorf("Expected JID to be foo, got [%s]", q.Names[0])
+	}
+}
+
+func TestListJobsByRunID(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?run_id=nightly")
+
+	if q.RunID != "nightly" {
+		t.Errorf("Expected run ID [nightly], got [%s]", q.RunID)
+	}
+}
+
+func TestListJobsByCreationTime(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?since=2015-03-14T09:00:00Z&until=2015-03-14T10:00:00%2B01:00")
+
+	if expected := StoreTime(time.Date(2015, 3, 14, 9, 0, 0, 0, time.UTC)); q.CreatedSince != expected {
+		t.Errorf("Expected created since [%s], got [%s]", expected, q.CreatedSince)
+	}
+	if expected := StoreTime(time.Date(2015, 3, 14, 9, 0, 0, 0, time.UTC)); q.CreatedUntil != expected {
+		t.Errorf("Expected created until [%s], got [%s]", expected, q.CreatedUntil)
+	}
+}
+
+func TestListJobsInvalidCreationTime(t *testing.T) {
+	for _, query := range []string{
+		"since=yesterday",
+		"until=2015-03-14",
+		"since=2015-03-14T10:00:00Z&until=2015-03-14T09:00:00Z",
+	} {
+		r, err := http.NewRequest("GET", "https://localhost/v1/jobs?"+query, nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.SetBasicAuth("admin", "12345")
+		w := httptest.NewRecorder()
+		s := &JobStorage{}
+		c := &Context{
+			Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+			Storage:  s,
+		}
+
+		JobHandler(c, w, r)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected [%s] to be rejected, got [%d] %s", query, w.Code, w.Body.String())
+		}
+		if s.Query.AccountName != "" {
+			t.Errorf("Expected [%s] not to reach storage", query)
+		}
+	}
+}
+
+func TestListJobsByMultipleNames(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?name=foo&name=bar")
+
+	if len(q.Names) != 2 {
+		t.Errorf("Expected two names, got [%v]", q.Names)
+	}
+	for i, expected := range []string{"foo", "bar"} {
+		if q.Names[i] != expected {
+			t.Errorf("Expected name %d to be [%s], got [%s]", i, expected, q.Names[i])
+		}
+	}
+}
+
+func TestListJobsBySingleStatus(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?status=processing")
+
+	if len(q.Statuses) != 1 {
+		t.Fatalf("Expected a single status, got [%v]", q.Statuses)
+	}
+	if q.Statuses[0] != StatusProcessing {
+		t.Errorf("Expected status to be processing, got [%s]", q.Statuses[0])
+	}
+}
+
+func TestListJobsByMultipleStatuses(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?status=error&status=killed")
+
+	if len(q.Statuses) != 2 {
+		t.Fatalf("Expected two statuses, got [%v]", q.Statuses)
+	}
+	for i, expected := range []string{StatusError, StatusKilled} {
+		if q.Statuses[i] != expected {
+			t.Errorf("Expected status %d to be [%s], got [%s]", i, expected, q.Statuses[i])
+		}
+	}
+}
+
+func TestListJobsByInvalidStatus(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs?status=error&status=sleepy", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: &JobStorage{},
+	}
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeInvalidJobStatus,
+		Message: "Invalid job status [sleepy]",
+		Retry:   false,
+	})
+	if !strings.Contains(w.Body.String(), "processing") {
+		t.Errorf("Expected the hint to list valid statuses: [%s]", w.Body.String())
+	}
+}
+
+func TestListJobsMaximumLimit(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?name=foo&limit=99999999")
+
+	if q.Limit != 9999 {
+		t.Errorf("Expected handler to clamp limit to 9999, but was %d", q.Limit)
+	}
+}
+
+func TestJobListHandlerPagination(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	for i := 0; i < 10; i++ {
+		s.InsertJob(SubmittedJob{Account: "admin", Status: StatusQueued})
+	}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	cases := []struct {
+		query    string
+		expected []uint64
+	}{
+		{"limit=3&offset=0", []uint64{1, 2, 3}},
+		{"limit=3&offset=3", []uint64{4, 5, 6}},
+		{"limit=3&offset=9", []uint64{10}},
+	}
+
+	for _, each := range cases {
+		r, err := http.NewRequest("GET", "https://localhost/v1/jobs?"+each.query, nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.SetBasicAuth("admin", "12345")
+		w := httptest.NewRecorder()
+
+		JobHandler(c, w, r)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected HTTP status for [%s]: [%d] %s", each.query, w.Code, w.Body.String())
+		}
+		var response struct {
+			Jobs  []SubmittedJob `json:"jobs"`
+			Total int            `json:"total"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+		}
+
+		if response.Total != 10 {
+			t.Errorf("Expected a total of 10 for [%s], got [%d]", each.query, response.Total)
+		}
+		var jids []uint64
+		for _, job := range response.Jobs {
+			jids = append(jids, job.JID)
+		}
+		if !reflect.DeepEqual(jids, each.expected) {
+			t.Errorf("Expected JIDs %v for [%s], got %v", each.expected, each.query, jids)
+		}
+	}
+}
+
+func listJobIDs(t *testing.T, c *Context, url string) []uint64 {
+	r, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Jobs []SubmittedJob `json:"jobs"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+
+	jids := []uint64{}
+	for _, job := range response.Jobs {
+		jids = append(jids, job.JID)
+	}
+	return jids
+}
+
+func TestListJobsByTag(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Job: Job{Tags: map[string]string{"env": "prod", "team": "ml"}}})
+	s.InsertJob(SubmittedJob{Account: "admin", Job: Job{Tags: map[string]string{"env": "prod", "team": "web"}}})
+	s.InsertJob(SubmittedJob{Account: "admin"})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	cases := []struct {
+		query    string
+		expected []uint64
+	}{
+		{"tag=env:prod", []uint64{1, 2}},
+		{"tag=env:prod&tag=team:ml", []uint64{1}},
+		{"tag=env:staging", []uint64{}},
+		{"tag=env:prod&tag=team:ops", []uint64{}},
+	}
+
+	for _, each := range cases {
+		jids := listJobIDs(t, c, "https://localhost/v1/jobs?"+each.query)
+		if !reflect.DeepEqual(jids, each.expected) {
+			t.Errorf("Expected JIDs %v for [%s], got %v", each.expected, each.query, jids)
+		}
+	}
+}
+
+func TestListJobsTagQuery(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?tag=env:prod&tag=url:http://example.com")
+
+	expected := map[string]string{"env": "prod", "url": "http://example.com"}
+	if !reflect.DeepEqual(q.Tags, expected) {
+		t.Errorf("Expected tags %v, got %v", expected, q.Tags)
+	}
+}
+
+func TestListJobsInvalidTag(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs?tag=prod", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &JobStorage{},
+	}
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeUnableToParseQuery,
+		Message: "Invalid tag filter [prod]",
+		Hint:    `Tag filters must have the form "key:value", and keys may not contain "." or "$".`,
+	})
+}
+
+func TestListJobsNegativeOffset(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs?offset=-1", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &JobStorage{},
+	}
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeUnableToParseQuery,
+		Message: "Invalid offset [-1]",
+		Hint:    "Please specify a valid, non-negative integral offset.",
+	})
+}
+
+func TestListJobsBeforeJID(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs?before_jid=33", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Query.BeforeJID != 33 {
+		t.Errorf("Expected BeforeJID to be 33, got [%d]", s.Query.BeforeJID)
+	}
+
+	var response struct {
+		Jobs []SubmittedJob `json:"jobs"`
+	}
+	out := w.Body.Bytes()
+	if err := json.Unmarshal(out, &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	}
+
+	if len(response.Jobs) != 2 {
+		t.Fatalf("Expected two jobs before JID 33, got [%d]", len(response.Jobs))
+	}
+	for i, expected := range []uint64{11, 22} {
+		if response.Jobs[i].JID != expected {
+			t.Errorf("Expected job %d to have JID [%d], got [%d]", i, expected, response.Jobs[i].JID)
+		}
+	}
+}
+
+func TestListJobsAfterJID(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?after_jid=11")
+
+	if q.AfterJID != 11 {
+		t.Errorf("Expected AfterJID to be 11, got [%d]", q.AfterJID)
+	}
+}
+
+func TestListJobsAfterIsInclusive(t *testing.T) {
+	q := jobListQuery(t, "https://localhost/v1/jobs?after=11")
+
+	if q.AfterJID != 10 {
+		t.Errorf("Expected AfterJID to be 10, got [%d]", q.AfterJID)
+	}
+}
+
+func TestListJobsBeforeJIDPagesBackwards(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	for i := 0; i < 10; i++ {
+		s.InsertJob(SubmittedJob{Account: "admin", Status: StatusDone})
+	}
+
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs?before_jid=8&limit=3", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d]", w.Code)
+	}
+
+	var response struct {
+		Jobs []SubmittedJob `json:"jobs"`
+	}
+	out := w.Body.Bytes()
+	if err := json.Unmarshal(out, &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	}
+
+	if len(response.Jobs) != 3 {
+		t.Fatalf("Expected three jobs before JID 8, got [%d]", len(response.Jobs))
+	}
+	for i, expected := range []uint64{5, 6, 7} {
+		if response.Jobs[i].JID != expected {
+			t.Errorf("Expected job %d to have JID [%d], got [%d]", i, expected, response.Jobs[i].JID)
+		}
+	}
+}
+
+func TestJobQueueStatsHandler(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/job/queue_stats", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	JobQueueStatsHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Query.AccountName != "admin" {
+		t.Errorf("Expected counts to be scoped to the account, got [%s]", s.Query.AccountName)
+	}
+
+	var response struct {
+		Statuses map[string]int `json:"statuses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+
+	expected := map[string]int{
+		StatusWaiting:    0,
+		StatusQueued:     3,
+		StatusProcessing: 1,
+		StatusDone:       7,
+		StatusError:      0,
+		StatusKilled:     0,
+		StatusTimeout:    0,
+		StatusStalled:    0,
+	}
+	if len(response.Statuses) != len(expected) {
+		t.Errorf("Expected counts for [%d] statuses, got %v", len(expected), response.Statuses)
+	}
+	for status, count := range expected {
+		if actual, ok := response.Statuses[status]; !ok || actual != count {
+			t.Errorf("Expected [%d] jobs with status [%s], got [%d]", count, status, actual)
+		}
+	}
+}
+
+func TestJobQueueStatsHandlerUnauthenticated(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/job/queue_stats", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	c := &Context{Storage: &JobStorage{}}
+
+	JobQueueStatsHandler(c, w, r)
+
+	hasError(t, w, http.StatusUnauthorized, APIError{
+		Code:    CodeCredentialsMissing,
+		Message: "You must authenticate.",
+	})
+}
+
+func killAllStorage() *MemoryStorage {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	for _, job := range []SubmittedJob{
+		{Account: "user", Status: StatusQueued},
+		{Account: "user", Status: StatusDone},
+		{Account: "user", Status: StatusQueued},
+		{Account: "user", Status: StatusDone},
+		{Account: "user", Status: StatusQueued},
+		{Account: "other", Status: StatusQueued},
+	} {
+		s.InsertJob(job)
+	}
+	return s
+}
+
+func TestJobKillAllHandler(t *testing.T) {
+	s := killAllStorage()
+	c := &Context{Storage: s, AuthService: TrustingAuthService{}}
+
+	w := serveRequest(t, c, JobKillAllHandler, "user", "POST", "/v1/job/kill_all", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status [%d]: %s", w.Code, w.Body.String())
+	}
+	for _, jid := range []uint64{1, 3, 5} {
+		if job := s.Jobs[jid]; !job.KillRequested || job.Status != StatusKilled {
+			t.Errorf("Expected queued job [%d] to be killed, got [%s] kill requested [%v]", jid, job.Status, job.KillRequested)
+		}
+	}
+	for _, jid := range []uint64{2, 4} {
+		if job := s.Jobs[jid]; job.KillRequested || job.Status != StatusDone {
+			t.Errorf("Expected done job [%d] to be unchanged, got [%s] kill requested [%v]", jid, job.Status, job.KillRequested)
+		}
+	}
+	if job := s.Jobs[6]; job.KillRequested || job.Status != StatusQueued {
+		t.Errorf("Expected another account's job to be unchanged, got [%s] kill requested [%v]", job.Status, job.KillRequested)
+	}
+}
+
+func TestJobKillAllHandlerOtherAccount(t *testing.T) {
+	s := killAllStorage()
+	c := &Context{Storage: s, AuthService: TrustingAuthService{}}
+
+	w := serveRequest(t, c, JobKillAllHandler, "user", "POST", "/v1/job/kill_all", "account=other")
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAdminRequired,
+		Message: "The account [user] may not kill the jobs of [other].",
+	})
+	for jid, job := range s.Jobs {
+		if job.KillRequested {
+			t.Errorf("Expected job [%d] not to be killed", jid)
+		}
+	}
+}
+
+func TestSubmittedJobContainerName(t *testing.T) {
+	name := "wat"
+	explicitName := SubmittedJob{
+		Job: Job{Name: &name},
+		JID: 1234,
+	}
+	if containerName := explicitName.ContainerName(); containerName != "job_1234_wat" {
+		t.Errorf("Expected explicit name to be [job_1234_wat], was [%s]", containerName)
+	}
+
+	anonymous := SubmittedJob{JID: 4321}
+	if containerName := anonymous.ContainerName(); containerName != "job_4321_unnamed" {
+		t.Errorf("Expected anonymous name to be [job_4321_unnamed], was [%s]", containerName)
+	}
+}
+
+func TestValidateMulticore(t *testing.T) {
+	for _, multicore := range []int{0, -1} {
+		job := Job{
+			Command:      "id",
+			Multicore:    multicore,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		}
+
+		err := job.Validate()
+		if err == nil {
+			t.Errorf("Expected multicore [%d] to be rejected", multicore)
+			continue
+		}
+		if err.Code != CodeInvalidMulticore {
+			t.Errorf("Unexpected error code for multicore [%d]: [%s]", multicore, err.Code)
+		}
+	}
+}
+
+func TestValidateMaxRuntime(t *testing.T) {
+	job := Job{
+		Command:      "id",
+		Multicore:    1,
+		MaxRuntime:   -1,
+		ResultSource: "stdout",
+		ResultType:   ResultBinary,
+	}
+
+	err := job.Validate()
+	if err == nil {
+		t.Fatal("Expected a negative maximum runtime to be rejected")
+	}
+	if err.Code != CodeInvalidMaxRuntime {
+		t.Errorf("Unexpected error code: [%s]", err.Code)
+	}
+}
+
+func TestValidateNegativeMaxOutputSize(t *testing.T) {
+	job := Job{
+		Command:       "id",
+		Multicore:     1,
+		MaxOutputSize: -1,
+		ResultSource:  "stdout",
+		ResultType:    ResultBinary,
+	}
+
+	err := job.Validate()
+	if err == nil {
+		t.Fatal("Expected a negative maximum output size to be rejected")
+	}
+	if err.Code != CodeInvalidMaxOutputSize {
+		t.Errorf("Unexpected error code: [%s]", err.Code)
+	}
+}
+
+func TestValidateAffinityLabel(t *testing.T) {
+	for _, label := range []string{"gpu", "=true", "gpu=", "="} {
+		job := Job{
+			Command:       "id",
+			Multicore:     1,
+			AffinityLabel: label,
+			ResultSource:  "stdout",
+			ResultType:    ResultBinary,
+		}
+
+		err := job.Validate()
+		if err == nil {
+			t.Errorf("Expected affinity label [%s] to be rejected", label)
+			continue
+		}
+		if err.Code != CodeInvalidAffinityLabel {
+			t.Errorf("Unexpected error code for affinity label [%s]: [%s]", label, err.Code)
+		}
+	}
+}
+
+func TestExpandCommandMalformed(t *testing.T) {
+	job := Job{Command: "echo {{.Tags.input", Tags: map[string]string{"input": "x"}}
+
+	_, err := job.ExpandCommand()
+	if err == nil {
+		t.Fatal("Expected a malformed template to be rejected")
+	}
+	if err.Code != CodeTemplateExpansionError {
+		t.Errorf("Unexpected error code: [%s]", err.Code)
+	}
+}
+
+func TestExpandCommandMissingTag(t *testing.T) {
+	for _, command := range []string{
+		"echo {{.Tags.output}}",
+		"echo {{if .Tags.input}}{{.Tags.output}}{{end}}",
+		"echo {{.Tags.output | printf \"%s\"}}",
+	} {
+		job := Job{Command: command, Tags: map[string]string{"input": "x"}}
+
+		_, err := job.ExpandCommand()
+		if err == nil {
+			t.Errorf("Expected [%s] to be rejected", command)
+			continue
+		}
+		if err.Code != CodeTemplateExpansionError {
+			t.Errorf("Unexpected error code for [%s]: [%s]", command, err.Code)
+		}
+	}
+}
+
+func TestExpandCommandWithoutTemplate(t *testing.T) {
+	job := Job{Command: "echo hello"}
+
+	expanded, err := job.ExpandCommand()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expanded != "echo hello" {
+		t.Errorf("Expected the command to be unchanged, got [%s]", expanded)
+	}
+}
+
+func TestValidateEnvironment(t *testing.T) {
+	for _, key := range []string{"", "FOO=BAR"} {
+		job := Job{
+			Command:      "id",
+			Multicore:    1,
+			Environment:  map[string]string{key: "value"},
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		}
+
+		err := job.Validate()
+		if err == nil {
+			t.Errorf("Expected environment variable [%s] to be rejected", key)
+			continue
+		}
+		if err.Code != CodeInvalidEnvironment {
+			t.Errorf("Unexpected error code for environment variable [%s]: [%s]", key, err.Code)
+		}
+	}
+}
+
+func TestIsCompleted(t *testing.T) {
+	for _, status := range []string{StatusDone, StatusError, StatusKilled, StatusTimeout, StatusStalled} {
+		if !IsCompleted(status) || !IsTerminal(status) {
+			t.Errorf("Expected status [%s] to be completed", status)
+		}
+	}
+	for _, status := range []string{StatusWaiting, StatusQueued, StatusProcessing, "bogus"} {
+		if IsCompleted(status) || IsTerminal(status) {
+			t.Errorf("Expected status [%s] not to be completed", status)
+		}
+	}
+}
+
+func TestSubmitJobKill(t *testing.T) {
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs/kill", strings.NewReader("jid=11"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	s := &JobStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	JobKillHandler(c, w, r)
+
+	if !s.Submitted.KillRequested {
+		t.Error("Expected a job kill to be requested")
+	}
+}
+
+func TestJobLogsHandler(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusProcessing, Stdout: "partial", Stderr: ""})
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusError, Stdout: "out", Stderr: "err"})
+	s.InsertJob(SubmittedJob{Account: "someone", Status: StatusDone, Stdout: "secret"})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	cases := []struct {
+		jid      string
+		stdout   string
+		stderr   string
+		complete bool
+	}{
+		{"1", "partial", "", false},
+		{"2", "out", "err", true},
+	}
+
+	for _, each := range cases {
+		w := serveRequest(t, c, JobOutputHandler, "admin", "GET", "/v1/jobs/"+each.jid+"/logs", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Unexpected HTTP status for job [%s]: [%d] %s", each.jid, w.Code, w.Body.String())
+		}
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+		}
+		if len(response) != 3 {
+			t.Errorf("Expected only stdout, stderr and complete, got %v", response)
+		}
+		if response["stdout"] != each.stdout {
+			t.Errorf("Expected stdout [%s] for job [%s], got [%v]", each.stdout, each.jid, response["stdout"])
+		}
+		if response["stderr"] != each.stderr {
+			t.Errorf("Expected stderr [%s] for job [%s], got [%v]", each.stderr, each.jid, response["stderr"])
+		}
+		if response["complete"] != each.complete {
+			t.Errorf("Expected complete to be %v for job [%s], got [%v]", each.complete, each.jid, response["complete"])
+		}
+	}
+
+	// Jobs belonging to other accounts aren't visible.
+	hasError(t, serveRequest(t, c, JobOutputHandler, "admin", "GET", "/v1/jobs/3/logs", ""), http.StatusNotFound, APIError{
+		Code:    CodeJobNotFound,
+		Message: "Unable to find a job with ID [3].",
+		Hint:    "Make sure that the JID is still valid.",
+	})
+}
+
+func TestJobLogsHandlerInvalidJID(t *testing.T) {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &JobStorage{},
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "GET", "/v1/jobs/nope/logs", "")
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+}
+
+func TestJobOutputHandler(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusError, Stdout: "out\n", Stderr: "err\n"})
+	s.InsertJob(SubmittedJob{Account: "someone", Status: StatusDone, Stdout: "secret"})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	cases := []struct {
+		path     string
+		status   int
+		expected string
+	}{
+		{"/v1/jobs/1/stdout", http.StatusOK, "out\n"},
+		{"/v1/jobs/1/stderr", http.StatusOK, "err\n"},
+		{"/v1/jobs/2/stdout", http.StatusNotFound, ""},
+		{"/v1/jobs/nope/stdout", http.StatusBadRequest, ""},
+		{"/v1/jobs/1/unknown", http.StatusNotFound, ""},
+	}
+
+	for _, each := range cases {
+		w := serveRequest(t, c, JobOutputHandler, "admin", "GET", each.path, "")
+		if w.Code != each.status {
+			t.Errorf("Unexpected HTTP status for [%s]: [%d] %s", each.path, w.Code, w.Body.String())
+			continue
+		}
+		if each.status != http.StatusOK {
+			continue
+		}
+
+		if contentType := w.HeaderMap.Get("Content-Type"); contentType != "text/plain; charset=utf-8" {
+			t.Errorf("Unexpected content type for [%s]: [%s]", each.path, contentType)
+		}
+		if body := w.Body.String(); body != each.expected {
+			t.Errorf("Expected [%q] from [%s], got [%q]", each.expected, each.path, body)
+		}
+	}
+}
+
+func TestJobResultHandler(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusDone, Job: Job{ResultType: ResultBinary}, Result: []byte{0, 1, 2}})
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusDone, Job: Job{ResultType: ResultPickle}, Result: []byte("pickled")})
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusProcessing, Job: Job{ResultType: ResultBinary}})
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusError, Job: Job{ResultType: ResultBinary}})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	cases := []struct {
+		jid         string
+		status      int
+		contentType string
+		body        string
+	}{
+		{"1", http.StatusOK, "application/octet-stream", "\x00\x01\x02"},
+		{"2", http.StatusOK, "application/python-pickle", "pickled"},
+		{"3", http.StatusAccepted, "application/json", `{"jid":3,"status":"processing"}` + "\n"},
+	}
+
+	for _, each := range cases {
+		w := serveRequest(t, c, JobOutputHandler, "admin", "GET", "/v1/jobs/"+each.jid+"/result", "")
+		if w.Code != each.status {
+			t.Errorf("Unexpected HTTP status for job [%s]: [%d] %s", each.jid, w.Code, w.Body.String())
+			continue
+		}
+		if contentType := w.HeaderMap.Get("Content-Type"); contentType != each.contentType {
+			t.Errorf("Unexpected content type for job [%s]: [%s]", each.jid, contentType)
+		}
+		if body := w.Body.String(); body != each.body {
+			t.Errorf("Expected [%q] from job [%s], got [%q]", each.body, each.jid, body)
+		}
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "GET", "/v1/jobs/4/result", "")
+	hasError(t, w, http.StatusConflict, APIError{
+		Code:    CodeJobNoResult,
+		Message: "The job [4] finished with status [error] and has no result.",
+		Retry:   false,
+	})
+}
+
+func TestJobRetryHandler(t *testing.T) {
+	name := "flaky"
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{
+		Account: "admin",
+		Status:  StatusError,
+		Job: Job{
+			Command:      "./flaky.sh",
+			Name:         &name,
+			Tags:         map[string]string{"team": "ml"},
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		Stderr: "boom",
+	})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "POST", "/v1/jobs/1/retry", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		JID     uint64 `json:"jid"`
+		RetryOf uint64 `json:"retry_of"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if response.JID != 2 || response.RetryOf != 1 {
+		t.Errorf("Unexpected response: %#v", response)
+	}
+
+	retried := s.Jobs[2]
+	if retried.Status != StatusQueued {
+		t.Errorf("Expected the retried job to be queued, but it was [%s]", retried.Status)
+	}
+	if retried.Command != "./flaky.sh" || *retried.Name != "flaky" || retried.Tags["team"] != "ml" {
+		t.Errorf("Expected the retried job to copy the original description, got %#v", retried.Job)
+	}
+	if retried.Stderr != "" || retried.CreatedAt.IsZero() {
+		t.Errorf("Expected the retried job to start fresh, got %#v", retried)
+	}
+	if retried.ExpandedCommand != "./flaky.sh" {
+		t.Errorf("Expected the retried job's command to be expanded, got [%s]", retried.ExpandedCommand)
+	}
+	if s.Jobs[1].Status != StatusError {
+		t.Errorf("Expected the original job to be left alone, but it was [%s]", s.Jobs[1].Status)
+	}
+}
+
+func TestJobRetryHandlerWithDependency(t *testing.T) {
+	parent := "1"
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusProcessing})
+	s.InsertJob(SubmittedJob{
+		Account: "admin",
+		Status:  StatusError,
+		Job:     Job{Command: "id", DependsOn: &parent, ResultSource: "stdout", ResultType: ResultBinary},
+	})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "POST", "/v1/jobs/2/retry", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if retried := s.Jobs[3]; retried == nil || retried.Status != StatusWaiting {
+		t.Errorf("Expected the retried job to wait for its dependency, got %#v", retried)
+	}
+}
+
+func TestJobRetryHandlerQueuedQuota(t *testing.T) {
+	s := &MemoryStorage{Accounts: quotaAccounts(1)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusQueued})
+	s.InsertJob(SubmittedJob{
+		Account: "admin",
+		Status:  StatusError,
+		Job:     Job{Command: "id", ResultSource: "stdout", ResultType: ResultBinary},
+	})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "POST", "/v1/jobs/2/retry", "")
+
+	if w.Code != statusTooManyRequests {
+		t.Errorf("Expected the retry to exceed the quota, got [%d] %s", w.Code, w.Body.String())
+	}
+	if s.LastJID != 2 {
+		t.Errorf("Expected no new job to be submitted, but the last JID was [%d]", s.LastJID)
+	}
+}
+
+func TestJobRetryHandlerRunningJob(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusProcessing})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "POST", "/v1/jobs/1/retry", "")
+
+	hasError(t, w, http.StatusConflict, APIError{
+		Code:    CodeJobNotRetryable,
+		Message: "Job [1] can't be retried while it's [processing].",
+	})
+	if s.LastJID != 1 {
+		t.Errorf("Expected no new job to be submitted, but the last JID was [%d]", s.LastJID)
+	}
+}
+
+func TestJobRetryHandlerRequiresPost(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusError})
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobOutputHandler, "admin", "GET", "/v1/jobs/1/retry", "")
+
+	hasError(t, w, http.StatusMethodNotAllowed, APIError{
+		Code:    CodeMethodNotSupported,
+		Message: "Method not supported",
+	})
+	if s.LastJID != 1 {
+		t.Errorf("Expected no new job to be submitted, but the last JID was [%d]", s.LastJID)
+	}
+}
+
+// quotaAccounts gives the admin account a queued job quota.
+func quotaAccounts(maxQueued int) map[string]*Account {
+	return map[string]*Account{"admin": {Name: "admin", MaxQueuedJobs: maxQueued}}
+}
+
+func TestJobSubmitHandlerQueuedQuota(t *testing.T) {
+	s := &MemoryStorage{Accounts: quotaAccounts(2)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	submit := func(count int) *httptest.ResponseRecorder {
+		jobs := make([]string, count)
+		for i := range jobs {
+			jobs[i] = `{"cmd": "id", "result_source": "stdout", "result_type": "binary"}`
+		}
+		body := strings.NewReader(`{"jobs": [` + strings.Join(jobs, ",") + `]}`)
+		r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.SetBasicAuth("admin", "12345")
+		w := httptest.NewRecorder()
+
+		JobHandler(c, w, r)
+
+		return w
+	}
+
+	if w := submit(1); w.Code != http.StatusOK {
+		t.Fatalf("Expected the first job to be accepted, got [%d] %s", w.Code, w.Body.String())
+	}
+
+	// A batch that would overflow the quota is rejected as a whole.
+	w := submit(2)
+	hasError(t, w, statusTooManyRequests, APIError{
+		Code:    CodeQuotaExceeded,
+		Message: "The account [admin] may have at most 2 jobs queued, and has 1.",
+		Retry:   true,
+	})
+	if len(s.Jobs) != 1 {
+		t.Errorf("Expected no jobs from the rejected batch to be stored, got %d jobs", len(s.Jobs))
+	}
+
+	if w := submit(1); w.Code != http.StatusOK {
+		t.Fatalf("Expected the second job to be accepted, got [%d] %s", w.Code, w.Body.String())
+	}
+	if w := submit(1); w.Code != statusTooManyRequests {
+		t.Fatalf("Expected the third job to be rejected, got [%d] %s", w.Code, w.Body.String())
+	}
+
+	// Jobs that have started running no longer count against the quota.
+	s.Jobs[1].Status = StatusProcessing
+	if w := submit(1); w.Code != http.StatusOK {
+		t.Errorf("Expected a job to be accepted once the queue drained, got [%d] %s", w.Code, w.Body.String())
+	}
+}
+
+func TestJobSubmitHandlerQueuedQuotaIgnoresReplays(t *testing.T) {
+	s := &MemoryStorage{Accounts: quotaAccounts(1)}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", IdempotencyTTL: 60},
+		Storage:  s,
+	}
+
+	first := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+	if first.Code != http.StatusOK {
+		t.Fatalf("Expected the first job to be accepted, got [%d] %s", first.Code, first.Body.String())
+	}
+	retry := serveRequest(t, c, JobHandler, "admin", "POST", "/v1/jobs", idempotentJobs)
+	if retry.Code != http.StatusOK {
+		t.Fatalf("Expected the retry to be replayed at the quota, got [%d] %s", retry.Code, retry.Body.String())
+	}
+	if retry.Body.String() != first.Body.String() {
+		t.Errorf("Expected the retry to return %s, got %s", first.Body.String(), retry.Body.String())
+	}
+}
+
+func TestJobSubmitHandlerQueuedQuotaEnforcedByStorage(t *testing.T) {
+	s := &MemoryStorage{Accounts: quotaAccounts(2), StaleCounts: true}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	// A concurrent request has queued a job that the first check doesn't see.
+	s.InsertJob(SubmittedJob{Job: Job{Command: "id"}, Account: "admin", Status: StatusQueued})
+
+	body := strings.NewReader(`{"jobs": [
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary"},
+		{"cmd": "id", "result_source": "stdout", "result_type": "binary"}
+	]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, statusTooManyRequests, APIError{
+		Code:    CodeQuotaExceeded,
+		Message: "The account [admin] may have at most 2 jobs queued, and has 2.",
+		Retry:   true,
+	})
+	if len(s.Jobs) != 2 {
+		t.Errorf("Expected the quota to stop the batch at 2 jobs, got %d jobs", len(s.Jobs))
+	}
+}
+
+func TestJobSubmitHandlerRateLimit(t *testing.T) {
+	clock := NewFakeClock()
+	c := &Context{
+		Settings:      Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:       &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)},
+		SubmitLimiter: NewRateLimiter(3, time.Minute, clock),
+	}
+
+	submit := func() *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"jobs": [{"cmd": "id", "result_source": "stdout", "result_type": "binary"}]}`)
+		r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.SetBasicAuth("admin", "12345")
+		w := httptest.NewRecorder()
+
+		JobHandler(c, w, r)
+
+		return w
+	}
+
+	for i := 0; i < 3; i++ {
+		if w := submit(); w.Code != http.StatusOK {
+			t.Fatalf("Expected submission %d to be accepted, got [%d] %s", i, w.Code, w.Body.String())
+		}
+	}
+
+	w := submit()
+	hasError(t, w, statusTooManyRequests, APIError{
+		Code:    CodeRateLimited,
+		Message: "You're submitting jobs too quickly.",
+		Retry:   true,
+	})
+	if retryAfter := w.HeaderMap.Get("Retry-After"); retryAfter != "20" {
+		t.Errorf("Expected a Retry-After of 20 seconds, got [%s]", retryAfter)
+	}
+
+	clock.Advance(10 * time.Second)
+	if w := submit(); w.Code != statusTooManyRequests {
+		t.Errorf("Expected submissions to be refused before Retry-After elapsed, got [%d]", w.Code)
+	}
+
+	clock.Advance(10 * time.Second)
+	if w := submit(); w.Code != http.StatusOK {
+		t.Errorf("Expected submissions to be accepted after waiting, got [%d] %s", w.Code, w.Body.String())
+	}
+}
+
+func TestJobSubmitHandlerBatchOverRateLimit(t *testing.T) {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	c := &Context{
+		Settings:      Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:       s,
+		SubmitLimiter: NewRateLimiter(3, time.Minute, NewFakeClock()),
+	}
+
+	job := `{"cmd": "id", "result_source": "stdout", "result_type": "binary"}`
+	body := strings.NewReader(`{"jobs": [` + strings.Repeat(job+",", 3) + job + `]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/jobs", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	JobHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeBatchTooLarge,
+		Message: "Too many jobs in one request: [4]",
+		Retry:   false,
+	})
+	if s.LastJID != 0 {
+		t.Errorf("Expected no jobs to be submitted, but the last JID was [%d]", s.LastJID)
+	}
+}
+
+func TestJobExportHandler(t *testing.T) {
+	s := &MemoryStorage{}
+	for i := 0; i < 1200; i++ {
+		s.InsertJob(SubmittedJob{Account: "admin", Status: StatusDone})
+	}
+	s.InsertJob(SubmittedJob{Account: "someone-else", Status: StatusDone})
+
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobExportHandler, "admin", "GET", "/v1/jobs/export", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if contentType := w.HeaderMap.Get("Content-Type"); contentType != "application/x-ndjson" {
+		t.Errorf("Unexpected content type: [%s]", contentType)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(w.Body.String(), "\n"), "\n")
+	if len(lines) != 1200 {
+		t.Fatalf("Expected 1200 exported jobs, got %d", len(lines))
+	}
+	var last SubmittedJob
+	if err := json.Unmarshal([]byte(lines[1199]), &last); err != nil {
+		t.Fatalf("Unable to parse an exported job [%s]: %v", lines[1199], err)
+	}
+	if last.JID != 1200 {
+		t.Errorf("Expected the last exported job to be [1200], got [%d]", last.JID)
+	}
+
+	if len(s.Queries) != 3 {
+		t.Fatalf("Expected three pages of jobs to be read, got %d", len(s.Queries))
+	}
+	if s.Queries[2].AfterJID != 1000 || s.Queries[2].Limit != exportBatchSize {
+		t.Errorf("Unexpected query for the last page: %+v", s.Queries[2])
+	}
+}
+
+func TestJobExportHandlerFilters(t *testing.T) {
+	s := &MemoryStorage{}
+	since := time.Date(2015, time.February, 3, 4, 5, 6, 0, time.UTC)
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusDone, CreatedAt: StoreTime(since.Add(-time.Hour))})
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusDone, CreatedAt: StoreTime(since.Add(time.Hour))})
+	s.InsertJob(SubmittedJob{Account: "admin", Status: StatusError, CreatedAt: StoreTime(since.Add(time.Hour))})
+
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, JobExportHandler, "admin", "GET", "/v1/jobs/export?status=done&since=2015-02-03T04:05:06Z", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+
+	if lines := strings.Count(w.Body.String(), "\n"); lines != 1 {
+		t.Errorf("Expected one exported job, got %d", lines)
+	}
+	if len(s.Queries) != 1 {
+		t.Fatalf("Expected one query, got %d", len(s.Queries))
+	}
+	query := s.Queries[0]
+	if query.AccountName != "admin" || !reflect.DeepEqual(query.Statuses, []string{StatusDone}) || query.CreatedSince != StoreTime(since) {
+		t.Errorf("Unexpected query: %+v", query)
+	}
+}
+
+func TestJobExportHandlerInvalidSince(t *testing.T) {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)},
+	}
+
+	w := serveRequest(t, c, JobExportHandler, "admin", "GET", "/v1/jobs/export?since=yesterday", "")
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeUnableToParseQuery,
+		Message: `Unable to parse since [yesterday]: parsing time "yesterday" as "2006-01-02T15:04:05Z07:00": cannot parse "yesterday" as "2006"`,
+		Retry:   false,
+	})
 }
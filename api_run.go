@@ -0,0 +1,353 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// runResponse summarizes the jobs in a single run.
+type runResponse struct {
+	RunID      string         `json:"run_id"`
+	CreatedAt  StoredTime     `json:"created_at"`
+	StartedAt  *StoredTime    `json:"started_at,omitempty"`
+	FinishedAt *StoredTime    `json:"finished_at,omitempty"`
+	Total      int            `json:"total"`
+	Completed  int            `json:"completed"`
+	Failed     int            `json:"failed"`
+	Complete   bool           `json:"complete"`
+	Statuses   map[string]int `json:"statuses"`
+}
+
+// newRunResponse reports a run's summary. Every status is reported, even those without any jobs.
+func newRunResponse(summary RunSummary) runResponse {
+	response := runResponse{
+		RunID:      summary.RunID,
+		CreatedAt:  summary.CreatedAt,
+		StartedAt:  summary.StartedAt,
+		FinishedAt: summary.FinishedAt,
+		Total:      summary.TotalJobs,
+		Completed:  summary.Completed,
+		Failed:     summary.Failed,
+		Complete:   summary.Completed == summary.TotalJobs,
+		Statuses:   make(map[string]int, len(validStatus)),
+	}
+	for status := range validStatus {
+		response.Statuses[status] = summary.Statuses[status]
+	}
+	return response
+}
+
+// RunResourceHandler dispatches requests that act on the run named by the request path: POST
+// /v1/runs/:run_id/cancel cancels it, POST /v1/runs/:run_id/retry-failed retries its failed jobs,
+// and GET /v1/runs/:run_id summarizes it.
+func RunResourceHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/cancel"):
+		RunCancelHandler(c, w, r)
+	case strings.HasSuffix(r.URL.Path, "/retry-failed"):
+		RunRetryFailedHandler(c, w, r)
+	default:
+		RunHandler(c, w, r)
+	}
+}
+
+// RunHandler reports the aggregate status of the authenticated account's jobs in a single run, as
+// in GET /v1/runs/:run_id.
+func RunHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use GET against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "run.get")
+
+	runID := strings.TrimPrefix(r.URL.Path, "/v1/runs/")
+	if runID == "" {
+		APIError{
+			Code:    CodeRunNotFound,
+			Message: "No run ID was provided.",
+			Hint:    "Specify the run as /v1/runs/:run_id.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	summary, err := c.GetRunSummary(account.Name, runID)
+	if err == ErrNotFound {
+		APIError{
+			Code:    CodeRunNotFound,
+			Message: fmt.Sprintf("Unable to find a run with ID [%s].", runID),
+			Hint:    "Double-check the run ID.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to summarize run [%s]: %v", runID, err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newRunResponse(summary))
+}
+
+// RunListHandler lists the authenticated account's runs, with the number of jobs in each status, as
+// in GET /v1/runs. Runs are ordered by the time that their first job was submitted, then by run ID.
+// To fetch the next page, pass the created_at and run_id of the last run on this one as the "after"
+// and "after_run_id" parameters.
+func RunListHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use GET against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "run.list")
+
+	limit := 100
+	if rawLimit := r.FormValue("limit"); rawLimit != "" {
+		parsed, err := strconv.ParseInt(rawLimit, 10, 0)
+		if err != nil || parsed < 1 {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf("Invalid limit [%s]", rawLimit),
+				Hint:    "Please specify a valid, positive integral limit.",
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+		if parsed > 1000 {
+			parsed = 1000
+		}
+		limit = int(parsed)
+	}
+
+	after := RunCursor{RunID: r.FormValue("after_run_id")}
+	if rawAfter := r.FormValue("after"); rawAfter != "" {
+		after.CreatedAt, err = ParseStoredTime(rawAfter)
+		if err != nil {
+			APIError{
+				Code:    CodeUnableToParseQuery,
+				Message: fmt.Sprintf("Unable to parse After bound [%s]: %v", rawAfter, err),
+				Hint:    `Please specify a timestamp like "2015-03-14 09:26:53.000" as the lower bound.`,
+				Retry:   false,
+			}.Log(account).Report(http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	summaries, err := c.ListRuns(account.Name, after, limit)
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to list runs: %v", err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	var response struct {
+		Runs []runResponse `json:"runs"`
+	}
+	response.Runs = make([]runResponse, len(summaries))
+	for i, summary := range summaries {
+		response.Runs[i] = newRunResponse(summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RunCancelHandler requests that every job in one of the authenticated account's runs that hasn't
+// finished yet be killed, as in POST /v1/runs/:run_id/cancel. It reports the number of jobs that
+// were cancelled. If the containers of some running jobs can't be killed, their JIDs are reported as
+// "kill_failed"; their runners still stop them once they notice the kill request.
+func RunCancelHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use POST against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "run.cancel")
+
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/runs/"), "/cancel")
+	if runID == "" {
+		APIError{
+			Code:    CodeRunNotFound,
+			Message: "No run ID was provided.",
+			Hint:    "Specify the run as /v1/runs/:run_id/cancel.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	var response struct {
+		Cancelled  int      `json:"cancelled"`
+		KillFailed []uint64 `json:"kill_failed,omitempty"`
+	}
+
+	query := JobQuery{AccountName: account.Name, RunID: runID}
+	if response.Cancelled, err = c.CancelJobs(query); err != nil {
+		APIError{
+			Code:    CodeJobUpdateFailure,
+			Message: fmt.Sprintf("Unable to cancel the jobs in run [%s]: %v", runID, err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	// Every running job has been flagged, so killing their containers only stops them sooner. A
+	// failure here doesn't undo the cancellation, so it's reported alongside it.
+	query.Statuses = []string{StatusProcessing}
+	running, err := c.ListJobs(query)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"account": account.Name,
+			"run id":  runID,
+			"error":   err,
+		}).Error("Unable to list the running jobs of a cancelled run.")
+	}
+	for i := range running {
+		if apiErr := killJobContainer(c, &running[i]); apiErr != nil {
+			RequestLog(w).WithFields(log.Fields{
+				"account":    account.Name,
+				"run id":     runID,
+				"jid":        running[i].JID,
+				"request id": RequestID(r),
+				"error":      apiErr,
+			}).Error("Unable to kill the container of a cancelled job.")
+			response.KillFailed = append(response.KillFailed, running[i].JID)
+		}
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account":     account.Name,
+		"run id":      runID,
+		"count":       response.Cancelled,
+		"kill failed": len(response.KillFailed),
+	}).Info("Run cancelled.")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// RunRetryFailedHandler resubmits every job in one of the authenticated account's runs that failed
+// or stalled, as in POST /v1/runs/:run_id/retry-failed. As with JobRetryHandler, the original jobs
+// are left as they are, and a copy of each joins the run with a fresh JID. It reports the JIDs of the
+// copies, along with the JIDs of the jobs that they retry.
+func RunRetryFailedHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use POST against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+		return
+	}
+
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "run.retry_failed")
+
+	runID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/runs/"), "/retry-failed")
+	if runID == "" {
+		APIError{
+			Code:    CodeRunNotFound,
+			Message: "No run ID was provided.",
+			Hint:    "Specify the run as /v1/runs/:run_id/retry-failed.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	jobs, err := c.ListJobs(JobQuery{
+		AccountName: account.Name,
+		RunID:       runID,
+		Statuses:    []string{StatusError, StatusStalled},
+	})
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: fmt.Sprintf("Unable to list the jobs in run [%s]: %v", runID, err),
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+
+	var response struct {
+		JIDs    []uint64 `json:"jids"`
+		RetryOf []uint64 `json:"retry_of"`
+	}
+	response.RetryOf = make([]uint64, len(jobs))
+	for i, job := range jobs {
+		response.RetryOf[i] = job.JID
+	}
+
+	var ok bool
+	if response.JIDs, ok = retryJobs(c, w, account, jobs); !ok {
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"account": account.Name,
+		"run id":  runID,
+		"count":   len(jobs),
+	}).Info("Failed jobs in a run retried.")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
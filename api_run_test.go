@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func runStorage() *MemoryStorage {
+	return &MemoryStorage{Jobs: map[uint64]*SubmittedJob{
+		1: {JID: 1, Account: "admin", Status: StatusDone, Job: Job{RunID: "nightly"}},
+		2: {JID: 2, Account: "admin", Status: StatusProcessing, Job: Job{RunID: "nightly"}},
+		3: {JID: 3, Account: "admin", Status: StatusError, Job: Job{RunID: "nightly"}},
+		4: {JID: 4, Account: "admin", Status: StatusDone, Job: Job{RunID: "weekly"}},
+		5: {JID: 5, Account: "other", Status: StatusQueued, Job: Job{RunID: "nightly"}},
+	}, LastJID: 5}
+}
+
+func TestRunHandler(t *testing.T) {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  runStorage(),
+	}
+
+	w := serveRequest(t, c, RunHandler, "admin", "GET", "/v1/runs/nightly", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		RunID    string         `json:"run_id"`
+		Total    int            `json:"total"`
+		Complete bool           `json:"complete"`
+		Statuses map[string]int `json:"statuses"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+
+	if response.RunID != "nightly" || response.Total != 3 || response.Complete {
+		t.Errorf("Unexpected run summary: %+v", response)
+	}
+	if response.Statuses[StatusDone] != 1 || response.Statuses[StatusProcessing] != 1 || response.Statuses[StatusError] != 1 {
+		t.Errorf("Unexpected status counts: %v", response.Statuses)
+	}
+	if count, ok := response.Statuses[StatusQueued]; !ok || count != 0 {
+		t.Errorf("Expected statuses without jobs to be reported as zero, got %v", response.Statuses)
+	}
+
+	w = serveRequest(t, c, RunHandler, "admin", "GET", "/v1/runs/weekly", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if !response.Complete {
+		t.Errorf("Expected a run of finished jobs to be complete: %+v", response)
+	}
+}
+
+func TestRunHandlerNotFound(t *testing.T) {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  runStorage(),
+	}
+
+	w := serveRequest(t, c, RunHandler, "admin", "GET", "/v1/runs/missing", "")
+
+	hasError(t, w, http.StatusNotFound, APIError{
+		Code:    CodeRunNotFound,
+		Message: "Unable to find a run with ID [missing].",
+		Retry:   false,
+	})
+}
+
+func TestRunListHandler(t *testing.T) {
+	first := StoreTime(time.Date(2015, 3, 14, 9, 26, 53, 123456789, time.UTC))
+	storage := &MemoryStorage{Jobs: map[uint64]*SubmittedJob{
+		1: {JID: 1, Account: "admin", Status: StatusDone, CreatedAt: first.Add(time.Second), Job: Job{RunID: "weekly"}},
+		2: {JID: 2, Account: "admin", Status: StatusDone, CreatedAt: first, Job: Job{RunID: "nightly"}},
+		3: {JID: 3, Account: "admin", Status: StatusQueued, CreatedAt: first.Add(time.Hour), Job: Job{RunID: "nightly"}},
+		4: {JID: 4, Account: "admin", Status: StatusQueued, CreatedAt: first},
+		5: {JID: 5, Account: "other", Status: StatusQueued, CreatedAt: first, Job: Job{RunID: "hourly"}},
+	}}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  storage,
+	}
+
+	var response struct {
+		Runs []struct {
+			RunID     string         `json:"run_id"`
+			CreatedAt string         `json:"created_at"`
+			Total     int            `json:"total"`
+			Complete  bool           `json:"complete"`
+			Statuses  map[string]int `json:"statuses"`
+		} `json:"runs"`
+	}
+
+	w := serveRequest(t, c, RunListHandler, "admin", "GET", "/v1/runs", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if len(response.Runs) != 2 || response.Runs[0].RunID != "nightly" || response.Runs[1].RunID != "weekly" {
+		t.Fatalf("Unexpected runs: %+v", response.Runs)
+	}
+	nightly := response.Runs[0]
+	if nightly.CreatedAt != "2015-03-14 09:26:53.123" || nightly.Total != 2 || nightly.Complete {
+		t.Errorf("Unexpected run summary: %+v", nightly)
+	}
+	if nightly.Statuses[StatusDone] != 1 || nightly.Statuses[StatusQueued] != 1 {
+		t.Errorf("Unexpected status counts: %v", nightly.Statuses)
+	}
+
+	// Page through the runs one at a time.
+	w = serveRequest(t, c, RunListHandler, "admin", "GET", "/v1/runs?limit=1", "")
+	response.Runs = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if len(response.Runs) != 1 || response.Runs[0].RunID != "nightly" {
+		t.Fatalf("Unexpected first page: %+v", response.Runs)
+	}
+
+	w = serveRequest(t, c, RunListHandler, "admin", "GET", "/v1/runs?limit=1&after="+url.QueryEscape(response.Runs[0].CreatedAt)+"&after_run_id=nightly", "")
+	response.Runs = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if len(response.Runs) != 1 || response.Runs[0].RunID != "weekly" || !response.Runs[0].Complete {
+		t.Fatalf("Unexpected second page: %+v", response.Runs)
+	}
+}
+
+func TestRunListHandlerPagesWithinAMillisecond(t *testing.T) {
+	first := StoreTime(time.Date(2015, 3, 14, 9, 26, 53, 123000000, time.UTC))
+	storage := &MemoryStorage{Jobs: map[uint64]*SubmittedJob{
+		1: {JID: 1, Account: "admin", Status: StatusDone, CreatedAt: first.Add(900 * time.Microsecond), Job: Job{RunID: "a"}},
+		2: {JID: 2, Account: "admin", Status: StatusDone, CreatedAt: first.Add(100 * time.Microsecond), Job: Job{RunID: "b"}},
+		3: {JID: 3, Account: "admin", Status: StatusDone, CreatedAt: first.Add(500 * time.Microsecond), Job: Job{RunID: "c"}},
+	}}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  storage,
+	}
+
+	var seen []string
+	query := "limit=1"
+	for i := 0; i < 4; i++ {
+		w := serveRequest(t, c, RunListHandler, "admin", "GET", "/v1/runs?"+query, "")
+		var response struct {
+			Runs []struct {
+				RunID     string `json:"run_id"`
+				CreatedAt string `json:"created_at"`
+			} `json:"runs"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+		}
+		if len(response.Runs) == 0 {
+			break
+		}
+		last := response.Runs[len(response.Runs)-1]
+		seen = append(seen, last.RunID)
+		query = "limit=1&after=" + url.QueryEscape(last.CreatedAt) + "&after_run_id=" + url.QueryEscape(last.RunID)
+	}
+
+	if expected := []string{"a", "b", "c"}; !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected to page through runs %v, got %v", expected, seen)
+	}
+}
+
+func TestRunListHandlerInvalidAfter(t *testing.T) {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  runStorage(),
+	}
+
+	w := serveRequest(t, c, RunListHandler, "admin", "GET", "/v1/runs?after=yesterday", "")
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+}
+
+func TestRunHandlerTimes(t *testing.T) {
+	base := StoreTime(time.Date(2015, 3, 14, 9, 0, 0, 0, time.UTC))
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage: &MemoryStorage{Jobs: map[uint64]*SubmittedJob{
+			1: {JID: 1, Account: "admin", Status: StatusDone, Job: Job{RunID: "nightly"},
+				CreatedAt: base, StartedAt: base.Add(3 * time.Minute), FinishedAt: base.Add(4 * time.Minute)},
+			2: {JID: 2, Account: "admin", Status: StatusError, Job: Job{RunID: "nightly"},
+				CreatedAt: base.Add(time.Minute), StartedAt: base.Add(2 * time.Minute), FinishedAt: base.Add(5 * time.Minute)},
+		}},
+	}
+
+	w := serveRequest(t, c, RunHandler, "admin", "GET", "/v1/runs/nightly", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Total      int    `json:"total"`
+		Completed  int    `json:"completed"`
+		Failed     int    `json:"failed"`
+		Complete   bool   `json:"complete"`
+		CreatedAt  string `json:"created_at"`
+		StartedAt  string `json:"started_at"`
+		FinishedAt string `json:"finished_at"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+
+	if response.Total != 2 || response.Completed != 2 || response.Failed != 1 || !response.Complete {
+		t.Errorf("Unexpected run summary: %+v", response)
+	}
+	if response.CreatedAt != "2015-03-14 09:00:00.000" ||
+		response.StartedAt != "2015-03-14 09:02:00.000" ||
+		response.FinishedAt != "2015-03-14 09:05:00.000" {
+		t.Errorf("Unexpected run times: %+v", response)
+	}
+}
+
+func TestRunCancelHandler(t *testing.T) {
+	s := runStorage()
+	s.Jobs[6] = &SubmittedJob{JID: 6, Account: "admin", Status: StatusQueued, Job: Job{RunID: "nightly"}}
+	s.Jobs[7] = &SubmittedJob{JID: 7, Account: "admin", Status: StatusQueued, Job: Job{RunID: "weekly"}}
+	s.LastJID = 7
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, RunResourceHandler, "admin", "POST", "/v1/runs/nightly/cancel", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Cancelled int `json:"cancelled"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if response.Cancelled != 2 {
+		t.Errorf("Expected two jobs to be cancelled, got [%d]", response.Cancelled)
+	}
+
+	if job := s.Jobs[6]; !job.KillRequested || job.Status != StatusKilled {
+		t.Errorf("Expected the queued job to be killed, got [%s] kill requested [%v]", job.Status, job.KillRequested)
+	}
+	if job := s.Jobs[2]; !job.KillRequested || job.Status != StatusProcessing {
+		t.Errorf("Expected the running job to be flagged for the runner, got [%s] kill requested [%v]", job.Status, job.KillRequested)
+	}
+	for _, jid := range []uint64{1, 3, 5, 7} {
+		if s.Jobs[jid].KillRequested {
+			t.Errorf("Expected job [%d] to be left alone", jid)
+		}
+	}
+}
+
+func TestRunCancelHandlerReportsKillFailures(t *testing.T) {
+	s := runStorage()
+	s.Jobs[2].ContainerID = "abc123"
+	d := &MockDockerClient{KillErr: errors.New("no such container")}
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+		Docker:   d,
+	}
+
+	w := serveRequest(t, c, RunResourceHandler, "admin", "POST", "/v1/runs/nightly/cancel", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the cancellation to succeed, got [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		Cancelled  int      `json:"cancelled"`
+		KillFailed []uint64 `json:"kill_failed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if response.Cancelled != 1 || !reflect.DeepEqual(response.KillFailed, []uint64{2}) {
+		t.Errorf("Expected job [2] to be cancelled with a failed kill, got %+v", response)
+	}
+	if len(d.Killed) != 1 || d.Killed[0] != "abc123" {
+		t.Errorf("Expected the running container to be killed, got %v", d.Killed)
+	}
+	if !s.Jobs[2].KillRequested {
+		t.Error("Expected the running job to stay flagged for its runner")
+	}
+}
+
+// retryFailedStorage adds valid failed jobs to the runs in runStorage. In the nightly run, job [6]
+// failed because its dependency [3] did, and job [8] stalled after its dependency [1] succeeded.
+func retryFailedStorage() *MemoryStorage {
+	s := runStorage()
+	failed := func(jid uint64, status string, dependsOn string, runID string) *SubmittedJob {
+		job := &SubmittedJob{
+			JID:     jid,
+			Account: "admin",
+			Status:  status,
+			Job:     Job{Command: "id", ResultSource: "stdout", ResultType: ResultBinary, RunID: runID},
+			Stderr:  "Traceback",
+		}
+		if dependsOn != "" {
+			job.DependsOn = &dependsOn
+		}
+		return job
+	}
+	s.Jobs[3] = failed(3, StatusError, "", "nightly")
+	s.Jobs[6] = failed(6, StatusError, "3", "nightly")
+	s.Jobs[7] = failed(7, StatusError, "", "weekly")
+	s.Jobs[8] = failed(8, StatusStalled, "1", "nightly")
+	s.LastJID = 8
+	return s
+}
+
+func TestRunRetryFailedHandler(t *testing.T) {
+	s := retryFailedStorage()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, RunResourceHandler, "admin", "POST", "/v1/runs/nightly/retry-failed", "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	var response struct {
+		JIDs    []uint64 `json:"jids"`
+		RetryOf []uint64 `json:"retry_of"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if !reflect.DeepEqual(response.JIDs, []uint64{9, 10, 11}) || !reflect.DeepEqual(response.RetryOf, []uint64{3, 6, 8}) {
+		t.Errorf("Expected jobs [3 6 8] to be retried as [9 10 11], got %v and %v", response.RetryOf, response.JIDs)
+	}
+
+	if retried := s.Jobs[9]; retried.Status != StatusQueued || retried.RunID != "nightly" || retried.Stderr != "" {
+		t.Errorf("Expected a fresh copy of job [3] to be queued in the run, got %+v", retried)
+	}
+	if retried := s.Jobs[10]; retried.Status != StatusWaiting || retried.Dependency() != 9 {
+		t.Errorf("Expected the copy of job [6] to wait for the copy of job [3], got %+v", retried)
+	}
+	if retried := s.Jobs[11]; retried.Status != StatusWaiting || retried.Dependency() != 1 {
+		t.Errorf("Expected the copy of job [8] to wait for job [1], got %+v", retried)
+	}
+	for _, jid := range []uint64{3, 6, 7} {
+		if s.Jobs[jid].Status != StatusError {
+			t.Errorf("Expected job [%d] to be left alone, but it was [%s]", jid, s.Jobs[jid].Status)
+		}
+	}
+}
+
+func TestRunRetryFailedHandlerQueuedQuota(t *testing.T) {
+	s := retryFailedStorage()
+	s.Accounts = quotaAccounts(2)
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  s,
+	}
+
+	w := serveRequest(t, c, RunResourceHandler, "admin", "POST", "/v1/runs/nightly/retry-failed", "")
+
+	if w.Code != statusTooManyRequests {
+		t.Errorf("Expected the retries to exceed the quota, got [%d] %s", w.Code, w.Body.String())
+	}
+	if s.LastJID != 8 {
+		t.Errorf("Expected no new jobs to be submitted, but the last JID was [%d]", s.LastJID)
+	}
+}
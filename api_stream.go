@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// JobStreamHandler upgrades a connection to a WebSocket and sends output from a running job as it's
+// written, as in GET /v1/jobs/{jid}/stream. Each message is a JSON-encoded OutputChunk. Output
+// written before the connection was made isn't repeated; fetch it from the job listing instead. The
+// connection is closed once the job completes.
+func JobStreamHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		RequestLog(w).WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "job.stream")
+
+	rawJID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/jobs/"), "/stream")
+	jid, err := strconv.ParseUint(rawJID, 10, 64)
+	if err != nil {
+		APIError{
+			Code:    CodeUnableToParseQuery,
+			Message: fmt.Sprintf("Unable to parse JID [%s]: %v", rawJID, err),
+			Hint:    "Please provide a valid integer job ID in the path.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	// Subscribe before looking up the job, so that it can't complete unnoticed in between.
+	chunks, unsubscribe := c.Output.Subscribe(jid)
+	defer unsubscribe()
+
+	jobs, err := c.ListJobs(JobQuery{AccountName: account.Name, JIDs: []uint64{jid}})
+	if err != nil {
+		APIError{
+			Code:    CodeListFailure,
+			Message: "Unable to list jobs.",
+			Hint:    "This is probably a storage error on our end.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusInternalServerError, w)
+		return
+	}
+	if len(jobs) == 0 {
+		APIError{
+			Code:    CodeJobNotFound,
+			Message: fmt.Sprintf("Unable to find a job with ID [%d].", jid),
+			Hint:    "Make sure that the JID is still valid.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusNotFound, w)
+		return
+	}
+
+	ws := UpgradeWebSocket(c, w, r, account)
+	if ws == nil {
+		return
+	}
+	defer ws.Close()
+
+	if IsCompleted(jobs[0].Status) {
+		return
+	}
+
+	RequestLog(w).WithFields(log.Fields{
+		"jid":     jid,
+		"account": account.Name,
+	}).Debug("Streaming job output.")
+
+	for {
+		select {
+		case chunk, ok := <-chunks:
+			if !ok {
+				// The job has completed.
+				return
+			}
+
+			message, err := json.Marshal(chunk)
+			if err != nil {
+				RequestLog(w).WithFields(log.Fields{"jid": jid, "error": err}).Error("Unable to encode job output.")
+				return
+			}
+			if err := ws.WriteText(message); err != nil {
+				return
+			}
+		case <-ws.Closed():
+			return
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// streamServer serves JobOutputHandler for job [11]. The returned channel is closed once a request
+// has been handled.
+func streamServer(c *Context) (*httptest.Server, <-chan struct{}) {
+	done := make(chan struct{})
+	handler := BindContext(c, JobOutputHandler)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		handler(w, r)
+	}))
+	return server, done
+}
+
+// dialJobStream opens a WebSocket to the stream of job [11], optionally from a browser origin.
+func dialJobStream(server *httptest.Server, origin string) (*websocket.Conn, *http.Response, error) {
+	r, _ := http.NewRequest("GET", server.URL, nil)
+	r.SetBasicAuth("admin", "12345")
+	header := http.Header{"Authorization": r.Header["Authorization"]}
+	if origin != "" {
+		header.Set("Origin", origin)
+	}
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/v1/jobs/11/stream"
+	return websocket.DefaultDialer.Dial(url, header)
+}
+
+func streamContext() *Context {
+	return &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", AllowedOrigins: []string{"https://app.example.com"}},
+		Storage:  &JobStorage{},
+		Output:   NewOutputBroker(),
+	}
+}
+
+func TestJobStreamHandler(t *testing.T) {
+	c := streamContext()
+	server, _ := streamServer(c)
+	defer server.Close()
+
+	conn, _, err := dialJobStream(server, "")
+	if err != nil {
+		t.Fatalf("Unable to connect: %v", err)
+	}
+	defer conn.Close()
+
+	job := &SubmittedJob{JID: 11}
+	collector := &OutputCollector{context: c, job: job, isStdout: true}
+	collector.Write([]byte("hello"))
+
+	messageType, payload, err := conn.ReadMessage()
+	if err != nil || messageType != websocket.TextMessage {
+		t.Fatalf("Expected a text message, got [%d] and %v", messageType, err)
+	}
+	var chunk OutputChunk
+	if err := json.Unmarshal(payload, &chunk); err != nil {
+		t.Fatalf("Unable to parse message as JSON: [%s]", payload)
+	}
+	if chunk.Stream != "stdout" || chunk.Data != "hello" {
+		t.Errorf("Unexpected output chunk: %#v", chunk)
+	}
+
+	c.Output.Close(11)
+
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Errorf("Expected a normal close once the job completed, got %v", err)
+	}
+}
+
+func TestJobStreamHandlerAnswersClientFrames(t *testing.T) {
+	c := streamContext()
+	server, done := streamServer(c)
+	defer server.Close()
+
+	conn, _, err := dialJobStream(server, "https://app.example.com")
+	if err != nil {
+		t.Fatalf("Unable to connect from an allowed origin: %v", err)
+	}
+	defer conn.Close()
+
+	pong := make(chan struct{})
+	conn.SetPongHandler(func(string) error {
+		close(pong)
+		return nil
+	})
+	closed := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		closed <- err
+	}()
+
+	if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Unable to send a ping: %v", err)
+	}
+	select {
+	case <-pong:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the ping to be answered")
+	}
+
+	message := websocket.FormatCloseMessage(websocket.CloseGoingAway, "")
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Unable to send a close frame: %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the stream to end once the client closed it")
+	}
+	if err := <-closed; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("Expected the close frame to be echoed, got %v", err)
+	}
+}
+
+func TestJobStreamHandlerRejectsOtherOrigins(t *testing.T) {
+	server, _ := streamServer(streamContext())
+	defer server.Close()
+
+	_, resp, err := dialJobStream(server, "https://evil.example.com")
+	if err == nil {
+		t.Fatal("Expected the handshake to be refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a 403 response, got %v", resp)
+	}
+}
+
+func TestJobStreamHandlerRequiresWebSocket(t *testing.T) {
+	r, err := http.NewRequest("GET", "https://localhost/v1/jobs/11/stream", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &JobStorage{},
+		Output:   NewOutputBroker(),
+	}
+
+	JobOutputHandler(c, w, r)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeWebSocketRequired,
+		Message: "Unable to open a WebSocket: websocket: not a websocket handshake: 'upgrade' token not found in 'Connection' header",
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AuditLogger records each action that an authenticated account takes. Events are written as JSON
+// to their own logger, so that they can be shipped and retained separately from the request log.
+type AuditLogger struct {
+	Logger *log.Logger
+	clock  Clock
+}
+
+// NewAuditLogger creates an AuditLogger that writes one JSON event per line to out.
+func NewAuditLogger(out io.Writer, clock Clock) *AuditLogger {
+	logger := log.New()
+	logger.Out = out
+	logger.Formatter = &log.JSONFormatter{}
+	logger.Level = log.InfoLevel
+
+	return &AuditLogger{Logger: logger, clock: clock}
+}
+
+// Record logs that account performed action, like "job.submit" or "job.kill", while handling r. A
+// nil AuditLogger discards the event.
+func (a *AuditLogger) Record(r *http.Request, account *Account, action string) {
+	if a == nil {
+		return
+	}
+
+	a.Logger.WithFields(log.Fields{
+		"account":     account.Name,
+		"action":      action,
+		"request_id":  RequestID(r),
+		"remote_addr": r.RemoteAddr,
+		"timestamp":   a.clock.Now().UTC().Format(time.RFC3339Nano),
+	}).Info("Audit event.")
+}
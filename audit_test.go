@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// auditEvents parses each line of captured audit output as a JSON object.
+func auditEvents(t *testing.T, out *bytes.Buffer) []map[string]interface{} {
+	var events []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if line == "" {
+			continue
+		}
+
+		var event map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("Unable to parse audit event [%s]: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLoggerRecord(t *testing.T) {
+	var out bytes.Buffer
+	clock := NewFakeClock()
+	audit := NewAuditLogger(&out, clock)
+
+	r, err := http.NewRequest("POST", "https://localhost/v1/job/kill", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.RemoteAddr = "10.0.0.1:5555"
+	r.Header.Set(RequestIDHeader, "abc123")
+
+	audit.Record(r, &Account{Name: "alice"}, "job.kill")
+
+	events := auditEvents(t, &out)
+	if len(events) != 1 {
+		t.Fatalf("Expected one audit event, got %d", len(events))
+	}
+	expected := map[string]string{
+		"account":     "alice",
+		"action":      "job.kill",
+		"request_id":  "abc123",
+		"remote_addr": "10.0.0.1:5555",
+		"timestamp":   "2015-03-14T09:26:53Z",
+	}
+	for key, value := range expected {
+		if events[0][key] != value {
+			t.Errorf("Expected audit field [%s] to be [%s], got [%v]", key, value, events[0][key])
+		}
+	}
+}
+
+func TestAuditLoggerNil(t *testing.T) {
+	var audit *AuditLogger
+	audit.Record(&http.Request{}, &Account{Name: "alice"}, "job.kill")
+}
+
+func TestJobSubmitIsAudited(t *testing.T) {
+	var out bytes.Buffer
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)},
+		Audit:    NewAuditLogger(&out, NewFakeClock()),
+	}
+
+	body := strings.NewReader(`{"jobs": [{"cmd": "id", "result_source": "stdout", "result_type": "binary"}]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/job", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	BindContext(c, JobHandler)(w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+
+	events := auditEvents(t, &out)
+	if len(events) != 1 {
+		t.Fatalf("Expected one audit event, got %d", len(events))
+	}
+	if events[0]["account"] != "admin" || events[0]["action"] != "job.submit" {
+		t.Errorf("Unexpected audit event: %v", events[0])
+	}
+	if id := w.HeaderMap.Get(RequestIDHeader); events[0]["request_id"] != id {
+		t.Errorf("Expected request ID [%s], got [%v]", id, events[0]["request_id"])
+	}
+}
@@ -1,28 +1,148 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"net/http"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 // Account represents a user of the cluster.
 type Account struct {
-	Name  string `bson:"_id"`
-	Admin bool   `bson:"admin"`
+	Name  string `json:"name" bson:"_id"`
+	Admin bool   `json:"admin" bson:"admin"`
 
 	// TotalRuntime tracks the cumulative runtime of all jobs submitted on behalf of this account, in
 	// nanoseconds.
-	TotalRuntime int64 `bson:"total_runtime"`
+	TotalRuntime int64 `json:"total_runtime" bson:"total_runtime"`
 
 	// TotalJobs tracks the number of jobs submitted on behalf of this account.
-	TotalJobs int64 `bson:"total_jobs"`
+	TotalJobs int64 `json:"total_jobs" bson:"total_jobs"`
+
+	// Suspended accounts are refused authentication until an administrator unsuspends them.
+	Suspended bool `json:"-" bson:"suspended"`
+
+	// Active is set to false when an administrator deactivates the account, which permanently
+	// revokes its access while keeping its jobs. Accounts that have never been deactivated may not
+	// have it set at all; use IsActive to check it.
+	Active *bool `json:"-" bson:"active,omitempty"`
+
+	// ExpiresAt is the time after which a time-limited account may no longer authenticate. It's nil
+	// for accounts that never expire.
+	ExpiresAt *StoredTime `json:"expires_at,omitempty" bson:"expires_at,omitempty"`
+
+	// AllowedCores restricts the compute cores that jobs submitted by this account may request. An
+	// empty list permits any core.
+	AllowedCores []string `json:"allowed_cores,omitempty" bson:"allowed_cores,omitempty"`
+
+	// AllowedImages lists images that this account may use in addition to the globally allowed
+	// images.
+	AllowedImages []string `json:"allowed_images,omitempty" bson:"allowed_images,omitempty"`
+
+	// Credits is the account's remaining compute balance. When a CostPerNanosecond is configured,
+	// each completed job deducts its runtime cost and accounts without credits may not submit jobs.
+	Credits int64 `json:"credits" bson:"credits"`
+
+	// MaxQueuedJobs limits the number of this account's jobs that may wait in the queue at once. Zero
+	// means that there's no limit.
+	MaxQueuedJobs int `json:"max_queued_jobs,omitempty" bson:"max_queued_jobs,omitempty"`
+
+	// MaxConcurrentJobs limits the number of this account's jobs that may run at once. Zero falls
+	// back to the DefaultMaxConcurrentJobs setting.
+	MaxConcurrentJobs int `json:"max_concurrent_jobs,omitempty" bson:"max_concurrent_jobs,omitempty"`
+
+	// APIKeyHash is the hex-encoded SHA-256 hash of the API key that an administrator assigned to
+	// the account when it was created. It's empty for accounts whose keys are managed by the
+	// AuthService alone.
+	APIKeyHash string `json:"-" bson:"api_key_hash,omitempty"`
+}
+
+// HashAPIKey hashes an API key for storage.
+func HashAPIKey(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// IsActive returns false if the account has been deactivated.
+func (a Account) IsActive() bool {
+	return a.Active == nil || *a.Active
 }
 
-// Authenticate reads authentication information from HTTP basic auth and attempts to locate a
-// corresponding user account.
+// Expired returns true if the account has an expiration time that has already passed.
+func (a Account) Expired() bool {
+	return a.ExpiresAt != nil && !StoreTime(time.Now()).Before(*a.ExpiresAt)
+}
+
+// ConcurrencyLimit returns the number of this account's jobs that may run at once, falling back to
+// defaultLimit if the account doesn't have its own. Zero means that there's no limit.
+func (a Account) ConcurrencyLimit(defaultLimit int) int {
+	if a.MaxConcurrentJobs > 0 {
+		return a.MaxConcurrentJobs
+	}
+	return defaultLimit
+}
+
+// ResourceScore weighs this account's historical footprint against the number of its jobs that are
+// waiting in the queue:
+//
+//	ResourceScore = (TotalRuntime / TotalJobs) * queueDepth
+//
+// Accounts with lower scores are preferred when jobs are claimed. Accounts without any completed
+// jobs score zero.
+func (a Account) ResourceScore(queueDepth int) float64 {
+	if a.TotalJobs == 0 {
+		return 0
+	}
+	return float64(a.TotalRuntime) / float64(a.TotalJobs) * float64(queueDepth)
+}
+
+// CoreAllowed returns true if this account may submit jobs that run on the named core.
+func (a Account) CoreAllowed(core string) bool {
+	if len(a.AllowedCores) == 0 {
+		return true
+	}
+
+	for _, allowed := range a.AllowedCores {
+		if allowed == core {
+			return true
+		}
+	}
+	return false
+}
+
+// ImageAllowed returns true if this account may run jobs using the named image. The effective list
+// of allowed images is the union of the globally allowed images and the account's own. If both are
+// empty, any image is permitted.
+func (a Account) ImageAllowed(image string, global []string) bool {
+	if len(global) == 0 && len(a.AllowedImages) == 0 {
+		return true
+	}
+
+	for _, allowed := range global {
+		if allowed == image {
+			return true
+		}
+	}
+	for _, allowed := range a.AllowedImages {
+		if allowed == image {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticate reads authentication information from a JWT bearer token or HTTP basic auth and
+// attempts to locate a corresponding user account. Bearer tokens are only accepted when a JWTSecret
+// is configured.
 func Authenticate(c *Context, w http.ResponseWriter, r *http.Request) (*Account, error) {
+	if token, ok := bearerToken(r); ok && c.Settings.JWTSecret != "" {
+		return authenticateJWT(c, w, token)
+	}
+
 	accountName, apiKey, ok := r.BasicAuth()
 	if !ok {
 		// Credentials not provided.
@@ -38,7 +158,7 @@ func Authenticate(c *Context, w http.ResponseWriter, r *http.Request) (*Account,
 
 	if c.Settings.AdminName != "" && c.Settings.AdminKey != "" {
 		if accountName == c.Settings.AdminName && apiKey == c.Settings.AdminKey {
-			log.WithFields(log.Fields{
+			RequestLog(w).WithFields(log.Fields{
 				"account": accountName,
 			}).Debug("Administrator authenticated.")
 
@@ -58,7 +178,27 @@ func Authenticate(c *Context, w http.ResponseWriter, r *http.Request) (*Account,
 		}
 	}
 
-	ok, err := c.AuthService.Validate(accountName, apiKey)
+	// Accounts that an administrator created through the API carry the hash of their own API key, so
+	// the authentication service doesn't know about them.
+	hash, err := c.GetAPIKeyHash(accountName)
+	if err != nil && err != ErrNotFound {
+		apiErr := &APIError{
+			Code:    CodeStorageError,
+			Message: fmt.Sprintf("Unable to communicate with storage: %v", err),
+			Hint:    "There was an internal error communicating with our backend storage.",
+			Retry:   true,
+		}
+		apiErr.Report(http.StatusInternalServerError, w)
+		return nil, apiErr
+	}
+	if hash != "" {
+		if subtle.ConstantTimeCompare([]byte(HashAPIKey(apiKey)), []byte(hash)) != 1 {
+			return nil, reportIncorrectCredentials(w, accountName)
+		}
+		return loadAccount(c, w, accountName)
+	}
+
+	ok, err = c.AuthService.Validate(accountName, apiKey)
 	if err != nil {
 		apiErr := &APIError{
 			Code:    CodeAuthServiceConnection,
@@ -70,17 +210,56 @@ func Authenticate(c *Context, w http.ResponseWriter, r *http.Request) (*Account,
 		return nil, apiErr
 	}
 	if !ok {
+		return nil, reportIncorrectCredentials(w, accountName)
+	}
+
+	return loadAccount(c, w, accountName)
+}
+
+// reportIncorrectCredentials reports that an account's API key was rejected.
+func reportIncorrectCredentials(w http.ResponseWriter, accountName string) *APIError {
+	apiErr := &APIError{
+		Code:    CodeCredentialsIncorrect,
+		Message: fmt.Sprintf("Unable to authenticate account [%s]", accountName),
+		Hint:    "Double-check the account name and API key you're providing to multyvac.config.set_key().",
+		Retry:   false,
+	}
+	apiErr.Report(http.StatusUnauthorized, w)
+	return apiErr
+}
+
+// authenticateJWT validates a JWT bearer token and locates the account named by its subject. The
+// account's administrator status is taken from the token's "admin" claim.
+func authenticateJWT(c *Context, w http.ResponseWriter, token string) (*Account, error) {
+	claims, err := ParseJWT(token, []byte(c.Settings.JWTSecret), c.Settings.JWTIssuer, time.Now())
+	if err != nil {
 		apiErr := &APIError{
-			Code:    CodeCredentialsIncorrect,
-			Message: fmt.Sprintf("Unable to authenticate account [%s]", accountName),
-			Hint:    "Double-check the account name and API key you're providing to multyvac.config.set_key().",
+			Code:    CodeInvalidToken,
+			Message: fmt.Sprintf("Unable to authenticate with bearer token: %v", err),
+			Hint:    "Request a new token and try again.",
 			Retry:   false,
 		}
 		apiErr.Report(http.StatusUnauthorized, w)
 		return nil, apiErr
 	}
 
-	// Success! Find or create the Account object in Mongo to return.
+	account, err := loadAccount(c, w, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+	account.Admin = claims.Admin
+
+	RequestLog(w).WithFields(log.Fields{
+		"account": account.Name,
+		"admin":   account.Admin,
+	}).Debug("Bearer token authenticated.")
+
+	return account, nil
+}
+
+// loadAccount finds or creates the Account for an authenticated account name, and ensures that it's
+// permitted to make requests.
+func loadAccount(c *Context, w http.ResponseWriter, accountName string) (*Account, error) {
 	account, err := c.GetAccount(accountName)
 	if err != nil {
 		apiErr := &APIError{
@@ -93,5 +272,60 @@ func Authenticate(c *Context, w http.ResponseWriter, r *http.Request) (*Account,
 		return nil, apiErr
 	}
 
+	if account.Suspended {
+		apiErr := &APIError{
+			Code:    CodeAccountSuspended,
+			Message: fmt.Sprintf("The account [%s] has been suspended.", accountName),
+			Hint:    "Contact your administrator to have your account reinstated.",
+			Retry:   false,
+		}
+		apiErr.Report(http.StatusForbidden, w)
+		return nil, apiErr
+	}
+
+	if !account.IsActive() {
+		apiErr := &APIError{
+			Code:    CodeAccountDeactivated,
+			Message: fmt.Sprintf("The account [%s] has been deactivated.", accountName),
+			Hint:    "Contact your administrator if you believe this is a mistake.",
+			Retry:   false,
+		}
+		apiErr.Report(http.StatusUnauthorized, w)
+		return nil, apiErr
+	}
+
+	if account.Expired() {
+		apiErr := &APIError{
+			Code:    CodeAccountExpired,
+			Message: fmt.Sprintf("The account [%s] expired at [%s].", accountName, account.ExpiresAt),
+			Hint:    "Contact your administrator to have your account extended.",
+			Retry:   false,
+		}
+		apiErr.Report(http.StatusForbidden, w)
+		return nil, apiErr
+	}
+
+	return account, nil
+}
+
+// AuthenticateAdmin authenticates a request with Authenticate, then ensures that the account is an
+// administrator.
+func AuthenticateAdmin(c *Context, w http.ResponseWriter, r *http.Request) (*Account, error) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		return nil, err
+	}
+
+	if !account.Admin {
+		apiErr := &APIError{
+			Code:    CodeAdminRequired,
+			Message: fmt.Sprintf("The account [%s] is not an administrator.", account.Name),
+			Hint:    "Only administrators may use this endpoint.",
+			Retry:   false,
+		}
+		apiErr.Log(account).Report(http.StatusForbidden, w)
+		return nil, apiErr
+	}
+
 	return account, nil
 }
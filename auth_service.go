@@ -1,6 +1,10 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -10,6 +14,14 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+const (
+	// AuthModeExternal validates API keys with the remote service at the configured AuthService URL.
+	AuthModeExternal = "external"
+
+	// AuthModeHMAC validates API keys locally with an HMACAuthService.
+	AuthModeHMAC = "hmac"
+)
+
 // AuthService describes the required and optional services that may be supplied by an authentication
 // backend for cloudpipe.
 type AuthService interface {
@@ -102,6 +114,30 @@ func (service RemoteAuthService) Style() string {
 	return service.ReportedStyle
 }
 
+// HMACAuthService is an AuthService that validates API keys locally, without a network round-trip.
+// An account's API key is the hex-encoded HMAC-SHA256 of its name, keyed with a shared secret.
+type HMACAuthService struct {
+	Secret []byte
+}
+
+// Key computes the API key for the named account.
+func (service HMACAuthService) Key(accountName string) string {
+	mac := hmac.New(sha256.New, service.Secret)
+	mac.Write([]byte(accountName))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Validate compares an API key to the expected key for the account in constant time.
+func (service HMACAuthService) Validate(accountName, apiKey string) (bool, error) {
+	expected := service.Key(accountName)
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(apiKey)) == 1, nil
+}
+
+// Style informs API consumers that keys are derived locally and no other calls are available.
+func (service HMACAuthService) Style() string {
+	return "hmac"
+}
+
 // NullAuthService is an AuthService implementation that refuses all users and provides no optional
 // capabilities. It's used as a default if no AuthService is provided and is useful to embed in
 // test cases.
@@ -120,3 +156,4 @@ func (service NullAuthService) Style() string {
 // Ensure that NullAuthService adheres to the AuthService interface.
 
 var _ AuthService = NullAuthService{}
+var _ AuthService = HMACAuthService{}
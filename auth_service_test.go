@@ -132,3 +132,34 @@ func TestUnsuccessfulRemoteAuth(t *testing.T) {
 		t.Errorf("Service unexpectedly accepted authentication")
 	}
 }
+
+func TestHMACAuthValidKey(t *testing.T) {
+	service := HMACAuthService{Secret: []byte("sekrit")}
+
+	ok, err := service.Validate("someone", service.Key("someone"))
+	if err != nil {
+		t.Fatalf("Unexpected error validating a key: %v", err)
+	}
+	if !ok {
+		t.Error("Expected a valid key to be accepted")
+	}
+}
+
+func TestHMACAuthInvalidKey(t *testing.T) {
+	service := HMACAuthService{Secret: []byte("sekrit")}
+	other := HMACAuthService{Secret: []byte("not the secret")}
+
+	for _, key := range []string{"", "12345", other.Key("someone")} {
+		if ok, _ := service.Validate("someone", key); ok {
+			t.Errorf("Expected the key [%s] to be rejected", key)
+		}
+	}
+}
+
+func TestHMACAuthWrongAccount(t *testing.T) {
+	service := HMACAuthService{Secret: []byte("sekrit")}
+
+	if ok, _ := service.Validate("someone", service.Key("someone-else")); ok {
+		t.Error("Expected another account's key to be rejected")
+	}
+}
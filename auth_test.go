@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 // TrustingAuthService accepts all usernames and tokens.
@@ -113,3 +114,211 @@ func TestAuthenticateNonAdminAccount(t *testing.T) {
 		t.Errorf("Expected account not to be an administrator")
 	}
 }
+
+func TestAuthenticateSuspendedAccount(t *testing.T) {
+	r, w := setupAuthRecorder(t, "suspended", "1234512345")
+	c := &Context{
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"suspended": {Name: "suspended", Suspended: true},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	_, err := Authenticate(c, w, r)
+	if err == nil {
+		t.Error("Expected Authenticate to return an error for a suspended account.")
+	}
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAccountSuspended,
+		Message: "The account [suspended] has been suspended.",
+		Retry:   false,
+	})
+}
+
+func TestAuthenticateExpiredAccount(t *testing.T) {
+	r, w := setupAuthRecorder(t, "trial", "1234512345")
+	expiresAt := StoreTime(time.Date(2015, time.January, 1, 0, 0, 0, 0, time.UTC))
+	c := &Context{
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"trial": {Name: "trial", ExpiresAt: &expiresAt},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	_, err := Authenticate(c, w, r)
+	if err == nil {
+		t.Error("Expected Authenticate to return an error for an expired account.")
+	}
+
+	hasError(t, w, http.StatusForbidden, APIError{
+		Code:    CodeAccountExpired,
+		Message: "The account [trial] expired at [2015-01-01 00:00:00.000].",
+		Retry:   false,
+	})
+}
+
+func TestAuthenticateUnexpiredAccount(t *testing.T) {
+	r, w := setupAuthRecorder(t, "trial", "1234512345")
+	expiresAt := StoreTime(time.Now().Add(time.Hour))
+	c := &Context{
+		Storage: &AccountStorage{
+			Accounts: map[string]*Account{
+				"trial": {Name: "trial", ExpiresAt: &expiresAt},
+			},
+		},
+		AuthService: TrustingAuthService{},
+	}
+
+	if _, err := Authenticate(c, w, r); err != nil {
+		t.Errorf("Unable to authenticate: %v", err)
+	}
+}
+
+func TestAuthenticateCreatedAccount(t *testing.T) {
+	s := &AccountStorage{Accounts: make(map[string]*Account)}
+	if err := s.CreateAccount(Account{Name: "created"}, "s3cret"); err != nil {
+		t.Fatalf("Unable to create an account: %v", err)
+	}
+	c := &Context{
+		Storage:     s,
+		AuthService: NullAuthService{},
+	}
+
+	r, w := setupAuthRecorder(t, "created", "s3cret")
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		t.Fatalf("Expected the account's own API key to be accepted: %v", err)
+	}
+	if account.Name != "created" {
+		t.Errorf("Unexpected account name: [%s]", account.Name)
+	}
+
+	r, w = setupAuthRecorder(t, "created", "wrong")
+	if _, err := Authenticate(c, w, r); err == nil {
+		t.Error("Expected Authenticate to reject the wrong API key.")
+	}
+	hasError(t, w, http.StatusUnauthorized, APIError{
+		Code:    CodeCredentialsIncorrect,
+		Message: "Unable to authenticate account [created]",
+		Retry:   false,
+	})
+}
+
+func TestAuthenticateJWTBearer(t *testing.T) {
+	secret := []byte("sekrit")
+	now := time.Now()
+	c := &Context{
+		Settings: Settings{
+			JWTSecret: "sekrit",
+			JWTIssuer: "https://auth.example.com",
+		},
+		Storage:     NullStorage{},
+		AuthService: NullAuthService{},
+	}
+
+	cases := []struct {
+		description string
+		claims      JWTClaims
+		secret      []byte
+		status      int
+		admin       bool
+		message     string
+	}{
+		{
+			description: "valid admin token",
+			claims:      JWTClaims{Subject: "someone", Issuer: "https://auth.example.com", ExpiresAt: now.Add(time.Hour).Unix(), Admin: true},
+			secret:      secret,
+			status:      http.StatusOK,
+			admin:       true,
+		},
+		{
+			description: "valid non-admin token",
+			claims:      JWTClaims{Subject: "someone", Issuer: "https://auth.example.com", ExpiresAt: now.Add(time.Hour).Unix()},
+			secret:      secret,
+			status:      http.StatusOK,
+			admin:       false,
+		},
+		{
+			description: "expired token",
+			claims:      JWTClaims{Subject: "someone", Issuer: "https://auth.example.com", ExpiresAt: now.Add(-time.Hour).Unix()},
+			secret:      secret,
+			status:      http.StatusUnauthorized,
+			message:     "Unable to authenticate with bearer token: token has expired",
+		},
+		{
+			description: "wrong issuer",
+			claims:      JWTClaims{Subject: "someone", Issuer: "https://evil.example.com", ExpiresAt: now.Add(time.Hour).Unix()},
+			secret:      secret,
+			status:      http.StatusUnauthorized,
+			message:     "Unable to authenticate with bearer token: token has an unexpected issuer",
+		},
+		{
+			description: "wrong signing key",
+			claims:      JWTClaims{Subject: "someone", Issuer: "https://auth.example.com", ExpiresAt: now.Add(time.Hour).Unix()},
+			secret:      []byte("guessed"),
+			status:      http.StatusUnauthorized,
+			message:     "Unable to authenticate with bearer token: invalid token signature",
+		},
+	}
+
+	for _, each := range cases {
+		token, err := SignJWT(each.claims, each.secret)
+		if err != nil {
+			t.Fatalf("Unable to sign token: %v", err)
+		}
+
+		r, w := setupAuthRecorder(t, "", "")
+		r.Header.Set("Authorization", "Bearer "+token)
+
+		account, err := Authenticate(c, w, r)
+
+		if w.Code != each.status {
+			t.Errorf("Unexpected HTTP status for %s: [%d]", each.description, w.Code)
+		}
+		if each.status != http.StatusOK {
+			if err == nil {
+				t.Errorf("Expected an error for %s", each.description)
+			}
+			hasError(t, w, each.status, APIError{Code: CodeInvalidToken, Message: each.message})
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", each.description, err)
+			continue
+		}
+		if account.Name != "someone" {
+			t.Errorf("Expected the account to be taken from the subject for %s, got [%s]", each.description, account.Name)
+		}
+		if account.Admin != each.admin {
+			t.Errorf("Expected account.Admin to be %v for %s", each.admin, each.description)
+		}
+	}
+}
+
+func TestAuthenticateBearerWithoutJWTSecret(t *testing.T) {
+	token, err := SignJWT(JWTClaims{Subject: "someone"}, []byte("sekrit"))
+	if err != nil {
+		t.Fatalf("Unable to sign token: %v", err)
+	}
+	r, w := setupAuthRecorder(t, "", "")
+	r.Header.Set("Authorization", "Bearer "+token)
+	c := &Context{
+		Storage:     NullStorage{},
+		AuthService: NullAuthService{},
+	}
+
+	if _, err := Authenticate(c, w, r); err == nil {
+		t.Error("Expected bearer tokens to be refused when no JWT secret is configured.")
+	}
+
+	hasError(t, w, http.StatusUnauthorized, APIError{
+		Code:    CodeCredentialsMissing,
+		Message: "You must authenticate.",
+	})
+}
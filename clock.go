@@ -0,0 +1,23 @@
+package main
+
+import "time"
+
+// Clock provides the current time and timers, so that time-dependent code can be tested without
+// real delays.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// RealClock is a Clock that uses the system time.
+type RealClock struct{}
+
+// Now returns the current system time.
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
+
+// After waits for a duration of real time to elapse.
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -12,9 +12,49 @@ const (
 	CodeCredentialsIncorrect = "AFAIL"
 	// CodeAuthServiceConnection means the auth service could not be reached.
 	CodeAuthServiceConnection = "ACONN"
+	// CodeInvalidToken means a bearer token was present, but was malformed, expired, or not signed
+	// by a trusted issuer.
+	CodeInvalidToken = "ATOKEN"
+	// CodeAccountSuspended means valid credentials were provided for an account that has been
+	// suspended.
+	CodeAccountSuspended = "ASUSP"
+	// CodeAccountExpired means valid credentials were provided for an account whose expiration time
+	// has passed.
+	CodeAccountExpired = "AEXP"
+	// CodeAccountDeactivated means valid credentials were provided for an account that an
+	// administrator has deactivated.
+	CodeAccountDeactivated = "AINACT"
+	// CodeAdminRequired means a request that requires an administrator was made by another account.
+	CodeAdminRequired = "AADMIN"
+	// CodeAccountNotFound means that an action was attempted on an account that doesn't exist.
+	CodeAccountNotFound = "ANF"
+	// CodeAccountExists means that an account couldn't be created because its name is already taken.
+	CodeAccountExists = "AEXISTS"
+	// CodeAccountUpdateFailure means that an update to an existing account could not be performed.
+	CodeAccountUpdateFailure = "AUPD"
+	// CodeInvalidAccountForm means that a POST body for an account update contained invalid values.
+	CodeInvalidAccountForm = "AFRM"
 
 	// CodeMethodNotSupported means a request was made against a resource with an unsupported method.
 	CodeMethodNotSupported = "MINVAL"
+	// CodeUnsupportedMediaType means a request body that must be JSON had a different Content-Type.
+	CodeUnsupportedMediaType = "RMEDIA"
+	// CodeRequestTooLarge means a request body was larger than the server accepts.
+	CodeRequestTooLarge = "RSIZE"
+	// CodeRateLimited means an account has made too many requests in a short period of time.
+	CodeRateLimited = "RLIMIT"
+	// CodeQuotaExceeded means an account already has as many jobs queued as its quota allows.
+	CodeQuotaExceeded = "QUOTA"
+	// CodeServiceUnavailable means that a dependency of the API, like storage or Docker, is unreachable.
+	CodeServiceUnavailable = "UNAVAIL"
+	// CodeSchemaVersionFailure means that the current schema version could not be read from storage.
+	CodeSchemaVersionFailure = "SCHEMA"
+	// CodeMigrationInProgress means that a schema migration was requested while another was running.
+	CodeMigrationInProgress = "SBUSY"
+	// CodeMigrationFailure means that a schema migration could not be started.
+	CodeMigrationFailure = "SMIGR"
+	// CodeMigrationNotFound means that progress was requested for a migration that doesn't exist.
+	CodeMigrationNotFound = "SNF"
 	// CodeUnableToParseQuery means a request contained a malformed query string.
 	CodeUnableToParseQuery = "QINVAL"
 
@@ -24,18 +64,82 @@ const (
 	CodeInvalidJobForm = "JFRM"
 	// CodeMissingCommand means a job is missing a "cmd" element.
 	CodeMissingCommand = "JCMD"
+	// CodeInvalidMulticore means a job requested a zero or negative number of cores.
+	CodeInvalidMulticore = "JMCORE"
+	// CodeInvalidMaxRuntime means a job specified a negative maximum runtime.
+	CodeInvalidMaxRuntime = "JMAXRT"
+	// CodeInvalidMaxOutputSize means a job specified a negative maximum output size.
+	CodeInvalidMaxOutputSize = "JMAXOUT"
+	// CodeInvalidResultTTL means a job specified a negative result TTL.
+	CodeInvalidResultTTL = "JRTTL"
+	// CodeInvalidMaxRetries means a job specified a maximum number of retries below -1.
+	CodeInvalidMaxRetries = "JRETRIES"
+	// CodeInvalidEnvironment means a job specified an environment variable with an invalid name.
+	CodeInvalidEnvironment = "JENV"
+	// CodeInvalidAffinityLabel means a job's "affinity_label" element was not of the form key=value.
+	CodeInvalidAffinityLabel = "JAFFIN"
+	// CodeTemplateExpansionError means a job's "cmd" was a malformed template or referred to a tag
+	// that the job doesn't have.
+	CodeTemplateExpansionError = "JTMPL"
+	// CodeInvalidDependency means a job's "depends_on" element was not a valid JID.
+	CodeInvalidDependency = "JDEP"
 	// CodeInvalidResultSource means a job has an invalid result source.
 	CodeInvalidResultSource = "JRSRC"
+	// CodeConflictingResultSource means a job specified both a "result_source" and a "result_path".
+	CodeConflictingResultSource = "JRPATH"
 	// CodeInvalidResultType means a job has an invalid result type.
 	CodeInvalidResultType = "JRTYPE"
+	// CodeCoreNotPermitted means a job requested a core that its account isn't allowed to use.
+	CodeCoreNotPermitted = "JCORE"
+	// CodeImageNotPermitted means a job requested an image that its account isn't allowed to use.
+	CodeImageNotPermitted = "JIMG"
+	// CodeUnknownVolume means a job requested a volume that hasn't been registered.
+	CodeUnknownVolume = "JVOL"
+	// CodeContainerConflict means a running container already has the name of a job's container.
+	CodeContainerConflict = "JCONT"
+	// CodeWebSocketRequired means a request to a streaming endpoint wasn't a valid WebSocket handshake.
+	CodeWebSocketRequired = "JWS"
 	// CodeEnqueueFailure means a job could not be enqueued in the storage engine.
 	CodeEnqueueFailure = "JQUEUE"
 	// CodeListFailure means that a query for jobs could not be performed by storage engine.
 	CodeListFailure = "JLIST"
+	// CodeInvalidWaitOptions means a submit-and-wait request had an invalid poll interval or timeout.
+	CodeInvalidWaitOptions = "JWAIT"
+	// CodeDuplicateJobName means a job was submitted with the name of one of the account's incomplete
+	// jobs while unique job names are enforced.
+	CodeDuplicateJobName = "JDUPNAME"
+	// CodeIdempotencyKeyInUse means a job was submitted with an idempotency key that another submission
+	// is still using to create its job.
+	CodeIdempotencyKeyInUse = "JIDEM"
+	// CodeJobNoResult means a job's result was requested, but the job didn't complete successfully.
+	CodeJobNoResult = "JNORESULT"
 	// CodeJobKillFailure means that a job's container was unable to be killed.
 	CodeJobKillFailure = "JKILL"
 	// CodeJobUpdateFailure means that an update to an existing job was unable to be performed.
 	CodeJobUpdateFailure = "JUPD"
 	// CodeJobNotFound means that an action was attempted on a job that doesn't exist.
 	CodeJobNotFound = "JNF"
+	// CodeBatchTooLarge means that a single request attempted to submit too many jobs at once.
+	CodeBatchTooLarge = "JBATCH"
+	// CodeInsufficientCredits means that an account without any remaining credits attempted to submit
+	// a job.
+	CodeInsufficientCredits = "JCRED"
+	// CodeInvalidJobStatus means that a job query specified a status that doesn't exist.
+	CodeInvalidJobStatus = "JSTAT"
+	// CodeJobNotRetryable means that a retry was requested for a job that hasn't failed.
+	CodeJobNotRetryable = "JRETRY"
+	// CodeRunNotFound means that a run was requested that has no jobs.
+	CodeRunNotFound = "JRUNNF"
+
+	// CodeInvalidConfigMapJSON means a POST body to /configmaps was not parseable JSON.
+	CodeInvalidConfigMapJSON = "CPRS"
+	// CodeMissingConfigMapName means a config map is missing a "name" element.
+	CodeMissingConfigMapName = "CNAME"
+	// CodeConfigMapTooLarge means a config map entry, or the config map as a whole, is too large.
+	CodeConfigMapTooLarge = "CSIZE"
+	// CodeConfigMapSaveFailure means a config map could not be saved by the storage engine.
+	CodeConfigMapSaveFailure = "CSAVE"
+	// CodeConfigMapListFailure means a query for config maps could not be performed by the storage
+	// engine.
+	CodeConfigMapListFailure = "CLIST"
 )
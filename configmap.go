@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// maxConfigMapEntrySize is the largest permitted size of a single file within a ConfigMap, in
+	// bytes.
+	maxConfigMapEntrySize = 1 << 20
+
+	// maxConfigMapSize is the largest permitted combined size of all files within a ConfigMap, in
+	// bytes.
+	maxConfigMapSize = 10 << 20
+)
+
+// ConfigMap is a named collection of configuration files owned by an account.
+type ConfigMap struct {
+	Name  string            `json:"name" bson:"name"`
+	Owner string            `json:"-" bson:"owner"`
+	Data  map[string]string `json:"data" bson:"data"`
+}
+
+// Validate ensures that a ConfigMap is named and that its contents are within the size limits.
+func (m ConfigMap) Validate() *APIError {
+	if m.Name == "" {
+		return &APIError{
+			Code:    CodeMissingConfigMapName,
+			Message: "All config maps must have a name.",
+			Hint:    `Specify a "name" element in your config map.`,
+		}
+	}
+
+	total := 0
+	for filename, content := range m.Data {
+		if len(content) > maxConfigMapEntrySize {
+			return &APIError{
+				Code:    CodeConfigMapTooLarge,
+				Message: fmt.Sprintf("Config map entry [%s] is too large: [%d] bytes", filename, len(content)),
+				Hint:    fmt.Sprintf("Each entry must be at most %d bytes.", maxConfigMapEntrySize),
+			}
+		}
+		total += len(content)
+	}
+
+	if total > maxConfigMapSize {
+		return &APIError{
+			Code:    CodeConfigMapTooLarge,
+			Message: fmt.Sprintf("Config map [%s] is too large: [%d] bytes", m.Name, total),
+			Hint:    fmt.Sprintf("The combined size of all entries must be at most %d bytes.", maxConfigMapSize),
+		}
+	}
+
+	return nil
+}
+
+// ConfigMapHandler dispatches API calls to /configmaps based on request type.
+func ConfigMapHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		ConfigMapListHandler(c, w, r)
+	case "POST":
+		ConfigMapCreateHandler(c, w, r)
+	default:
+		APIError{
+			Code:    CodeMethodNotSupported,
+			Message: "Method not supported",
+			Hint:    "Use GET or POST against this endpoint.",
+			Retry:   false,
+		}.Report(http.StatusMethodNotAllowed, w)
+	}
+}
+
+// ConfigMapListHandler lists all of the config maps owned by the authenticated account.
+func ConfigMapListHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "configmap.list")
+
+	maps, err := c.ListConfigMaps(account.Name)
+	if err != nil {
+		APIError{
+			Code:    CodeConfigMapListFailure,
+			Message: fmt.Sprintf("Unable to list config maps: %v", err),
+			Hint:    "This is most likely a database problem.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusServiceUnavailable, w)
+		return
+	}
+
+	var response struct {
+		ConfigMaps []ConfigMap `json:"configmaps"`
+	}
+	response.ConfigMaps = maps
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ConfigMapCreateHandler creates a new config map owned by the authenticated account, or replaces
+// the contents of an existing one with the same name.
+func ConfigMapCreateHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	account, err := Authenticate(c, w, r)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, account, "configmap.create")
+
+	var m ConfigMap
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		APIError{
+			Code:    CodeInvalidConfigMapJSON,
+			Message: fmt.Sprintf("Unable to parse config map payload as JSON: %v", err),
+			Hint:    "Please supply valid JSON in your request.",
+			Retry:   false,
+		}.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+	m.Owner = account.Name
+
+	if err := m.Validate(); err != nil {
+		err.Log(account).Report(http.StatusBadRequest, w)
+		return
+	}
+
+	if err := c.SaveConfigMap(m); err != nil {
+		APIError{
+			Code:    CodeConfigMapSaveFailure,
+			Message: fmt.Sprintf("Unable to save config map: %v", err),
+			Hint:    "This is most likely a database problem.",
+			Retry:   true,
+		}.Log(account).Report(http.StatusServiceUnavailable, w)
+		return
+	}
+
+	log.WithFields(log.Fields{
+		"account":   account.Name,
+		"configmap": m.Name,
+		"entries":   len(m.Data),
+	}).Info("Config map saved.")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// ConfigMapStorage is a fake Storage implementation that only provides config map storage methods.
+type ConfigMapStorage struct {
+	NullStorage
+
+	Saved []ConfigMap
+	Owner string
+}
+
+func (storage *ConfigMapStorage) ListConfigMaps(owner string) ([]ConfigMap, error) {
+	storage.Owner = owner
+
+	return []ConfigMap{
+		{Name: "first", Owner: owner, Data: map[string]string{"a.cfg": "a"}},
+		{Name: "second", Owner: owner, Data: map[string]string{"b.cfg": "b"}},
+	}, nil
+}
+
+func (storage *ConfigMapStorage) SaveConfigMap(m ConfigMap) error {
+	storage.Saved = append(storage.Saved, m)
+	return nil
+}
+
+func configMapRequest(t *testing.T, method, body string) (*httptest.ResponseRecorder, *ConfigMapStorage) {
+	s := &ConfigMapStorage{}
+	c := &Context{
+		Settings: Settings{
+			AdminName: "admin",
+			AdminKey:  "12345",
+		},
+		Storage: s,
+	}
+
+	return serveRequest(t, c, ConfigMapHandler, "admin", method, "/v1/configmaps", body), s
+}
+
+func TestCreateConfigMap(t *testing.T) {
+	w, s := configMapRequest(t, "POST", `
+	{
+		"name": "settings",
+		"data": {
+			"app.ini": "[main]\nverbose = true\n",
+			"hosts": "127.0.0.1 localhost\n"
+		}
+	}
+	`)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+
+	if len(s.Saved) != 1 {
+		t.Fatalf("Expected one config map to be saved, got [%d]", len(s.Saved))
+	}
+	saved := s.Saved[0]
+	if saved.Name != "settings" {
+		t.Errorf("Unexpected config map name: [%s]", saved.Name)
+	}
+	if saved.Owner != "admin" {
+		t.Errorf("Expected config map to belong to admin, not [%s]", saved.Owner)
+	}
+	if len(saved.Data) != 2 {
+		t.Errorf("Expected two config map entries, got [%d]", len(saved.Data))
+	}
+	if hosts := saved.Data["hosts"]; hosts != "127.0.0.1 localhost\n" {
+		t.Errorf("Unexpected content for hosts entry: [%s]", hosts)
+	}
+}
+
+func TestCreateConfigMapMissingName(t *testing.T) {
+	w, s := configMapRequest(t, "POST", `{"data": {"a": "b"}}`)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeMissingConfigMapName,
+		Message: "All config maps must have a name.",
+		Retry:   false,
+	})
+	if len(s.Saved) != 0 {
+		t.Errorf("Expected no config maps to be saved, got [%d]", len(s.Saved))
+	}
+}
+
+func TestCreateConfigMapEntryTooLarge(t *testing.T) {
+	large := strings.Repeat("x", maxConfigMapEntrySize+1)
+	w, s := configMapRequest(t, "POST", fmt.Sprintf(`{"name": "big", "data": {"huge.txt": "%s"}}`, large))
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeConfigMapTooLarge,
+		Message: fmt.Sprintf("Config map entry [huge.txt] is too large: [%d] bytes", maxConfigMapEntrySize+1),
+		Retry:   false,
+	})
+	if len(s.Saved) != 0 {
+		t.Errorf("Expected no config maps to be saved, got [%d]", len(s.Saved))
+	}
+}
+
+func TestCreateConfigMapTooLarge(t *testing.T) {
+	entries := make([]string, 11)
+	for i := range entries {
+		entries[i] = fmt.Sprintf(`"file%d": "%s"`, i, strings.Repeat("x", maxConfigMapEntrySize))
+	}
+	body := fmt.Sprintf(`{"name": "big", "data": {%s}}`, strings.Join(entries, ","))
+
+	w, _ := configMapRequest(t, "POST", body)
+
+	hasError(t, w, http.StatusBadRequest, APIError{
+		Code:    CodeConfigMapTooLarge,
+		Message: fmt.Sprintf("Config map [big] is too large: [%d] bytes", 11*maxConfigMapEntrySize),
+		Retry:   false,
+	})
+}
+
+func TestListConfigMaps(t *testing.T) {
+	w, s := configMapRequest(t, "GET", "")
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+	}
+	if s.Owner != "admin" {
+		t.Errorf("Expected config maps to be listed for admin, not [%s]", s.Owner)
+	}
+
+	var response struct {
+		ConfigMaps []ConfigMap `json:"configmaps"`
+	}
+	out := w.Body.Bytes()
+	if err := json.Unmarshal(out, &response); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", string(out))
+	}
+
+	if len(response.ConfigMaps) != 2 {
+		t.Fatalf("Unexpected number of config maps returned: [%d]", len(response.ConfigMaps))
+	}
+	for i, expected := range []string{"first", "second"} {
+		if name := response.ConfigMaps[i].Name; name != expected {
+			t.Errorf("Expected config map %d to be named [%s], got [%s]", i, expected, name)
+		}
+	}
+}
@@ -3,11 +3,16 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/kelseyhightower/envconfig"
@@ -26,6 +31,29 @@ type Context struct {
 	// Shared clients.
 	HTTPS       *http.Client
 	AuthService AuthService
+
+	// Output delivers output from running jobs to streaming clients.
+	Output *OutputBroker
+
+	// Migrations tracks schema migrations that were started through the API.
+	Migrations *MigrationTracker
+
+	// Audit records the actions taken by authenticated accounts. Events are discarded if it's nil.
+	Audit *AuditLogger
+
+	// Clock provides the current time to the runner. The system clock is used if it's nil.
+	Clock Clock
+
+	// InFlight counts the jobs that this process is currently executing.
+	InFlight sync.WaitGroup
+
+	// Ready is set to 1 once the runner has completed its first successful claim cycle. Access it
+	// with atomic.LoadInt32 and atomic.StoreInt32.
+	Ready int32
+
+	// SubmitLimiter limits how quickly each account may submit jobs. It's nil if submissions aren't
+	// rate limited.
+	SubmitLimiter *RateLimiter
 }
 
 // Settings contains configuration options loaded from the environment.
@@ -44,17 +72,104 @@ type Settings struct {
 	Image       string
 	Poll        int
 	AuthService string
+	AuthMode    string
+	AuthSecret  string
+
+	// PostgresDSN selects PostgreSQL storage instead of MongoDB when it's set.
+	PostgresDSN string
+
+	// ImagePullPolicy controls when the default Image is pulled from its registry: before every
+	// runner loop ("always"), only if it's missing from the Docker host ("ifnotpresent"), or not at
+	// all ("never").
+	ImagePullPolicy string
+
+	// JWTSecret enables authentication with HS256-signed JWT bearer tokens. If JWTIssuer is set,
+	// tokens must also carry a matching "iss" claim.
+	JWTSecret string
+	JWTIssuer string
+
+	MaxJobsPerRequest int
+
+	// CacheTTL is the number of seconds for which a completed job's result may be reused by jobs
+	// submitted with the same cache key, unless the job sets its own ResultTTL. Zero means that cached
+	// results never expire.
+	CacheTTL int
+
+	// IdempotencyTTL is the number of seconds for which a job's idempotency key is remembered. A job
+	// resubmitted with the same key within that window returns the original JID.
+	IdempotencyTTL int
+
+	// EnforceUniqueJobNames rejects a named job if the same account already has an incomplete job
+	// with that name, so that clients can use job names as idempotency keys.
+	EnforceUniqueJobNames bool
+
+	CostPerNanosecond int64
+	MaxRetries        int
+
+	// DefaultMaxConcurrentJobs limits the number of jobs that each account may run at once, unless
+	// the account has its own limit. Zero means that there's no limit.
+	DefaultMaxConcurrentJobs int
+
+	// MaxStdout and MaxStderr limit the bytes of each stream retained for each job. Zero means that
+	// there's no limit.
+	MaxStdout int
+	MaxStderr int
+
+	// OutputFlushInterval is the minimum time, in milliseconds, between writes of a running job's
+	// output to storage.
+	OutputFlushInterval int
+
+	// MaxWorkers limits the number of jobs that run at once across the whole cluster. Zero means that
+	// there's no limit. If PreemptionEnabled is set, a queued job may preempt a running job with a
+	// lower priority when every worker is busy.
+	MaxWorkers        int
+	PreemptionEnabled bool
+
+	// RunnerID identifies this process's job runner. It defaults to the hostname. If
+	// WorkStealingEnabled is set, a runner with nothing to claim restarts jobs that other runners
+	// started but have been running for more than twice their maximum runtime. The original runner
+	// stops its copy of a stolen job once it notices.
+	RunnerID            string
+	WorkStealingEnabled bool
+
+	// StalledJobTTL is the number of seconds that a stalled job remains in the active jobs collection
+	// before it's archived.
+	StalledJobTTL int
+
+	// AuditLog is the path of the file that audit events are appended to. Audit events are written
+	// to stdout if it's empty.
+	AuditLog string
+
+	// MaxRequestBodyBytes limits the size of a job submission's request body.
+	MaxRequestBodyBytes int64
+
+	// SubmitRateLimit is the number of jobs that each account may submit per minute. Zero means that
+	// there's no limit.
+	SubmitRateLimit int
+
+	// AllowedImages is loaded from a comma-separated PIPE_ALLOWEDIMAGES variable. The default Image
+	// is always allowed. Lists are parsed by Load rather than by envconfig.
+	AllowedImages []string `ignored:"true"`
+
+	// AllowedOrigins is loaded from a comma-separated PIPE_ALLOWEDORIGINS variable. It lists the
+	// origins of browser-based clients that may call the API, or "*" for any origin. CORS is disabled
+	// if it's empty.
+	AllowedOrigins []string `ignored:"true"`
 }
 
 // NewContext loads the active configuration and applies any immediate, global settings like the
 // logging level.
 func NewContext() (*Context, error) {
-	c := &Context{}
+	c := &Context{Clock: RealClock{}, Output: NewOutputBroker(), Migrations: NewMigrationTracker()}
 
 	if err := c.Load(); err != nil {
 		return c, err
 	}
 
+	if c.SubmitRateLimit > 0 {
+		c.SubmitLimiter = NewRateLimiter(c.SubmitRateLimit, time.Minute, c.Clock)
+	}
+
 	// Configure the logging level and formatter.
 
 	level, err := log.ParseLevel(c.LogLevel)
@@ -67,22 +182,55 @@ func NewContext() (*Context, error) {
 		ForceColors: c.LogColors,
 	})
 
+	// Direct audit events to their own stream.
+
+	auditOut := io.Writer(os.Stdout)
+	if c.AuditLog != "" {
+		auditOut, err = os.OpenFile(c.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return c, err
+		}
+	}
+	c.Audit = NewAuditLogger(auditOut, c.Clock)
+
 	// Summarize the loaded settings.
 
 	log.WithFields(log.Fields{
-		"port":               c.Port,
-		"logging level":      c.LogLevel,
-		"log with color":     c.LogColors,
-		"mongo URL":          c.MongoURL,
-		"admin account":      c.AdminName,
-		"docker host":        c.DockerHost,
-		"docker TLS enabled": c.DockerTLS,
-		"CA cert":            c.CACert,
-		"cert":               c.Cert,
-		"key":                c.Key,
-		"default layer":      c.Image,
-		"polling interval":   c.Poll,
-		"auth service":       c.Settings.AuthService,
+		"port":                c.Port,
+		"logging level":       c.LogLevel,
+		"log with color":      c.LogColors,
+		"mongo URL":           c.MongoURL,
+		"postgres enabled":    c.PostgresDSN != "",
+		"admin account":       c.AdminName,
+		"docker host":         c.DockerHost,
+		"docker TLS enabled":  c.DockerTLS,
+		"CA cert":             c.CACert,
+		"cert":                c.Cert,
+		"key":                 c.Key,
+		"default layer":       c.Image,
+		"image pull policy":   c.ImagePullPolicy,
+		"polling interval":    c.Poll,
+		"auth service":        c.Settings.AuthService,
+		"auth mode":           c.AuthMode,
+		"JWT enabled":         c.JWTSecret != "",
+		"JWT issuer":          c.JWTIssuer,
+		"max jobs/request":    c.MaxJobsPerRequest,
+		"unique job names":    c.EnforceUniqueJobNames,
+		"cache TTL":           c.CacheTTL,
+		"idempotency TTL":     c.IdempotencyTTL,
+		"audit log":           c.AuditLog,
+		"allowed images":      c.AllowedImages,
+		"allowed origins":     c.AllowedOrigins,
+		"cost/nanosecond":     c.CostPerNanosecond,
+		"max retries":         c.MaxRetries,
+		"max concurrent jobs": c.DefaultMaxConcurrentJobs,
+		"max request body":    c.MaxRequestBodyBytes,
+		"submit rate limit":   c.SubmitRateLimit,
+		"stalled job TTL":     c.StalledJobTTL,
+		"max workers":         c.MaxWorkers,
+		"preemption enabled":  c.PreemptionEnabled,
+		"runner ID":           c.RunnerID,
+		"work stealing":       c.WorkStealingEnabled,
 	}).Info("Initializing with loaded settings.")
 
 	// Configure a HTTP(S) client to use the provided TLS credentials.
@@ -111,38 +259,36 @@ func NewContext() (*Context, error) {
 	transport := &http.Transport{TLSClientConfig: tlsConfig}
 	c.HTTPS = &http.Client{Transport: transport}
 
-	// Connect to MongoDB.
+	// Connect to PostgreSQL if it's configured, or MongoDB otherwise.
 
-	c.Storage, err = NewMongoStorage(c)
+	if c.PostgresDSN != "" {
+		c.Storage, err = NewPostgresStorage(c)
+	} else {
+		c.Storage, err = NewMongoStorage(c)
+	}
 	if err != nil {
 		return c, err
 	}
 	if err := c.Storage.Bootstrap(); err != nil {
 		return c, err
 	}
+	if err := MigrateSchemaLocked(c.Storage, c.clock()); err != nil {
+		return c, err
+	}
 
 	// Connect to Docker.
 
-	if c.DockerTLS {
-		c.Docker, err = docker.NewTLSClient(c.DockerHost, c.Cert, c.Key, c.CACert)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"docker host": c.DockerHost,
-			}).Fatal("Unable to connect to Docker with TLS.")
-			return c, err
-		}
-	} else {
-		c.Docker, err = docker.NewClient(c.DockerHost)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"docker host": c.DockerHost,
-				"error":       err,
-			}).Error("Unable to connect to Docker.")
-			return c, err
-		}
+	c.Docker, err = c.ConnectToDocker()
+	if err != nil {
+		return c, err
 	}
 
 	// Initialize an appropriate authentication service.
+	if c.AuthMode == AuthModeHMAC {
+		c.AuthService = HMACAuthService{Secret: []byte(c.AuthSecret)}
+		return c, nil
+	}
+
 	c.AuthService, err = ConnectToAuthService(c, c.Settings.AuthService)
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -155,8 +301,24 @@ func NewContext() (*Context, error) {
 	return c, nil
 }
 
+// envList splits the comma-separated list in the environment variable name into its non-empty,
+// whitespace-trimmed elements. It returns nil if the variable is unset or empty.
+func envList(name string) []string {
+	var list []string
+	for _, element := range strings.Split(os.Getenv(name), ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+	return list
+}
+
 // Load configuration settings from the environment, apply defaults, and validate them.
 func (c *Context) Load() error {
+	// Zero is a meaningful number of retries, so its default is applied before the environment is
+	// read rather than in place of a zero value.
+	c.MaxRetries = 3
+
 	if err := envconfig.Process("PIPE", &c.Settings); err != nil {
 		return err
 	}
@@ -177,6 +339,40 @@ func (c *Context) Load() error {
 		c.Poll = 500
 	}
 
+	if c.MaxJobsPerRequest == 0 {
+		c.MaxJobsPerRequest = 100
+	}
+
+	if c.RunnerID == "" {
+		if hostname, err := os.Hostname(); err == nil {
+			c.RunnerID = hostname
+		}
+	}
+
+	if c.StalledJobTTL == 0 {
+		c.StalledJobTTL = 24 * 60 * 60
+	}
+
+	if c.IdempotencyTTL == 0 {
+		c.IdempotencyTTL = 24 * 60 * 60
+	}
+
+	if c.MaxRequestBodyBytes == 0 {
+		c.MaxRequestBodyBytes = 4 << 20
+	}
+
+	if c.MaxStdout == 0 {
+		c.MaxStdout = 1 << 20
+	}
+
+	if c.MaxStderr == 0 {
+		c.MaxStderr = 1 << 20
+	}
+
+	if c.OutputFlushInterval == 0 {
+		c.OutputFlushInterval = 1000
+	}
+
 	if c.DockerHost == "" {
 		if host := os.Getenv("DOCKER_HOST"); host != "" {
 			c.DockerHost = host
@@ -206,10 +402,39 @@ func (c *Context) Load() error {
 		c.Image = "cloudpipe/runner-py2"
 	}
 
+	if c.ImagePullPolicy == "" {
+		c.ImagePullPolicy = PullNever
+	}
+	if c.ImagePullPolicy != PullAlways && c.ImagePullPolicy != PullIfNotPresent && c.ImagePullPolicy != PullNever {
+		return fmt.Errorf("unrecognized image pull policy [%s]: must be %q, %q, or %q",
+			c.ImagePullPolicy, PullAlways, PullIfNotPresent, PullNever)
+	}
+
+	if images := envList("PIPE_ALLOWEDIMAGES"); len(images) > 0 {
+		c.AllowedImages = []string{c.Image}
+		for _, image := range images {
+			if image != c.Image {
+				c.AllowedImages = append(c.AllowedImages, image)
+			}
+		}
+	}
+
+	c.AllowedOrigins = envList("PIPE_ALLOWEDORIGINS")
+
 	if c.Settings.AuthService == "" {
 		c.Settings.AuthService = "https://authstore:9001/v1"
 	}
 
+	if c.AuthMode == "" {
+		c.AuthMode = AuthModeExternal
+	}
+	if c.AuthMode != AuthModeExternal && c.AuthMode != AuthModeHMAC {
+		return fmt.Errorf("unrecognized auth mode [%s]: must be %q or %q", c.AuthMode, AuthModeExternal, AuthModeHMAC)
+	}
+	if c.AuthMode == AuthModeHMAC && c.AuthSecret == "" {
+		return errors.New("an auth secret is required to use HMAC authentication")
+	}
+
 	if _, err := log.ParseLevel(c.LogLevel); err != nil {
 		return err
 	}
@@ -217,7 +442,60 @@ func (c *Context) Load() error {
 	return nil
 }
 
+// newDockerClient and newDockerTLSClient create Docker clients. They're only variables so that tests
+// can substitute fakes.
+var (
+	newDockerClient = func(endpoint string) (Docker, error) {
+		return docker.NewClient(endpoint)
+	}
+	newDockerTLSClient = func(endpoint, cert, key, ca string) (Docker, error) {
+		return docker.NewTLSClient(endpoint, cert, key, ca)
+	}
+)
+
+// ConnectToDocker creates a client for the configured Docker host. Docker is reached directly over a
+// "unix://" socket, without TLS, even if DockerTLS is set.
+func (c *Context) ConnectToDocker() (Docker, error) {
+	if strings.HasPrefix(c.DockerHost, "unix://") {
+		client, err := newDockerClient(c.DockerHost)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"docker socket": c.DockerHost,
+				"error":         err,
+			}).Error("Unable to connect to the Docker socket.")
+		}
+		return client, err
+	}
+
+	if c.DockerTLS {
+		client, err := newDockerTLSClient(c.DockerHost, c.Cert, c.Key, c.CACert)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"docker host": c.DockerHost,
+			}).Fatal("Unable to connect to Docker with TLS.")
+		}
+		return client, err
+	}
+
+	client, err := newDockerClient(c.DockerHost)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"docker host": c.DockerHost,
+			"error":       err,
+		}).Error("Unable to connect to Docker.")
+	}
+	return client, err
+}
+
 // ListenAddr generates an address to bind the net/http server to based on the current settings.
 func (c *Context) ListenAddr() string {
 	return fmt.Sprintf(":%d", c.Port)
 }
+
+// clock returns the Context's Clock, falling back to the system clock if none has been set.
+func (c *Context) clock() Clock {
+	if c.Clock == nil {
+		return RealClock{}
+	}
+	return c.Clock
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -22,6 +23,20 @@ func TestLoadFromEnvironment(t *testing.T) {
 	os.Setenv("PIPE_CERT", "/lockbox/cert.pem")
 	os.Setenv("PIPE_KEY", "/lockbox/key.pem")
 	os.Setenv("PIPE_AUTHSERVICE", "https://auth")
+	os.Setenv("PIPE_JWTSECRET", "sekrit")
+	os.Setenv("PIPE_JWTISSUER", "https://auth.example.com")
+	os.Setenv("PIPE_MAXJOBSPERREQUEST", "25")
+	os.Setenv("PIPE_MAXRETRIES", "5")
+	os.Setenv("PIPE_MAXREQUESTBODYBYTES", "1024")
+	os.Setenv("PIPE_SUBMITRATELIMIT", "60")
+	os.Setenv("PIPE_STALLEDJOBTTL", "3600")
+	os.Setenv("PIPE_IDEMPOTENCYTTL", "600")
+	os.Setenv("PIPE_DEFAULTMAXCONCURRENTJOBS", "4")
+	os.Setenv("PIPE_MAXSTDOUT", "2048")
+	os.Setenv("PIPE_MAXSTDERR", "4096")
+	os.Setenv("PIPE_OUTPUTFLUSHINTERVAL", "250")
+	os.Setenv("PIPE_ALLOWEDIMAGES", "cloudpipe/runner-py3, cloudpipe/runner-r")
+	os.Setenv("PIPE_ALLOWEDORIGINS", "https://a.example.com, https://b.example.com")
 
 	if err := c.Load(); err != nil {
 		t.Errorf("Error loading configuration: %v", err)
@@ -82,6 +97,61 @@ func TestLoadFromEnvironment(t *testing.T) {
 	if c.Settings.AuthService != "https://auth" {
 		t.Errorf("Unexpected authentication service URL: [%s]", c.AuthService)
 	}
+
+	if c.MaxJobsPerRequest != 25 {
+		t.Errorf("Unexpected maximum jobs per request: [%d]", c.MaxJobsPerRequest)
+	}
+
+	if c.MaxRetries != 5 {
+		t.Errorf("Unexpected maximum retries: [%d]", c.MaxRetries)
+	}
+
+	if c.MaxRequestBodyBytes != 1024 {
+		t.Errorf("Unexpected maximum request body size: [%d]", c.MaxRequestBodyBytes)
+	}
+
+	if c.StalledJobTTL != 3600 {
+		t.Errorf("Unexpected stalled job TTL: [%d]", c.StalledJobTTL)
+	}
+
+	if c.IdempotencyTTL != 600 {
+		t.Errorf("Unexpected idempotency TTL: [%d]", c.IdempotencyTTL)
+	}
+
+	if c.SubmitRateLimit != 60 {
+		t.Errorf("Unexpected submission rate limit: [%d]", c.SubmitRateLimit)
+	}
+
+	if c.JWTSecret != "sekrit" || c.JWTIssuer != "https://auth.example.com" {
+		t.Errorf("Unexpected JWT secret [%s] and issuer [%s]", c.JWTSecret, c.JWTIssuer)
+	}
+
+	if c.DefaultMaxConcurrentJobs != 4 {
+		t.Errorf("Unexpected default maximum concurrent jobs: [%d]", c.DefaultMaxConcurrentJobs)
+	}
+
+	if c.MaxStdout != 2048 || c.MaxStderr != 4096 {
+		t.Errorf("Unexpected output limits: stdout [%d], stderr [%d]", c.MaxStdout, c.MaxStderr)
+	}
+
+	if c.OutputFlushInterval != 250 {
+		t.Errorf("Unexpected output flush interval: [%d]", c.OutputFlushInterval)
+	}
+
+	expectedImages := []string{"cloudpipe/runner-py2", "cloudpipe/runner-py3", "cloudpipe/runner-r"}
+	if len(c.AllowedImages) != len(expectedImages) {
+		t.Fatalf("Unexpected allowed images: [%v]", c.AllowedImages)
+	}
+	for i, expected := range expectedImages {
+		if c.AllowedImages[i] != expected {
+			t.Errorf("Expected allowed image %d to be [%s], got [%s]", i, expected, c.AllowedImages[i])
+		}
+	}
+
+	expectedOrigins := []string{"https://a.example.com", "https://b.example.com"}
+	if !reflect.DeepEqual(c.AllowedOrigins, expectedOrigins) {
+		t.Errorf("Unexpected allowed origins: [%v]", c.AllowedOrigins)
+	}
 }
 
 func TestDefaultValues(t *testing.T) {
@@ -104,6 +174,21 @@ func TestDefaultValues(t *testing.T) {
 	os.Setenv("DOCKER_CERT_PATH", "")
 	os.Setenv("PIPE_IMAGE", "")
 	os.Setenv("PIPE_AUTHSERVICE", "")
+	os.Setenv("PIPE_JWTSECRET", "")
+	os.Setenv("PIPE_JWTISSUER", "")
+	os.Setenv("PIPE_MAXJOBSPERREQUEST", "")
+	os.Setenv("PIPE_MAXRETRIES", "")
+	os.Setenv("PIPE_MAXREQUESTBODYBYTES", "")
+	os.Setenv("PIPE_SUBMITRATELIMIT", "")
+	os.Setenv("PIPE_STALLEDJOBTTL", "")
+	os.Setenv("PIPE_IDEMPOTENCYTTL", "")
+	os.Setenv("PIPE_DEFAULTMAXCONCURRENTJOBS", "")
+	os.Setenv("PIPE_MAXSTDOUT", "")
+	os.Setenv("PIPE_MAXSTDERR", "")
+	os.Setenv("PIPE_OUTPUTFLUSHINTERVAL", "")
+	os.Setenv("PIPE_ALLOWEDIMAGES", "")
+	os.Setenv("PIPE_ALLOWEDORIGINS", "")
+	os.Setenv("PIPE_IMAGEPULLPOLICY", "")
 
 	if err := c.Load(); err != nil {
 		t.Errorf("Error loading configuration: %v", err)
@@ -156,6 +241,70 @@ func TestDefaultValues(t *testing.T) {
 	if c.Settings.AuthService != "https://authstore:9001/v1" {
 		t.Errorf("Unexpected default auth service: [%s]", c.AuthService)
 	}
+
+	if c.MaxJobsPerRequest != 100 {
+		t.Errorf("Unexpected default maximum jobs per request: [%d]", c.MaxJobsPerRequest)
+	}
+
+	if c.MaxRetries != 3 {
+		t.Errorf("Unexpected default maximum retries: [%d]", c.MaxRetries)
+	}
+
+	if c.AuthMode != AuthModeExternal {
+		t.Errorf("Unexpected default auth mode: [%s]", c.AuthMode)
+	}
+
+	if c.StalledJobTTL != 86400 {
+		t.Errorf("Unexpected default stalled job TTL: [%d]", c.StalledJobTTL)
+	}
+
+	if c.IdempotencyTTL != 86400 {
+		t.Errorf("Unexpected default idempotency TTL: [%d]", c.IdempotencyTTL)
+	}
+
+	if c.SubmitRateLimit != 0 {
+		t.Errorf("Expected submissions to be unlimited by default, but the limit was [%d]", c.SubmitRateLimit)
+	}
+
+	if c.JWTSecret != "" {
+		t.Errorf("Expected JWT authentication to be disabled by default, but the secret was [%s]", c.JWTSecret)
+	}
+
+	if c.MaxRequestBodyBytes != 4<<20 {
+		t.Errorf("Unexpected default maximum request body size: [%d]", c.MaxRequestBodyBytes)
+	}
+
+	if c.DefaultMaxConcurrentJobs != 0 {
+		t.Errorf("Expected no concurrency limit by default, got [%d]", c.DefaultMaxConcurrentJobs)
+	}
+
+	if c.MaxStdout != 1<<20 || c.MaxStderr != 1<<20 {
+		t.Errorf("Unexpected default output limits: stdout [%d], stderr [%d]", c.MaxStdout, c.MaxStderr)
+	}
+
+	if c.OutputFlushInterval != 1000 {
+		t.Errorf("Unexpected default output flush interval: [%d]", c.OutputFlushInterval)
+	}
+
+	if len(c.AllowedImages) != 0 {
+		t.Errorf("Expected no image restrictions by default, got [%v]", c.AllowedImages)
+	}
+
+	if len(c.AllowedOrigins) != 0 {
+		t.Errorf("Expected CORS to be disabled by default, got [%v]", c.AllowedOrigins)
+	}
+
+	if c.ImagePullPolicy != PullNever {
+		t.Errorf("Unexpected default image pull policy: [%s]", c.ImagePullPolicy)
+	}
+
+	if hostname, _ := os.Hostname(); c.RunnerID != hostname {
+		t.Errorf("Expected the runner ID to default to the hostname [%s], got [%s]", hostname, c.RunnerID)
+	}
+
+	if c.WorkStealingEnabled {
+		t.Error("Expected work stealing to be disabled by default")
+	}
 }
 
 func TestUseDockerHost(t *testing.T) {
@@ -192,3 +341,106 @@ func TestValidateLogLevel(t *testing.T) {
 		t.Errorf("Expected an error when loading an invalid PIPE_LOG_LEVEL.")
 	}
 }
+
+func TestLoadHMACAuthMode(t *testing.T) {
+	os.Setenv("PIPE_LOGLEVEL", "")
+	os.Setenv("PIPE_AUTHMODE", "hmac")
+	os.Setenv("PIPE_AUTHSECRET", "")
+	defer os.Setenv("PIPE_AUTHMODE", "")
+
+	c := Context{}
+	if err := c.Load(); err == nil {
+		t.Error("Expected HMAC auth without a secret to be rejected")
+	}
+
+	os.Setenv("PIPE_AUTHSECRET", "sekrit")
+	defer os.Setenv("PIPE_AUTHSECRET", "")
+
+	c = Context{}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if c.AuthMode != AuthModeHMAC || c.AuthSecret != "sekrit" {
+		t.Errorf("Unexpected auth mode [%s] and secret [%s]", c.AuthMode, c.AuthSecret)
+	}
+
+	os.Setenv("PIPE_AUTHMODE", "carrier-pigeon")
+	c = Context{}
+	if err := c.Load(); err == nil {
+		t.Error("Expected an unrecognized auth mode to be rejected")
+	}
+}
+
+func TestConnectToDocker(t *testing.T) {
+	defer func(plain func(string) (Docker, error), secure func(string, string, string, string) (Docker, error)) {
+		newDockerClient, newDockerTLSClient = plain, secure
+	}(newDockerClient, newDockerTLSClient)
+
+	var connected string
+	newDockerClient = func(endpoint string) (Docker, error) {
+		connected = "plain " + endpoint
+		return NullDocker{}, nil
+	}
+	newDockerTLSClient = func(endpoint, cert, key, ca string) (Docker, error) {
+		connected = "tls " + endpoint
+		return NullDocker{}, nil
+	}
+
+	cases := []struct {
+		host     string
+		tls      bool
+		expected string
+	}{
+		{"unix:///var/run/docker.sock", true, "plain unix:///var/run/docker.sock"},
+		{"unix:///var/run/docker.sock", false, "plain unix:///var/run/docker.sock"},
+		{"tcp://1.2.3.4:2376", true, "tls tcp://1.2.3.4:2376"},
+		{"tcp://1.2.3.4:2375", false, "plain tcp://1.2.3.4:2375"},
+	}
+
+	for _, each := range cases {
+		connected = ""
+		c := Context{Settings: Settings{DockerHost: each.host, DockerTLS: each.tls}}
+
+		if _, err := c.ConnectToDocker(); err != nil {
+			t.Errorf("Unexpected error connecting to [%s]: %v", each.host, err)
+		}
+		if connected != each.expected {
+			t.Errorf("Expected a [%s] connection, got [%s]", each.expected, connected)
+		}
+	}
+}
+
+func TestLoadImagePullPolicy(t *testing.T) {
+	os.Setenv("PIPE_LOGLEVEL", "")
+	os.Setenv("PIPE_IMAGEPULLPOLICY", "ifnotpresent")
+	defer os.Setenv("PIPE_IMAGEPULLPOLICY", "")
+
+	c := Context{}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if c.ImagePullPolicy != PullIfNotPresent {
+		t.Errorf("Unexpected image pull policy: [%s]", c.ImagePullPolicy)
+	}
+
+	os.Setenv("PIPE_IMAGEPULLPOLICY", "sometimes")
+	c = Context{}
+	if err := c.Load(); err == nil {
+		t.Error("Expected an unrecognized image pull policy to be rejected")
+	}
+}
+
+func TestLoadZeroMaxRetries(t *testing.T) {
+	os.Setenv("PIPE_LOGLEVEL", "")
+	os.Setenv("PIPE_IMAGEPULLPOLICY", "")
+	os.Setenv("PIPE_MAXRETRIES", "0")
+	defer os.Setenv("PIPE_MAXRETRIES", "")
+
+	c := Context{}
+	if err := c.Load(); err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+	if c.MaxRetries != 0 {
+		t.Errorf("Expected restartable jobs not to be retried, got [%d] retries", c.MaxRetries)
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"errors"
+
 	docker "github.com/smashwilson/go-dockerclient"
 )
 
@@ -9,11 +11,25 @@ import (
 type Docker interface {
 	CreateContainer(docker.CreateContainerOptions) (*docker.Container, error)
 	AttachToContainer(docker.AttachToContainerOptions) error
+	InspectContainer(string) (*docker.Container, error)
 	StartContainer(string, *docker.HostConfig) error
 	WaitContainer(string) (int, error)
 	CopyFromContainer(docker.CopyFromContainerOptions) error
 	RemoveContainer(docker.RemoveContainerOptions) error
 	KillContainer(docker.KillContainerOptions) error
+	StopContainer(string, uint) error
+	InspectImage(string) (*docker.Image, error)
+	PullImage(docker.PullImageOptions, docker.AuthConfiguration) error
+	Stats(docker.StatsOptions) error
+	Ping() error
+}
+
+// DockerPing checks that the Docker host is reachable through a client.
+func DockerPing(client Docker) error {
+	if client == nil {
+		return errors.New("no Docker client is configured")
+	}
+	return client.Ping()
 }
 
 // NullDocker is an embeddable struct that implements the full Docker interface as no-ops, allowing
@@ -30,6 +46,11 @@ func (n NullDocker) AttachToContainer(docker.AttachToContainerOptions) error {
 	return nil
 }
 
+// InspectContainer is a no-op that reports every container as missing.
+func (n NullDocker) InspectContainer(id string) (*docker.Container, error) {
+	return nil, &docker.NoSuchContainer{ID: id}
+}
+
 // StartContainer is a no-op.
 func (n NullDocker) StartContainer(string, *docker.HostConfig) error {
 	return nil
@@ -55,5 +76,31 @@ func (n NullDocker) KillContainer(docker.KillContainerOptions) error {
 	return nil
 }
 
+// StopContainer is a no-op.
+func (n NullDocker) StopContainer(string, uint) error {
+	return nil
+}
+
+// InspectImage is a no-op that reports every image as present.
+func (n NullDocker) InspectImage(string) (*docker.Image, error) {
+	return &docker.Image{}, nil
+}
+
+// PullImage is a no-op.
+func (n NullDocker) PullImage(docker.PullImageOptions, docker.AuthConfiguration) error {
+	return nil
+}
+
+// Ping always succeeds.
+func (n NullDocker) Ping() error {
+	return nil
+}
+
+// Stats is a no-op that closes the stats channel without sending any samples.
+func (n NullDocker) Stats(opts docker.StatsOptions) error {
+	close(opts.Stats)
+	return nil
+}
+
 // Ensure that NullDocker adheres to the Docker interface.
 var _ Docker = NullDocker{}
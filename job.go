@@ -1,8 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
+	"text/template"
+	"text/template/parse"
 )
 
 // JobLayer associates a Layer with a Job.
@@ -42,8 +49,17 @@ const (
 	// StatusKilled indicates that the user requested that the job be terminated.
 	StatusKilled = "killed"
 
+	// StatusTimeout indicates that the job was stopped for running longer than its maximum runtime.
+	StatusTimeout = "timeout"
+
 	// StatusStalled indicates that the job has gotten stuck (usually fetching dependencies).
 	StatusStalled = "stalled"
+
+	// SwarmAffinitiesLabel is the container label that Docker Swarm reads node affinities from.
+	SwarmAffinitiesLabel = "com.docker.swarm.affinities"
+
+	// UnlimitedRetries is a "max_retries" value that allows a job to be retried any number of times.
+	UnlimitedRetries = -1
 )
 
 var (
@@ -56,6 +72,7 @@ var (
 		StatusDone:       true,
 		StatusError:      true,
 		StatusKilled:     true,
+		StatusTimeout:    true,
 		StatusStalled:    true,
 	}
 
@@ -63,25 +80,86 @@ var (
 		StatusDone:    true,
 		StatusError:   true,
 		StatusKilled:  true,
+		StatusTimeout: true,
 		StatusStalled: true,
 	}
 )
 
-// Collected contains various metrics about the running job.
+// IsCompleted returns true if a job with the given status has finished running, successfully or
+// otherwise, and will not be run again.
+func IsCompleted(status string) bool {
+	return completedStatus[status]
+}
+
+// IsTerminal is an alias for IsCompleted.
+func IsTerminal(status string) bool {
+	return IsCompleted(status)
+}
+
+// validStatusNames returns the names of all valid job statuses in a stable order.
+func validStatusNames() []string {
+	names := make([]string, 0, len(validStatus))
+	for status := range validStatus {
+		names = append(names, status)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Collected contains various metrics about the running job. CPU times are in nanoseconds, memory
+// usage is in bytes, and WallTime is in whole seconds.
 type Collected struct {
 	CPUTimeUser     uint64 `json:"cputime_user,omitempty" bson:"cputime_user,omitempty"`
 	CPUTimeSystem   uint64 `json:"cputime_system,omitempty" bson:"cputime_system,omitempty"`
 	MemoryFailCount uint64 `json:"memory_failcnt,omitempty" bson:"memory_failcnt,omitempty"`
 	MemoryMaxUsage  uint64 `json:"memory_max_usage,omitempty" bson:"memory_max_usage,omitempty"`
+	WallTime        uint64 `json:"walltime,omitempty" bson:"walltime,omitempty"`
+
+	// CPUPercent is the container's CPU utilisation, as reported by "docker stats", in its last
+	// stats sample before it exited.
+	CPUPercent float64 `json:"cpu_percent,omitempty" bson:"cpu_percent,omitempty"`
+}
+
+// JobInput is the data provided to a job on stdin. It's encoded as a base64 string in JSON, but a
+// plain string that isn't valid base64 is also accepted and used as-is. Note that some plain strings,
+// like "abcd", happen to be valid base64 and will be decoded.
+type JobInput []byte
+
+// UnmarshalJSON decodes a base64 string, falling back to the string's own bytes.
+func (in *JobInput) UnmarshalJSON(data []byte) error {
+	var raw *string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*in = nil
+		return nil
+	}
+
+	if decoded, err := base64.StdEncoding.DecodeString(*raw); err == nil {
+		*in = decoded
+	} else {
+		*in = []byte(*raw)
+	}
+	return nil
 }
 
 // Job is a user-submitted compute task to be executed in an appropriate Docker container.
 type Job struct {
-	Command      string            `json:"cmd" bson:"cmd"`
-	Name         *string           `json:"name,omitempty" bson:"name,omitempty"`
-	Core         string            `json:"core" bson:"core"`
-	Multicore    int               `json:"multicore" bson:"multicore"`
-	Restartable  bool              `json:"restartable" bson:"restartable"`
+	Command     string  `json:"cmd" bson:"cmd"`
+	Name        *string `json:"name,omitempty" bson:"name,omitempty"`
+	Core        string  `json:"core" bson:"core"`
+	Multicore   int     `json:"multicore" bson:"multicore"`
+	Restartable bool    `json:"restartable" bson:"restartable"` // Deprecated: use MaxRetries.
+	MaxRetries  *int    `json:"max_retries,omitempty" bson:"max_retries,omitempty"`
+
+	// PreemptionPriority lets a queued job take the worker slot of a running job with a lower
+	// priority when preemption is enabled and every slot is busy.
+	PreemptionPriority int `json:"preemption_priority,omitempty" bson:"preemption_priority,omitempty"`
+
+	// AffinityLabel restricts the job to Docker Swarm nodes with a matching "key=value" label.
+	AffinityLabel string `json:"affinity_label,omitempty" bson:"affinity_label,omitempty"`
+
 	Tags         map[string]string `json:"tags" bson:"tags"`
 	Layers       []JobLayer        `json:"layer" bson:"layer"`
 	Volumes      []JobVolume       `json:"vol" bson:"vol"`
@@ -89,10 +167,52 @@ type Job struct {
 	ResultSource string            `json:"result_source" bson:"result_source"`
 	ResultType   string            `json:"result_type" bson:"result_type"`
 	MaxRuntime   int               `json:"max_runtime" bson:"max_runtime"`
-	Stdin        []byte            `json:"stdin" bson:"stdin"`
+	Stdin        JobInput          `json:"stdin" bson:"stdin"`
 
 	Profile   *bool   `json:"profile,omitempty" bson:"profile,omitempty"`
 	DependsOn *string `json:"depends_on,omitempty" bson:"depends_on,omitempty"`
+
+	// RunID groups the jobs that belong to the same logical run, across any number of submissions.
+	// A random UUID is assigned to jobs that are submitted without one.
+	RunID string `json:"run_id,omitempty" bson:"run_id,omitempty"`
+
+	// ScheduledAt defers a queued job until the given time. Runners won't claim the job before then.
+	ScheduledAt StoredTime `json:"scheduled_at,omitempty" bson:"scheduled_at,omitempty"`
+
+	// CacheKey identifies jobs that compute the same result. A job submitted with the CacheKey of a
+	// job that has already completed successfully isn't run again.
+	CacheKey string `json:"cache_key,omitempty" bson:"cache_key,omitempty"`
+
+	// IdempotencyKey identifies a submission, so that a client may safely retry it. A job resubmitted
+	// with the same IdempotencyKey within the server's idempotency TTL isn't created again.
+	IdempotencyKey string `json:"idempotency_key,omitempty" bson:"idempotency_key,omitempty"`
+
+	// MaxOutputSize limits the combined bytes of stdout and stderr retained for the job, in addition to
+	// the server's per-stream limits. Zero means that there's no combined limit.
+	MaxOutputSize int64 `json:"max_output_size,omitempty" bson:"max_output_size,omitempty"`
+
+	// ResultTTL is the number of seconds for which the job's result may be reused by jobs submitted
+	// with the same CacheKey. Zero uses the server's default cache TTL.
+	ResultTTL int `json:"result_ttl,omitempty" bson:"result_ttl,omitempty"`
+
+	// ResultPath is shorthand for a "result_source" of "file:{ResultPath}". ApplyDefaults converts it
+	// into a ResultSource, so it's never stored.
+	ResultPath string `json:"result_path,omitempty" bson:"-"`
+}
+
+// ApplyDefaults fills in default values for optional fields that were omitted.
+func (j *Job) ApplyDefaults() {
+	// An omitted "multicore" means that a single core is requested.
+	if j.Multicore == 0 {
+		j.Multicore = 1
+	}
+
+	// A "result_path" is equivalent to a "file:" result source. It's left in place if a
+	// "result_source" was also given, so that Validate can reject the conflict.
+	if j.ResultPath != "" && j.ResultSource == "" {
+		j.ResultSource = "file:" + j.ResultPath
+		j.ResultPath = ""
+	}
 }
 
 // Validate ensures that all required fields have non-zero values, and that enum-like fields have
@@ -107,7 +227,93 @@ func (j Job) Validate() *APIError {
 		}
 	}
 
+	// Multicore
+	if j.Multicore < 1 {
+		return &APIError{
+			Code:    CodeInvalidMulticore,
+			Message: fmt.Sprintf("Invalid multicore value [%d]", j.Multicore),
+			Hint:    `The "multicore" element must be a positive number of cores.`,
+		}
+	}
+
+	// MaxRuntime
+	if j.MaxRuntime < 0 {
+		return &APIError{
+			Code:    CodeInvalidMaxRuntime,
+			Message: fmt.Sprintf("Invalid maximum runtime [%d]", j.MaxRuntime),
+			Hint:    `The "max_runtime" must be a number of seconds, or zero for no limit.`,
+		}
+	}
+
+	// MaxOutputSize
+	if j.MaxOutputSize < 0 {
+		return &APIError{
+			Code:    CodeInvalidMaxOutputSize,
+			Message: fmt.Sprintf("Invalid maximum output size [%d]", j.MaxOutputSize),
+			Hint:    `The "max_output_size" must be a number of bytes, or zero for no limit.`,
+		}
+	}
+
+	// ResultTTL
+	if j.ResultTTL < 0 {
+		return &APIError{
+			Code:    CodeInvalidResultTTL,
+			Message: fmt.Sprintf("Invalid result TTL [%d]", j.ResultTTL),
+			Hint:    `The "result_ttl" must be a number of seconds, or zero for the default.`,
+		}
+	}
+
+	// MaxRetries
+	if j.MaxRetries != nil && *j.MaxRetries < UnlimitedRetries {
+		return &APIError{
+			Code:    CodeInvalidMaxRetries,
+			Message: fmt.Sprintf("Invalid maximum retries [%d]", *j.MaxRetries),
+			Hint:    `The "max_retries" must be a number of retries, zero for none, or -1 for no limit.`,
+		}
+	}
+
+	// Environment
+	for key := range j.Environment {
+		if key == "" || strings.Contains(key, "=") {
+			return &APIError{
+				Code:    CodeInvalidEnvironment,
+				Message: fmt.Sprintf("Invalid environment variable name [%s]", key),
+				Hint:    `Environment variable names in "env" must be non-empty and may not contain "=".`,
+			}
+		}
+	}
+
+	// AffinityLabel
+	if j.AffinityLabel != "" {
+		parts := strings.SplitN(j.AffinityLabel, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return &APIError{
+				Code:    CodeInvalidAffinityLabel,
+				Message: fmt.Sprintf("Invalid affinity label [%s]", j.AffinityLabel),
+				Hint:    `The "affinity_label" element must be of the form "key=value".`,
+			}
+		}
+	}
+
+	// DependsOn
+	if j.DependsOn != nil {
+		if _, err := strconv.ParseUint(*j.DependsOn, 10, 64); err != nil {
+			return &APIError{
+				Code:    CodeInvalidDependency,
+				Message: fmt.Sprintf("Invalid dependency [%s]", *j.DependsOn),
+				Hint:    `The "depends_on" element must be the JID of a previously submitted job.`,
+			}
+		}
+	}
+
 	// ResultSource
+	if j.ResultPath != "" {
+		return &APIError{
+			Code:    CodeConflictingResultSource,
+			Message: fmt.Sprintf("Conflicting result source [%s] and result path [%s]", j.ResultSource, j.ResultPath),
+			Hint:    `Specify either a "result_source" or a "result_path", but not both.`,
+		}
+	}
 	if j.ResultSource != "stdout" && !strings.HasPrefix(j.ResultSource, "file:") {
 		return &APIError{
 			Code:    CodeInvalidResultSource,
@@ -133,6 +339,150 @@ func (j Job) Validate() *APIError {
 	return nil
 }
 
+// RetryLimit returns the number of times that this job may be retried after it fails, or
+// UnlimitedRetries. Jobs that don't set "max_retries" and are only marked "restartable" may be
+// retried restartableLimit times. An explicit "max_retries" of zero disables retries, even for a
+// restartable job.
+func (j Job) RetryLimit(restartableLimit int) int {
+	if j.MaxRetries != nil {
+		return *j.MaxRetries
+	}
+	if j.Restartable {
+		return restartableLimit
+	}
+	return 0
+}
+
+// Dependency returns the JID of the job that this job depends on, or 0 if it has no dependency.
+// It should only be called on a Job that has been validated.
+func (j Job) Dependency() uint64 {
+	if j.DependsOn == nil {
+		return 0
+	}
+	jid, _ := strconv.ParseUint(*j.DependsOn, 10, 64)
+	return jid
+}
+
+// EnvironmentList returns this job's environment variables as KEY=VALUE pairs, sorted by key.
+func (j Job) EnvironmentList() []string {
+	env := make([]string, 0, len(j.Environment))
+	for key, value := range j.Environment {
+		env = append(env, key+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// ExpandCommand returns the job's command with template references to its tags, like
+// "{{.Tags.input}}", replaced by the corresponding tag values. Malformed templates and references to
+// tags that the job doesn't have are rejected.
+func (j Job) ExpandCommand() (string, *APIError) {
+	tmpl, err := template.New("cmd").Parse(j.Command)
+	if err != nil {
+		return "", &APIError{
+			Code:    CodeTemplateExpansionError,
+			Message: fmt.Sprintf("Unable to parse the command template [%s]: %v", j.Command, err),
+			Hint:    `Refer to tags in your "cmd" as {{.Tags.name}}.`,
+		}
+	}
+
+	// Templates render missing map keys as "<no value>", so look for references to absent tags before
+	// executing the template.
+	if missing := missingTags(tmpl.Tree.Root, j.Tags); len(missing) > 0 {
+		return "", &APIError{
+			Code:    CodeTemplateExpansionError,
+			Message: fmt.Sprintf("The command template [%s] refers to missing tags: %s", j.Command, strings.Join(missing, ", ")),
+			Hint:    `Every tag referenced by your "cmd" must be present in your job's "tags".`,
+		}
+	}
+
+	data := struct {
+		Tags map[string]string
+	}{Tags: j.Tags}
+	if data.Tags == nil {
+		data.Tags = map[string]string{}
+	}
+
+	var expanded bytes.Buffer
+	if err := tmpl.Execute(&expanded, data); err != nil {
+		return "", &APIError{
+			Code:    CodeTemplateExpansionError,
+			Message: fmt.Sprintf("Unable to expand the command template [%s]: %v", j.Command, err),
+			Hint:    `Every tag referenced by your "cmd" must be present in your job's "tags".`,
+		}
+	}
+
+	return expanded.String(), nil
+}
+
+// missingTags returns the names of the tags referenced as .Tags.name anywhere within node that
+// aren't present in tags.
+func missingTags(node parse.Node, tags map[string]string) []string {
+	var missing []string
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return nil
+		}
+		for _, child := range n.Nodes {
+			missing = append(missing, missingTags(child, tags)...)
+		}
+	case *parse.ActionNode:
+		missing = missingTags(n.Pipe, tags)
+	case *parse.PipeNode:
+		if n == nil {
+			return nil
+		}
+		for _, cmd := range n.Cmds {
+			for _, arg := range cmd.Args {
+				missing = append(missing, missingTags(arg, tags)...)
+			}
+		}
+	case *parse.IfNode:
+		missing = missingTagsInBranch(n.BranchNode, tags)
+	case *parse.RangeNode:
+		missing = missingTagsInBranch(n.BranchNode, tags)
+	case *parse.WithNode:
+		missing = missingTagsInBranch(n.BranchNode, tags)
+	case *parse.TemplateNode:
+		missing = missingTags(n.Pipe, tags)
+	case *parse.FieldNode:
+		if len(n.Ident) >= 2 && n.Ident[0] == "Tags" {
+			if _, ok := tags[n.Ident[1]]; !ok {
+				missing = append(missing, n.Ident[1])
+			}
+		}
+	}
+	return missing
+}
+
+// missingTagsInBranch returns the missing tags referenced by an if, range, or with action.
+func missingTagsInBranch(n parse.BranchNode, tags map[string]string) []string {
+	missing := missingTags(n.Pipe, tags)
+	missing = append(missing, missingTags(n.List, tags)...)
+	return append(missing, missingTags(n.ElseList, tags)...)
+}
+
+// ContainerLabels returns the labels to apply to this job's container, or nil if it needs none. A
+// job with an AffinityLabel is labelled so that Docker Swarm schedules it on a matching node.
+func (j Job) ContainerLabels() map[string]string {
+	if j.AffinityLabel == "" {
+		return nil
+	}
+
+	affinities, _ := json.Marshal([]string{j.AffinityLabel})
+	return map[string]string{SwarmAffinitiesLabel: string(affinities)}
+}
+
+// Images returns the names of the images that this job's layers require.
+func (j Job) Images() []string {
+	images := make([]string, len(j.Layers))
+	for i, layer := range j.Layers {
+		images[i] = layer.Name
+	}
+	return images
+}
+
 // SubmittedJob is a Job that has already been submitted.
 type SubmittedJob struct {
 	Job
@@ -150,14 +500,76 @@ type SubmittedJob struct {
 	Stderr        string `json:"stderr" bson:"stderr"`
 	Stdout        string `json:"stdout" bson:"stdout"`
 
+	// PullProgress holds the latest progress of each layer, by layer ID, while an image for the job is
+	// being pulled. It's cleared once the pull is over.
+	PullProgress map[string]string `json:"pull_progress,omitempty" bson:"pull_progress,omitempty"`
+
+	// OutputTruncated is set once any of the job's stdout or stderr has been discarded because it
+	// exceeded a size limit.
+	OutputTruncated bool `json:"output_truncated,omitempty" bson:"output_truncated,omitempty"`
+
 	Collected Collected `json:"collected,omitempty" bson:"collected,omitempty"`
 
+	// ExpandedCommand is the job's command after its tags were substituted into it. It's what is
+	// actually executed, while Command keeps the template as it was submitted.
+	ExpandedCommand string `json:"expanded_cmd,omitempty" bson:"expanded_cmd,omitempty"`
+
+	// RetryCount is the number of times that a failed, restartable job has been returned to the queue.
+	RetryCount int `json:"retry_count" bson:"retry_count"`
+
+	// ResourceScore is the fair-share score of the job's account at the time that the job was
+	// claimed. See Account.ResourceScore.
+	ResourceScore float64 `json:"resource_score,omitempty" bson:"resource_score,omitempty"`
+
+	// LastError holds the end of the stderr from the job's most recent failed attempt. Stderr only
+	// covers the current attempt.
+	LastError string `json:"last_error,omitempty" bson:"last_error,omitempty"`
+
+	// ContainerSize is the uncompressed size, in bytes, of the image that the job's container was
+	// created from.
+	ContainerSize int64 `json:"container_size,omitempty" bson:"container_size,omitempty"`
+
+	// CacheExpiresAt is the time after which a successfully completed job's result is no longer reused
+	// for jobs with the same CacheKey. Zero means that the result never expires.
+	CacheExpiresAt StoredTime `json:"cache_expires_at,omitempty" bson:"cache_expires_at,omitempty"`
+
+	// Runner is the RunnerID of the runner that claimed the job most recently.
+	Runner string `json:"runner,omitempty" bson:"runner,omitempty"`
+
 	JID           uint64 `json:"jid" bson:"_id"`
 	Account       string `json:"-" bson:"account"`
-	ContainerID   string `json:"-" bson:"container_id,omitempty"`
+	ContainerID   string `json:"-" bson:"container_id"`
 	KillRequested bool   `json:"-" bson:"kill_requested,omitempty"`
 }
 
+// ResetRun discards the state of the job's current attempt, so that it may be run again from the
+// beginning.
+func (j *SubmittedJob) ResetRun() {
+	j.StartedAt = 0
+	j.FinishedAt = 0
+	j.ContainerID = ""
+	j.ContainerSize = 0
+	j.ReturnCode = ""
+	j.Result = nil
+	j.Runtime = 0
+	j.OverheadDelay = 0
+	j.Stdout = ""
+	j.Stderr = ""
+	j.OutputTruncated = false
+	j.PullProgress = nil
+	j.Collected = Collected{}
+	j.CacheExpiresAt = 0
+}
+
+// RunCommand returns the command to execute in the job's container. Jobs submitted before command
+// templates were expanded don't have an ExpandedCommand, and run their Command as-is.
+func (j SubmittedJob) RunCommand() string {
+	if j.ExpandedCommand != "" {
+		return j.ExpandedCommand
+	}
+	return j.Command
+}
+
 // ContainerName derives a name for the Docker container used to execute this job.
 func (j SubmittedJob) ContainerName() string {
 	var nameFragment string
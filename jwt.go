@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrTokenMalformed is returned for a bearer token that isn't a well-formed, HS256-signed JWT.
+	ErrTokenMalformed = errors.New("malformed token")
+	// ErrTokenSignature is returned for a JWT that wasn't signed with the configured secret.
+	ErrTokenSignature = errors.New("invalid token signature")
+	// ErrTokenExpired is returned for a JWT whose "exp" claim has passed.
+	ErrTokenExpired = errors.New("token has expired")
+	// ErrTokenIssuer is returned for a JWT that wasn't issued by the configured issuer.
+	ErrTokenIssuer = errors.New("token has an unexpected issuer")
+)
+
+// JWTClaims are the claims that we accept from a JWT bearer token.
+type JWTClaims struct {
+	Subject   string `json:"sub"`
+	Issuer    string `json:"iss,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	Admin     bool   `json:"admin,omitempty"`
+}
+
+// jwtHeader is the JOSE header of a JWT.
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer" header, if one is present.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if len(header) < 7 || !strings.EqualFold(header[:7], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(header[7:]), true
+}
+
+// encodeSegment base64url-encodes one segment of a token. JWTs omit the "=" padding.
+func encodeSegment(raw []byte) string {
+	return strings.TrimRight(base64.URLEncoding.EncodeToString(raw), "=")
+}
+
+// decodeSegment decodes one unpadded, base64url-encoded segment of a token.
+func decodeSegment(segment string) ([]byte, error) {
+	if strings.Contains(segment, "=") {
+		return nil, ErrTokenMalformed
+	}
+	if remainder := len(segment) % 4; remainder != 0 {
+		segment += strings.Repeat("=", 4-remainder)
+	}
+	return base64.URLEncoding.DecodeString(segment)
+}
+
+// jwtSignature computes the base64url-encoded HS256 signature of a token's header and payload.
+func jwtSignature(signingInput string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(signingInput))
+	return encodeSegment(mac.Sum(nil))
+}
+
+// ParseJWT verifies an HS256-signed JWT and returns its claims. If issuer is non-empty, the token's
+// "iss" claim must match it. Tokens without an "exp" claim never expire.
+func ParseJWT(token string, secret []byte, issuer string, now time.Time) (*JWTClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenMalformed
+	}
+
+	rawHeader, err := decodeSegment(parts[0])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(rawHeader, &header); err != nil || header.Algorithm != "HS256" {
+		return nil, ErrTokenMalformed
+	}
+
+	expected := jwtSignature(parts[0]+"."+parts[1], secret)
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		return nil, ErrTokenSignature
+	}
+
+	rawClaims, err := decodeSegment(parts[1])
+	if err != nil {
+		return nil, ErrTokenMalformed
+	}
+	var claims JWTClaims
+	if err := json.Unmarshal(rawClaims, &claims); err != nil || claims.Subject == "" {
+		return nil, ErrTokenMalformed
+	}
+
+	if claims.ExpiresAt != 0 && !now.Before(time.Unix(claims.ExpiresAt, 0)) {
+		return nil, ErrTokenExpired
+	}
+	if issuer != "" && claims.Issuer != issuer {
+		return nil, ErrTokenIssuer
+	}
+
+	return &claims, nil
+}
+
+// SignJWT creates an HS256-signed JWT carrying claims.
+func SignJWT(claims JWTClaims, secret []byte) (string, error) {
+	rawHeader, err := json.Marshal(jwtHeader{Algorithm: "HS256", Type: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	rawClaims, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encodeSegment(rawHeader) + "." +
+		encodeSegment(rawClaims)
+	return signingInput + "." + jwtSignature(signingInput, secret), nil
+}
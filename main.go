@@ -1,15 +1,30 @@
 package main
 
 import (
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"mime"
 	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrateCommand(os.Args[2:]); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Fatal("Unable to copy jobs to PostgreSQL.")
+		}
+		return
+	}
+
 	c, err := NewContext()
 	if err != nil {
 		log.WithFields(log.Fields{
@@ -21,15 +36,45 @@ func main() {
 	log.Info("Commence primary ignition.")
 
 	log.Info("Launching job runner.")
-	go Runner(c)
+	stop, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		Runner(c, stop)
+		close(stopped)
+	}()
+	go Archiver(c)
+	go shutdownOnSignal(stop, stopped)
+
+	// Unauthenticated probes
+	http.HandleFunc("/healthz", BindContext(c, HealthHandler))
+	http.HandleFunc("/readyz", BindContext(c, ReadyHandler))
+
+	// Admin-only monitoring
+	http.HandleFunc("/metrics", BindContext(c, MetricsHandler))
 
 	// v1 routes
 	http.HandleFunc("/v1/auth_service", BindContext(c, AuthDiscoverHandler))
+	http.HandleFunc("/v1/account", BindContext(c, AccountHandler))
+	http.HandleFunc("/v1/accounts", BindContext(c, RequireJSONBody(AccountCreateHandler)))
+	http.HandleFunc("/v1/accounts/", BindContext(c, RequireJSONBody(AccountResourceHandler)))
 
-	http.HandleFunc("/v1/job", BindContext(c, JobHandler))
+	http.HandleFunc("/v1/job", BindContext(c, RequireBodyType(JobHandler, "application/json", "multipart/form-data")))
 	http.HandleFunc("/v1/job/kill", BindContext(c, JobKillHandler))
 	http.HandleFunc("/v1/job/kill_all", BindContext(c, JobKillAllHandler))
 	http.HandleFunc("/v1/job/queue_stats", BindContext(c, JobQueueStatsHandler))
+	http.HandleFunc("/v1/jobs/", BindContext(c, JobOutputHandler))
+	http.HandleFunc("/v1/jobs/export", BindContext(c, JobExportHandler))
+	http.HandleFunc("/v1/jobs/submit_and_wait", BindContext(c, RequireJSONBody(JobSubmitAndWaitHandler)))
+
+	http.HandleFunc("/v1/configmaps", BindContext(c, RequireJSONBody(ConfigMapHandler)))
+
+	http.HandleFunc("/v1/runs", BindContext(c, RunListHandler))
+	http.HandleFunc("/v1/runs/", BindContext(c, RunResourceHandler))
+	http.HandleFunc("/v1/queue", BindContext(c, QueueDepthHandler))
+	http.HandleFunc("/v1/admin/accounts/", BindContext(c, AdminAccountResourceHandler))
+	http.HandleFunc("/v1/admin/account/update", BindContext(c, AccountUpdateHandler))
+	http.HandleFunc("/v1/admin/schema-version", BindContext(c, SchemaVersionHandler))
+	http.HandleFunc("/v1/admin/migrate", BindContext(c, MigrateHandler))
+	http.HandleFunc("/v1/admin/migrate/", BindContext(c, MigrateHandler))
 
 	log.WithFields(log.Fields{
 		"address": c.ListenAddr(),
@@ -37,13 +82,202 @@ func main() {
 	http.ListenAndServe(c.ListenAddr(), nil)
 }
 
+// shutdownOnSignal stops the job runner when the process is asked to terminate, and exits once the
+// runner's in-flight jobs have finished so that they aren't left behind as StatusProcessing.
+func shutdownOnSignal(stop chan<- struct{}, stopped <-chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	log.WithFields(log.Fields{"signal": sig}).Info("Shutting down.")
+
+	close(stop)
+	<-stopped
+	os.Exit(0)
+}
+
 // ContextHandler is an HTTP HandlerFunc that accepts an additional parameter containing the
 // server context.
 type ContextHandler func(c *Context, w http.ResponseWriter, r *http.Request)
 
-// BindContext returns an http.HandlerFunc that binds a ContextHandler to a specific Context.
+// BindContext returns an http.HandlerFunc that binds a ContextHandler to a specific Context. Each
+// request is assigned a request ID by RequestIDMiddleware, and CORS is applied for the Context's
+// AllowedOrigins.
 func BindContext(c *Context, handler ContextHandler) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) { handler(c, w, r) }
+	bound := func(w http.ResponseWriter, r *http.Request) { handler(c, w, r) }
+	return RequestIDMiddleware(CORSMiddleware(c.AllowedOrigins)(bound))
+}
+
+// CORSMiddleware returns a middleware that allows browser-based clients from allowedOrigins to call
+// the API. An allowed "*" matches any origin. CORS preflight requests are answered without reaching
+// the wrapped handler. If allowedOrigins is empty, requests are passed through untouched.
+func CORSMiddleware(allowedOrigins []string) func(http.HandlerFunc) http.HandlerFunc {
+	return func(handler http.HandlerFunc) http.HandlerFunc {
+		if len(allowedOrigins) == 0 {
+			return handler
+		}
+
+		return func(w http.ResponseWriter, r *http.Request) {
+			if origin := r.Header.Get("Origin"); origin != "" && originAllowed(allowedOrigins, origin) {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			w.Header().Add("Vary", "Origin")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, "+RequestIDHeader)
+			w.Header().Set("Access-Control-Expose-Headers", RequestIDHeader)
+
+			if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			handler(w, r)
+		}
+	}
+}
+
+// originAllowed returns true if origin is one of allowedOrigins, or if any origin is allowed with
+// "*".
+func originAllowed(allowedOrigins []string, origin string) bool {
+	for _, allowed := range allowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireJSONBody wraps a ContextHandler whose POST and PUT requests carry JSON bodies. Those requests
+// are rejected with a 415 unless their Content-Type is application/json. Requests with other methods
+// are passed through untouched.
+func RequireJSONBody(handler ContextHandler) ContextHandler {
+	return RequireBodyType(handler, "application/json")
+}
+
+// RequireBodyType wraps a ContextHandler whose POST and PUT requests must have one of mediaTypes as
+// their Content-Type. Other requests are rejected with a 415.
+func RequireBodyType(handler ContextHandler, mediaTypes ...string) ContextHandler {
+	return func(c *Context, w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" || r.Method == "PUT" {
+			contentType := r.Header.Get("Content-Type")
+			mediaType, _, err := mime.ParseMediaType(contentType)
+			supported := false
+			for _, each := range mediaTypes {
+				if err == nil && mediaType == each {
+					supported = true
+					break
+				}
+			}
+			if !supported {
+				APIError{
+					Code:    CodeUnsupportedMediaType,
+					Message: fmt.Sprintf("Unsupported Content-Type [%s]", contentType),
+					Hint:    fmt.Sprintf("Please send a body with a Content-Type of %s.", strings.Join(mediaTypes, " or ")),
+					Retry:   false,
+				}.Report(http.StatusUnsupportedMediaType, w)
+				return
+			}
+		}
+
+		handler(c, w, r)
+	}
+}
+
+// RequestIDHeader is the header that carries a request's ID, in both the request and the response.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDMiddleware assigns an ID to each request, so that client errors can be correlated with
+// server logs. A valid client-provided X-Request-ID is kept; otherwise a random UUID is generated.
+// The ID is stored in the request's X-Request-ID header and echoed in the response's, where
+// RequestLog and APIError.Report pick it up.
+func RequestIDMiddleware(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			if id != "" {
+				log.WithFields(log.Fields{
+					"request id": id,
+				}).Debug("Replacing an invalid client request ID.")
+			}
+
+			var err error
+			id, err = newUUID()
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Unable to generate a request ID.")
+			}
+			r.Header.Set(RequestIDHeader, id)
+		}
+		w.Header().Set(RequestIDHeader, id)
+
+		log.WithFields(log.Fields{
+			"request id": id,
+			"method":     r.Method,
+			"path":       r.URL.Path,
+		}).Debug("Request received.")
+
+		handler(w, r)
+	}
+}
+
+// maxRequestIDLength is the longest client-provided request ID that will be accepted.
+const maxRequestIDLength = 128
+
+// validRequestID returns true if a client-provided request ID is short enough, and only uses
+// characters that are safe to echo in headers and write to logs.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, ch := range id {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case ch == '-', ch == '_', ch == '.', ch == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequestID returns the ID that RequestIDMiddleware assigned to a request.
+func RequestID(r *http.Request) string {
+	return r.Header.Get(RequestIDHeader)
+}
+
+// RequestLog returns a log entry that carries the ID that RequestIDMiddleware assigned to the
+// request being answered through w. Handlers log through it, so that every entry written while
+// serving a request can be correlated with that request.
+func RequestLog(w http.ResponseWriter) *log.Entry {
+	if id := w.Header().Get(RequestIDHeader); id != "" {
+		return log.WithField("request id", id)
+	}
+	return log.WithFields(log.Fields{})
+}
+
+// newUUID generates a random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// ReportOptions responds to an OPTIONS request for a resource that supports the listed methods.
+// CORS headers are left to CORSMiddleware, which only grants them to allowed origins.
+func ReportOptions(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	w.WriteHeader(http.StatusOK)
+}
+
+// isBodyTooLarge returns true if err was caused by reading past the limit of an
+// http.MaxBytesReader.
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == "http: request body too large"
 }
 
 // APIError stores information that may be returned in an error response from the API.
@@ -52,6 +286,14 @@ type APIError struct {
 	Message string `json:"message"`
 	Hint    string `json:"hint,omitempty"`
 	Retry   bool   `json:"retry,omitempty"`
+
+	// RequestID identifies the request that caused the error. Report fills it in from the response's
+	// X-Request-ID header.
+	RequestID string `json:"request_id,omitempty"`
+
+	// logged and account are set by Log, so that Report can log the error with its request ID.
+	logged  bool
+	account string
 }
 
 // Report serializes an error report as JSON to an open ResponseWriter.
@@ -60,10 +302,24 @@ func (e APIError) Report(status int, w http.ResponseWriter) error {
 		Error APIError `json:"error"`
 	}
 	outer.Error = e
+	if outer.Error.RequestID == "" {
+		outer.Error.RequestID = w.Header().Get(RequestIDHeader)
+	}
+
+	f := log.Fields{"code": e.Code, "status": status}
+	if e.logged {
+		f["error"] = outer.Error
+		if e.account != "" {
+			f["account"] = e.account
+		}
+		RequestLog(w).WithFields(f).Error(e.Message)
+	} else if outer.Error.RequestID != "" {
+		RequestLog(w).WithFields(f).Info("Reported an error.")
+	}
 
 	b, err := json.Marshal(outer)
 	if err != nil {
-		log.WithFields(log.Fields{
+		RequestLog(w).WithFields(log.Fields{
 			"error": err,
 		}).Error("Unable to serialize API error.")
 		fmt.Fprintf(w, "Er, there was an error serializing the error. Talk to your administrator, please.")
@@ -76,14 +332,13 @@ func (e APIError) Report(status int, w http.ResponseWriter) error {
 	return err
 }
 
-// Log logs an APIError at the ERROR level.
+// Log marks an APIError to be logged at the ERROR level when it's reported. The log entry includes
+// the account and the ID of the request that caused it.
 func (e APIError) Log(account *Account) APIError {
-	f := log.Fields{"error": e}
+	e.logged = true
 	if account != nil {
-		f["account"] = account.Name
+		e.account = account.Name
 	}
-
-	log.WithFields(f).Error(e.Message)
 	return e
 }
 
@@ -105,25 +360,68 @@ func StoreTime(t time.Time) StoredTime {
 	return StoredTime(t.UTC().UnixNano())
 }
 
+// ParseStoredTime parses a UTC timestamp string, in the same format used for JSON, as a StoredTime.
+func ParseStoredTime(input string) (StoredTime, error) {
+	parsed, err := time.Parse(timeFormat, input)
+	if err != nil {
+		return 0, err
+	}
+	return StoreTime(parsed), nil
+}
+
 // AsTime converts a StoredTime back to a Go time.Time.
-func (t *StoredTime) AsTime() time.Time {
-	return time.Unix(0, int64(*t)).UTC()
+func (t StoredTime) AsTime() time.Time {
+	return time.Unix(0, int64(t)).UTC()
+}
+
+// IsZero returns true if this time has never been set.
+func (t StoredTime) IsZero() bool {
+	return t == 0
 }
 
-func (t *StoredTime) String() string {
+// Before returns true if this time is earlier than other.
+func (t StoredTime) Before(other StoredTime) bool {
+	return t < other
+}
+
+// After returns true if this time is later than other.
+func (t StoredTime) After(other StoredTime) bool {
+	return t > other
+}
+
+// Add returns this time offset by the duration d.
+func (t StoredTime) Add(d time.Duration) StoredTime {
+	return t + StoredTime(d.Nanoseconds())
+}
+
+// Truncate rounds this time down to a multiple of the duration d.
+func (t StoredTime) Truncate(d time.Duration) StoredTime {
+	return t - t%StoredTime(d.Nanoseconds())
+}
+
+func (t StoredTime) String() string {
 	return t.AsTime().Format(timeFormat)
 }
 
-// MarshalJSON encodes a JSONTime as a UTC timestamp string.
-func (t *StoredTime) MarshalJSON() ([]byte, error) {
+// MarshalJSON encodes a StoredTime as a UTC timestamp string. It uses a value receiver so that
+// StoredTimes within non-addressable values, like a SubmittedJob passed to json.Marshal directly,
+// aren't encoded as raw integers.
+func (t StoredTime) MarshalJSON() ([]byte, error) {
 	return []byte(t.AsTime().Format(quotedFormat)), nil
 }
 
-// UnmarshalJSON decodes a UTC timestamp string into a time.
+// UnmarshalJSON decodes a UTC timestamp string into a time. A JSON null leaves the time unchanged.
 func (t *StoredTime) UnmarshalJSON(input []byte) error {
+	if string(input) == "null" {
+		return nil
+	}
+
 	parsed, err := time.Parse(quotedFormat, string(input))
-	*t = StoredTime(parsed.UTC().UnixNano())
-	return err
+	if err != nil {
+		return err
+	}
+	*t = StoreTime(parsed)
+	return nil
 }
 
 // OKResponse returns the standard "all is well" response.
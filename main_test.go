@@ -2,10 +2,37 @@ package main
 
 import (
 	"encoding/json"
+	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
+// serveRequest sends a request through a handler and records its response. The request is
+// authenticated as username with the key "12345", unless username is empty. A JSON body is sent as
+// application/json and any other non-empty body as a form.
+func serveRequest(t *testing.T, c *Context, handler ContextHandler, username, method, path, body string) *httptest.ResponseRecorder {
+	r, err := http.NewRequest(method, "https://localhost"+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	switch trimmed := strings.TrimSpace(body); {
+	case strings.HasPrefix(trimmed, "{"), strings.HasPrefix(trimmed, "["):
+		r.Header.Set("Content-Type", "application/json")
+	case body != "":
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	if username != "" {
+		r.SetBasicAuth(username, "12345")
+	}
+	w := httptest.NewRecorder()
+
+	handler(c, w, r)
+
+	return w
+}
+
 func hasError(t *testing.T, w *httptest.ResponseRecorder, expectedStatus int, expectedErr APIError) {
 	if w.Code != expectedStatus {
 		t.Errorf("Unexpected HTTP status: wanted [%d], got [%d]", expectedStatus, w.Code)
@@ -32,3 +59,334 @@ func hasError(t *testing.T, w *httptest.ResponseRecorder, expectedStatus int, ex
 		t.Errorf("Retry is set to true and should be false.")
 	}
 }
+
+func TestStoredTimeJSON(t *testing.T) {
+	cases := []struct {
+		description string
+		time        StoredTime
+		json        string
+	}{
+		{"zero", StoredTime(0), `"1970-01-01 00:00:00.000"`},
+		{"epoch", StoreTime(time.Unix(0, 0)), `"1970-01-01 00:00:00.000"`},
+		{"realistic", StoreTime(time.Date(2015, time.February, 3, 4, 5, 6, 789000000, time.UTC)), `"2015-02-03 04:05:06.789"`},
+	}
+
+	for _, c := range cases {
+		out, err := json.Marshal(c.time)
+		if err != nil {
+			t.Errorf("[%s] Unable to marshal: %v", c.description, err)
+			continue
+		}
+		if string(out) != c.json {
+			t.Errorf("[%s] Expected JSON [%s], got [%s]", c.description, c.json, out)
+		}
+
+		var parsed StoredTime
+		if err := json.Unmarshal(out, &parsed); err != nil {
+			t.Errorf("[%s] Unable to unmarshal [%s]: %v", c.description, out, err)
+			continue
+		}
+		if parsed != c.time {
+			t.Errorf("[%s] Round trip changed the time from [%d] to [%d]", c.description, c.time, parsed)
+		}
+	}
+}
+
+func TestStoredTimeUnmarshalInvalid(t *testing.T) {
+	original := StoreTime(time.Date(2015, time.February, 3, 4, 5, 6, 0, time.UTC))
+	parsed := original
+
+	if err := json.Unmarshal([]byte(`"yesterday"`), &parsed); err == nil {
+		t.Error("Expected an error unmarshalling an invalid timestamp")
+	}
+	if parsed != original {
+		t.Errorf("Expected an invalid timestamp to leave the time unchanged, but was [%s]", parsed)
+	}
+}
+
+func TestSubmittedJobOmitsZeroTimes(t *testing.T) {
+	job := SubmittedJob{
+		CreatedAt: StoreTime(time.Date(2015, time.February, 3, 4, 5, 6, 0, time.UTC)),
+		Status:    StatusQueued,
+	}
+
+	out, err := json.Marshal(job)
+	if err != nil {
+		t.Fatalf("Unable to marshal job: %v", err)
+	}
+	body := string(out)
+
+	if !strings.Contains(body, `"created_at":"2015-02-03 04:05:06.000"`) {
+		t.Errorf("Expected created_at to be encoded as a timestamp: [%s]", body)
+	}
+	if strings.Contains(body, `"started_at"`) {
+		t.Errorf("Expected started_at to be omitted for a queued job: [%s]", body)
+	}
+	if strings.Contains(body, `"finished_at"`) {
+		t.Errorf("Expected finished_at to be omitted for a queued job: [%s]", body)
+	}
+}
+
+func TestStoredTimeComparison(t *testing.T) {
+	earlier := StoreTime(time.Date(2015, time.February, 3, 4, 5, 6, 0, time.UTC))
+	later := earlier.Add(time.Second)
+
+	if !earlier.Before(later) || earlier.After(later) {
+		t.Errorf("Expected [%s] to be before [%s]", earlier, later)
+	}
+	if !later.After(earlier) || later.Before(earlier) {
+		t.Errorf("Expected [%s] to be after [%s]", later, earlier)
+	}
+	if earlier.Before(earlier) || earlier.After(earlier) {
+		t.Errorf("Expected [%s] to be neither before nor after itself", earlier)
+	}
+	if !later.AsTime().Equal(earlier.AsTime().Add(time.Second)) {
+		t.Errorf("Expected Add to mirror time.Time: got [%s]", later)
+	}
+
+	if !StoredTime(0).IsZero() {
+		t.Error("Expected the zero StoredTime to be zero")
+	}
+	if earlier.IsZero() {
+		t.Errorf("Expected [%s] not to be zero", earlier)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var seen string
+	handler := RequestIDMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		seen = RequestID(r)
+		APIError{Code: CodeListFailure, Message: "Nope."}.Report(http.StatusInternalServerError, w)
+	})
+
+	r, err := http.NewRequest("GET", "https://localhost/v1/job", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+	handler(w, r)
+
+	id := w.HeaderMap.Get(RequestIDHeader)
+	if len(id) != 36 || strings.Count(id, "-") != 4 {
+		t.Errorf("Expected a generated UUID, got [%s]", id)
+	}
+	if seen != id {
+		t.Errorf("Expected the handler to see request ID [%s], got [%s]", id, seen)
+	}
+
+	var e struct {
+		Error APIError
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &e); err != nil {
+		t.Fatalf("Unable to parse response body as JSON: [%s]", w.Body.String())
+	}
+	if e.Error.RequestID != id {
+		t.Errorf("Expected the error to include request ID [%s], got [%s]", id, e.Error.RequestID)
+	}
+
+	// A client-provided request ID is kept.
+	r.Header.Set(RequestIDHeader, "abc123")
+	w = httptest.NewRecorder()
+	handler(w, r)
+
+	if id := w.HeaderMap.Get(RequestIDHeader); id != "abc123" {
+		t.Errorf("Expected the client's request ID to be echoed, got [%s]", id)
+	}
+}
+
+func TestRequestIDMiddlewareReplacesInvalidIDs(t *testing.T) {
+	handler := RequestIDMiddleware(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, id := range []string{"abc 123", "abc\x1b[31m", strings.Repeat("a", maxRequestIDLength+1)} {
+		r, err := http.NewRequest("GET", "https://localhost/v1/job", nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.Header.Set(RequestIDHeader, id)
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		generated := w.HeaderMap.Get(RequestIDHeader)
+		if len(generated) != 36 || strings.Count(generated, "-") != 4 {
+			t.Errorf("Expected request ID [%q] to be replaced by a generated UUID, got [%s]", id, generated)
+		}
+		if RequestID(r) != generated {
+			t.Errorf("Expected the handler to see request ID [%s], got [%s]", generated, RequestID(r))
+		}
+	}
+}
+
+func TestRequestLog(t *testing.T) {
+	var logged interface{}
+	handler := RequestIDMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		logged = RequestLog(w).Data["request id"]
+	})
+
+	r, err := http.NewRequest("GET", "https://localhost/v1/job", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.Header.Set(RequestIDHeader, "abc123")
+	handler(httptest.NewRecorder(), r)
+
+	if logged != "abc123" {
+		t.Errorf("Expected log entries to carry request ID [abc123], got [%v]", logged)
+	}
+}
+
+func TestRequireJSONBody(t *testing.T) {
+	called := false
+	handler := RequireJSONBody(func(c *Context, w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	cases := []struct {
+		method      string
+		contentType string
+		allowed     bool
+	}{
+		{"POST", "application/json", true},
+		{"POST", "application/json; charset=utf-8", true},
+		{"PUT", "application/json", true},
+		{"GET", "", true},
+		{"POST", "application/x-www-form-urlencoded", false},
+		{"PUT", "application/x-www-form-urlencoded", false},
+		{"POST", "", false},
+	}
+
+	for _, each := range cases {
+		called = false
+		r, err := http.NewRequest(each.method, "https://localhost/v1/job", strings.NewReader("jobs=1"))
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		if each.contentType != "" {
+			r.Header.Set("Content-Type", each.contentType)
+		}
+		w := httptest.NewRecorder()
+
+		handler(&Context{}, w, r)
+
+		if each.allowed {
+			if !called {
+				t.Errorf("Expected a %s with Content-Type [%s] to reach the handler", each.method, each.contentType)
+			}
+			continue
+		}
+
+		if called {
+			t.Errorf("Expected a %s with Content-Type [%s] to be rejected", each.method, each.contentType)
+		}
+		hasError(t, w, http.StatusUnsupportedMediaType, APIError{
+			Code:    CodeUnsupportedMediaType,
+			Message: "Unsupported Content-Type [" + each.contentType + "]",
+			Retry:   false,
+		})
+	}
+}
+
+func TestRequireBodyType(t *testing.T) {
+	called := false
+	handler := RequireBodyType(func(c *Context, w http.ResponseWriter, r *http.Request) {
+		called = true
+	}, "application/json", "multipart/form-data")
+
+	cases := []struct {
+		contentType string
+		allowed     bool
+	}{
+		{"application/json", true},
+		{"multipart/form-data; boundary=abc", true},
+		{"text/plain", false},
+	}
+
+	for _, each := range cases {
+		called = false
+		r, err := http.NewRequest("POST", "https://localhost/v1/job", strings.NewReader(""))
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.Header.Set("Content-Type", each.contentType)
+		w := httptest.NewRecorder()
+
+		handler(&Context{}, w, r)
+
+		if called != each.allowed {
+			t.Errorf("Expected Content-Type [%s] allowed to be [%v], got [%v]", each.contentType, each.allowed, called)
+		}
+		if !each.allowed && w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Unexpected HTTP status: [%d]", w.Code)
+		}
+	}
+}
+
+func TestCORSMiddleware(t *testing.T) {
+	called := false
+	handler := CORSMiddleware([]string{"https://app.example.com"})(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	})
+
+	cases := []struct {
+		description string
+		method      string
+		origin      string
+		preflight   bool
+		allowOrigin string
+		reached     bool
+	}{
+		{"allowed origin", "GET", "https://app.example.com", false, "https://app.example.com", true},
+		{"disallowed origin", "GET", "https://evil.example.com", false, "", true},
+		{"preflight", "OPTIONS", "https://app.example.com", true, "https://app.example.com", false},
+		{"plain OPTIONS", "OPTIONS", "https://app.example.com", false, "https://app.example.com", true},
+	}
+
+	for _, each := range cases {
+		called = false
+		r, err := http.NewRequest(each.method, "https://localhost/v1/job", nil)
+		if err != nil {
+			t.Fatalf("Unable to create request: %v", err)
+		}
+		r.Header.Set("Origin", each.origin)
+		if each.preflight {
+			r.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		w := httptest.NewRecorder()
+
+		handler(w, r)
+
+		if actual := w.HeaderMap.Get("Access-Control-Allow-Origin"); actual != each.allowOrigin {
+			t.Errorf("[%s] Expected Access-Control-Allow-Origin [%s], got [%s]", each.description, each.allowOrigin, actual)
+		}
+		if methods := w.HeaderMap.Get("Access-Control-Allow-Methods"); methods == "" {
+			t.Errorf("[%s] Expected Access-Control-Allow-Methods to be set", each.description)
+		}
+		if headers := w.HeaderMap.Get("Access-Control-Allow-Headers"); !strings.Contains(headers, "Authorization") {
+			t.Errorf("[%s] Unexpected Access-Control-Allow-Headers [%s]", each.description, headers)
+		}
+		if called != each.reached {
+			t.Errorf("[%s] Expected the handler to be reached: %v", each.description, each.reached)
+		}
+		if each.preflight && w.Code != http.StatusNoContent {
+			t.Errorf("[%s] Unexpected HTTP status: [%d]", each.description, w.Code)
+		}
+	}
+}
+
+func TestCORSMiddlewareDisabled(t *testing.T) {
+	handler := CORSMiddleware(nil)(func(w http.ResponseWriter, r *http.Request) {})
+
+	r, err := http.NewRequest("GET", "https://localhost/v1/job", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.Header.Set("Origin", "https://app.example.com")
+	w := httptest.NewRecorder()
+
+	handler(w, r)
+
+	for _, header := range []string{"Access-Control-Allow-Origin", "Access-Control-Allow-Methods", "Access-Control-Allow-Headers"} {
+		if value := w.HeaderMap.Get(header); value != "" {
+			t.Errorf("Expected no [%s] header, got [%s]", header, value)
+		}
+	}
+}
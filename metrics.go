@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// jobsSubmitted counts the jobs that each account has submitted.
+var jobsSubmitted = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rho_jobs_submitted_total",
+	Help: "Number of jobs submitted.",
+}, []string{"account"})
+
+// jobsCompleted counts the jobs that have finished running, by their final status.
+var jobsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "rho_jobs_completed_total",
+	Help: "Number of jobs that finished running.",
+}, []string{"status"})
+
+// jobDuration tracks the runtime of each job that finishes running.
+var jobDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "rho_job_duration_seconds",
+	Help:    "Time that finished jobs spent running.",
+	Buckets: []float64{1, 5, 15, 60, 300, 900, 3600, 4 * 3600, 24 * 3600},
+})
+
+// queueDepth tracks the number of jobs in each of the statuses in queueDepthStatuses.
+var queueDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "rho_queue_depth",
+	Help: "Number of jobs that are waiting on a dependency, queued, or processing.",
+}, []string{"status"})
+
+// queueDepthStatuses lists the statuses of the jobs that haven't finished yet.
+var queueDepthStatuses = []string{StatusWaiting, StatusQueued, StatusProcessing}
+
+// dockerOperationLatency tracks how long each Docker operation performed by Execute takes.
+var dockerOperationLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+	Name:    "rho_docker_operation_seconds",
+	Help:    "Time taken by the Docker operations used to run a job.",
+	Buckets: prometheus.DefBuckets,
+}, []string{"operation"})
+
+func init() {
+	prometheus.MustRegister(jobsSubmitted)
+	prometheus.MustRegister(jobsCompleted)
+	prometheus.MustRegister(jobDuration)
+	prometheus.MustRegister(queueDepth)
+	prometheus.MustRegister(dockerOperationLatency)
+}
+
+// MetricsHandler exposes the server's metrics in the Prometheus text format. Only administrators may
+// use it.
+func MetricsHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	admin, err := AuthenticateAdmin(c, w, r)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Authentication failure.")
+		return
+	}
+	c.Audit.Record(r, admin, "admin.metrics")
+
+	prometheus.Handler().ServeHTTP(w, r)
+}
+
+// recordJobCompletion counts a job that has finished running and records its runtime. Jobs that were
+// returned to the queue aren't counted.
+func recordJobCompletion(job *SubmittedJob) {
+	if job.Status == StatusQueued {
+		return
+	}
+
+	jobsCompleted.WithLabelValues(job.Status).Inc()
+	jobDuration.Observe(time.Duration(job.Runtime).Seconds())
+}
+
+// observeDockerOperation records the time that a Docker operation, like "create" or "wait", took since
+// it started.
+func observeDockerOperation(operation string, started time.Time) {
+	dockerOperationLatency.WithLabelValues(operation).Observe(time.Since(started).Seconds())
+}
+
+// RecordQueueDepth updates the queue depth gauges from storage. It's called on every poll tick of
+// the Runner.
+func RecordQueueDepth(c *Context) {
+	counts, err := c.CountJobsByStatus("")
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to count jobs for the queue depth metric.")
+		return
+	}
+
+	for _, status := range queueDepthStatuses {
+		queueDepth.WithLabelValues(status).Set(float64(counts[status]))
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// StatusCountStorage reports fixed job counts by status.
+type StatusCountStorage struct {
+	NullStorage
+
+	Counts map[string]int
+}
+
+func (storage StatusCountStorage) CountJobsByStatus(accountName string) (map[string]int, error) {
+	return storage.Counts, nil
+}
+
+// scrapeMetrics returns the metrics served by MetricsHandler to an administrator.
+func scrapeMetrics(t *testing.T) string {
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345"},
+		Storage:  NullStorage{},
+	}
+
+	r, err := http.NewRequest("GET", "https://localhost/metrics", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	MetricsHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+	return w.Body.String()
+}
+
+// metricValue finds the value of a single series within scraped metrics. Series that haven't been
+// recorded yet are zero.
+func metricValue(t *testing.T, body, series string) float64 {
+	for _, line := range strings.Split(body, "\n") {
+		if !strings.HasPrefix(line, series+" ") {
+			continue
+		}
+
+		value, err := strconv.ParseFloat(strings.TrimPrefix(line, series+" "), 64)
+		if err != nil {
+			t.Fatalf("Unable to parse the value of [%s]: %v", line, err)
+		}
+		return value
+	}
+	return 0
+}
+
+func TestMetricsRequiresAdmin(t *testing.T) {
+	c := &Context{Settings: Settings{AdminName: "admin", AdminKey: "12345"}}
+
+	r, err := http.NewRequest("GET", "https://localhost/metrics", nil)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	w := httptest.NewRecorder()
+
+	MetricsHandler(c, w, r)
+
+	hasError(t, w, http.StatusUnauthorized, APIError{
+		Code:    CodeCredentialsMissing,
+		Message: "You must authenticate.",
+		Retry:   false,
+	})
+}
+
+func TestJobLifecycleMetrics(t *testing.T) {
+	const (
+		submitted = `rho_jobs_submitted_total{account="admin"}`
+		completed = `rho_jobs_completed_total{status="done"}`
+		durations = `rho_job_duration_seconds_count`
+	)
+	before := scrapeMetrics(t)
+
+	c := &Context{
+		Settings: Settings{AdminName: "admin", AdminKey: "12345", Image: "cloudpipe/runner-py2"},
+		Storage:  &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)},
+		Docker:   &MockDockerClient{},
+	}
+	body := strings.NewReader(`{"jobs": [{"cmd": "id", "result_source": "stdout", "result_type": "binary"}, {"cmd": "id", "result_source": "stdout", "result_type": "binary"}]}`)
+	r, err := http.NewRequest("POST", "https://localhost/v1/job", body)
+	if err != nil {
+		t.Fatalf("Unable to create request: %v", err)
+	}
+	r.SetBasicAuth("admin", "12345")
+	w := httptest.NewRecorder()
+
+	JobHandler(c, w, r)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Unexpected HTTP status: [%d] %s", w.Code, w.Body.String())
+	}
+
+	Execute(c, &SubmittedJob{
+		Job:     Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:     1,
+		Account: "admin",
+		Status:  StatusProcessing,
+	})
+
+	after := scrapeMetrics(t)
+	if delta := metricValue(t, after, submitted) - metricValue(t, before, submitted); delta != 2 {
+		t.Errorf("Expected [%s] to increase by 2, got %v", submitted, delta)
+	}
+	if delta := metricValue(t, after, completed) - metricValue(t, before, completed); delta != 1 {
+		t.Errorf("Expected [%s] to increase by 1, got %v", completed, delta)
+	}
+	if delta := metricValue(t, after, durations) - metricValue(t, before, durations); delta != 1 {
+		t.Errorf("Expected [%s] to increase by 1, got %v", durations, delta)
+	}
+}
+
+func TestRecordQueueDepth(t *testing.T) {
+	c := &Context{
+		Storage: StatusCountStorage{Counts: map[string]int{StatusQueued: 3, StatusProcessing: 1, StatusDone: 8}},
+	}
+
+	RecordQueueDepth(c)
+
+	body := scrapeMetrics(t)
+	for _, expected := range []string{
+		`rho_queue_depth{status="queued"} 3`,
+		`rho_queue_depth{status="processing"} 1`,
+		`rho_queue_depth{status="waiting"} 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected the metrics to include [%s], got:\n%s", expected, body)
+		}
+	}
+	if strings.Contains(body, `rho_queue_depth{status="done"}`) {
+		t.Errorf("Expected finished jobs not to be tracked, got:\n%s", body)
+	}
+}
+
+func TestExecuteObservesDockerOperations(t *testing.T) {
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   &MockDockerClient{},
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	body := scrapeMetrics(t)
+	for _, operation := range []string{"create", "start", "wait", "remove"} {
+		expected := `rho_docker_operation_seconds_count{operation="` + operation + `"}`
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected the metrics to include [%s], got:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// MigrationRunning indicates that a schema migration is still being applied.
+	MigrationRunning = "running"
+
+	// MigrationDone indicates that every pending schema migration was applied.
+	MigrationDone = "done"
+
+	// MigrationFailed indicates that a schema migration returned an error.
+	MigrationFailed = "failed"
+)
+
+// ErrMigrationInProgress is returned when a schema migration is started while another one holds the
+// migration lock.
+var ErrMigrationInProgress = errors.New("a schema migration is already in progress")
+
+// Migration records the progress of a schema migration that was started through the API.
+type Migration struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	FromVersion int        `json:"from_version"`
+	ToVersion   int        `json:"to_version"`
+	StartedAt   StoredTime `json:"started_at"`
+	FinishedAt  StoredTime `json:"finished_at,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// MigrationTracker runs schema migrations in the background and remembers their progress. Progress
+// is only known to the process that started the migration.
+type MigrationTracker struct {
+	lock       sync.Mutex
+	migrations map[string]*Migration
+}
+
+// NewMigrationTracker creates a MigrationTracker that hasn't started any migrations.
+func NewMigrationTracker() *MigrationTracker {
+	return &MigrationTracker{migrations: make(map[string]*Migration)}
+}
+
+// Start acquires the storage engine's migration lock and applies any pending schema migrations in
+// a new goroutine. ErrMigrationInProgress is returned if the lock is already held. Call done, if it's
+// provided, once the migration has finished.
+func (t *MigrationTracker) Start(c *Context, done func()) (Migration, error) {
+	id, err := newMigrationID()
+	if err != nil {
+		return Migration{}, err
+	}
+
+	locked, err := c.LockMigrations(id)
+	if err != nil {
+		return Migration{}, err
+	}
+	if !locked {
+		return Migration{}, ErrMigrationInProgress
+	}
+
+	from, err := c.SchemaVersion()
+	if err != nil {
+		c.UnlockMigrations(id)
+		return Migration{}, err
+	}
+
+	m := &Migration{
+		ID:          id,
+		Status:      MigrationRunning,
+		FromVersion: from,
+		ToVersion:   LatestSchemaVersion(),
+		StartedAt:   StoreTime(c.clock().Now()),
+	}
+
+	t.lock.Lock()
+	t.migrations[id] = m
+	started := *m
+	t.lock.Unlock()
+
+	go func() {
+		if done != nil {
+			defer done()
+		}
+
+		err := c.MigrateSchema()
+
+		t.lock.Lock()
+		m.FinishedAt = StoreTime(c.clock().Now())
+		if err != nil {
+			m.Status = MigrationFailed
+			m.Error = err.Error()
+		} else {
+			m.Status = MigrationDone
+		}
+		t.lock.Unlock()
+
+		if err := c.UnlockMigrations(id); err != nil {
+			log.WithFields(log.Fields{
+				"migration": id,
+				"error":     err,
+			}).Error("Unable to release the migration lock.")
+		}
+	}()
+
+	return started, nil
+}
+
+// Get returns the progress of a migration started by this tracker.
+func (t *MigrationTracker) Get(id string) (Migration, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	m, ok := t.migrations[id]
+	if !ok {
+		return Migration{}, false
+	}
+	return *m, true
+}
+
+// migrationLockPoll is how often MigrateSchemaLocked checks whether another process has released
+// the migration lock.
+const migrationLockPoll = time.Second
+
+// MigrateSchemaLocked applies any pending schema migrations to storage while holding its migration
+// lock, so that processes starting at the same time don't apply the same migration twice. If
+// another process holds the lock, it waits for the lock to be released first.
+func MigrateSchemaLocked(storage Storage, clock Clock) error {
+	owner, err := newMigrationID()
+	if err != nil {
+		return err
+	}
+
+	for {
+		locked, err := storage.LockMigrations(owner)
+		if err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+
+		log.Info("Waiting for another process to finish migrating the schema.")
+		<-clock.After(migrationLockPoll)
+	}
+
+	defer func() {
+		if err := storage.UnlockMigrations(owner); err != nil {
+			log.WithFields(log.Fields{
+				"migration": owner,
+				"error":     err,
+			}).Error("Unable to release the migration lock.")
+		}
+	}()
+
+	return storage.MigrateSchema()
+}
+
+// newMigrationID generates a random identifier for a migration.
+func newMigrationID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	docker "github.com/smashwilson/go-dockerclient"
+)
+
+// MockDockerClient is a fake Docker implementation for runner tests. It records the calls made to
+// it and returns configurable results, so that tests don't require a live Docker daemon. Its zero
+// value creates containers that exit successfully as soon as they're started.
+type MockDockerClient struct {
+	NullDocker
+
+	// CreateErr, StartErr and KillErr are returned from CreateContainer, StartContainer and
+	// KillContainer.
+	CreateErr error
+	StartErr  error
+	KillErr   error
+
+	// ExitStatus and WaitErr are returned from WaitContainer once a container exits on its own.
+	ExitStatus int
+	WaitErr    error
+
+	// Runtime is how long a container runs before it exits on its own. If RunUntilStopped is set
+	// and Runtime is zero, containers run until StopContainer is called. Stopped containers exit
+	// with status 137.
+	Runtime         time.Duration
+	RunUntilStopped bool
+
+	// Clock, if it's set, is advanced by Runtime when a container runs, instead of waiting for Runtime
+	// to pass in real time.
+	Clock *FakeClock
+
+	// LocalImages are present on the Docker host, and RemoteImages may be pulled from a registry.
+	// Every image is considered present if LocalImages is nil.
+	LocalImages  map[string]bool
+	RemoteImages map[string]bool
+
+	// ImageSize is the virtual size reported for every image that's inspected.
+	ImageSize int64
+
+	// Existing are containers that are already present on the Docker host, by name.
+	Existing map[string]*docker.Container
+
+	// Samples are sent, in order, to every stats stream.
+	Samples []*docker.Stats
+
+	// PullMessages are written, in order, to the output stream of every pull.
+	PullMessages []string
+
+	// Files holds the contents of files within containers, by path, for CopyFromContainer.
+	Files map[string]string
+
+	// Recorded calls.
+	Created   []docker.CreateContainerOptions
+	Attached  []docker.AttachToContainerOptions
+	Started   []*docker.HostConfig
+	Removed   []string
+	Stopped   []string
+	Killed    []string
+	Inspected []string
+	Pulled    []docker.PullImageOptions
+	Copied    []string
+
+	lock    sync.Mutex
+	stopped chan struct{}
+}
+
+// stoppedChannel lazily creates the channel that's closed when the first container is stopped.
+func (d *MockDockerClient) stoppedChannel() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stopped == nil {
+		d.stopped = make(chan struct{})
+	}
+	return d.stopped
+}
+
+func (d *MockDockerClient) CreateContainer(opts docker.CreateContainerOptions) (*docker.Container, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Created = append(d.Created, opts)
+	if d.CreateErr != nil {
+		return nil, d.CreateErr
+	}
+	return &docker.Container{ID: "abc123", Name: opts.Name}, nil
+}
+
+func (d *MockDockerClient) InspectContainer(id string) (*docker.Container, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if container, ok := d.Existing[id]; ok {
+		return container, nil
+	}
+	return nil, &docker.NoSuchContainer{ID: id}
+}
+
+func (d *MockDockerClient) AttachToContainer(opts docker.AttachToContainerOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Attached = append(d.Attached, opts)
+	return nil
+}
+
+func (d *MockDockerClient) StartContainer(id string, hostConfig *docker.HostConfig) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Started = append(d.Started, hostConfig)
+	return d.StartErr
+}
+
+func (d *MockDockerClient) WaitContainer(id string) (int, error) {
+	stopped := d.stoppedChannel()
+
+	if d.Runtime > 0 && d.Clock != nil {
+		d.Clock.Advance(d.Runtime)
+	} else if d.Runtime > 0 {
+		select {
+		case <-stopped:
+			return 137, nil
+		case <-time.After(d.Runtime):
+		}
+	} else if d.RunUntilStopped {
+		<-stopped
+		return 137, nil
+	}
+
+	return d.ExitStatus, d.WaitErr
+}
+
+func (d *MockDockerClient) CopyFromContainer(opts docker.CopyFromContainerOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Copied = append(d.Copied, opts.Resource)
+	content, ok := d.Files[opts.Resource]
+	if !ok {
+		return errors.New("no such file")
+	}
+
+	tw := tar.NewWriter(opts.OutputStream)
+	if err := tw.WriteHeader(&tar.Header{Name: opts.Resource, Mode: 0644, Size: int64(len(content))}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(content)); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func (d *MockDockerClient) Stats(opts docker.StatsOptions) error {
+	for _, sample := range d.Samples {
+		opts.Stats <- sample
+	}
+	close(opts.Stats)
+	return nil
+}
+
+func (d *MockDockerClient) RemoveContainer(opts docker.RemoveContainerOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Removed = append(d.Removed, opts.ID)
+	return nil
+}
+
+func (d *MockDockerClient) StopContainer(id string, timeout uint) error {
+	stopped := d.stoppedChannel()
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if len(d.Stopped) == 0 {
+		close(stopped)
+	}
+	d.Stopped = append(d.Stopped, id)
+	return nil
+}
+
+func (d *MockDockerClient) KillContainer(opts docker.KillContainerOptions) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Killed = append(d.Killed, opts.ID)
+	return d.KillErr
+}
+
+func (d *MockDockerClient) InspectImage(name string) (*docker.Image, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Inspected = append(d.Inspected, name)
+	if d.LocalImages != nil && !d.LocalImages[name] {
+		return nil, docker.ErrNoSuchImage
+	}
+	return &docker.Image{ID: name, VirtualSize: d.ImageSize}, nil
+}
+
+func (d *MockDockerClient) PullImage(opts docker.PullImageOptions, auth docker.AuthConfiguration) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.Pulled = append(d.Pulled, opts)
+	if opts.OutputStream != nil {
+		for _, message := range d.PullMessages {
+			io.WriteString(opts.OutputStream, message)
+		}
+	}
+
+	name := opts.Repository + ":" + opts.Tag
+	if !d.RemoteImages[name] {
+		return errors.New("not found in registry")
+	}
+	if d.LocalImages != nil {
+		d.LocalImages[name] = true
+	}
+	return nil
+}
+
+// Ensure that MockDockerClient adheres to the Docker interface.
+var _ Docker = &MockDockerClient{}
@@ -0,0 +1,1091 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	_ "github.com/lib/pq"
+)
+
+// PostgresStorage is a Storage implementation that connects to a PostgreSQL database.
+type PostgresStorage struct {
+	DB *sql.DB
+}
+
+// Ensure that PostgresStorage adheres to the Storage interface.
+var _ Storage = &PostgresStorage{}
+
+// NewPostgresStorage opens a connection pool to the PostgreSQL database at the configured DSN.
+func NewPostgresStorage(c *Context) (*PostgresStorage, error) {
+	db, err := sql.Open("postgres", c.Settings.PostgresDSN)
+	if err != nil {
+		return nil, err
+	}
+	return &PostgresStorage{DB: db}, nil
+}
+
+// Bootstrap creates the table that tracks schema migrations. Every other table is created by a
+// migration.
+func (storage *PostgresStorage) Bootstrap() error {
+	if _, err := storage.DB.Exec(postgresSchemaVersionsSQL); err != nil {
+		return err
+	}
+	_, err := storage.DB.Exec(postgresLocksSQL)
+	return err
+}
+
+// Ping checks that the PostgreSQL database is reachable.
+func (storage *PostgresStorage) Ping() error {
+	return storage.DB.Ping()
+}
+
+// postgresMigration is a versioned change to the PostgreSQL schema.
+type postgresMigration struct {
+	Version     int
+	Description string
+	SQL         string
+}
+
+// postgresMigrations lists every migration in the order that they must be applied. Versions are
+// kept in step with schemaMigrations, so that LatestSchemaVersion holds for either storage engine.
+var postgresMigrations = []postgresMigration{
+	{
+		Version:     1,
+		Description: "Create tables.",
+		SQL:         postgres0001CreateTablesSQL,
+	},
+	{
+		Version:     2,
+		Description: "Index job status, account and tags.",
+		SQL:         postgres0002CreateJobIndicesSQL,
+	},
+	{
+		Version:     3,
+		Description: "Index job cache keys.",
+		SQL:         postgres0003CreateCacheKeyIndexSQL,
+	},
+	{
+		Version:     4,
+		Description: "Create idempotency_keys.",
+		SQL:         postgres0004CreateIdempotencyKeysSQL,
+	},
+	{
+		Version:     5,
+		Description: "Store API key hashes on accounts.",
+		SQL:         postgres0005AddAccountKeyHashSQL,
+	},
+	{
+		Version:     6,
+		Description: "Track whether accounts are active.",
+		SQL:         postgres0006AddAccountActiveSQL,
+	},
+	{
+		Version:     7,
+		Description: "Index job run IDs.",
+		SQL:         postgres0007CreateRunIDIndexSQL,
+	},
+	{
+		Version:     8,
+		Description: "Store queued job quotas on accounts.",
+		SQL:         postgres0008AddAccountQueuedQuotaSQL,
+	},
+}
+
+// SchemaVersion returns the version of the most recent migration that has been applied, or zero if
+// none have.
+func (storage *PostgresStorage) SchemaVersion() (int, error) {
+	var version int
+	err := storage.DB.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM schema_versions`).Scan(&version)
+	return version, err
+}
+
+// MigrateSchema applies each migration that's newer than the current schema version, in order. Each
+// migration is applied in its own transaction.
+func (storage *PostgresStorage) MigrateSchema() error {
+	current, err := storage.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range postgresMigrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		fields := log.Fields{
+			"version":     migration.Version,
+			"description": migration.Description,
+		}
+		if err := storage.applyMigration(migration); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to apply a schema migration.")
+			return err
+		}
+		log.WithFields(fields).Info("Applied a schema migration.")
+	}
+	return nil
+}
+
+func (storage *PostgresStorage) applyMigration(migration postgresMigration) error {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(migration.SQL); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO schema_versions (version, applied_at) VALUES ($1, $2)`,
+		migration.Version, StoreTime(time.Now()),
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// LockMigrations acquires the advisory lock on schema migrations for owner. It returns false if
+// another owner already holds it. A lock that's older than migrationLockTTL is taken over.
+func (storage *PostgresStorage) LockMigrations(owner string) (bool, error) {
+	now := time.Now()
+	result, err := storage.DB.Exec(
+		`INSERT INTO locks (id, owner, locked_at) VALUES ($1, $2, $3)
+		ON CONFLICT (id) DO UPDATE SET owner = EXCLUDED.owner, locked_at = EXCLUDED.locked_at
+		WHERE locks.locked_at < $4`,
+		migrationLockID, owner, StoreTime(now), StoreTime(now.Add(-migrationLockTTL)),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// UnlockMigrations releases the advisory lock on schema migrations if owner holds it.
+func (storage *PostgresStorage) UnlockMigrations(owner string) error {
+	_, err := storage.DB.Exec(`DELETE FROM locks WHERE id = $1 AND owner = $2`, migrationLockID, owner)
+	return err
+}
+
+// Job storage
+
+// jobColumns lists the columns of the "jobs" and "dead_jobs" tables in the order that scanJob
+// expects them.
+const jobColumns = `jid, account, status, created_at, started_at, finished_at, container_id, kill_requested, data`
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// execer is satisfied by both *sql.DB and *sql.Tx.
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// scanJob reads a SubmittedJob from a row of jobColumns. Columns take precedence over the JSONB
+// data, which doesn't include the fields that are hidden from JSON.
+func scanJob(row rowScanner) (*SubmittedJob, error) {
+	var (
+		job     SubmittedJob
+		columns SubmittedJob
+		data    []byte
+	)
+	err := row.Scan(
+		&columns.JID, &columns.Account, &columns.Status, &columns.CreatedAt, &columns.StartedAt,
+		&columns.FinishedAt, &columns.ContainerID, &columns.KillRequested, &data,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, err
+	}
+
+	job.JID = columns.JID
+	job.Account = columns.Account
+	job.Status = columns.Status
+	job.CreatedAt = columns.CreatedAt
+	job.StartedAt = columns.StartedAt
+	job.FinishedAt = columns.FinishedAt
+	job.ContainerID = columns.ContainerID
+	job.KillRequested = columns.KillRequested
+	return &job, nil
+}
+
+// InsertJob appends a job to the queue and returns a newly allocated job ID. A job that already has
+// a JID, like one copied from another storage engine, keeps it.
+func (storage *PostgresStorage) InsertJob(job SubmittedJob) (uint64, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return 0, err
+	}
+
+	if job.JID != 0 {
+		return job.JID, storage.insertJobWithJID(job, data)
+	}
+
+	var jid uint64
+	err = storage.DB.QueryRow(
+		`INSERT INTO jobs (account, status, created_at, started_at, finished_at, container_id, kill_requested, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING jid`,
+		job.Account, job.Status, job.CreatedAt, job.StartedAt, job.FinishedAt, job.ContainerID, job.KillRequested, data,
+	).Scan(&jid)
+	if err != nil {
+		return 0, err
+	}
+	return jid, nil
+}
+
+// InsertJobWithinQuota inserts a job unless its account would then have more than maxQueued jobs
+// waiting to run, in which case ErrQuotaExceeded is returned. The account's submissions are
+// serialized by a transaction-scoped advisory lock, so that concurrent submissions can't overshoot the
+// quota.
+func (storage *PostgresStorage) InsertJobWithinQuota(job SubmittedJob, maxQueued int) (uint64, error) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, job.Account); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	where, args := JobQuery{AccountName: job.Account, Statuses: quotaStatuses}.whereClause()
+	var queued int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM jobs`+where, args...).Scan(&queued); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if queued >= maxQueued {
+		tx.Rollback()
+		return 0, ErrQuotaExceeded
+	}
+
+	var jid uint64
+	err = tx.QueryRow(
+		`INSERT INTO jobs (account, status, created_at, started_at, finished_at, container_id, kill_requested, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING jid`,
+		job.Account, job.Status, job.CreatedAt, job.StartedAt, job.FinishedAt, job.ContainerID, job.KillRequested, data,
+	).Scan(&jid)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return jid, nil
+}
+
+// insertJobWithJID inserts a job with an existing JID and advances the JID sequence past it, so that
+// newly submitted jobs don't collide with it.
+func (storage *PostgresStorage) insertJobWithJID(job SubmittedJob, data []byte) error {
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO jobs (`+jobColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`,
+		job.JID, job.Account, job.Status, job.CreatedAt, job.StartedAt, job.FinishedAt,
+		job.ContainerID, job.KillRequested, data,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	_, err = tx.Exec(`SELECT setval(pg_get_serial_sequence('jobs', 'jid'), (SELECT MAX(jid) FROM jobs))`)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// whereClause builds the SQL condition that matches a JobQuery, ignoring its Limit and Offset, along
+// with its arguments.
+func (query JobQuery) whereClause() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	arg := func(value interface{}) string {
+		args = append(args, value)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	in := func(column string, values []interface{}) {
+		placeholders := make([]string, len(values))
+		for i, value := range values {
+			placeholders[i] = arg(value)
+		}
+		conditions = append(conditions, column+" IN ("+strings.Join(placeholders, ", ")+")")
+	}
+
+	if query.AccountName != "" {
+		conditions = append(conditions, "account = "+arg(query.AccountName))
+	}
+
+	if len(query.JIDs) > 0 {
+		values := make([]interface{}, len(query.JIDs))
+		for i, jid := range query.JIDs {
+			values[i] = jid
+		}
+		in("jid", values)
+	}
+	if query.BeforeJID != 0 {
+		conditions = append(conditions, "jid < "+arg(query.BeforeJID))
+	}
+	if query.AfterJID != 0 {
+		conditions = append(conditions, "jid > "+arg(query.AfterJID))
+	}
+
+	if len(query.Names) > 0 {
+		values := make([]interface{}, len(query.Names))
+		for i, name := range query.Names {
+			values[i] = name
+		}
+		in("data ->> 'name'", values)
+	}
+
+	if len(query.Statuses) > 0 {
+		values := make([]interface{}, len(query.Statuses))
+		for i, status := range query.Statuses {
+			values[i] = status
+		}
+		in("status", values)
+	}
+
+	for key, value := range query.Tags {
+		conditions = append(conditions, "data -> 'tags' ->> "+arg(key)+" = "+arg(value))
+	}
+
+	if !query.CreatedSince.IsZero() {
+		conditions = append(conditions, "created_at >= "+arg(query.CreatedSince))
+	}
+	if !query.CreatedUntil.IsZero() {
+		conditions = append(conditions, "created_at <= "+arg(query.CreatedUntil))
+	}
+
+	if query.RunID != "" {
+		conditions = append(conditions, "data ->> 'run_id' = "+arg(query.RunID))
+	}
+
+	// Scheduled times are stored in the job's data as fixed-width timestamp strings, so they sort
+	// chronologically when they're compared as text.
+	if !query.ScheduledUntil.IsZero() {
+		conditions = append(conditions,
+			"(data ->> 'scheduled_at' IS NULL OR data ->> 'scheduled_at' <= "+arg(query.ScheduledUntil.String())+")")
+	}
+
+	if len(conditions) == 0 {
+		return "", args
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// ListJobs queries jobs that have been submitted to the cluster. Jobs from all accounts are returned
+// if the query's AccountName is empty.
+func (storage *PostgresStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
+	where, args := query.whereClause()
+
+	q := `SELECT ` + jobColumns + ` FROM jobs` + where + ` ORDER BY jid`
+	if query.descending() {
+		q += " DESC"
+	}
+	if query.Limit > 0 {
+		q += fmt.Sprintf(" LIMIT %d", query.Limit)
+	}
+	if query.Offset > 0 {
+		q += fmt.Sprintf(" OFFSET %d", query.Offset)
+	}
+
+	rows, err := storage.DB.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []SubmittedJob{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if query.descending() {
+		reverseJobs(result)
+	}
+	return result, nil
+}
+
+// GetJobByName returns the most recently submitted job with a given name that belongs to an account.
+// Archived jobs are ignored. ErrNotFound is returned if there isn't one.
+func (storage *PostgresStorage) GetJobByName(accountName, name string) (*SubmittedJob, error) {
+	row := storage.DB.QueryRow(
+		`SELECT `+jobColumns+` FROM jobs WHERE account = $1 AND data ->> 'name' = $2 ORDER BY jid DESC LIMIT 1`,
+		accountName, name,
+	)
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return job, err
+}
+
+// FindCachedJob returns an account's most recent successfully completed job with a cache key whose
+// result hasn't expired. ErrNotFound is returned if there isn't one.
+func (storage *PostgresStorage) FindCachedJob(accountName, cacheKey string) (*SubmittedJob, error) {
+	rows, err := storage.DB.Query(
+		`SELECT `+jobColumns+` FROM jobs WHERE account = $1 AND data ->> 'cache_key' = $2 AND status = $3
+		ORDER BY jid DESC`,
+		accountName, cacheKey, StatusDone,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	// Expiry times are stored as timestamp strings within the JSONB data, so they're compared here.
+	now := StoreTime(time.Now())
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		if job.CacheExpiresAt.IsZero() || job.CacheExpiresAt.After(now) {
+			return job, nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+// GetIdempotencyKey returns the record of an account's idempotency key that is unexpired as of now.
+// ErrNotFound is returned if there isn't one.
+func (storage *PostgresStorage) GetIdempotencyKey(accountName, key string, now time.Time) (*IdempotencyKey, error) {
+	record := IdempotencyKey{Account: accountName, Key: key}
+	var expiresAt StoredTime
+	err := storage.DB.QueryRow(
+		`SELECT jid, expires_at FROM idempotency_keys WHERE account = $1 AND key = $2 AND expires_at > $3`,
+		accountName, key, StoreTime(now),
+	).Scan(&record.JID, &expiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	record.ExpiresAt = expiresAt.AsTime()
+	return &record, nil
+}
+
+// ReserveIdempotencyKey records an idempotency key before its job is created, replacing any record
+// that expired before now. The primary key makes the reservation atomic, so that only one of several
+// concurrent submissions with the same key can hold it. ErrIdempotencyKeyExists is returned if an
+// unexpired record already holds the key.
+func (storage *PostgresStorage) ReserveIdempotencyKey(record IdempotencyKey, now time.Time) error {
+	result, err := storage.DB.Exec(
+		`INSERT INTO idempotency_keys (account, key, jid, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (account, key) DO UPDATE SET jid = EXCLUDED.jid, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= $5`,
+		record.Account, record.Key, record.JID, StoreTime(record.ExpiresAt), StoreTime(now),
+	)
+	if err != nil {
+		return err
+	}
+
+	reserved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if reserved == 0 {
+		return ErrIdempotencyKeyExists
+	}
+	return nil
+}
+
+// SaveIdempotencyKey records the job created for an idempotency key, replacing any expired record.
+// PostgreSQL has no TTL indices, so expired records stay in place until they're replaced.
+func (storage *PostgresStorage) SaveIdempotencyKey(record IdempotencyKey) error {
+	_, err := storage.DB.Exec(
+		`INSERT INTO idempotency_keys (account, key, jid, expires_at) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (account, key) DO UPDATE SET jid = EXCLUDED.jid, expires_at = EXCLUDED.expires_at`,
+		record.Account, record.Key, record.JID, StoreTime(record.ExpiresAt),
+	)
+	return err
+}
+
+// ReleaseIdempotencyKey discards a reservation whose submission failed, so that the key may be used
+// again. Keys that already record a job are left alone.
+func (storage *PostgresStorage) ReleaseIdempotencyKey(accountName, key string) error {
+	_, err := storage.DB.Exec(
+		`DELETE FROM idempotency_keys WHERE account = $1 AND key = $2 AND jid = 0`,
+		accountName, key,
+	)
+	return err
+}
+
+// CountJobs counts the jobs that match a query, ignoring its Limit and Offset.
+func (storage *PostgresStorage) CountJobs(query JobQuery) (int, error) {
+	where, args := query.whereClause()
+
+	var count int
+	err := storage.DB.QueryRow(`SELECT COUNT(*) FROM jobs`+where, args...).Scan(&count)
+	return count, err
+}
+
+// CountJobsByStatus counts the jobs submitted by an account in each status. Jobs from all accounts
+// are counted if accountName is empty. Statuses without any jobs are omitted.
+func (storage *PostgresStorage) CountJobsByStatus(accountName string) (map[string]int, error) {
+	depths, err := storage.countByStatus(JobQuery{AccountName: accountName})
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(depths))
+	for status, count := range depths {
+		counts[status] = int(count)
+	}
+	return counts, nil
+}
+
+// CountJobsByAccount counts each account's jobs in each of statuses, in a single query. Results are
+// ordered by account, then status. Accounts without any jobs in statuses are omitted.
+func (storage *PostgresStorage) CountJobsByAccount(statuses []string) ([]AccountJobCount, error) {
+	where, args := JobQuery{Statuses: statuses}.whereClause()
+
+	rows, err := storage.DB.Query(
+		`SELECT account, status, COUNT(*), MIN(created_at) FROM jobs`+where+` GROUP BY 1, 2 ORDER BY 1, 2`,
+		args...,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := []AccountJobCount{}
+	for rows.Next() {
+		var count AccountJobCount
+		if err := rows.Scan(&count.Account, &count.Status, &count.Count, &count.OldestCreatedAt); err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// ListRuns summarizes an account's runs, in the order that their first jobs were submitted. Only the
+// runs that follow the cursor after are included, and at most limit runs are returned.
+func (storage *PostgresStorage) ListRuns(accountName string, after RunCursor, limit int) ([]RunSummary, error) {
+	rows, err := storage.DB.Query(`WITH runs AS (
+			SELECT data ->> 'run_id' AS run_id, MIN(created_at) - MIN(created_at) % $5 AS created_ms FROM jobs
+			WHERE account = $1 AND data ? 'run_id'
+			GROUP BY 1 HAVING (MIN(created_at) - MIN(created_at) % $5, data ->> 'run_id') > ($2, $3)
+			ORDER BY 2, 1 LIMIT $4
+		)
+		SELECT runs.run_id, jobs.status, COUNT(*), MIN(jobs.created_at),
+			COALESCE(MIN(NULLIF(jobs.started_at, 0)), 0), MAX(jobs.finished_at)
+		FROM runs JOIN jobs ON jobs.account = $1 AND jobs.data ->> 'run_id' = runs.run_id
+		GROUP BY runs.run_id, runs.created_ms, jobs.status
+		ORDER BY runs.created_ms, runs.run_id`,
+		accountName, after.CreatedAt.Truncate(time.Millisecond), after.RunID, limit, int64(time.Millisecond),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return scanRunSummaries(rows)
+}
+
+// GetRunSummary summarizes a single run of an account's jobs. ErrNotFound is returned if the run
+// has no jobs.
+func (storage *PostgresStorage) GetRunSummary(accountName, runID string) (RunSummary, error) {
+	rows, err := storage.DB.Query(`SELECT data ->> 'run_id', status, COUNT(*), MIN(created_at),
+			COALESCE(MIN(NULLIF(started_at, 0)), 0), MAX(finished_at)
+		FROM jobs WHERE account = $1 AND data ->> 'run_id' = $2
+		GROUP BY 1, 2`,
+		accountName, runID,
+	)
+	if err != nil {
+		return RunSummary{}, err
+	}
+
+	runs, err := scanRunSummaries(rows)
+	if err != nil {
+		return RunSummary{}, err
+	}
+	if len(runs) == 0 {
+		return RunSummary{}, ErrNotFound
+	}
+	return runs[0], nil
+}
+
+// scanRunSummaries reads rows of run ID, status, count, and the earliest creation, earliest start
+// and latest finish times of the jobs with that status. Each run's rows must be adjacent.
+func scanRunSummaries(rows *sql.Rows) ([]RunSummary, error) {
+	defer rows.Close()
+
+	runs := []RunSummary{}
+	for rows.Next() {
+		var (
+			runID                            string
+			status                           string
+			count                            int
+			createdAt, startedAt, finishedAt StoredTime
+		)
+		if err := rows.Scan(&runID, &status, &count, &createdAt, &startedAt, &finishedAt); err != nil {
+			return nil, err
+		}
+
+		if len(runs) == 0 || runs[len(runs)-1].RunID != runID {
+			runs = append(runs, RunSummary{RunID: runID})
+		}
+		runs[len(runs)-1].add(status, count, createdAt, startedAt, finishedAt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range runs {
+		runs[i].finish()
+	}
+	return runs, nil
+}
+
+// GetQueueDepths counts the jobs in each status across all accounts.
+func (storage *PostgresStorage) GetQueueDepths() (map[string]int64, error) {
+	return storage.countByStatus(JobQuery{})
+}
+
+// countByStatus groups the jobs that match a query by status.
+func (storage *PostgresStorage) countByStatus(query JobQuery) (map[string]int64, error) {
+	where, args := query.whereClause()
+
+	rows, err := storage.DB.Query(`SELECT status, COUNT(*) FROM jobs`+where+` GROUP BY status`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var status string
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// JobKillRequested returns true if a request has been submitted to kill the job with with provided
+// JID, and false otherwise.
+func (storage *PostgresStorage) JobKillRequested(id uint64) (bool, error) {
+	var killRequested bool
+	err := storage.DB.QueryRow(`SELECT kill_requested FROM jobs WHERE jid = $1`, id).Scan(&killRequested)
+	if err == sql.ErrNoRows {
+		return false, ErrNotFound
+	}
+	return killRequested, err
+}
+
+// JobRunner returns the RunnerID of the runner that most recently claimed the job with the provided
+// ID, or an empty string if it hasn't been claimed.
+func (storage *PostgresStorage) JobRunner(id uint64) (string, error) {
+	var runner string
+	err := storage.DB.QueryRow(`SELECT COALESCE(data->>'runner', '') FROM jobs WHERE jid = $1`, id).Scan(&runner)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return runner, err
+}
+
+// ClaimJob atomically searches for the oldest pending SubmittedJob that doesn't belong to one of
+// skipAccounts and isn't scheduled to run after now, marks it as StatusProcessing, and returns it.
+// nil is returned if no SubmittedJobs are available.
+func (storage *PostgresStorage) ClaimJob(skipAccounts []string, now StoredTime) (*SubmittedJob, error) {
+	// Scheduled times are stored in the job's data as fixed-width timestamp strings, so they sort
+	// chronologically when they're compared as text.
+	args := []interface{}{StatusProcessing, StatusQueued, now.String()}
+
+	var skip string
+	if len(skipAccounts) > 0 {
+		placeholders := make([]string, len(skipAccounts))
+		for i, account := range skipAccounts {
+			args = append(args, account)
+			placeholders[i] = fmt.Sprintf("$%d", len(args))
+		}
+		skip = " AND account NOT IN (" + strings.Join(placeholders, ", ") + ")"
+	}
+
+	// SKIP LOCKED lets concurrent runners claim different jobs instead of waiting on each other.
+	row := storage.DB.QueryRow(`UPDATE jobs SET status = $1
+		WHERE jid = (
+			SELECT jid FROM jobs WHERE status = $2
+				AND (data->>'scheduled_at' IS NULL OR data->>'scheduled_at' <= $3)`+skip+`
+			ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, args...)
+
+	job, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		// No jobs in the queue.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// ReclaimJob atomically hands a running job over to runner, restamping its StartedAt, as long as the
+// job is still running and hasn't been restarted since it was loaded. nil is returned if it has.
+func (storage *PostgresStorage) ReclaimJob(job SubmittedJob, runner string, startedAt StoredTime) (*SubmittedJob, error) {
+	row := storage.DB.QueryRow(`UPDATE jobs SET started_at = $1, data = jsonb_set(data, '{runner}', to_jsonb($2::TEXT))
+		WHERE jid = $3 AND status = $4 AND started_at = $5
+		RETURNING `+jobColumns,
+		startedAt, runner, job.JID, StatusProcessing, job.StartedAt,
+	)
+
+	reclaimed, err := scanJob(row)
+	if err == sql.ErrNoRows {
+		// Another runner got to it first, or the job finished.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return reclaimed, nil
+}
+
+// UpdateJob updates the state of a job in the database to match any changes made to the model. A
+// kill request is never cleared, to match the MongoDB implementation.
+func (storage *PostgresStorage) UpdateJob(job *SubmittedJob) error {
+	return updateJob(storage.DB, job)
+}
+
+// CancelJobs flags every job that matches a query and hasn't finished to be killed, ignoring the
+// query's Statuses. Jobs that haven't started are killed outright, and running jobs are left for
+// their runners to stop. The update is conditioned on each job's status, so a job that finishes in
+// the meantime is left alone. It returns the number of jobs that were flagged.
+func (storage *PostgresStorage) CancelJobs(query JobQuery) (int, error) {
+	query.Statuses = []string{StatusWaiting, StatusQueued, StatusProcessing}
+	where, args := query.whereClause()
+	args = append(args, StatusProcessing, StatusKilled)
+
+	result, err := storage.DB.Exec(fmt.Sprintf(`UPDATE jobs SET kill_requested = TRUE,
+			status = CASE WHEN status = $%d THEN status ELSE $%d END`, len(args)-1, len(args))+where,
+		args...,
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	cancelled, err := result.RowsAffected()
+	return int(cancelled), err
+}
+
+// updateJob writes a job's model over its row through db, which may be a transaction.
+func updateJob(db execer, job *SubmittedJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(
+		`UPDATE jobs SET account = $2, status = $3, created_at = $4, started_at = $5, finished_at = $6,
+			container_id = $7, kill_requested = kill_requested OR $8, data = $9
+		WHERE jid = $1`,
+		job.JID, job.Account, job.Status, job.CreatedAt, job.StartedAt, job.FinishedAt,
+		job.ContainerID, job.KillRequested, data,
+	)
+	return requireRow(result, err)
+}
+
+// ArchiveJob moves a job from the active jobs table into the "dead_jobs" table. It's safe to archive
+// the same job more than once.
+func (storage *PostgresStorage) ArchiveJob(job SubmittedJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	tx, err := storage.DB.Begin()
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO dead_jobs (`+jobColumns+`) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		ON CONFLICT (jid) DO UPDATE SET account = EXCLUDED.account, status = EXCLUDED.status,
+			created_at = EXCLUDED.created_at, started_at = EXCLUDED.started_at,
+			finished_at = EXCLUDED.finished_at, container_id = EXCLUDED.container_id,
+			kill_requested = EXCLUDED.kill_requested, data = EXCLUDED.data`,
+		job.JID, job.Account, job.Status, job.CreatedAt, job.StartedAt, job.FinishedAt,
+		job.ContainerID, job.KillRequested, data,
+	)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM jobs WHERE jid = $1`, job.JID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Account storage
+
+// GetAccount loads an account by its unique account name, creating it if it doesn't already exist.
+func (storage *PostgresStorage) GetAccount(name string) (*Account, error) {
+	_, err := storage.DB.Exec(`INSERT INTO accounts (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		account       Account
+		active        bool
+		expiresAt     sql.NullInt64
+		allowedCores  []byte
+		allowedImages []byte
+	)
+	err = storage.DB.QueryRow(
+		`SELECT name, admin, suspended, active, expires_at, total_runtime, total_jobs, credits,
+			max_queued_jobs, max_concurrent_jobs, allowed_cores, allowed_images
+		FROM accounts WHERE name = $1`, name,
+	).Scan(
+		&account.Name, &account.Admin, &account.Suspended, &active, &expiresAt, &account.TotalRuntime,
+		&account.TotalJobs, &account.Credits, &account.MaxQueuedJobs, &account.MaxConcurrentJobs,
+		&allowedCores, &allowedImages,
+	)
+	if err != nil {
+		return nil, err
+	}
+	account.Active = &active
+
+	if expiresAt.Valid {
+		t := StoredTime(expiresAt.Int64)
+		account.ExpiresAt = &t
+	}
+	if len(allowedCores) > 0 {
+		if err := json.Unmarshal(allowedCores, &account.AllowedCores); err != nil {
+			return nil, err
+		}
+	}
+	if len(allowedImages) > 0 {
+		if err := json.Unmarshal(allowedImages, &account.AllowedImages); err != nil {
+			return nil, err
+		}
+	}
+	return &account, nil
+}
+
+// GetAPIKeyHash returns the hash of the API key that was assigned to an account when it was created,
+// without creating the account. It's empty for accounts that are authenticated elsewhere, and
+// ErrNotFound is returned if there's no such account.
+func (storage *PostgresStorage) GetAPIKeyHash(name string) (string, error) {
+	var hash string
+	err := storage.DB.QueryRow(
+		`SELECT COALESCE(api_key_hash, '') FROM accounts WHERE name = $1`, name,
+	).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return hash, err
+}
+
+// CreateAccount creates a new account with an API key, which is stored as a hash. ErrAccountExists is
+// returned if an account with the same name already exists.
+func (storage *PostgresStorage) CreateAccount(account Account, apiKey string) error {
+	var expiresAt sql.NullInt64
+	if account.ExpiresAt != nil {
+		expiresAt = sql.NullInt64{Int64: int64(*account.ExpiresAt), Valid: true}
+	}
+
+	var allowedCores, allowedImages []byte
+	var err error
+	if len(account.AllowedCores) > 0 {
+		if allowedCores, err = json.Marshal(account.AllowedCores); err != nil {
+			return err
+		}
+	}
+	if len(account.AllowedImages) > 0 {
+		if allowedImages, err = json.Marshal(account.AllowedImages); err != nil {
+			return err
+		}
+	}
+
+	result, err := storage.DB.Exec(
+		`INSERT INTO accounts (name, admin, suspended, active, expires_at, credits, max_queued_jobs,
+			max_concurrent_jobs, allowed_cores, allowed_images, api_key_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+		ON CONFLICT (name) DO NOTHING`,
+		account.Name, account.Admin, account.Suspended, account.IsActive(), expiresAt, account.Credits,
+		account.MaxQueuedJobs, account.MaxConcurrentJobs, allowedCores, allowedImages, HashAPIKey(apiKey),
+	)
+	if err != nil {
+		return err
+	}
+	if affected, err := result.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return ErrAccountExists
+	}
+	return nil
+}
+
+// UpdateAccountAdmin flags or unflags an account as an administrator.
+func (storage *PostgresStorage) UpdateAccountAdmin(name string, admin bool) error {
+	return requireRow(storage.DB.Exec(`UPDATE accounts SET admin = $2 WHERE name = $1`, name, admin))
+}
+
+// UpdateAccountSuspended suspends or reinstates an account.
+func (storage *PostgresStorage) UpdateAccountSuspended(name string, suspended bool) error {
+	return requireRow(storage.DB.Exec(`UPDATE accounts SET suspended = $2 WHERE name = $1`, name, suspended))
+}
+
+// UpdateAccountActive deactivates or reactivates an account.
+func (storage *PostgresStorage) UpdateAccountActive(name string, active bool) error {
+	return requireRow(storage.DB.Exec(`UPDATE accounts SET active = $2 WHERE name = $1`, name, active))
+}
+
+// UpdateAccountQuota sets the number of jobs that an account may have queued and running at once.
+func (storage *PostgresStorage) UpdateAccountQuota(name string, maxQueuedJobs, maxConcurrentJobs int) error {
+	return requireRow(storage.DB.Exec(
+		`UPDATE accounts SET max_queued_jobs = $2, max_concurrent_jobs = $3 WHERE name = $1`,
+		name, maxQueuedJobs, maxConcurrentJobs,
+	))
+}
+
+// UpdateAccountExpiry sets or clears the time at which an account expires.
+func (storage *PostgresStorage) UpdateAccountExpiry(name string, expiresAt *StoredTime) error {
+	var value sql.NullInt64
+	if expiresAt != nil {
+		value = sql.NullInt64{Int64: int64(*expiresAt), Valid: true}
+	}
+	return requireRow(storage.DB.Exec(`UPDATE accounts SET expires_at = $2 WHERE name = $1`, name, value))
+}
+
+// UpdateAccountUsage adds a job's runtime to an account's usage. Only finished jobs are counted
+// towards its total jobs.
+func (storage *PostgresStorage) UpdateAccountUsage(name string, runtime int64, finished bool) error {
+	jobs := 0
+	if finished {
+		jobs = 1
+	}
+	return requireRow(storage.DB.Exec(
+		`UPDATE accounts SET total_runtime = total_runtime + $2, total_jobs = total_jobs + $3 WHERE name = $1`,
+		name, runtime, jobs,
+	))
+}
+
+// AdjustAccountCredits adds a (possibly negative) number of credits to an account's balance.
+func (storage *PostgresStorage) AdjustAccountCredits(name string, delta int64) error {
+	return requireRow(storage.DB.Exec(`UPDATE accounts SET credits = credits + $2 WHERE name = $1`, name, delta))
+}
+
+// requireRow returns ErrNotFound if a statement didn't affect any rows.
+func requireRow(result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Config map storage
+
+// ListConfigMaps returns all of the config maps owned by an account.
+func (storage *PostgresStorage) ListConfigMaps(owner string) ([]ConfigMap, error) {
+	rows, err := storage.DB.Query(`SELECT name, data FROM config_maps WHERE owner = $1 ORDER BY name`, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := []ConfigMap{}
+	for rows.Next() {
+		m := ConfigMap{Owner: owner}
+		var data []byte
+		if err := rows.Scan(&m.Name, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &m.Data); err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, rows.Err()
+}
+
+// SaveConfigMap creates a config map, or replaces the data of an existing config map with the same
+// owner and name.
+func (storage *PostgresStorage) SaveConfigMap(m ConfigMap) error {
+	data, err := json.Marshal(m.Data)
+	if err != nil {
+		return err
+	}
+
+	_, err = storage.DB.Exec(
+		`INSERT INTO config_maps (owner, name, data) VALUES ($1, $2, $3)
+		ON CONFLICT (owner, name) DO UPDATE SET data = EXCLUDED.data`,
+		m.Owner, m.Name, data,
+	)
+	return err
+}
+
+// GetVolume looks up a registered volume by name. ErrNotFound is returned if no volume with that
+// name has been registered.
+func (storage *PostgresStorage) GetVolume(name string) (*Volume, error) {
+	var out Volume
+	err := storage.DB.QueryRow(
+		`SELECT name, host_path, container_path FROM volumes WHERE name = $1`, name,
+	).Scan(&out.Name, &out.HostPath, &out.ContainerPath)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
@@ -0,0 +1,132 @@
+package main
+
+// SQL for each PostgreSQL schema migration. Migrations are embedded in the binary as constants so
+// that a deployment never depends on SQL files being present next to the executable. Append new
+// files to postgresMigrations in postgres.go with the next version number.
+
+// postgresSchemaVersionsSQL creates the table that records applied migrations. It's executed by
+// Bootstrap, before any migration runs.
+const postgresSchemaVersionsSQL = `
+CREATE TABLE IF NOT EXISTS schema_versions (
+	version    INTEGER PRIMARY KEY,
+	applied_at BIGINT NOT NULL
+);
+`
+
+// postgresLocksSQL creates the table that holds the migration lock. It's executed by Bootstrap, so
+// that the lock can be taken before the first migration runs.
+const postgresLocksSQL = `
+CREATE TABLE IF NOT EXISTS locks (
+	id        TEXT PRIMARY KEY,
+	owner     TEXT NOT NULL,
+	locked_at BIGINT NOT NULL
+);
+`
+
+// postgres0001CreateTablesSQL creates a table for each MongoDB collection. Fields that are queried
+// or updated individually are stored in their own columns. Everything else about a job is kept in
+// its JSONB "data" column.
+const postgres0001CreateTablesSQL = `
+CREATE TABLE jobs (
+	jid            BIGSERIAL PRIMARY KEY,
+	account        TEXT NOT NULL,
+	status         TEXT NOT NULL,
+	created_at     BIGINT NOT NULL DEFAULT 0,
+	started_at     BIGINT NOT NULL DEFAULT 0,
+	finished_at    BIGINT NOT NULL DEFAULT 0,
+	container_id   TEXT NOT NULL DEFAULT '',
+	kill_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	data           JSONB NOT NULL
+);
+
+CREATE TABLE dead_jobs (
+	jid            BIGINT PRIMARY KEY,
+	account        TEXT NOT NULL,
+	status         TEXT NOT NULL,
+	created_at     BIGINT NOT NULL DEFAULT 0,
+	started_at     BIGINT NOT NULL DEFAULT 0,
+	finished_at    BIGINT NOT NULL DEFAULT 0,
+	container_id   TEXT NOT NULL DEFAULT '',
+	kill_requested BOOLEAN NOT NULL DEFAULT FALSE,
+	data           JSONB NOT NULL
+);
+
+CREATE TABLE accounts (
+	name                TEXT PRIMARY KEY,
+	admin               BOOLEAN NOT NULL DEFAULT FALSE,
+	suspended           BOOLEAN NOT NULL DEFAULT FALSE,
+	expires_at          BIGINT,
+	total_runtime       BIGINT NOT NULL DEFAULT 0,
+	total_jobs          BIGINT NOT NULL DEFAULT 0,
+	credits             BIGINT NOT NULL DEFAULT 0,
+	max_concurrent_jobs INTEGER NOT NULL DEFAULT 0,
+	allowed_cores       JSONB,
+	allowed_images      JSONB
+);
+
+CREATE TABLE config_maps (
+	owner TEXT NOT NULL,
+	name  TEXT NOT NULL,
+	data  JSONB NOT NULL,
+	PRIMARY KEY (owner, name)
+);
+
+CREATE TABLE volumes (
+	name           TEXT PRIMARY KEY,
+	host_path      TEXT NOT NULL,
+	container_path TEXT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS locks (
+	id        TEXT PRIMARY KEY,
+	owner     TEXT NOT NULL,
+	locked_at BIGINT NOT NULL
+);
+`
+
+// postgres0002CreateJobIndicesSQL indexes the job columns used by the runner and by job queries.
+const postgres0002CreateJobIndicesSQL = `
+CREATE INDEX jobs_status_created_at ON jobs (status, created_at);
+CREATE INDEX jobs_account ON jobs (account);
+CREATE INDEX jobs_tags ON jobs USING GIN ((data -> 'tags'));
+`
+
+// postgres0003CreateCacheKeyIndexSQL indexes the cache keys of completed jobs.
+const postgres0003CreateCacheKeyIndexSQL = `
+CREATE INDEX jobs_cache_key ON jobs (account, (data ->> 'cache_key'), jid DESC)
+	WHERE status = 'done' AND data ? 'cache_key';
+`
+
+// postgres0004CreateIdempotencyKeysSQL creates the table that maps idempotency keys to the jobs that
+// were created for them.
+const postgres0004CreateIdempotencyKeysSQL = `
+CREATE TABLE idempotency_keys (
+	account    TEXT NOT NULL,
+	key        TEXT NOT NULL,
+	jid        BIGINT NOT NULL,
+	expires_at BIGINT NOT NULL,
+	PRIMARY KEY (account, key)
+);
+`
+
+// postgres0005AddAccountKeyHashSQL adds the hashed API keys of accounts that were created through the
+// API.
+const postgres0005AddAccountKeyHashSQL = `
+ALTER TABLE accounts ADD COLUMN api_key_hash TEXT;
+`
+
+// postgres0006AddAccountActiveSQL tracks whether each account is active. Existing accounts are.
+const postgres0006AddAccountActiveSQL = `
+ALTER TABLE accounts ADD COLUMN active BOOLEAN NOT NULL DEFAULT TRUE;
+`
+
+// postgres0007CreateRunIDIndexSQL indexes the run IDs of jobs.
+const postgres0007CreateRunIDIndexSQL = `
+CREATE INDEX jobs_run_id ON jobs (account, (data ->> 'run_id')) WHERE data ? 'run_id';
+`
+
+// postgres0008AddAccountQueuedQuotaSQL limits the number of jobs that each account may have queued.
+// Zero means that there's no limit.
+const postgres0008AddAccountQueuedQuotaSQL = `
+ALTER TABLE accounts ADD COLUMN max_queued_jobs INTEGER NOT NULL DEFAULT 0;
+`
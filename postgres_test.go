@@ -0,0 +1,666 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPostgresMigrationsAreSequential(t *testing.T) {
+	for i, migration := range postgresMigrations {
+		if migration.Version != i+1 {
+			t.Errorf("Expected migration %d to have version [%d], got [%d]", i, i+1, migration.Version)
+		}
+		if migration.SQL == "" {
+			t.Errorf("Expected migration [%d] to have SQL", migration.Version)
+		}
+	}
+
+	last := postgresMigrations[len(postgresMigrations)-1].Version
+	if last != LatestSchemaVersion() {
+		t.Errorf("Expected the PostgreSQL schema to end at version [%d], got [%d]", LatestSchemaVersion(), last)
+	}
+}
+
+// postgresStorage connects to the database at TEST_POSTGRES_DSN and resets its schema. The test is
+// skipped if TEST_POSTGRES_DSN isn't set.
+func postgresStorage(t *testing.T) *PostgresStorage {
+	dsn := os.Getenv("TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("TEST_POSTGRES_DSN is not set.")
+	}
+
+	s, err := NewPostgresStorage(&Context{Settings: Settings{PostgresDSN: dsn}})
+	if err != nil {
+		t.Fatalf("Unable to connect to PostgreSQL: %v", err)
+	}
+
+	_, err = s.DB.Exec(`DROP TABLE IF EXISTS
+		schema_versions, jobs, dead_jobs, accounts, config_maps, volumes, locks, idempotency_keys`)
+	if err != nil {
+		t.Fatalf("Unable to reset the schema: %v", err)
+	}
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("Unable to bootstrap: %v", err)
+	}
+	if err := s.MigrateSchema(); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+	return s
+}
+
+func TestPostgresMigrateSchema(t *testing.T) {
+	s := postgresStorage(t)
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("Expected schema version [%d], got [%d]", LatestSchemaVersion(), version)
+	}
+
+	// Migrating again is a no-op.
+	if err := s.MigrateSchema(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestPostgresJobs(t *testing.T) {
+	s := postgresStorage(t)
+
+	name := "first"
+	first := SubmittedJob{
+		Job:       Job{Command: "echo one", Name: &name, Tags: map[string]string{"kind": "a"}},
+		Account:   "alice",
+		Status:    StatusQueued,
+		CreatedAt: 100,
+	}
+	second := SubmittedJob{
+		Job:       Job{Command: "echo two", Tags: map[string]string{"kind": "b"}},
+		Account:   "bob",
+		Status:    StatusQueued,
+		CreatedAt: 200,
+	}
+
+	firstJID, err := s.InsertJob(first)
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	secondJID, err := s.InsertJob(second)
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+
+	jobs, err := s.ListJobs(JobQuery{Tags: map[string]string{"kind": "a"}})
+	if err != nil {
+		t.Fatalf("Unable to list jobs: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].JID != firstJID || jobs[0].Command != "echo one" || jobs[0].Account != "alice" {
+		t.Errorf("Unexpected jobs: %+v", jobs)
+	}
+
+	count, err := s.CountJobs(JobQuery{Names: []string{"first"}, Statuses: []string{StatusQueued}})
+	if err != nil {
+		t.Fatalf("Unable to count jobs: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected one job named [first], got %d", count)
+	}
+
+	claimed, err := s.ClaimJob([]string{"alice"}, StoreTime(time.Now()))
+	if err != nil {
+		t.Fatalf("Unable to claim a job: %v", err)
+	}
+	if claimed == nil || claimed.JID != secondJID || claimed.Status != StatusProcessing {
+		t.Fatalf("Unexpected claimed job: %+v", claimed)
+	}
+
+	depths, err := s.GetQueueDepths()
+	if err != nil {
+		t.Fatalf("Unable to get queue depths: %v", err)
+	}
+	if expected := map[string]int64{StatusQueued: 1, StatusProcessing: 1}; !reflect.DeepEqual(depths, expected) {
+		t.Errorf("Unexpected queue depths: %v", depths)
+	}
+
+	if _, err := s.DB.Exec(`UPDATE jobs SET kill_requested = TRUE WHERE jid = $1`, secondJID); err != nil {
+		t.Fatalf("Unable to request a kill: %v", err)
+	}
+	claimed.Status = StatusDone
+	claimed.Stdout = "two\n"
+	if err := s.UpdateJob(claimed); err != nil {
+		t.Fatalf("Unable to update a job: %v", err)
+	}
+	killed, err := s.JobKillRequested(secondJID)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !killed {
+		t.Error("Expected UpdateJob to preserve the kill request")
+	}
+
+	if err := s.ArchiveJob(*claimed); err != nil {
+		t.Fatalf("Unable to archive a job: %v", err)
+	}
+	if err := s.ArchiveJob(*claimed); err != nil {
+		t.Errorf("Unable to archive a job twice: %v", err)
+	}
+	if _, err := s.JobKillRequested(secondJID); err != ErrNotFound {
+		t.Errorf("Expected the archived job to be gone, got %v", err)
+	}
+}
+
+func TestPostgresClaimJobSkipsScheduledJobs(t *testing.T) {
+	s := postgresStorage(t)
+
+	// The future job is older, so it would be claimed first if its schedule were ignored.
+	future := SubmittedJob{
+		Job:       Job{Command: "echo later", ScheduledAt: StoreTime(time.Now().Add(time.Hour))},
+		Account:   "alice",
+		Status:    StatusQueued,
+		CreatedAt: 100,
+	}
+	runnable := SubmittedJob{
+		Job:       Job{Command: "echo now", ScheduledAt: StoreTime(time.Now().Add(-time.Hour))},
+		Account:   "alice",
+		Status:    StatusQueued,
+		CreatedAt: 200,
+	}
+
+	if _, err := s.InsertJob(future); err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	runnableJID, err := s.InsertJob(runnable)
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+
+	claimed, err := s.ClaimJob(nil, StoreTime(time.Now()))
+	if err != nil {
+		t.Fatalf("Unable to claim a job: %v", err)
+	}
+	if claimed == nil || claimed.JID != runnableJID {
+		t.Fatalf("Expected the runnable job to be claimed, got %+v", claimed)
+	}
+
+	claimed, err = s.ClaimJob(nil, StoreTime(time.Now()))
+	if err != nil {
+		t.Fatalf("Unable to claim a job: %v", err)
+	}
+	if claimed != nil {
+		t.Errorf("Expected the future job not to be claimed, got %+v", claimed)
+	}
+}
+
+func TestPostgresReclaimJob(t *testing.T) {
+	s := postgresStorage(t)
+
+	running := SubmittedJob{
+		Job:       Job{Command: "sleep 100"},
+		Account:   "alice",
+		Status:    StatusProcessing,
+		StartedAt: 1000,
+		Runner:    "slow",
+	}
+	jid, err := s.InsertJob(running)
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	running.JID = jid
+
+	reclaimed, err := s.ReclaimJob(running, "fast", 2000)
+	if err != nil {
+		t.Fatalf("Unable to reclaim a job: %v", err)
+	}
+	if reclaimed == nil || reclaimed.Runner != "fast" || reclaimed.StartedAt != 2000 {
+		t.Fatalf("Unexpected reclaimed job: %+v", reclaimed)
+	}
+	if runner, err := s.JobRunner(jid); err != nil || runner != "fast" {
+		t.Errorf("Expected the job's runner to be [fast], got [%s] and %v", runner, err)
+	}
+
+	// The job was restamped, so a second runner with the stale copy loses the race.
+	reclaimed, err = s.ReclaimJob(running, "other", 3000)
+	if err != nil {
+		t.Fatalf("Unable to reclaim a job: %v", err)
+	}
+	if reclaimed != nil {
+		t.Errorf("Expected a stale reclaim to fail, got %+v", reclaimed)
+	}
+}
+
+func TestPostgresCancelJobs(t *testing.T) {
+	s := postgresStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusQueued},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusProcessing},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusDone},
+		{Job: Job{Command: "true", RunID: "weekly"}, Account: "alice", Status: StatusQueued},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	cancelled, err := s.CancelJobs(JobQuery{AccountName: "alice", RunID: "nightly"})
+	if err != nil {
+		t.Fatalf("Unable to cancel jobs: %v", err)
+	}
+	if cancelled != 2 {
+		t.Errorf("Expected two jobs to be cancelled, got %d", cancelled)
+	}
+
+	jobs, err := s.ListJobs(JobQuery{AccountName: "alice"})
+	if err != nil {
+		t.Fatalf("Unable to list jobs: %v", err)
+	}
+	expected := []struct {
+		status string
+		killed bool
+	}{
+		{StatusKilled, true}, {StatusProcessing, true}, {StatusDone, false}, {StatusQueued, false},
+	}
+	for i, job := range jobs {
+		if job.Status != expected[i].status || job.KillRequested != expected[i].killed {
+			t.Errorf("Unexpected job [%d]: [%s] kill requested [%v]", job.JID, job.Status, job.KillRequested)
+		}
+	}
+}
+
+func TestPostgresCountJobsByStatus(t *testing.T) {
+	s := postgresStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusDone},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusQueued},
+		{Job: Job{Command: "true", RunID: "weekly"}, Account: "alice", Status: StatusDone},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "bob", Status: StatusDone},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	counts, err := s.CountJobsByStatus("alice")
+	if err != nil {
+		t.Fatalf("Unable to count jobs: %v", err)
+	}
+	if expected := map[string]int{StatusDone: 2, StatusQueued: 1}; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Unexpected counts: %v", counts)
+	}
+}
+
+func TestPostgresCountJobsByAccount(t *testing.T) {
+	s := postgresStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true"}, Account: "bob", Status: StatusProcessing, CreatedAt: 30},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusProcessing, CreatedAt: 20},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusProcessing, CreatedAt: 10},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusQueued, CreatedAt: 40},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusDone, CreatedAt: 5},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	counts, err := s.CountJobsByAccount([]string{StatusQueued, StatusProcessing})
+	if err != nil {
+		t.Fatalf("Unable to count jobs: %v", err)
+	}
+	expected := []AccountJobCount{
+		{Account: "alice", Status: StatusProcessing, Count: 2, OldestCreatedAt: 10},
+		{Account: "alice", Status: StatusQueued, Count: 1, OldestCreatedAt: 40},
+		{Account: "bob", Status: StatusProcessing, Count: 1, OldestCreatedAt: 30},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Unexpected counts: %+v", counts)
+	}
+}
+
+func TestPostgresListRuns(t *testing.T) {
+	s := postgresStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true", RunID: "weekly"}, Account: "alice", Status: StatusDone, CreatedAt: 20},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusDone, CreatedAt: 10},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusQueued, CreatedAt: 30},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusDone, CreatedAt: 5},
+		{Job: Job{Command: "true", RunID: "hourly"}, Account: "bob", Status: StatusDone, CreatedAt: 1},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	runs, err := s.ListRuns("alice", RunCursor{}, 10)
+	if err != nil {
+		t.Fatalf("Unable to list runs: %v", err)
+	}
+	if len(runs) != 2 || runs[0].RunID != "nightly" || runs[1].RunID != "weekly" {
+		t.Fatalf("Unexpected runs: %+v", runs)
+	}
+	if runs[0].CreatedAt != 10 || runs[0].TotalJobs != 2 || runs[0].Completed != 1 {
+		t.Errorf("Unexpected run summary: %+v", runs[0])
+	}
+	if expected := map[string]int{StatusDone: 1, StatusQueued: 1}; !reflect.DeepEqual(runs[0].Statuses, expected) {
+		t.Errorf("Unexpected status counts: %v", runs[0].Statuses)
+	}
+
+	runs, err = s.ListRuns("alice", RunCursor{CreatedAt: 10, RunID: "nightly"}, 10)
+	if err != nil {
+		t.Fatalf("Unable to list runs: %v", err)
+	}
+	if len(runs) != 1 || runs[0].RunID != "weekly" {
+		t.Errorf("Expected only the runs after the cursor, got %+v", runs)
+	}
+}
+
+func TestPostgresGetRunSummary(t *testing.T) {
+	s := postgresStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusDone, CreatedAt: 10, StartedAt: 30, FinishedAt: 40},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusError, CreatedAt: 20, StartedAt: 25, FinishedAt: 50},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusQueued, CreatedAt: 30},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "bob", Status: StatusDone, CreatedAt: 1},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	summary, err := s.GetRunSummary("alice", "nightly")
+	if err != nil {
+		t.Fatalf("Unable to summarize the run: %v", err)
+	}
+	if summary.TotalJobs != 3 || summary.Completed != 2 || summary.Failed != 1 || summary.CreatedAt != 10 {
+		t.Errorf("Unexpected run summary: %+v", summary)
+	}
+	if summary.StartedAt == nil || *summary.StartedAt != 25 {
+		t.Errorf("Expected the run to have started at 25, got %v", summary.StartedAt)
+	}
+	if summary.FinishedAt != nil {
+		t.Errorf("Expected an incomplete run not to have finished, got %v", *summary.FinishedAt)
+	}
+
+	if _, err := s.GetRunSummary("alice", "missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing run, got %v", err)
+	}
+}
+
+func TestPostgresAccounts(t *testing.T) {
+	s := postgresStorage(t)
+
+	if _, err := s.GetAccount("alice"); err != nil {
+		t.Fatalf("Unable to create an account: %v", err)
+	}
+	if err := s.UpdateAccountAdmin("alice", true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.UpdateAccountUsage("alice", 1000, true); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := s.AdjustAccountCredits("alice", -10); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expiry := StoredTime(12345)
+	if err := s.UpdateAccountExpiry("alice", &expiry); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	account, err := s.GetAccount("alice")
+	if err != nil {
+		t.Fatalf("Unable to load an account: %v", err)
+	}
+	if !account.Admin || account.TotalRuntime != 1000 || account.TotalJobs != 1 || account.Credits != -10 {
+		t.Errorf("Unexpected account: %+v", account)
+	}
+	if account.ExpiresAt == nil || *account.ExpiresAt != expiry {
+		t.Errorf("Unexpected expiry: %v", account.ExpiresAt)
+	}
+
+	if err := s.UpdateAccountSuspended("nobody", true); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing account, got %v", err)
+	}
+}
+
+func TestPostgresCreateAccount(t *testing.T) {
+	s := postgresStorage(t)
+
+	if err := s.CreateAccount(Account{Name: "alice", Credits: 10}, "s3cret"); err != nil {
+		t.Fatalf("Unable to create an account: %v", err)
+	}
+	if err := s.CreateAccount(Account{Name: "alice"}, "other"); err != ErrAccountExists {
+		t.Errorf("Expected ErrAccountExists, got %v", err)
+	}
+
+	hash, err := s.GetAPIKeyHash("alice")
+	if err != nil {
+		t.Fatalf("Unable to read the API key hash: %v", err)
+	}
+	if hash != HashAPIKey("s3cret") {
+		t.Errorf("Unexpected API key hash: [%s]", hash)
+	}
+	if _, err := s.GetAPIKeyHash("bob"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing account, got %v", err)
+	}
+
+	account, err := s.GetAccount("alice")
+	if err != nil {
+		t.Fatalf("Unable to load the account: %v", err)
+	}
+	if account.Credits != 10 {
+		t.Errorf("Expected the account's credits to be stored, got [%d]", account.Credits)
+	}
+	if !account.IsActive() {
+		t.Error("Expected a new account to be active")
+	}
+
+	if err := s.UpdateAccountActive("alice", false); err != nil {
+		t.Fatalf("Unable to deactivate the account: %v", err)
+	}
+	account, err = s.GetAccount("alice")
+	if err != nil {
+		t.Fatalf("Unable to load the account: %v", err)
+	}
+	if account.IsActive() {
+		t.Error("Expected the account to be deactivated")
+	}
+	if err := s.UpdateAccountActive("nobody", false); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an unknown account, got %v", err)
+	}
+
+	if err := s.UpdateAccountQuota("alice", 100, 5); err != nil {
+		t.Fatalf("Unable to update the account's quota: %v", err)
+	}
+	account, err = s.GetAccount("alice")
+	if err != nil {
+		t.Fatalf("Unable to load the account: %v", err)
+	}
+	if account.MaxQueuedJobs != 100 || account.MaxConcurrentJobs != 5 {
+		t.Errorf("Unexpected quotas: %+v", account)
+	}
+	if err := s.UpdateAccountQuota("nobody", 1, 1); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an unknown account, got %v", err)
+	}
+}
+
+func TestPostgresConfigMaps(t *testing.T) {
+	s := postgresStorage(t)
+
+	if err := s.SaveConfigMap(ConfigMap{Owner: "alice", Name: "m", Data: map[string]string{"a": "1"}}); err != nil {
+		t.Fatalf("Unable to save a config map: %v", err)
+	}
+	if err := s.SaveConfigMap(ConfigMap{Owner: "alice", Name: "m", Data: map[string]string{"a": "2"}}); err != nil {
+		t.Fatalf("Unable to replace a config map: %v", err)
+	}
+
+	maps, err := s.ListConfigMaps("alice")
+	if err != nil {
+		t.Fatalf("Unable to list config maps: %v", err)
+	}
+	expected := []ConfigMap{{Owner: "alice", Name: "m", Data: map[string]string{"a": "2"}}}
+	if !reflect.DeepEqual(maps, expected) {
+		t.Errorf("Unexpected config maps: %+v", maps)
+	}
+}
+
+func TestPostgresLockMigrations(t *testing.T) {
+	s := postgresStorage(t)
+
+	if locked, err := s.LockMigrations("one"); err != nil || !locked {
+		t.Fatalf("Expected to acquire the lock, got %v, %v", locked, err)
+	}
+	if locked, err := s.LockMigrations("two"); err != nil || locked {
+		t.Fatalf("Expected the lock to be held, got %v, %v", locked, err)
+	}
+	if err := s.UnlockMigrations("one"); err != nil {
+		t.Fatalf("Unable to release the lock: %v", err)
+	}
+	if locked, err := s.LockMigrations("two"); err != nil || !locked {
+		t.Errorf("Expected to acquire the released lock, got %v, %v", locked, err)
+	}
+}
+
+func TestPostgresLockMigrationsTakesOverAbandonedLock(t *testing.T) {
+	s := postgresStorage(t)
+
+	abandoned := StoreTime(time.Now().Add(-2 * migrationLockTTL))
+	_, err := s.DB.Exec(`INSERT INTO locks (id, owner, locked_at) VALUES ($1, $2, $3)`,
+		migrationLockID, "crashed", abandoned)
+	if err != nil {
+		t.Fatalf("Unable to insert an abandoned lock: %v", err)
+	}
+
+	if locked, err := s.LockMigrations("one"); err != nil || !locked {
+		t.Fatalf("Expected to take over the abandoned lock, got %v, %v", locked, err)
+	}
+	if locked, err := s.LockMigrations("two"); err != nil || locked {
+		t.Errorf("Expected the fresh lock to be held, got %v, %v", locked, err)
+	}
+}
+
+func TestPostgresInsertJobKeepsJID(t *testing.T) {
+	s := postgresStorage(t)
+
+	jid, err := s.InsertJob(SubmittedJob{JID: 1000, Account: "alice", Status: StatusQueued})
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	if jid != 1000 {
+		t.Errorf("Expected the job to keep JID 1000, got %d", jid)
+	}
+
+	next, err := s.InsertJob(SubmittedJob{Account: "alice", Status: StatusQueued})
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	if next != 1001 {
+		t.Errorf("Expected the next job to be assigned JID 1001, got %d", next)
+	}
+}
+
+func TestPostgresFindCachedJob(t *testing.T) {
+	s := postgresStorage(t)
+
+	fresh := SubmittedJob{
+		Job:            Job{Command: "id", CacheKey: "abc"},
+		Account:        "alice",
+		Status:         StatusDone,
+		CacheExpiresAt: StoreTime(time.Now().Add(time.Hour)),
+	}
+	stale := fresh
+	stale.CacheExpiresAt = StoreTime(time.Now().Add(-time.Hour))
+
+	freshJID, err := s.InsertJob(fresh)
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	if _, err := s.InsertJob(stale); err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+
+	job, err := s.FindCachedJob("alice", "abc")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if job.JID != freshJID {
+		t.Errorf("Expected the unexpired job [%d], got [%d]", freshJID, job.JID)
+	}
+
+	if _, err := s.FindCachedJob("bob", "abc"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for another account, got %v", err)
+	}
+}
+
+func TestPostgresIdempotencyKeys(t *testing.T) {
+	s := postgresStorage(t)
+	now := time.Now()
+
+	if _, err := s.GetIdempotencyKey("alice", "k", now); err != ErrNotFound {
+		t.Fatalf("Expected ErrNotFound for an unknown key, got %v", err)
+	}
+
+	expired := IdempotencyKey{Account: "alice", Key: "k", JID: 1, ExpiresAt: now.Add(-time.Hour)}
+	if err := s.SaveIdempotencyKey(expired); err != nil {
+		t.Fatalf("Unable to save an idempotency key: %v", err)
+	}
+	if _, err := s.GetIdempotencyKey("alice", "k", now); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for an expired key, got %v", err)
+	}
+
+	reservation := IdempotencyKey{Account: "alice", Key: "k", ExpiresAt: now.Add(time.Hour)}
+	if err := s.ReserveIdempotencyKey(reservation, now); err != nil {
+		t.Fatalf("Unable to reserve over an expired key: %v", err)
+	}
+	if err := s.ReserveIdempotencyKey(reservation, now); err != ErrIdempotencyKeyExists {
+		t.Errorf("Expected ErrIdempotencyKeyExists for a reserved key, got %v", err)
+	}
+
+	fresh := IdempotencyKey{Account: "alice", Key: "k", JID: 2, ExpiresAt: now.Add(time.Hour)}
+	if err := s.SaveIdempotencyKey(fresh); err != nil {
+		t.Fatalf("Unable to replace an idempotency key: %v", err)
+	}
+	record, err := s.GetIdempotencyKey("alice", "k", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if record.JID != 2 {
+		t.Errorf("Expected JID [2], got [%d]", record.JID)
+	}
+
+	// Keys that record a job aren't released.
+	if err := s.ReleaseIdempotencyKey("alice", "k"); err != nil {
+		t.Fatalf("Unable to release an idempotency key: %v", err)
+	}
+	if _, err := s.GetIdempotencyKey("alice", "k", now); err != nil {
+		t.Errorf("Expected the saved key to survive a release, got %v", err)
+	}
+}
+
+func TestPostgresInsertJobWithinQuota(t *testing.T) {
+	s := postgresStorage(t)
+
+	job := SubmittedJob{Job: Job{Command: "true"}, Account: "alice", Status: StatusQueued}
+	for i := 0; i < 2; i++ {
+		if _, err := s.InsertJobWithinQuota(job, 2); err != nil {
+			t.Fatalf("Unable to insert job %d within the quota: %v", i, err)
+		}
+	}
+	if _, err := s.InsertJobWithinQuota(job, 2); err != ErrQuotaExceeded {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if count, _ := s.CountJobs(JobQuery{AccountName: "alice"}); count != 2 {
+		t.Errorf("Expected the refused job not to be stored, but alice has %d jobs", count)
+	}
+
+	job.Account = "bob"
+	if _, err := s.InsertJobWithinQuota(job, 2); err != nil {
+		t.Errorf("Expected another account's job to be inserted, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits how often each account may perform an action with a token bucket per account.
+// Each bucket holds up to Limit tokens and refills at a rate of Limit tokens every Period. A nil
+// RateLimiter allows everything.
+type RateLimiter struct {
+	Limit  int
+	Period time.Duration
+	Clock  Clock
+
+	lock    sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// NewRateLimiter creates a RateLimiter that allows limit actions per period for each account.
+func NewRateLimiter(limit int, period time.Duration, clock Clock) *RateLimiter {
+	return &RateLimiter{
+		Limit:   limit,
+		Period:  period,
+		Clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Fits returns false if n tokens are more than a bucket can ever hold, so that Allow would never
+// allow them.
+func (l *RateLimiter) Fits(n int) bool {
+	return l == nil || n <= l.Limit
+}
+
+// Allow attempts to take n tokens from an account's bucket. If there aren't enough, nothing is taken
+// and the time until there will be is returned instead. Check Fits first: a request for more than
+// Limit tokens is never allowed.
+func (l *RateLimiter) Allow(accountName string, n int) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.Clock.Now()
+	perToken := l.Period / time.Duration(l.Limit)
+
+	// A bucket that has been idle for a whole Period has refilled completely, which is no different
+	// from having no bucket at all. Discard those once per Period, so that accounts that stop
+	// submitting don't hold on to memory forever.
+	if now.Sub(l.swept) >= l.Period {
+		for name, idle := range l.buckets {
+			if now.Sub(idle.updated) >= l.Period {
+				delete(l.buckets, name)
+			}
+		}
+		l.swept = now
+	}
+
+	b, ok := l.buckets[accountName]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.Limit), updated: now}
+		l.buckets[accountName] = b
+	}
+
+	// Refill the bucket for the time that has passed since it was last used.
+	b.tokens += float64(now.Sub(b.updated)) / float64(perToken)
+	if b.tokens > float64(l.Limit) {
+		b.tokens = float64(l.Limit)
+	}
+	b.updated = now
+
+	if b.tokens >= float64(n) {
+		b.tokens -= float64(n)
+		return true, 0
+	}
+
+	missing := float64(n) - b.tokens
+	return false, time.Duration(missing * float64(perToken))
+}
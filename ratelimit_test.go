@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterFits(t *testing.T) {
+	l := NewRateLimiter(3, time.Minute, NewFakeClock())
+
+	if !l.Fits(3) || l.Fits(4) {
+		t.Error("Expected requests for at most 3 tokens to fit")
+	}
+	if !(*RateLimiter)(nil).Fits(1000) {
+		t.Error("Expected a nil RateLimiter to fit everything")
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	clock := NewFakeClock()
+	l := NewRateLimiter(3, time.Minute, clock)
+
+	l.Allow("idle", 1)
+	l.Allow("busy", 1)
+	clock.Advance(59 * time.Second)
+	l.Allow("busy", 1)
+	clock.Advance(time.Second)
+	l.Allow("other", 1)
+
+	if _, ok := l.buckets["idle"]; ok {
+		t.Error("Expected the idle bucket to be evicted")
+	}
+	if len(l.buckets) != 2 {
+		t.Errorf("Expected two buckets to remain, got %v", l.buckets)
+	}
+
+	// The busy account's bucket still remembers the tokens that it spent.
+	if ok, _ := l.Allow("busy", 2); !ok {
+		t.Error("Expected the busy account to have refilled enough for two tokens")
+	}
+	if ok, _ := l.Allow("busy", 1); ok {
+		t.Error("Expected the busy account's bucket to be empty")
+	}
+}
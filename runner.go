@@ -3,73 +3,461 @@ package main
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	log "github.com/Sirupsen/logrus"
 	docker "github.com/smashwilson/go-dockerclient"
 )
 
+const (
+	// PullAlways pulls the default image before every runner loop, so that updates to it are picked
+	// up.
+	PullAlways = "always"
+
+	// PullIfNotPresent pulls the default image only when it's missing from the Docker host.
+	PullIfNotPresent = "ifnotpresent"
+
+	// PullNever never pulls the default image.
+	PullNever = "never"
+)
+
+// cpuSharesPerCore is the relative CPU weight given to a container for each core requested by its
+// job. 1024 is Docker's default weight for a single container.
+const cpuSharesPerCore = 1024
+
+// stopGracePeriod is the number of seconds that a container is given to exit after it's asked to
+// stop, before it's killed.
+const stopGracePeriod = 10
+
+// lastErrorSize is the number of bytes from the end of a failed attempt's stderr that are kept in
+// its job's LastError.
+const lastErrorSize = 4 << 10
+
+// maxRuntimeUnit is the unit of a Job's MaxRuntime. It's only a variable so that tests don't need
+// to wait for whole seconds.
+var maxRuntimeUnit = time.Second
+
+// killPollInterval is how often a running job is checked for a kill request.
+var killPollInterval = time.Second
+
+// preemptions holds a channel for each job that's running in this process. Closing a job's channel
+// asks its watcher to stop the job's container so that a higher-priority job can take its place.
+var preemptions = struct {
+	sync.Mutex
+	channels map[uint64]chan struct{}
+}{channels: make(map[uint64]chan struct{})}
+
+// profilePath is where /usr/bin/time writes a profiled job's resource usage within its container.
+const profilePath = "/tmp/rho_profile"
+
+// profileFormat makes /usr/bin/time report user CPU seconds, system CPU seconds, elapsed seconds,
+// and maximum resident set size in kilobytes.
+const profileFormat = "%U %S %e %M"
+
+// archiveInterval is how often stalled jobs are checked to see if they should be archived.
+var archiveInterval = time.Minute
+
 // OutputCollector is an io.Writer that accumulates output from a specified stream in an attached
-// Docker container and appends it to the appropriate field within a SubmittedJob.
+// Docker container and appends it to the appropriate field within a SubmittedJob. Output beyond the
+// stream's size limit is discarded, and the job is written to storage at most once per flush
+// interval.
 type OutputCollector struct {
 	context  *Context
 	job      *SubmittedJob
 	isStdout bool
+
+	lastFlush time.Time
+	truncated bool
 }
 
 // DescribeStream returns "stdout" or "stderr" to indicate which stream this collector is consuming.
-func (c OutputCollector) DescribeStream() string {
+func (c *OutputCollector) DescribeStream() string {
 	if c.isStdout {
 		return "stdout"
 	}
 	return "stderr"
 }
 
+// limit returns the maximum number of bytes to retain from this collector's stream, or zero if
+// there's no limit.
+func (c *OutputCollector) limit() int {
+	if c.isStdout {
+		return c.context.MaxStdout
+	}
+	return c.context.MaxStderr
+}
+
+// truncate marks the job's output as truncated, and logs the first time that this collector discards
+// output because of limit.
+func (c *OutputCollector) truncate(limit int64) {
+	c.job.OutputTruncated = true
+	if c.truncated {
+		return
+	}
+
+	c.truncated = true
+	log.WithFields(log.Fields{
+		"jid":    c.job.JID,
+		"stream": c.DescribeStream(),
+		"limit":  limit,
+	}).Warn("Job output exceeded its size limit. Discarding the rest.")
+}
+
 // Write appends bytes to the selected stream and updates the SubmittedJob.
-func (c OutputCollector) Write(p []byte) (int, error) {
+func (c *OutputCollector) Write(p []byte) (int, error) {
 	log.WithFields(log.Fields{
 		"length": len(p),
 		"bytes":  string(p),
 		"stream": c.DescribeStream(),
 	}).Debug("Received output from a job")
 
+	output := &c.job.Stderr
 	if c.isStdout {
-		c.job.Stdout += string(p)
-	} else {
-		c.job.Stderr += string(p)
+		output = &c.job.Stdout
+	}
+
+	// The per-stream limit and the job's combined limit are enforced independently. Whichever leaves
+	// less room wins.
+	accepted := p
+	if limit := c.limit(); limit > 0 && len(*output)+len(accepted) > limit {
+		// The stream may already be over the limit if it was lowered since the job started.
+		remaining := limit - len(*output)
+		if remaining < 0 {
+			remaining = 0
+		}
+		accepted = accepted[:remaining]
+		c.truncate(int64(limit))
+	}
+	if limit := c.job.MaxOutputSize; limit > 0 {
+		remaining := limit - int64(len(c.job.Stdout)+len(c.job.Stderr))
+		if remaining < 0 {
+			remaining = 0
+		}
+		if int64(len(accepted)) > remaining {
+			accepted = accepted[:remaining]
+			c.truncate(limit)
+		}
+	}
+	*output += string(accepted)
+
+	if len(accepted) > 0 {
+		c.context.Output.Publish(c.job.JID, OutputChunk{Stream: c.DescribeStream(), Data: string(accepted)})
+	}
+
+	// Report the whole payload as written, so that the stream keeps being consumed.
+	interval := time.Duration(c.context.OutputFlushInterval) * time.Millisecond
+	now := c.context.clock().Now()
+	if len(accepted) == 0 || now.Sub(c.lastFlush) < interval {
+		return len(p), nil
 	}
 
 	if err := c.context.UpdateJob(c.job); err != nil {
 		return 0, err
 	}
+	c.lastFlush = now
 
 	return len(p), nil
 }
 
-// Runner is the main entry point for the job runner goroutine.
-func Runner(c *Context) {
+// Runner is the main entry point for the job runner goroutine. Once stop is closed, it stops
+// claiming new jobs and returns when every job that it has already launched has finished.
+func Runner(c *Context, stop <-chan struct{}) {
 	for {
+		RefreshImage(c)
+		Promote(c)
 		Claim(c)
+		RecordQueueDepth(c)
+
+		select {
+		case <-stop:
+			log.Info("Job runner stopping. Waiting for running jobs to finish.")
+			c.InFlight.Wait()
+			log.Info("Job runner stopped.")
+			return
+		case <-c.clock().After(time.Duration(c.Poll) * time.Millisecond):
+		}
+	}
+}
+
+// RefreshImage pulls the default image according to the ImagePullPolicy.
+func RefreshImage(c *Context) {
+	switch c.ImagePullPolicy {
+	case PullAlways:
+	case PullIfNotPresent:
+		_, err := c.InspectImage(c.Image)
+		if err == nil {
+			return
+		}
+		if err != docker.ErrNoSuchImage {
+			log.WithFields(log.Fields{
+				"image": c.Image,
+				"error": err,
+			}).Error("Unable to inspect the default image.")
+			return
+		}
+	default:
+		return
+	}
+
+	repository, tag := docker.ParseRepositoryTag(c.Image)
+	if err := c.PullImage(docker.PullImageOptions{Repository: repository, Tag: tag}, docker.AuthConfiguration{}); err != nil {
+		log.WithFields(log.Fields{
+			"image": c.Image,
+			"error": err,
+		}).Error("Unable to pull the default image.")
+	}
+}
+
+// Archiver is the entry point for the goroutine that moves stalled jobs out of the active jobs
+// collection.
+func Archiver(c *Context) {
+	for {
+		ArchiveStalledJobs(c)
+
+		<-c.clock().After(archiveInterval)
+	}
+}
+
+// cacheExpiry returns the time at which a completed job's result should stop being reused, or zero if
+// it shouldn't expire.
+func cacheExpiry(c *Context, job *SubmittedJob) StoredTime {
+	ttl := job.ResultTTL
+	if ttl == 0 {
+		ttl = c.CacheTTL
+	}
+	if job.CacheKey == "" || ttl <= 0 {
+		return 0
+	}
+	return job.FinishedAt.Add(time.Duration(ttl) * time.Second)
+}
+
+// ArchiveStalledJobs archives each job that stalled more than StalledJobTTL seconds ago. Jobs that
+// stalled before their stall time was recorded are aged from when they started, or were created.
+func ArchiveStalledJobs(c *Context) {
+	if c.StalledJobTTL <= 0 {
+		return
+	}
+
+	stalled, err := c.ListJobs(JobQuery{Statuses: []string{StatusStalled}})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to list stalled jobs.")
+		return
+	}
+
+	cutoff := StoreTime(c.clock().Now().Add(-time.Duration(c.StalledJobTTL) * time.Second))
+	for _, job := range stalled {
+		stalledAt := job.FinishedAt
+		if stalledAt.IsZero() {
+			stalledAt = job.StartedAt
+		}
+		if stalledAt.IsZero() {
+			stalledAt = job.CreatedAt
+		}
+		if !stalledAt.Before(cutoff) {
+			continue
+		}
+
+		fields := log.Fields{
+			"jid":        job.JID,
+			"account":    job.Account,
+			"stalled at": stalledAt,
+		}
+		if err := c.ArchiveJob(job); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to archive a stalled job.")
+			continue
+		}
+		log.WithFields(fields).Info("Archived a stalled job.")
+	}
+}
+
+// Promote moves waiting jobs into the queue once the jobs that they depend on have completed
+// successfully. A waiting job whose dependency failed, was killed, or doesn't exist is failed in turn.
+func Promote(c *Context) {
+	waiting, err := c.ListJobs(JobQuery{Statuses: []string{StatusWaiting}})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to list waiting jobs.")
+		return
+	}
+
+	for i := range waiting {
+		job := &waiting[i]
+		parentJID := job.Dependency()
+		fields := log.Fields{
+			"jid":        job.JID,
+			"account":    job.Account,
+			"depends on": parentJID,
+		}
+
+		parents, err := c.ListJobs(JobQuery{AccountName: job.Account, JIDs: []uint64{parentJID}})
+		if err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to look up a waiting job's dependency.")
+			continue
+		}
 
-		time.Sleep(time.Duration(c.Poll) * time.Millisecond)
+		if len(parents) == 0 {
+			job.Status = StatusError
+			job.Stderr += fmt.Sprintf("\nDependency failed: job [%d] does not exist.\n", parentJID)
+		} else if parent := parents[0]; parent.Status == StatusDone {
+			job.Status = StatusQueued
+		} else if IsCompleted(parent.Status) {
+			job.Status = StatusError
+			job.Stderr += fmt.Sprintf("\nDependency failed: job [%d] finished with status [%s].\n", parentJID, parent.Status)
+		} else {
+			// Keep waiting.
+			continue
+		}
+
+		if err := c.UpdateJob(job); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to update a waiting job's status.")
+			continue
+		}
+
+		fields["status"] = job.Status
+		log.WithFields(fields).Info("Waiting job's dependency has completed.")
 	}
 }
 
-// Claim acquires the oldest single pending job and launches a goroutine to execute its command in
-// a new container.
+// saturatedAccounts returns the names of accounts that are already running as many jobs as their
+// concurrency limit allows, given the number of jobs that each account is running.
+func saturatedAccounts(c *Context, running map[string]int) ([]string, error) {
+	var saturated []string
+	for name, count := range running {
+		account, err := c.GetAccount(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if limit := account.ConcurrencyLimit(c.DefaultMaxConcurrentJobs); limit > 0 && count >= limit {
+			saturated = append(saturated, name)
+		}
+	}
+	sort.Strings(saturated)
+	return saturated, nil
+}
+
+// fairShareAccount chooses the account whose queued job should be claimed next: the account with
+// the lowest ResourceScore, ignoring skipAccounts. Ties go to the account with the oldest queued job.
+// queued holds the number of queued jobs of each account. It returns an empty name if there are no
+// eligible queued jobs.
+func fairShareAccount(c *Context, queued []AccountJobCount, skipAccounts []string) (string, float64, error) {
+	skipped := make(map[string]bool, len(skipAccounts))
+	for _, name := range skipAccounts {
+		skipped[name] = true
+	}
+
+	var preferred string
+	var lowest float64
+	var oldest StoredTime
+	for _, depth := range queued {
+		if skipped[depth.Account] {
+			continue
+		}
+
+		account, err := c.GetAccount(depth.Account)
+		if err != nil {
+			return "", 0, err
+		}
+
+		score := account.ResourceScore(depth.Count)
+		if preferred == "" || score < lowest || (score == lowest && depth.OldestCreatedAt.Before(oldest)) {
+			preferred, lowest, oldest = depth.Account, score, depth.OldestCreatedAt
+		}
+	}
+	return preferred, lowest, nil
+}
+
+// Claim acquires the oldest single pending job from the account with the lowest ResourceScore and
+// launches a goroutine to execute its command in a new container. Jobs from accounts that have
+// reached their concurrency limit are skipped. If every worker slot is busy, nothing is claimed
+// unless a running job can be preempted. If the queue is empty, an overdue job may be stolen from
+// another runner instead. The Context is marked Ready once a claim cycle completes without errors.
 func Claim(c *Context) {
-	job, err := c.ClaimJob()
+	// Only the number of jobs that each account is running or has queued is needed here, so count
+	// them in storage rather than listing every job on every poll.
+	counts, err := c.CountJobsByAccount([]string{StatusQueued, StatusProcessing})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to count running and queued jobs.")
+		return
+	}
+
+	running := make(map[string]int)
+	totalRunning := 0
+	var queued []AccountJobCount
+	for _, count := range counts {
+		if count.Status == StatusQueued {
+			queued = append(queued, count)
+			continue
+		}
+		running[count.Account] += count.Count
+		totalRunning += count.Count
+	}
+
+	skip, err := saturatedAccounts(c, running)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to look up the accounts of running jobs.")
+		return
+	}
+
+	preferred, score, err := fairShareAccount(c, queued, skip)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to compute resource scores.")
+		return
+	}
+
+	if c.MaxWorkers > 0 && totalRunning >= c.MaxWorkers && !preempt(c, preferred) {
+		// Every worker is busy, which still counts as a successful claim cycle.
+		atomic.StoreInt32(&c.Ready, 1)
+		return
+	}
+
+	// Claim from the preferred account alone by skipping every other account with queued jobs.
+	claimSkip := append([]string(nil), skip...)
+	if preferred != "" {
+		skipped := make(map[string]bool)
+		for _, name := range skip {
+			skipped[name] = true
+		}
+		for _, depth := range queued {
+			if depth.Account != preferred && !skipped[depth.Account] {
+				skipped[depth.Account] = true
+				claimSkip = append(claimSkip, depth.Account)
+			}
+		}
+	}
+
+	job, err := c.ClaimJob(claimSkip, StoreTime(c.clock().Now()))
 	if err != nil {
 		log.WithFields(log.Fields{"error": err}).Error("Unable to claim a job.")
 		return
 	}
+	atomic.StoreInt32(&c.Ready, 1)
+	if job == nil {
+		job = steal(c)
+	}
 	if job == nil {
 		// Nothing to claim.
 		return
 	}
+	job.Runner = c.RunnerID
+	if job.Account == preferred {
+		job.ResourceScore = score
+	}
+	job.ApplyDefaults()
 	if err := job.Validate(); err != nil {
 		fields := log.Fields{
 			"jid":     job.JID,
@@ -88,7 +476,522 @@ func Claim(c *Context) {
 		return
 	}
 
-	go Execute(c, job)
+	c.InFlight.Add(1)
+	go func() {
+		defer c.InFlight.Done()
+		Execute(c, job)
+	}()
+}
+
+// stealMultiplier is how many times longer than its MaxRuntime a job must have been running on
+// another runner before it may be stolen. A healthy runner stops the job once its MaxRuntime has
+// elapsed, so a job that's still running well past it has most likely been abandoned.
+const stealMultiplier = 2
+
+// steal re-claims the longest-running job that was started by another runner and has been running
+// for more than stealMultiplier times its MaxRuntime, if work stealing is enabled. Jobs without a
+// MaxRuntime are never stolen, because there's no way to tell whether they're overdue. The stolen
+// job is reset to run again from the beginning, and its previous runner abandons it once it notices.
+// nil is returned if there's no job to steal.
+func steal(c *Context) *SubmittedJob {
+	if !c.WorkStealingEnabled {
+		return nil
+	}
+
+	running, err := c.ListJobs(JobQuery{Statuses: []string{StatusProcessing}})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to list running jobs.")
+		return nil
+	}
+
+	now := c.clock().Now()
+
+	candidates := make([]SubmittedJob, 0, len(running))
+	for _, job := range running {
+		if job.Runner == c.RunnerID || job.StartedAt.IsZero() || job.MaxRuntime <= 0 {
+			continue
+		}
+		cutoff := StoreTime(now.Add(-stealMultiplier * time.Duration(job.MaxRuntime) * maxRuntimeUnit))
+		if job.StartedAt.Before(cutoff) {
+			candidates = append(candidates, job)
+		}
+	}
+	sort.Sort(byStartedAt(candidates))
+
+	for _, candidate := range candidates {
+		fields := log.Fields{
+			"jid":             candidate.JID,
+			"account":         candidate.Account,
+			"previous runner": candidate.Runner,
+			"started at":      candidate.StartedAt,
+			"max runtime":     candidate.MaxRuntime,
+		}
+
+		job, err := c.ReclaimJob(candidate, c.RunnerID, StoreTime(now))
+		if err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to steal an overdue job.")
+			return nil
+		}
+		if job == nil {
+			// Another runner stole it first.
+			continue
+		}
+
+		log.WithFields(fields).Info("Stole an overdue job from another runner.")
+		job.ResetRun()
+		return job
+	}
+	return nil
+}
+
+// byStartedAt sorts jobs by the time that they started running, oldest first.
+type byStartedAt []SubmittedJob
+
+func (jobs byStartedAt) Len() int           { return len(jobs) }
+func (jobs byStartedAt) Swap(i, j int)      { jobs[i], jobs[j] = jobs[j], jobs[i] }
+func (jobs byStartedAt) Less(i, j int) bool { return jobs[i].StartedAt.Before(jobs[j].StartedAt) }
+
+// preempt stops the oldest running job to make room for the job that Claim will take next, the
+// oldest queued job of the account that fair share prefers, if preemption is enabled and that job
+// has a higher PreemptionPriority. It returns true if a job was preempted.
+func preempt(c *Context, preferred string) bool {
+	if !c.PreemptionEnabled || preferred == "" {
+		return false
+	}
+
+	// Jobs that are scheduled for later can't be claimed yet, so they don't count as the head.
+	queued, err := c.ListJobs(JobQuery{
+		AccountName:    preferred,
+		Statuses:       []string{StatusQueued},
+		ScheduledUntil: StoreTime(c.clock().Now()),
+		Limit:          1,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to find the next queued job.")
+		return false
+	}
+	if len(queued) == 0 {
+		return false
+	}
+	head := queued[0]
+
+	running, err := c.ListJobs(JobQuery{Statuses: []string{StatusProcessing}})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Unable to list running jobs.")
+		return false
+	}
+	if len(running) == 0 {
+		return false
+	}
+
+	oldest := running[0]
+	for _, job := range running[1:] {
+		if job.StartedAt.Before(oldest.StartedAt) || (job.StartedAt == oldest.StartedAt && job.JID < oldest.JID) {
+			oldest = job
+		}
+	}
+
+	if oldest.PreemptionPriority >= head.PreemptionPriority || !requestPreemption(oldest.JID) {
+		return false
+	}
+
+	log.WithFields(log.Fields{
+		"jid":           oldest.JID,
+		"priority":      oldest.PreemptionPriority,
+		"next jid":      head.JID,
+		"next priority": head.PreemptionPriority,
+	}).Info("Preempting a running job for a higher-priority job.")
+	return true
+}
+
+// watchForPreemption registers a running job so that it may be preempted. Call the returned function
+// once the job is no longer running.
+func watchForPreemption(jid uint64) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+
+	preemptions.Lock()
+	preemptions.channels[jid] = ch
+	preemptions.Unlock()
+
+	unwatch := func() {
+		preemptions.Lock()
+		defer preemptions.Unlock()
+
+		if preemptions.channels[jid] == ch {
+			delete(preemptions.channels, jid)
+		}
+	}
+	return ch, unwatch
+}
+
+// requestPreemption asks a job that's running in this process to stop and return to the queue. It
+// returns false if the job isn't running here, or has already been asked.
+func requestPreemption(jid uint64) bool {
+	preemptions.Lock()
+	defer preemptions.Unlock()
+
+	ch, ok := preemptions.channels[jid]
+	if !ok {
+		return false
+	}
+	close(ch)
+	delete(preemptions.channels, jid)
+	return true
+}
+
+// stoppedStolen is sent by watchContainer when a job's container was stopped because another runner
+// stole the job. It isn't a real status: the job now belongs to the other runner, so it's left alone.
+const stoppedStolen = "stolen"
+
+// watchContainer stops a job's container if it's still running once the job's MaxRuntime has
+// elapsed, if a kill is requested while it runs, if it's preempted, or if another runner steals it.
+// Close finished once the container has exited. Exactly one value is sent on the returned channel:
+// the status that the job should be given because it was stopped (StatusTimeout, StatusKilled, or
+// StatusQueued if it was preempted), stoppedStolen if it was stolen, or an empty string if it
+// wasn't stopped.
+func watchContainer(c *Context, job *SubmittedJob, containerID string, finished <-chan struct{}) <-chan string {
+	stoppedAs := make(chan string, 1)
+	preempted, unwatch := watchForPreemption(job.JID)
+
+	go func() {
+		defer unwatch()
+		clock := c.clock()
+
+		var deadline <-chan time.Time
+		if job.MaxRuntime > 0 {
+			deadline = clock.After(time.Duration(job.MaxRuntime) * maxRuntimeUnit)
+		}
+
+		fields := log.Fields{
+			"jid":          job.JID,
+			"account":      job.Account,
+			"container id": containerID,
+		}
+		stop := func(status string) {
+			if err := c.StopContainer(containerID, stopGracePeriod); err != nil {
+				fields["error"] = err
+				log.WithFields(fields).Error("Unable to stop a job's container.")
+			}
+			stoppedAs <- status
+		}
+
+		for {
+			select {
+			case <-finished:
+				stoppedAs <- ""
+				return
+			case <-deadline:
+				fields["max runtime"] = job.MaxRuntime
+				log.WithFields(fields).Info("Job exceeded its maximum runtime. Stopping its container.")
+				stop(StatusTimeout)
+				return
+			case <-preempted:
+				log.WithFields(fields).Info("Job preempted by a higher-priority job. Stopping its container.")
+				stop(StatusQueued)
+				return
+			case <-clock.After(killPollInterval):
+				killed, err := c.JobKillRequested(job.JID)
+				if err != nil {
+					fields["error"] = err
+					log.WithFields(fields).Error("Unable to check whether a running job was killed.")
+					delete(fields, "error")
+					continue
+				}
+				if killed {
+					log.WithFields(fields).Info("Kill requested for a running job. Stopping its container.")
+					stop(StatusKilled)
+					return
+				}
+
+				// Jobs that have never been reclaimed may not have a runner recorded at all.
+				runner, err := c.JobRunner(job.JID)
+				if err != nil {
+					fields["error"] = err
+					log.WithFields(fields).Error("Unable to check whether a running job was stolen.")
+					delete(fields, "error")
+					continue
+				}
+				if runner != "" && runner != job.Runner {
+					fields["new runner"] = runner
+					log.WithFields(fields).Info("Job stolen by another runner. Stopping its container.")
+					stop(stoppedStolen)
+					return
+				}
+			}
+		}
+	}()
+
+	return stoppedAs
+}
+
+// requeueForRetry returns a failed job to the queue if it hasn't used up its retries. Jobs that are
+// only marked restartable may be retried as many times as the MaxRetries setting allows. The end of
+// the failed attempt's stderr is kept in LastError, and stderr is cleared for the next attempt. It
+// returns true if the job was requeued.
+func requeueForRetry(c *Context, job *SubmittedJob) bool {
+	if job.Status != StatusError {
+		return false
+	}
+	job.LastError = lastError(job.Stderr)
+
+	limit := job.RetryLimit(c.MaxRetries)
+	if limit == 0 || (limit != UnlimitedRetries && job.RetryCount >= limit) {
+		return false
+	}
+
+	job.RetryCount++
+	job.Status = StatusQueued
+	job.ResetRun()
+	return true
+}
+
+// lastError returns at most the final lastErrorSize bytes of stderr, without splitting a UTF-8
+// character.
+func lastError(stderr string) string {
+	if len(stderr) <= lastErrorSize {
+		return stderr
+	}
+
+	start := len(stderr) - lastErrorSize
+	for start < len(stderr) && !utf8.RuneStart(stderr[start]) {
+		start++
+	}
+	return stderr[start:]
+}
+
+// failJob marks a job as StatusError after a fatal error, appending a description of the error to
+// its stderr so that it can be diagnosed through the job API. Jobs with retries left are requeued
+// instead.
+func failJob(c *Context, job *SubmittedJob, message string, err error) {
+	fields := log.Fields{
+		"jid":     job.JID,
+		"account": job.Account,
+		"error":   err,
+	}
+	log.WithFields(fields).Error(message)
+
+	job.Status = StatusError
+	job.Stderr += fmt.Sprintf("\n%s: %v\n", message, err)
+	requeueForRetry(c, job)
+	recordJobCompletion(job)
+
+	if err := c.UpdateJob(job); err != nil {
+		fields["error"] = err
+		log.WithFields(fields).Error("Unable to update the job's status.")
+	}
+}
+
+// volumeBinds looks up each of a job's volumes and returns the bind specifications needed to mount
+// them within its container.
+func volumeBinds(c *Context, job *SubmittedJob) ([]string, error) {
+	binds := make([]string, 0, len(job.Volumes))
+	for _, jv := range job.Volumes {
+		volume, err := c.GetVolume(jv.Name)
+		if err == ErrNotFound {
+			return nil, &APIError{
+				Code:    CodeUnknownVolume,
+				Message: fmt.Sprintf("Unknown volume [%s]", jv.Name),
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+		binds = append(binds, volume.Bind())
+	}
+	return binds, nil
+}
+
+// pullLayers pulls the image for each of a job's layers that isn't already present on the Docker
+// host. It returns the image that the job's container should be created from: the job's final
+// layer, or the default image if it has none.
+func pullLayers(c *Context, job *SubmittedJob) (string, error) {
+	image := c.Image
+	for _, name := range job.Images() {
+		_, err := c.InspectImage(name)
+		if err == docker.ErrNoSuchImage {
+			log.WithFields(log.Fields{
+				"jid":   job.JID,
+				"image": name,
+			}).Info("Pulling a job's layer.")
+
+			err = pullWithProgress(c, job, name)
+		}
+		if err != nil {
+			return "", fmt.Errorf("unable to pull the layer [%s]: %v", name, err)
+		}
+		image = name
+	}
+	return image, nil
+}
+
+// pullWithProgress pulls an image for a job, recording the progress of each of the image's layers in
+// the job's PullProgress while the pull runs. PullProgress is cleared once the pull is over.
+func pullWithProgress(c *Context, job *SubmittedJob, image string) error {
+	reader, writer := io.Pipe()
+	recorded := make(chan struct{})
+	go func() {
+		recordPullProgress(c, job, reader)
+		close(recorded)
+	}()
+
+	repository, tag := docker.ParseRepositoryTag(image)
+	err := c.PullImage(docker.PullImageOptions{
+		Repository:    repository,
+		Tag:           tag,
+		OutputStream:  writer,
+		RawJSONStream: true,
+	}, docker.AuthConfiguration{})
+	writer.Close()
+	<-recorded
+
+	job.PullProgress = nil
+	if updateErr := c.UpdateJob(job); updateErr != nil {
+		log.WithFields(log.Fields{
+			"jid":   job.JID,
+			"image": image,
+			"error": updateErr,
+		}).Error("Unable to clear the job's pull progress.")
+	}
+	return err
+}
+
+// pullMessage is one of the JSON progress messages that Docker streams while it pulls an image.
+type pullMessage struct {
+	ID       string `json:"id"`
+	Status   string `json:"status"`
+	Progress string `json:"progress"`
+}
+
+// recordPullProgress decodes pull progress messages from stream until it's closed, and keeps the
+// latest message for each layer in the job's PullProgress. The job is updated no more often than the
+// OutputFlushInterval allows.
+func recordPullProgress(c *Context, job *SubmittedJob, stream io.Reader) {
+	// Keep consuming the stream after a decoding error, so that the pull isn't blocked.
+	defer io.Copy(ioutil.Discard, stream)
+
+	interval := time.Duration(c.OutputFlushInterval) * time.Millisecond
+	var lastFlush time.Time
+
+	decoder := json.NewDecoder(stream)
+	for {
+		var message pullMessage
+		if err := decoder.Decode(&message); err != nil {
+			if err != io.EOF {
+				log.WithFields(log.Fields{
+					"jid":   job.JID,
+					"error": err,
+				}).Debug("Unable to decode pull progress.")
+			}
+			return
+		}
+		if message.ID == "" {
+			continue
+		}
+
+		if job.PullProgress == nil {
+			job.PullProgress = make(map[string]string)
+		}
+		job.PullProgress[message.ID] = strings.TrimSpace(message.Status + " " + message.Progress)
+
+		now := c.clock().Now()
+		if now.Sub(lastFlush) < interval {
+			continue
+		}
+		if err := c.UpdateJob(job); err != nil {
+			log.WithFields(log.Fields{
+				"jid":   job.JID,
+				"error": err,
+			}).Error("Unable to record the job's pull progress.")
+		}
+		lastFlush = now
+	}
+}
+
+// removeStaleContainer removes a stopped container that was left behind with the name of a job's
+// container, such as by a previous run that crashed. It returns an error if that container is still
+// running.
+func removeStaleContainer(c *Context, job *SubmittedJob) error {
+	name := job.ContainerName()
+	existing, err := c.InspectContainer(name)
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if existing.State.Running {
+		return &APIError{
+			Code:    CodeContainerConflict,
+			Message: fmt.Sprintf("A container named [%s] is already running", name),
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"jid":            job.JID,
+		"container id":   existing.ID,
+		"container name": name,
+	}).Info("Removing a stale container left behind by a previous run.")
+	return c.RemoveContainer(docker.RemoveContainerOptions{ID: existing.ID})
+}
+
+// readContainerFile copies a single file out of a container and returns its contents.
+func readContainerFile(c *Context, containerID, path string) ([]byte, error) {
+	var archive bytes.Buffer
+	err := c.CopyFromContainer(docker.CopyFromContainerOptions{
+		Container:    containerID,
+		Resource:     path,
+		OutputStream: &archive,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// CopyFromContainer returns the file contents as a tarball.
+	var content bytes.Buffer
+	tr := tar.NewReader(&archive)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to read tar-encoded content: %v", err)
+		}
+
+		if _, err := io.Copy(&content, tr); err != nil {
+			return nil, fmt.Errorf("unable to copy decoded content: %v", err)
+		}
+	}
+	return content.Bytes(), nil
+}
+
+// containerCommand returns the command that a job's container runs. Profiled jobs are run under
+// /usr/bin/time, which writes their resource usage to profilePath.
+func containerCommand(job *SubmittedJob) []string {
+	cmd := []string{"/bin/bash", "-c", job.RunCommand()}
+	if job.Profile == nil || !*job.Profile {
+		return cmd
+	}
+	return append([]string{"/usr/bin/time", "-f", profileFormat, "-o", profilePath}, cmd...)
+}
+
+// parseProfile parses the output of /usr/bin/time, written with profileFormat, into job metrics.
+// CPU times are converted to nanoseconds and the maximum resident set size to bytes.
+func parseProfile(output string) (Collected, error) {
+	var user, system, wall float64
+	var maxRSS uint64
+	if _, err := fmt.Sscan(output, &user, &system, &wall, &maxRSS); err != nil {
+		return Collected{}, fmt.Errorf("unable to parse profile [%s]: %v", strings.TrimSpace(output), err)
+	}
+
+	return Collected{
+		CPUTimeUser:    uint64(user * float64(time.Second)),
+		CPUTimeSystem:  uint64(system * float64(time.Second)),
+		MemoryMaxUsage: maxRSS * 1024,
+		WallTime:       uint64(wall),
+	}, nil
 }
 
 // Execute launches a container to process the submitted job. It passes any provided stdin data
@@ -132,29 +1035,80 @@ func Execute(c *Context, job *SubmittedJob) {
 		return true
 	}
 
+	// Charge the job's account for its runtime so far. finished is false for an attempt that was cut
+	// short and will run again, which shouldn't count towards the account's total jobs.
+	chargeAccount := func(finished bool) {
+		if err := c.UpdateAccountUsage(job.Account, job.Runtime, finished); err != nil {
+			reportErr("Update account usage: ERROR", err)
+		}
+		if c.CostPerNanosecond > 0 {
+			err := c.AdjustAccountCredits(job.Account, -job.Runtime*c.CostPerNanosecond)
+			checkErr("Deducted the job's cost from the account's credits", err)
+		}
+	}
+
 	log.WithFields(defaultFields).Info("Launching a job.")
 
-	job.StartedAt = StoreTime(time.Now())
+	// Let anyone streaming this job's output know when it's finished. A job that's returned to the
+	// queue will run again, so its streams are left open for its next attempt.
+	defer func() {
+		if job.Status != StatusQueued {
+			c.Output.Close(job.JID)
+		}
+	}()
+
+	job.StartedAt = StoreTime(c.clock().Now())
 	job.QueueDelay = job.StartedAt.AsTime().Sub(job.CreatedAt.AsTime()).Nanoseconds()
 
+	binds, err := volumeBinds(c, job)
+	if err != nil {
+		failJob(c, job, "Unable to mount the job's volumes", err)
+		return
+	}
+
+	image, err := pullLayers(c, job)
+	if err != nil {
+		// The job can't make progress until its layers are available.
+		reportErr("Pulled the job's layers: ERROR", err)
+		job.Status = StatusStalled
+		job.FinishedAt = StoreTime(c.clock().Now())
+		job.Stderr += fmt.Sprintf("\nJob stalled: %v\n", err)
+		updateJob("status")
+		return
+	}
+
+	if err := removeStaleContainer(c, job); err != nil {
+		failJob(c, job, "Unable to reuse the job's container name", err)
+		return
+	}
+
+	started := time.Now()
 	container, err := c.CreateContainer(docker.CreateContainerOptions{
 		Name: job.ContainerName(),
 		Config: &docker.Config{
-			Image:     c.Image,
-			Cmd:       []string{"/bin/bash", "-c", job.Command},
+			Image:     image,
+			Cmd:       containerCommand(job),
+			CPUShares: int64(job.Multicore) * cpuSharesPerCore,
+			Env:       job.EnvironmentList(),
+			Labels:    job.ContainerLabels(),
 			OpenStdin: true,
 			StdinOnce: true,
 		},
 	})
-	if checkErr("Created the job's container", err) {
-		job.Status = StatusError
-		updateJob("status")
+	observeDockerOperation("create", started)
+	if err != nil {
+		failJob(c, job, "Unable to create the job's container", err)
 		return
 	}
 
+	// Record the size of the job's image for capacity planning.
+	if inspected, err := c.InspectImage(image); !checkErr("Inspected the job's image", err) {
+		job.ContainerSize = inspected.VirtualSize
+	}
+
 	// Record the job's container ID.
 	job.ContainerID = container.ID
-	if !updateJob("start timestamp and container id") {
+	if !updateJob("start timestamp, container id, and container size") {
 		return
 	}
 
@@ -162,6 +1116,15 @@ func Execute(c *Context, job *SubmittedJob) {
 	defaultFields["container id"] = container.ID
 	defaultFields["container name"] = container.Name
 
+	// removeContainer discards the job's container. It's forced, so that a container left running by
+	// a failed Docker call is removed too.
+	removeContainer := func() {
+		started := time.Now()
+		err := c.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+		observeDockerOperation("remove", started)
+		checkErr("Removed the container", err)
+	}
+
 	// Was a kill requested between the time the job was claimed, and the time the container was
 	// created? If so: transition the job to StatusKilled and jump ahead to removing the container
 	// we just created. If not: continue with job execution normally.
@@ -175,12 +1138,12 @@ func Execute(c *Context, job *SubmittedJob) {
 	} else {
 		// Prepare the input and output streams.
 		stdin := bytes.NewReader(job.Stdin)
-		stdout := OutputCollector{
+		stdout := &OutputCollector{
 			context:  c,
 			job:      job,
 			isStdout: true,
 		}
-		stderr := OutputCollector{
+		stderr := &OutputCollector{
 			context:  c,
 			job:      job,
 			isStdout: false,
@@ -201,30 +1164,66 @@ func Execute(c *Context, job *SubmittedJob) {
 		}()
 
 		// Start the created container.
-		err = c.StartContainer(container.ID, &docker.HostConfig{})
-		if checkErr("Started the container", err) {
-			job.Status = StatusError
-			updateJob("status")
+		started = time.Now()
+		err = c.StartContainer(container.ID, &docker.HostConfig{Binds: binds})
+		observeDockerOperation("start", started)
+		if err != nil {
+			removeContainer()
+			failJob(c, job, "Unable to start the job's container", err)
 			return
 		}
 
 		// Measure the container-launch overhead here.
-		overhead := time.Now()
+		overhead := c.clock().Now()
 		job.OverheadDelay = overhead.Sub(job.StartedAt.AsTime()).Nanoseconds()
 		updateJob("overhead delay")
 
+		// Stop the container if it runs for longer than the job's maximum runtime, or if it's killed.
+		finished := make(chan struct{})
+		stoppedAs := watchContainer(c, job, container.ID, finished)
+
+		statsDone := make(chan bool)
+		lastStats := collectStats(c, container.ID, statsDone)
+
+		started = time.Now()
 		status, err := c.WaitContainer(container.ID)
-		if checkErr("Waited for the container to complete", err) {
-			job.Status = StatusError
-			updateJob("status")
+		observeDockerOperation("wait", started)
+		close(finished)
+		close(statsDone)
+		if err != nil {
+			removeContainer()
+			failJob(c, job, "Unable to wait for the job's container to complete", err)
 			return
 		}
 
-		job.FinishedAt = StoreTime(time.Now())
+		job.FinishedAt = StoreTime(c.clock().Now())
 		job.Runtime = job.FinishedAt.AsTime().Sub(overhead).Nanoseconds()
-		if status == 0 {
+		job.ReturnCode = strconv.Itoa(status)
+		stopped := <-stoppedAs
+		if stopped == stoppedStolen {
+			// Another runner has taken the job over, so any state recorded here would overwrite its
+			// progress. Its new runner will charge for the job when it finishes.
+			removeContainer()
+			log.WithFields(defaultFields).Info("Abandoned a job that was stolen by another runner.")
+			return
+		}
+		if stopped == StatusTimeout {
+			// The runtime limit was exceeded.
+			job.Status = StatusTimeout
+			job.Stderr += fmt.Sprintf("\nJob timed out: exceeded its maximum runtime of %d seconds.\n", job.MaxRuntime)
+		} else if stopped == StatusKilled {
+			// A kill was requested while the job was running.
+			job.Status = StatusKilled
+		} else if stopped == StatusQueued {
+			// The job was preempted. Charge for the time that it ran, then return it to the queue to
+			// start over later.
+			job.Status = StatusQueued
+			chargeAccount(false)
+			job.ResetRun()
+		} else if status == 0 {
 			// Successful termination.
 			job.Status = StatusDone
+			job.CacheExpiresAt = cacheExpiry(c, job)
 
 			// Extract the result from the job.
 			if job.ResultSource == "stdout" {
@@ -233,39 +1232,11 @@ func Execute(c *Context, job *SubmittedJob) {
 			} else if strings.HasPrefix(job.ResultSource, "file:") {
 				resultPath := job.ResultSource[len("file:"):len(job.ResultSource)]
 
-				var resultBuffer bytes.Buffer
-				err = c.CopyFromContainer(docker.CopyFromContainerOptions{
-					Container:    container.ID,
-					Resource:     resultPath,
-					OutputStream: &resultBuffer,
-				})
+				result, err := readContainerFile(c, container.ID, resultPath)
 				if checkErr(fmt.Sprintf("Acquired the job's result from the file [%s]", resultPath), err) {
 					job.Status = StatusError
 				} else {
-					// CopyFromContainer returns the file contents as a tarball.
-					var content bytes.Buffer
-					r := bytes.NewReader(resultBuffer.Bytes())
-					tr := tar.NewReader(r)
-
-					for {
-						_, err := tr.Next()
-						if err == io.EOF {
-							break
-						}
-						if err != nil {
-							reportErr("Read tar-encoded content: ERROR", err)
-							job.Status = StatusError
-							break
-						}
-
-						if _, err = io.Copy(&content, tr); err != nil {
-							reportErr("Copy decoded content: ERROR", err)
-							job.Status = StatusError
-							break
-						}
-					}
-
-					job.Result = content.Bytes()
+					job.Result = result
 				}
 			}
 		} else {
@@ -275,7 +1246,7 @@ func Execute(c *Context, job *SubmittedJob) {
 			// transition to StatusError.
 			killed, err := c.JobKillRequested(job.JID)
 			if err != nil {
-				reportErr("Check the job kill status: ERROR", err)
+				failJob(c, job, "Unable to check whether the job was killed", err)
 				return
 			}
 
@@ -286,24 +1257,108 @@ func Execute(c *Context, job *SubmittedJob) {
 			}
 		}
 
+		if stats := <-lastStats; stats != nil && job.Status != StatusQueued {
+			job.Collected.CPUPercent = cpuPercent(stats)
+		}
+
+		// Collect the resource usage of profiled jobs that ran to completion.
+		if job.Profile != nil && *job.Profile && (job.Status == StatusDone || job.Status == StatusError) {
+			output, err := readContainerFile(c, container.ID, profilePath)
+			if !checkErr("Acquired the job's profile", err) {
+				collected, err := parseProfile(string(output))
+				if !checkErr("Parsed the job's profile", err) {
+					job.Collected.CPUTimeUser = collected.CPUTimeUser
+					job.Collected.CPUTimeSystem = collected.CPUTimeSystem
+					job.Collected.MemoryMaxUsage = collected.MemoryMaxUsage
+					job.Collected.WallTime = collected.WallTime
+				}
+			}
+		}
+
 		// Job execution has completed successfully.
 	}
 
-	err = c.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID})
-	checkErr("Removed the container", err)
+	removeContainer()
 
-	err = c.UpdateAccountUsage(job.Account, job.Runtime)
-	if err != nil {
-		reportErr("Update account usage: ERROR", err)
+	// A preempted job has already been charged for its attempt.
+	if job.Status != StatusQueued {
+		chargeAccount(true)
+	}
+
+	if requeueForRetry(c, job) {
+		log.WithFields(log.Fields{
+			"jid":         job.JID,
+			"account":     job.Account,
+			"retry count": job.RetryCount,
+		}).Info("Failed job has retries left. Returning it to the queue.")
 	}
 	updateJob("status and final result")
+	recordJobCompletion(job)
 
-	log.WithFields(log.Fields{
-		"jid":      job.JID,
-		"account":  job.Account,
-		"status":   job.Status,
-		"runtime":  job.Runtime,
-		"overhead": job.OverheadDelay,
-		"queue":    job.QueueDelay,
-	}).Info("Job complete.")
+	log.WithFields(completionFields(job)).Info("Job complete.")
+}
+
+// collectStats streams a container's resource usage until done is closed. The returned channel
+// receives the last sample that arrived, or nil if there weren't any, once the stream has ended.
+func collectStats(c *Context, containerID string, done <-chan bool) <-chan *docker.Stats {
+	samples := make(chan *docker.Stats)
+	last := make(chan *docker.Stats, 1)
+
+	go func() {
+		var latest *docker.Stats
+		for sample := range samples {
+			latest = sample
+		}
+		last <- latest
+	}()
+
+	go func() {
+		// Stats closes the samples channel when it returns.
+		err := c.Stats(docker.StatsOptions{ID: containerID, Stats: samples, Stream: true, Done: done})
+		if err != nil {
+			log.WithFields(log.Fields{
+				"container id": containerID,
+				"error":        err,
+			}).Debug("Unable to stream container stats.")
+		}
+	}()
+
+	return last
+}
+
+// cpuPercent computes a container's CPU utilisation from a stats sample the same way that "docker
+// stats" does: the container's share of the host's CPU time since the previous sample, scaled by
+// the number of CPUs.
+func cpuPercent(stats *docker.Stats) float64 {
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemCPUUsage) - float64(stats.PreCPUStats.SystemCPUUsage)
+	if cpuDelta <= 0 || systemDelta <= 0 {
+		return 0
+	}
+
+	cpus := float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	return cpuDelta / systemDelta * cpus * 100.0
+}
+
+// completionFields describes a finished job for logging. Its wall-clock duration, from the time it
+// was started until its container exited, and the time it spent in the queue are reported in
+// milliseconds alongside the raw nanosecond measurements. A non-zero return code is included.
+func completionFields(job *SubmittedJob) log.Fields {
+	duration := time.Duration(job.OverheadDelay + job.Runtime)
+	queueDelay := time.Duration(job.QueueDelay)
+
+	fields := log.Fields{
+		"jid":            job.JID,
+		"account":        job.Account,
+		"status":         job.Status,
+		"runtime":        job.Runtime,
+		"overhead":       job.OverheadDelay,
+		"queue":          job.QueueDelay,
+		"duration ms":    int64(duration / time.Millisecond),
+		"queue delay ms": int64(queueDelay / time.Millisecond),
+	}
+	if job.ReturnCode != "" && job.ReturnCode != "0" {
+		fields["return code"] = job.ReturnCode
+	}
+	return fields
 }
@@ -0,0 +1,1729 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	docker "github.com/smashwilson/go-dockerclient"
+)
+
+func executeJob(t *testing.T, job Job) (*SubmittedJob, *MockDockerClient) {
+	d := &MockDockerClient{}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+
+	job.ApplyDefaults()
+	if err := job.Validate(); err != nil {
+		t.Fatalf("Invalid job: %v", err)
+	}
+	submitted := &SubmittedJob{Job: job, JID: 42, Status: StatusProcessing}
+
+	Execute(c, submitted)
+
+	if len(d.Created) != 1 {
+		t.Fatalf("Expected one container to be created, got [%d]", len(d.Created))
+	}
+	return submitted, d
+}
+
+func TestExecuteMulticoreShares(t *testing.T) {
+	_, d := executeJob(t, Job{
+		Command:      "id",
+		Multicore:    2,
+		ResultSource: "stdout",
+		ResultType:   ResultBinary,
+	})
+
+	// The pinned Docker client sets CPU shares on the container's Config, rather than its HostConfig.
+	if shares := d.Created[0].Config.CPUShares; shares != 2048 {
+		t.Errorf("Expected a two-core job to receive 2048 CPU shares, got [%d]", shares)
+	}
+}
+
+func TestExecuteDefaultMulticoreShares(t *testing.T) {
+	_, d := executeJob(t, Job{
+		Command:      "id",
+		ResultSource: "stdout",
+		ResultType:   ResultBinary,
+	})
+
+	if shares := d.Created[0].Config.CPUShares; shares != 1024 {
+		t.Errorf("Expected a single-core job to receive 1024 CPU shares, got [%d]", shares)
+	}
+}
+
+func TestExecuteEnvironment(t *testing.T) {
+	_, d := executeJob(t, Job{
+		Command:      "env",
+		Environment:  map[string]string{"FOO": "bar", "EMPTY": "", "URL": "http://x/?a=b"},
+		ResultSource: "stdout",
+		ResultType:   ResultBinary,
+	})
+
+	expected := []string{"EMPTY=", "FOO=bar", "URL=http://x/?a=b"}
+	env := d.Created[0].Config.Env
+	if len(env) != len(expected) {
+		t.Fatalf("Expected environment %v, got %v", expected, env)
+	}
+	for i := range expected {
+		if env[i] != expected[i] {
+			t.Errorf("Expected environment entry [%s], got [%s]", expected[i], env[i])
+		}
+	}
+}
+
+func TestExecuteAffinityLabel(t *testing.T) {
+	_, d := executeJob(t, Job{
+		Command:       "nvidia-smi",
+		AffinityLabel: "gpu=true",
+		ResultSource:  "stdout",
+		ResultType:    ResultBinary,
+	})
+
+	expected := map[string]string{"com.docker.swarm.affinities": `["gpu=true"]`}
+	if labels := d.Created[0].Config.Labels; !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected container labels %v, got %v", expected, labels)
+	}
+}
+
+// CreditStorage is a fake Storage implementation that records account usage and adjustments to
+// account credits.
+type CreditStorage struct {
+	NullStorage
+
+	Credits map[string]int64
+	Runtime int64
+	Jobs    int
+}
+
+func (storage *CreditStorage) UpdateAccountUsage(name string, runtime int64, finished bool) error {
+	storage.Runtime += runtime
+	if finished {
+		storage.Jobs++
+	}
+	return nil
+}
+
+func (storage *CreditStorage) AdjustAccountCredits(name string, delta int64) error {
+	storage.Credits[name] += delta
+	return nil
+}
+
+func TestExecuteDeductsCredits(t *testing.T) {
+	clock := NewFakeClock()
+	s := &CreditStorage{Credits: map[string]int64{"user": 50000000000}}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2", CostPerNanosecond: 2},
+		Storage:  s,
+		Docker:   &MockDockerClient{Runtime: 10 * time.Second, Clock: clock},
+		Clock:    clock,
+	}
+	job := &SubmittedJob{
+		Job:     Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:     42,
+		Account: "user",
+		Status:  StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusDone {
+		t.Fatalf("Expected the job to be done, but was [%s]", job.Status)
+	}
+	if job.Runtime != (10 * time.Second).Nanoseconds() {
+		t.Fatalf("Expected the job to run for ten seconds, got [%d]", job.Runtime)
+	}
+	if s.Credits["user"] != 30000000000 {
+		t.Errorf("Expected a balance of [30000000000] credits after the run, got [%d]", s.Credits["user"])
+	}
+	if s.Runtime != job.Runtime || s.Jobs != 1 {
+		t.Errorf("Expected one job of [%d] to be recorded, got [%d] jobs of [%d]", job.Runtime, s.Jobs, s.Runtime)
+	}
+}
+
+func TestExecuteEnforcesMaxRuntime(t *testing.T) {
+	clock := NewFakeClock()
+	profile := true
+	d := &MockDockerClient{RunUntilStopped: true, Files: map[string]string{profilePath: "1.50 0.25 3.00 2048\n"}}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+		Clock:    clock,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "sleep 100",
+			Multicore:    1,
+			MaxRuntime:   10,
+			Profile:      &profile,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Execute(c, job)
+		close(done)
+	}()
+
+	// Wait for both the runtime deadline and the first kill poll to be scheduled.
+	clock.WaitForTimers(2)
+	clock.Advance(10 * time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the job to be stopped once its maximum runtime elapsed")
+	}
+
+	if len(d.Stopped) != 1 || d.Stopped[0] != "abc123" {
+		t.Errorf("Expected the container to be stopped once, got [%v]", d.Stopped)
+	}
+	if job.Status != StatusTimeout {
+		t.Errorf("Expected the job to time out, but was [%s]", job.Status)
+	}
+	if !strings.Contains(job.Stderr, "exceeded its maximum runtime of 10 seconds") {
+		t.Errorf("Expected stderr to explain the runtime limit: [%s]", job.Stderr)
+	}
+	if job.Runtime != (10 * time.Second).Nanoseconds() {
+		t.Errorf("Expected the job's runtime to be measured with the clock, got [%d]", job.Runtime)
+	}
+	if len(d.Copied) != 0 || job.Collected != (Collected{}) {
+		t.Errorf("Expected the profile of a timed out job to be ignored, got %v and %+v", d.Copied, job.Collected)
+	}
+}
+
+func TestExecuteWithMaxRuntime(t *testing.T) {
+	d := &MockDockerClient{Runtime: 10 * time.Second}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "sleep 10",
+			Multicore:    1,
+			MaxRuntime:   1,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Execute(c, job)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the job to be stopped within 3 seconds")
+	}
+
+	if job.Status != StatusTimeout {
+		t.Errorf("Expected the job to time out, but was [%s]", job.Status)
+	}
+}
+
+// KillStorage is a fake Storage implementation whose jobs can be killed while they're running.
+type KillStorage struct {
+	NullStorage
+
+	lock   sync.Mutex
+	killed bool
+}
+
+func (storage *KillStorage) RequestKill() {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	storage.killed = true
+}
+
+func (storage *KillStorage) JobKillRequested(jid uint64) (bool, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	return storage.killed, nil
+}
+
+func TestExecuteWithKillRequest(t *testing.T) {
+	defer func(interval time.Duration) { killPollInterval = interval }(killPollInterval)
+	killPollInterval = time.Millisecond
+
+	d := &MockDockerClient{Runtime: 10 * time.Second}
+	s := &KillStorage{}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  s,
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "sleep 10",
+			Multicore:    1,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.RequestKill()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		Execute(c, job)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the job to be stopped within 3 seconds")
+	}
+
+	if len(d.Stopped) != 1 || d.Stopped[0] != "abc123" {
+		t.Errorf("Expected the container to be stopped once, got [%v]", d.Stopped)
+	}
+	if job.Status != StatusKilled {
+		t.Errorf("Expected the job to be killed, but was [%s]", job.Status)
+	}
+}
+
+// StolenStorage is a fake Storage implementation whose jobs are always recorded as belonging to
+// another runner. It records the status of each job update.
+type StolenStorage struct {
+	NullStorage
+
+	lock     sync.Mutex
+	Statuses []string
+}
+
+func (storage *StolenStorage) JobRunner(jid uint64) (string, error) {
+	return "thief", nil
+}
+
+func (storage *StolenStorage) UpdateJob(job *SubmittedJob) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	storage.Statuses = append(storage.Statuses, job.Status)
+	return nil
+}
+
+func TestExecuteAbandonsStolenJob(t *testing.T) {
+	defer func(interval time.Duration) { killPollInterval = interval }(killPollInterval)
+	killPollInterval = time.Millisecond
+
+	d := &MockDockerClient{Runtime: 10 * time.Second}
+	s := &StolenStorage{}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2", RunnerID: "slow"},
+		Storage:  s,
+		Docker:   d,
+	}
+	job := layeredJob()
+	job.Runner = "slow"
+
+	done := make(chan struct{})
+	go func() {
+		Execute(c, job)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the stolen job to be stopped within 3 seconds")
+	}
+
+	if len(d.Stopped) != 1 || d.Stopped[0] != "abc123" {
+		t.Errorf("Expected the container to be stopped once, got [%v]", d.Stopped)
+	}
+	if len(d.Removed) != 1 || d.Removed[0] != "abc123" {
+		t.Errorf("Expected the container to be removed once, got [%v]", d.Removed)
+	}
+	for _, status := range s.Statuses {
+		if status != StatusProcessing {
+			t.Errorf("Expected the stolen job's final state not to be recorded, got updates %v", s.Statuses)
+			break
+		}
+	}
+}
+
+func TestExecuteRetriesRestartableJob(t *testing.T) {
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2", MaxRetries: 3},
+		Storage:  NullStorage{},
+		Docker:   &MockDockerClient{ExitStatus: 1},
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "false",
+			Multicore:    1,
+			Restartable:  true,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		Execute(c, job)
+
+		if job.Status != StatusQueued {
+			t.Fatalf("Expected attempt %d to requeue the job, but it was [%s]", attempt, job.Status)
+		}
+		if job.RetryCount != attempt {
+			t.Errorf("Expected retry count [%d] after attempt %d, got [%d]", attempt, attempt, job.RetryCount)
+		}
+		if !job.StartedAt.IsZero() || !job.FinishedAt.IsZero() {
+			t.Errorf("Expected timestamps to be reset, got [%s] and [%s]", job.StartedAt, job.FinishedAt)
+		}
+		if job.ContainerID != "" {
+			t.Errorf("Expected container ID to be reset, got [%s]", job.ContainerID)
+		}
+
+		job.Status = StatusProcessing
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusError {
+		t.Errorf("Expected the job to fail once its retries were exhausted, but it was [%s]", job.Status)
+	}
+	if job.RetryCount != 3 {
+		t.Errorf("Expected the retry count to stay at 3, got [%d]", job.RetryCount)
+	}
+}
+
+func TestExecuteDoesNotRetryOrdinaryJob(t *testing.T) {
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2", MaxRetries: 3},
+		Storage:  NullStorage{},
+		Docker:   &MockDockerClient{ExitStatus: 1},
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "false", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusError {
+		t.Errorf("Expected the job to fail, but it was [%s]", job.Status)
+	}
+	if job.RetryCount != 0 {
+		t.Errorf("Expected no retries, got [%d]", job.RetryCount)
+	}
+}
+
+// retries returns a pointer to a job's maximum retry count.
+func retries(n int) *int {
+	return &n
+}
+
+func TestRequeueForRetryUsesMaxRetries(t *testing.T) {
+	c := &Context{Settings: Settings{MaxRetries: 3}}
+
+	cases := []struct {
+		description string
+		job         Job
+		retryCount  int
+		requeued    bool
+	}{
+		{"explicit limit with retries left", Job{MaxRetries: retries(1)}, 0, true},
+		{"explicit limit exhausted", Job{MaxRetries: retries(1)}, 1, false},
+		{"explicit limit overrides restartable", Job{MaxRetries: retries(5), Restartable: true}, 4, true},
+		{"explicit zero overrides restartable", Job{MaxRetries: retries(0), Restartable: true}, 0, false},
+		{"unlimited retries", Job{MaxRetries: retries(UnlimitedRetries)}, 1000, true},
+		{"restartable falls back to the setting", Job{Restartable: true}, 2, true},
+		{"restartable exhausted", Job{Restartable: true}, 3, false},
+		{"no retries", Job{}, 0, false},
+	}
+
+	for _, each := range cases {
+		job := &SubmittedJob{Job: each.job, Status: StatusError, RetryCount: each.retryCount}
+
+		if requeued := requeueForRetry(c, job); requeued != each.requeued {
+			t.Errorf("Expected requeueForRetry to return %v for %s", each.requeued, each.description)
+		}
+	}
+}
+
+func TestRequeueForRetryKeepsLastError(t *testing.T) {
+	c := &Context{Settings: Settings{MaxRetries: 3}}
+	job := &SubmittedJob{Job: Job{MaxRetries: retries(2)}, Status: StatusProcessing}
+
+	for attempt := 1; attempt <= 3; attempt++ {
+		job.Status = StatusError
+		job.Stderr += fmt.Sprintf("attempt %d failed\n", attempt)
+		job.Stdout = fmt.Sprintf("attempt %d output\n", attempt)
+		job.OutputTruncated = true
+		requeued := requeueForRetry(c, job)
+
+		expected := fmt.Sprintf("attempt %d failed\n", attempt)
+		if job.LastError != expected {
+			t.Errorf("Expected LastError [%q] after attempt %d, got [%q]", expected, attempt, job.LastError)
+		}
+		if requeued && (job.Stderr != "" || job.Stdout != "" || job.OutputTruncated) {
+			t.Errorf("Expected output to be cleared for the retry after attempt %d, got [%q] [%q] %v",
+				attempt, job.Stdout, job.Stderr, job.OutputTruncated)
+		}
+	}
+
+	if job.Status != StatusError || job.Stderr != "attempt 3 failed\n" {
+		t.Errorf("Expected the final attempt's stderr to be kept, got [%s] [%q]", job.Status, job.Stderr)
+	}
+}
+
+func TestLastErrorTruncates(t *testing.T) {
+	stderr := strings.Repeat("x", 10) + strings.Repeat("é", lastErrorSize)
+
+	last := lastError(stderr)
+
+	if len(last) > lastErrorSize {
+		t.Errorf("Expected at most %d bytes, got %d", lastErrorSize, len(last))
+	}
+	if !utf8.ValidString(last) || !strings.HasSuffix(stderr, last) {
+		t.Errorf("Expected a valid UTF-8 suffix of stderr")
+	}
+}
+
+func TestExecuteReportsDockerFailures(t *testing.T) {
+	d := &MockDockerClient{StartErr: errors.New("no such image")}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusError {
+		t.Errorf("Expected the job to fail, but it was [%s]", job.Status)
+	}
+	if !strings.Contains(job.Stderr, "Unable to start the job's container: no such image") {
+		t.Errorf("Expected stderr to describe the failure, got [%s]", job.Stderr)
+	}
+	if len(d.Removed) != 1 || d.Removed[0] != "abc123" {
+		t.Errorf("Expected the container that failed to start to be removed, got %v", d.Removed)
+	}
+}
+
+// VolumeStorage is a fake Storage implementation that knows about a fixed set of volumes.
+type VolumeStorage struct {
+	NullStorage
+
+	Volumes map[string]Volume
+}
+
+func (storage VolumeStorage) GetVolume(name string) (*Volume, error) {
+	volume, ok := storage.Volumes[name]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return &volume, nil
+}
+
+func volumeContext(d Docker) *Context {
+	return &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage: VolumeStorage{
+			Volumes: map[string]Volume{
+				"data":    {Name: "data", HostPath: "/srv/data", ContainerPath: "/data"},
+				"scratch": {Name: "scratch", HostPath: "/tmp/scratch", ContainerPath: "/scratch"},
+			},
+		},
+		Docker: d,
+	}
+}
+
+func TestExecuteMountsVolumes(t *testing.T) {
+	d := &MockDockerClient{}
+	c := volumeContext(d)
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "ls /data",
+			Multicore:    1,
+			Volumes:      []JobVolume{{Name: "data"}, {Name: "scratch"}},
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if len(d.Started) != 1 {
+		t.Fatalf("Expected one container to be started, got [%d]", len(d.Started))
+	}
+	binds := d.Started[0].Binds
+	if len(binds) != 2 || binds[0] != "/srv/data:/data" || binds[1] != "/tmp/scratch:/scratch" {
+		t.Errorf("Unexpected binds: %v", binds)
+	}
+}
+
+func TestExecuteUnknownVolume(t *testing.T) {
+	d := &MockDockerClient{}
+	c := volumeContext(d)
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "ls /nope",
+			Multicore:    1,
+			Volumes:      []JobVolume{{Name: "data"}, {Name: "nope"}},
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	_, err := volumeBinds(c, job)
+	if apiErr, ok := err.(*APIError); !ok || apiErr.Code != CodeUnknownVolume {
+		t.Errorf("Expected a [%s] error, got [%v]", CodeUnknownVolume, err)
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusError {
+		t.Errorf("Expected the job to fail, but it was [%s]", job.Status)
+	}
+	if !strings.Contains(job.Stderr, "Unknown volume [nope]") {
+		t.Errorf("Expected stderr to name the unknown volume, got [%s]", job.Stderr)
+	}
+	if len(d.Created) != 0 {
+		t.Errorf("Expected no container to be created, got [%d]", len(d.Created))
+	}
+}
+
+func layeredJob(layers ...string) *SubmittedJob {
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "id",
+			Multicore:    1,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+	for _, layer := range layers {
+		job.Layers = append(job.Layers, JobLayer{Name: layer})
+	}
+	return job
+}
+
+func TestExecutePullsMissingLayers(t *testing.T) {
+	d := &MockDockerClient{
+		LocalImages:  map[string]bool{"cloudpipe/base:latest": true},
+		RemoteImages: map[string]bool{"cloudpipe/scipy:1.0": true},
+	}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := layeredJob("cloudpipe/base:latest", "cloudpipe/scipy:1.0")
+
+	Execute(c, job)
+
+	// Both layers are inspected before they're pulled, then the final layer is inspected for its size.
+	expectedInspected := []string{"cloudpipe/base:latest", "cloudpipe/scipy:1.0", "cloudpipe/scipy:1.0"}
+	if !reflect.DeepEqual(d.Inspected, expectedInspected) {
+		t.Errorf("Expected both layers to be inspected, got %v", d.Inspected)
+	}
+	if len(d.Pulled) != 1 || d.Pulled[0].Repository != "cloudpipe/scipy" || d.Pulled[0].Tag != "1.0" {
+		t.Errorf("Expected only the missing layer to be pulled, got %v", d.Pulled)
+	}
+	if len(d.Created) != 1 {
+		t.Fatalf("Expected one container to be created, got [%d]", len(d.Created))
+	}
+	if image := d.Created[0].Config.Image; image != "cloudpipe/scipy:1.0" {
+		t.Errorf("Expected the container to use the final layer, got [%s]", image)
+	}
+	if job.Status != StatusDone {
+		t.Errorf("Expected the job to complete, but it was [%s]", job.Status)
+	}
+}
+
+func TestExecuteStallsWhenPullFails(t *testing.T) {
+	d := &MockDockerClient{LocalImages: map[string]bool{}}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := layeredJob("cloudpipe/missing:latest")
+
+	Execute(c, job)
+
+	if job.Status != StatusStalled {
+		t.Errorf("Expected the job to stall, but it was [%s]", job.Status)
+	}
+	if !strings.Contains(job.Stderr, "cloudpipe/missing:latest") {
+		t.Errorf("Expected stderr to name the missing layer, got [%s]", job.Stderr)
+	}
+	if len(d.Created) != 0 {
+		t.Errorf("Expected no container to be created, got [%d]", len(d.Created))
+	}
+}
+
+func TestExecuteRecordsPullProgress(t *testing.T) {
+	d := &MockDockerClient{
+		LocalImages:  map[string]bool{},
+		RemoteImages: map[string]bool{"cloudpipe/scipy:1.0": true},
+		PullMessages: []string{
+			`{"status":"Pulling from cloudpipe/scipy","id":"1.0"}`,
+			`{"status":"Downloading","progress":"[=>    ] 1 MB/5 MB","id":"a1b2c3"}`,
+			`{"status":"Download complete","id":"a1b2c3"}`,
+			`{"status":"Status: Downloaded newer image for cloudpipe/scipy:1.0"}`,
+		},
+	}
+	s := &MemoryStorage{}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  s,
+		Docker:   d,
+	}
+	job := layeredJob("cloudpipe/scipy:1.0")
+
+	Execute(c, job)
+
+	if len(d.Pulled) != 1 || !d.Pulled[0].RawJSONStream {
+		t.Fatalf("Expected a single pull with a raw JSON stream, got %v", d.Pulled)
+	}
+
+	var seen []string
+	for _, update := range s.Updates {
+		if status, ok := update.PullProgress["a1b2c3"]; ok {
+			seen = append(seen, status)
+		}
+	}
+	expected := []string{"Downloading [=>    ] 1 MB/5 MB", "Download complete"}
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected the layer's progress to be recorded as %v, got %v", expected, seen)
+	}
+	if job.PullProgress != nil {
+		t.Errorf("Expected the pull progress to be cleared, got %v", job.PullProgress)
+	}
+	if job.Status != StatusDone {
+		t.Errorf("Expected the job to complete, but it was [%s]", job.Status)
+	}
+}
+
+// insertJobs stores jobs in a MemoryStorage. Their JIDs are assigned in order, starting from 1.
+func insertJobs(s *MemoryStorage, jobs ...SubmittedJob) *MemoryStorage {
+	for _, job := range jobs {
+		s.InsertJob(job)
+	}
+	return s
+}
+
+func claimSkipped(t *testing.T, defaultLimit int) []string {
+	s := insertJobs(&MemoryStorage{
+		Accounts: map[string]*Account{
+			"limited": {Name: "limited", MaxConcurrentJobs: 1},
+			"other":   {Name: "other", MaxConcurrentJobs: 5},
+		},
+	},
+		SubmittedJob{Account: "busy", Status: StatusProcessing},
+		SubmittedJob{Account: "busy", Status: StatusProcessing},
+		SubmittedJob{Account: "limited", Status: StatusProcessing},
+		SubmittedJob{Account: "other", Status: StatusProcessing},
+		SubmittedJob{Account: "other", Status: StatusProcessing},
+	)
+	c := &Context{
+		Settings: Settings{DefaultMaxConcurrentJobs: defaultLimit},
+		Storage:  s,
+	}
+
+	Claim(c)
+
+	if len(s.Skipped) != 1 {
+		t.Fatalf("Expected one claim, got [%d]", len(s.Skipped))
+	}
+	return s.Skipped[0]
+}
+
+func TestClaimSkipsSaturatedAccounts(t *testing.T) {
+	skipped := claimSkipped(t, 2)
+
+	if len(skipped) != 2 || skipped[0] != "busy" || skipped[1] != "limited" {
+		t.Errorf("Expected [busy] and [limited] to be skipped, got %v", skipped)
+	}
+}
+
+func TestClaimWithoutDefaultConcurrencyLimit(t *testing.T) {
+	skipped := claimSkipped(t, 0)
+
+	if len(skipped) != 1 || skipped[0] != "limited" {
+		t.Errorf("Expected only [limited] to be skipped, got %v", skipped)
+	}
+}
+
+func TestClaimPrefersLowestResourceScore(t *testing.T) {
+	s := insertJobs(&MemoryStorage{
+		Accounts: map[string]*Account{
+			// Scores: heavy 100/1 * 1 = 100, light 10/2 * 2 = 10, new 0.
+			"heavy": {Name: "heavy", TotalRuntime: 100, TotalJobs: 1},
+			"light": {Name: "light", TotalRuntime: 10, TotalJobs: 2},
+			"new":   {Name: "new"},
+			"busy":  {Name: "busy", MaxConcurrentJobs: 1},
+		},
+	},
+		SubmittedJob{Account: "heavy", Status: StatusQueued},
+		SubmittedJob{Account: "light", Status: StatusQueued},
+		SubmittedJob{Account: "light", Status: StatusQueued},
+		SubmittedJob{Account: "new", Status: StatusQueued},
+		SubmittedJob{Account: "busy", Status: StatusQueued},
+		SubmittedJob{Account: "busy", Status: StatusProcessing},
+	)
+	c := &Context{Storage: s, Docker: &MockDockerClient{}}
+
+	Claim(c)
+	c.InFlight.Wait()
+
+	expected := [][]string{{"busy", "heavy", "light"}}
+	if !reflect.DeepEqual(s.Skipped, expected) {
+		t.Errorf("Expected every account but [new] to be skipped, got %v", s.Skipped)
+	}
+
+	if !reflect.DeepEqual(s.Claimed, []uint64{4}) {
+		t.Errorf("Expected the job from [new] to be claimed, got %v", s.Claimed)
+	}
+
+	queued, _ := s.CountJobsByAccount([]string{StatusQueued})
+	preferred, score, err := fairShareAccount(c, queued, []string{"busy", "new"})
+	if err != nil || preferred != "light" || score != 10 {
+		t.Errorf("Expected [light] to be preferred with a score of 10, got [%s] [%v] [%v]", preferred, score, err)
+	}
+}
+
+func TestFairShareAccountPrefersOldestQueuedJobOnTies(t *testing.T) {
+	c := &Context{Storage: &MemoryStorage{}}
+	queued := []AccountJobCount{
+		{Account: "alice", Status: StatusQueued, Count: 1, OldestCreatedAt: 20},
+		{Account: "bob", Status: StatusQueued, Count: 3, OldestCreatedAt: 10},
+	}
+
+	preferred, score, err := fairShareAccount(c, queued, nil)
+	if err != nil || preferred != "bob" || score != 0 {
+		t.Errorf("Expected [bob] to be preferred with a score of 0, got [%s] [%v] [%v]", preferred, score, err)
+	}
+}
+
+func stealContext(s *MemoryStorage) *Context {
+	return &Context{
+		Settings: Settings{RunnerID: "fast", WorkStealingEnabled: true},
+		Storage:  s,
+		Clock:    NewFakeClock(),
+	}
+}
+
+func TestStealOverdueJob(t *testing.T) {
+	now := NewFakeClock().Now()
+	s := insertJobs(&MemoryStorage{},
+		// Running for less than twice its maximum runtime.
+		SubmittedJob{Job: Job{MaxRuntime: 600}, Status: StatusProcessing, Runner: "slow", StartedAt: StoreTime(now.Add(-15 * time.Minute))},
+		// Overdue, but already running here.
+		SubmittedJob{Job: Job{MaxRuntime: 600}, Status: StatusProcessing, Runner: "fast", StartedAt: StoreTime(now.Add(-3 * time.Hour))},
+		// Overdue on another runner.
+		SubmittedJob{Job: Job{MaxRuntime: 600}, Status: StatusProcessing, Runner: "slow", StartedAt: StoreTime(now.Add(-time.Hour)), Stdout: "partial"},
+		SubmittedJob{Job: Job{MaxRuntime: 600}, Status: StatusProcessing, Runner: "slow", StartedAt: StoreTime(now.Add(-2 * time.Hour))},
+		// Running for a long time, but without a maximum runtime to compare against.
+		SubmittedJob{Status: StatusProcessing, Runner: "slow", StartedAt: StoreTime(now.Add(-4 * time.Hour))},
+	)
+	// Another runner steals job [4] after it's listed here.
+	s.OnListJobs = func(query JobQuery) {
+		s.Jobs[4].Runner = "other"
+		s.Jobs[4].StartedAt = StoreTime(now)
+	}
+	c := stealContext(s)
+
+	job := steal(c)
+
+	if job == nil {
+		t.Fatal("Expected an overdue job to be stolen")
+	}
+	if job.JID != 3 || s.Jobs[3].Runner != "fast" {
+		t.Errorf("Expected job [3] to be reclaimed after losing job [4], got job [%d]", job.JID)
+	}
+	if s.Jobs[4].Runner != "other" {
+		t.Errorf("Expected job [4] to be left with the runner that stole it, got [%s]", s.Jobs[4].Runner)
+	}
+	if job.Runner != "fast" {
+		t.Errorf("Expected the stolen job to belong to this runner, got [%s]", job.Runner)
+	}
+	if !job.StartedAt.IsZero() || job.Stdout != "" {
+		t.Errorf("Expected the stolen job to be reset, got %+v", job)
+	}
+}
+
+func TestStealWithoutMaxRuntime(t *testing.T) {
+	now := NewFakeClock().Now()
+	s := insertJobs(&MemoryStorage{},
+		SubmittedJob{Status: StatusProcessing, Runner: "slow", StartedAt: StoreTime(now.Add(-time.Hour))},
+	)
+	c := stealContext(s)
+
+	if job := steal(c); job != nil {
+		t.Errorf("Expected nothing to be stolen without a maximum runtime, got %+v", job)
+	}
+
+	s.Jobs[1].MaxRuntime = 60
+	c.WorkStealingEnabled = false
+	if job := steal(c); job != nil {
+		t.Errorf("Expected nothing to be stolen with work stealing disabled, got %+v", job)
+	}
+}
+
+func TestClaimStealsWhenQueueIsEmpty(t *testing.T) {
+	now := NewFakeClock().Now()
+	stolen := *layeredJob()
+	stolen.Runner = "slow"
+	stolen.MaxRuntime = 60
+	stolen.StartedAt = StoreTime(now.Add(-time.Hour))
+	stolen.Status = StatusProcessing
+	s := insertJobs(&MemoryStorage{}, stolen)
+	c := stealContext(s)
+	c.Docker = &MockDockerClient{}
+
+	Claim(c)
+	c.InFlight.Wait()
+
+	if len(s.Skipped) != 1 {
+		t.Errorf("Expected the queue to be checked first, got [%d] claims", len(s.Skipped))
+	}
+	if runner := s.Jobs[1].Runner; runner != "fast" {
+		t.Errorf("Expected the job to be stolen, but its runner was [%s]", runner)
+	}
+}
+
+func TestConcurrentClaimsClaimJobOnce(t *testing.T) {
+	job := *layeredJob()
+	job.Status = StatusQueued
+	s := insertJobs(&MemoryStorage{}, job)
+	c := &Context{Storage: s, Docker: &MockDockerClient{}}
+
+	var start, done sync.WaitGroup
+	start.Add(1)
+	for i := 0; i < 10; i++ {
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			start.Wait()
+			Claim(c)
+		}()
+	}
+	start.Done()
+	done.Wait()
+	c.InFlight.Wait()
+
+	if !reflect.DeepEqual(s.Claimed, []uint64{1}) {
+		t.Errorf("Expected the job to be claimed exactly once, got claims %v", s.Claimed)
+	}
+}
+
+func TestOutputCollectorWriteLargePayload(t *testing.T) {
+	for _, size := range []int{1, 1024, 1025} {
+		s := &MemoryStorage{}
+		c := &Context{Settings: Settings{MaxStdout: 1024}, Storage: s}
+		job := &SubmittedJob{}
+		collector := &OutputCollector{context: c, job: job, isStdout: true}
+
+		n, err := collector.Write([]byte(strings.Repeat("x", size)))
+		if err != nil {
+			t.Errorf("Unexpected error writing [%d] bytes: %v", size, err)
+		}
+		if n != size {
+			t.Errorf("Expected the whole [%d] byte payload to be consumed, got [%d]", size, n)
+		}
+
+		expected := size
+		if expected > 1024 {
+			expected = 1024
+		}
+		if len(job.Stdout) != expected {
+			t.Errorf("Expected [%d] bytes of stdout to be kept from a [%d] byte payload, got [%d]", expected, size, len(job.Stdout))
+		}
+		if len(s.Updates) != 1 {
+			t.Errorf("Expected one update after writing [%d] bytes, got [%d]", size, len(s.Updates))
+		}
+	}
+}
+
+func TestOutputCollectorDiscardsOutputPastLimit(t *testing.T) {
+	s := &MemoryStorage{}
+	c := &Context{Settings: Settings{MaxStderr: 4}, Storage: s}
+	job := &SubmittedJob{}
+	collector := &OutputCollector{context: c, job: job, isStdout: false}
+
+	for _, chunk := range []string{"abc", "def", "ghi"} {
+		if n, _ := collector.Write([]byte(chunk)); n != len(chunk) {
+			t.Errorf("Expected the chunk [%s] to be consumed, got [%d]", chunk, n)
+		}
+	}
+
+	if job.Stderr != "abcd" {
+		t.Errorf("Expected stderr to be truncated to [abcd], got [%s]", job.Stderr)
+	}
+	if !job.OutputTruncated {
+		t.Error("Expected the job's output to be marked as truncated")
+	}
+	if len(s.Updates) != 2 {
+		t.Errorf("Expected no updates once the limit was reached, got [%d]", len(s.Updates))
+	}
+}
+
+func TestOutputCollectorStreamAlreadyPastLimit(t *testing.T) {
+	s := &MemoryStorage{}
+	c := &Context{Settings: Settings{MaxStdout: 4}, Storage: s}
+	job := &SubmittedJob{Stdout: "abcdef"}
+	collector := &OutputCollector{context: c, job: job, isStdout: true}
+
+	if n, err := collector.Write([]byte("ghi")); err != nil || n != 3 {
+		t.Errorf("Expected the chunk to be consumed, got [%d] and %v", n, err)
+	}
+	if job.Stdout != "abcdef" {
+		t.Errorf("Expected stdout to be left alone, got [%s]", job.Stdout)
+	}
+	if !job.OutputTruncated {
+		t.Error("Expected the job's output to be marked as truncated")
+	}
+}
+
+func TestOutputCollectorCombinedLimit(t *testing.T) {
+	c := &Context{Settings: Settings{MaxStdout: 4}, Storage: &MemoryStorage{}}
+	job := &SubmittedJob{Job: Job{MaxOutputSize: 6}}
+	stdout := &OutputCollector{context: c, job: job, isStdout: true}
+	stderr := &OutputCollector{context: c, job: job, isStdout: false}
+
+	stderr.Write([]byte("ab"))
+	if job.OutputTruncated {
+		t.Error("Expected output within both limits not to be truncated")
+	}
+
+	// The per-stream limit applies before the combined limit is reached.
+	stdout.Write([]byte("cdefg"))
+	if job.Stdout != "cdef" {
+		t.Errorf("Expected stdout to be truncated to [cdef], got [%s]", job.Stdout)
+	}
+	if !job.OutputTruncated {
+		t.Error("Expected the job's output to be marked as truncated")
+	}
+
+	// The combined limit applies to a stream without its own limit.
+	stderr.Write([]byte("hij"))
+	if job.Stderr != "ab" {
+		t.Errorf("Expected the combined limit to leave stderr as [ab], got [%s]", job.Stderr)
+	}
+	if total := len(job.Stdout) + len(job.Stderr); total != 6 {
+		t.Errorf("Expected [6] bytes of output to be kept, got [%d]", total)
+	}
+}
+
+func TestOutputCollectorFlushInterval(t *testing.T) {
+	s := &MemoryStorage{}
+	c := &Context{Settings: Settings{OutputFlushInterval: 60000}, Storage: s}
+	job := &SubmittedJob{}
+	collector := &OutputCollector{context: c, job: job, isStdout: true}
+
+	for i := 0; i < 5; i++ {
+		collector.Write([]byte("x"))
+	}
+
+	if job.Stdout != "xxxxx" {
+		t.Errorf("Expected all output to be kept, got [%s]", job.Stdout)
+	}
+	if len(s.Updates) != 1 {
+		t.Errorf("Expected only the first write within the flush interval to update the job, got [%d]", len(s.Updates))
+	}
+
+	s.Updates = nil
+	c.OutputFlushInterval = 0
+	for i := 0; i < 5; i++ {
+		collector.Write([]byte("x"))
+	}
+
+	if len(s.Updates) != 5 {
+		t.Errorf("Expected every write to update the job without a flush interval, got [%d]", len(s.Updates))
+	}
+}
+
+// ArchiveStorage is a fake Storage implementation that records the jobs that are archived.
+type ArchiveStorage struct {
+	MemoryStorage
+
+	Archived []uint64
+}
+
+func (storage *ArchiveStorage) ArchiveJob(job SubmittedJob) error {
+	storage.Archived = append(storage.Archived, job.JID)
+	delete(storage.Jobs, job.JID)
+	return nil
+}
+
+func TestArchiveStalledJobs(t *testing.T) {
+	clock := NewFakeClock()
+	now := clock.Now()
+	hoursAgo := func(hours int) StoredTime {
+		return StoreTime(now.Add(-time.Duration(hours) * time.Hour))
+	}
+
+	s := &ArchiveStorage{MemoryStorage: MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}}
+	// Stalled long ago.
+	s.InsertJob(SubmittedJob{Status: StatusStalled, CreatedAt: hoursAgo(30), FinishedAt: hoursAgo(25)})
+	// Stalled recently.
+	s.InsertJob(SubmittedJob{Status: StatusStalled, CreatedAt: hoursAgo(30), FinishedAt: hoursAgo(1)})
+	// Stalled without a recorded stall time.
+	s.InsertJob(SubmittedJob{Status: StatusStalled, CreatedAt: hoursAgo(48)})
+	// Failed long ago, but didn't stall.
+	s.InsertJob(SubmittedJob{Status: StatusError, CreatedAt: hoursAgo(48), FinishedAt: hoursAgo(48)})
+
+	c := &Context{
+		Settings: Settings{StalledJobTTL: 24 * 60 * 60},
+		Storage:  s,
+		Clock:    clock,
+	}
+
+	ArchiveStalledJobs(c)
+
+	if !reflect.DeepEqual(s.Archived, []uint64{1, 3}) {
+		t.Errorf("Expected jobs 1 and 3 to be archived, got %v", s.Archived)
+	}
+	if _, ok := s.Jobs[2]; !ok {
+		t.Error("Expected the recently stalled job to remain active")
+	}
+}
+
+func TestExecuteRecordsStallTime(t *testing.T) {
+	clock := NewFakeClock()
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   &MockDockerClient{LocalImages: map[string]bool{}},
+		Clock:    clock,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "id",
+			Multicore:    1,
+			Layers:       []JobLayer{{Name: "cloudpipe/missing"}},
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusStalled {
+		t.Fatalf("Expected the job to stall, but it was [%s]", job.Status)
+	}
+	if !job.FinishedAt.AsTime().Equal(clock.Now()) {
+		t.Errorf("Expected the stall time to be recorded, got [%s]", job.FinishedAt)
+	}
+}
+
+func preemptClaim(t *testing.T, settings Settings, runningPriority int, queued Job) (bool, bool) {
+	s := &MemoryStorage{}
+	running, _ := s.InsertJob(SubmittedJob{
+		Job:       Job{PreemptionPriority: runningPriority},
+		Account:   "low",
+		Status:    StatusProcessing,
+		StartedAt: StoreTime(time.Now()),
+	})
+	s.InsertJob(SubmittedJob{Job: queued, Account: "high", Status: StatusQueued})
+
+	preempted, unwatch := watchForPreemption(running)
+	defer unwatch()
+
+	c := &Context{Settings: settings, Storage: s, Docker: &MockDockerClient{}}
+	Claim(c)
+	c.InFlight.Wait()
+
+	// With every worker busy, the runner only looks for work if it preempted the running job.
+	claimed := len(s.Skipped) > 0
+	select {
+	case <-preempted:
+		return true, claimed
+	default:
+		return false, claimed
+	}
+}
+
+func TestClaimPreemptsLowerPriorityJob(t *testing.T) {
+	preempted, claimed := preemptClaim(t, Settings{MaxWorkers: 1, PreemptionEnabled: true}, 0, Job{PreemptionPriority: 5})
+
+	if !preempted {
+		t.Error("Expected the running job to be preempted")
+	}
+	if !claimed {
+		t.Error("Expected the queued job to be claimed")
+	}
+}
+
+func TestClaimWithoutPreemption(t *testing.T) {
+	cases := []struct {
+		description     string
+		settings        Settings
+		runningPriority int
+		queued          Job
+	}{
+		{"preemption disabled", Settings{MaxWorkers: 1}, 0, Job{PreemptionPriority: 5}},
+		{"equal priority", Settings{MaxWorkers: 1, PreemptionEnabled: true}, 5, Job{PreemptionPriority: 5}},
+		{"higher running priority", Settings{MaxWorkers: 1, PreemptionEnabled: true}, 9, Job{PreemptionPriority: 5}},
+		{"a queued job scheduled for later", Settings{MaxWorkers: 1, PreemptionEnabled: true}, 0, Job{
+			PreemptionPriority: 5,
+			ScheduledAt:        StoreTime(time.Now().Add(time.Hour)),
+		}},
+	}
+
+	for _, each := range cases {
+		preempted, claimed := preemptClaim(t, each.settings, each.runningPriority, each.queued)
+
+		if preempted || claimed {
+			t.Errorf("Expected nothing to be preempted or claimed with %s", each.description)
+		}
+	}
+}
+
+func TestClaimPreemptsForFairShareChoice(t *testing.T) {
+	cases := []struct {
+		description   string
+		heavyPriority int
+		newPriority   int
+		preempted     bool
+	}{
+		// The oldest queued job outranks the running job, but it isn't the one that will be claimed.
+		{"an older high-priority job from a heavier account", 5, 0, false},
+		{"a newer high-priority job from a lighter account", 0, 5, true},
+	}
+
+	for _, each := range cases {
+		s := insertJobs(&MemoryStorage{
+			Accounts: map[string]*Account{
+				"heavy": {Name: "heavy", TotalRuntime: 100, TotalJobs: 1},
+			},
+		},
+			SubmittedJob{Account: "low", Status: StatusProcessing, StartedAt: StoreTime(time.Now())},
+			SubmittedJob{Job: Job{PreemptionPriority: each.heavyPriority}, Account: "heavy", Status: StatusQueued},
+			SubmittedJob{Job: Job{PreemptionPriority: each.newPriority}, Account: "new", Status: StatusQueued},
+		)
+
+		preempted, unwatch := watchForPreemption(1)
+
+		c := &Context{Settings: Settings{MaxWorkers: 1, PreemptionEnabled: true}, Storage: s, Docker: &MockDockerClient{}}
+		Claim(c)
+		c.InFlight.Wait()
+		unwatch()
+
+		select {
+		case <-preempted:
+			if !each.preempted {
+				t.Errorf("Expected nothing to be preempted for %s", each.description)
+			}
+			if !reflect.DeepEqual(s.Claimed, []uint64{3}) {
+				t.Errorf("Expected the job from [new] to be claimed for %s, got %v", each.description, s.Claimed)
+			}
+		default:
+			if each.preempted {
+				t.Errorf("Expected the running job to be preempted for %s", each.description)
+			}
+			if len(s.Claimed) != 0 {
+				t.Errorf("Expected nothing to be claimed for %s, got %v", each.description, s.Claimed)
+			}
+		}
+	}
+}
+
+func TestExecutePreempted(t *testing.T) {
+	d := &MockDockerClient{RunUntilStopped: true}
+	s := &CreditStorage{Credits: map[string]int64{"user": 50000000000}}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2", CostPerNanosecond: 1},
+		Storage:  s,
+		Docker:   d,
+		Output:   NewOutputBroker(),
+	}
+	job := &SubmittedJob{
+		Job:     Job{Command: "sleep 100", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:     42,
+		Account: "user",
+		Status:  StatusProcessing,
+	}
+	output, unsubscribe := c.Output.Subscribe(42)
+	defer unsubscribe()
+
+	done := make(chan struct{})
+	go func() {
+		Execute(c, job)
+		close(done)
+	}()
+
+	deadline := time.After(3 * time.Second)
+	for !requestPreemption(42) {
+		select {
+		case <-deadline:
+			t.Fatal("Expected the running job to accept a preemption request")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the preempted job to be stopped within 3 seconds")
+	}
+
+	if len(d.Stopped) != 1 || d.Stopped[0] != "abc123" {
+		t.Errorf("Expected the container to be stopped once, got [%v]", d.Stopped)
+	}
+	if job.Status != StatusQueued {
+		t.Errorf("Expected the job to be returned to the queue, but was [%s]", job.Status)
+	}
+	if !job.StartedAt.IsZero() || job.ContainerID != "" {
+		t.Errorf("Expected the job to be reset for its next run, got [%s] and [%s]", job.StartedAt, job.ContainerID)
+	}
+	if s.Runtime <= 0 || s.Credits["user"] != 50000000000-s.Runtime {
+		t.Errorf("Expected the preempted attempt to be charged, got [%d] credits for [%d]", s.Credits["user"], s.Runtime)
+	}
+	if s.Jobs != 0 {
+		t.Errorf("Expected the preempted attempt not to count as a job, got [%d]", s.Jobs)
+	}
+	select {
+	case _, ok := <-output:
+		if !ok {
+			t.Error("Expected the output stream to stay open while the job is queued again")
+		}
+	default:
+	}
+}
+
+func TestExecuteProfile(t *testing.T) {
+	profile := true
+	d := &MockDockerClient{Files: map[string]string{profilePath: "1.50 0.25 3.00 2048\n"}}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "id",
+			Multicore:    1,
+			Profile:      &profile,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	expectedCmd := []string{"/usr/bin/time", "-f", "%U %S %e %M", "-o", "/tmp/rho_profile", "/bin/bash", "-c", "id"}
+	if cmd := d.Created[0].Config.Cmd; !reflect.DeepEqual(cmd, expectedCmd) {
+		t.Errorf("Expected the command to be wrapped with time, got %v", cmd)
+	}
+	if job.Status != StatusDone {
+		t.Errorf("Expected the job to complete, but it was [%s]", job.Status)
+	}
+
+	expected := Collected{
+		CPUTimeUser:    1500000000,
+		CPUTimeSystem:  250000000,
+		MemoryMaxUsage: 2048 * 1024,
+		WallTime:       3,
+	}
+	if job.Collected != expected {
+		t.Errorf("Expected collected metrics %+v, got %+v", expected, job.Collected)
+	}
+}
+
+func TestExecuteWithoutProfile(t *testing.T) {
+	job, d := executeJob(t, Job{Command: "id", ResultSource: "stdout", ResultType: ResultBinary})
+
+	if cmd := d.Created[0].Config.Cmd; !reflect.DeepEqual(cmd, []string{"/bin/bash", "-c", "id"}) {
+		t.Errorf("Expected the command to be run directly, got %v", cmd)
+	}
+	if len(d.Copied) != 0 {
+		t.Errorf("Expected no files to be copied, got %v", d.Copied)
+	}
+	if job.Collected != (Collected{}) {
+		t.Errorf("Expected no collected metrics, got %+v", job.Collected)
+	}
+}
+
+func TestParseProfileInvalid(t *testing.T) {
+	if _, err := parseProfile("Command terminated by signal 9\n"); err == nil {
+		t.Error("Expected an error parsing a malformed profile")
+	}
+}
+
+func TestExecuteMeasuresDurationAndQueueDelay(t *testing.T) {
+	clock := NewFakeClock()
+	d := &MockDockerClient{RunUntilStopped: true}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+		Clock:    clock,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "sleep 100",
+			Multicore:    1,
+			MaxRuntime:   10,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		JID:       42,
+		Status:    StatusProcessing,
+		CreatedAt: StoreTime(clock.Now().Add(-5 * time.Second)),
+	}
+
+	done := make(chan struct{})
+	go func() {
+		Execute(c, job)
+		close(done)
+	}()
+
+	clock.WaitForTimers(2)
+	clock.Advance(10 * time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the job to be stopped once its maximum runtime elapsed")
+	}
+
+	if job.QueueDelay != (5 * time.Second).Nanoseconds() {
+		t.Errorf("Expected a five second queue delay, got [%d]", job.QueueDelay)
+	}
+
+	fields := completionFields(job)
+	if fields["duration ms"] != int64(10000) {
+		t.Errorf("Expected a duration of 10000ms to be logged, got [%v]", fields["duration ms"])
+	}
+	if fields["queue delay ms"] != int64(5000) {
+		t.Errorf("Expected a queue delay of 5000ms to be logged, got [%v]", fields["queue delay ms"])
+	}
+}
+
+func TestExecuteRemovesStaleContainer(t *testing.T) {
+	d := &MockDockerClient{
+		Existing: map[string]*docker.Container{
+			"job_42_unnamed": {ID: "stale", Name: "job_42_unnamed"},
+		},
+	}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if len(d.Removed) != 2 || d.Removed[0] != "stale" {
+		t.Errorf("Expected the stale container to be removed first, got %v", d.Removed)
+	}
+	if job.Status != StatusDone {
+		t.Errorf("Expected the job to complete, but it was [%s]", job.Status)
+	}
+}
+
+func TestExecuteContainerNameConflict(t *testing.T) {
+	running := &docker.Container{ID: "running", Name: "job_42_unnamed"}
+	running.State.Running = true
+	d := &MockDockerClient{Existing: map[string]*docker.Container{"job_42_unnamed": running}}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.Status != StatusError {
+		t.Errorf("Expected the job to fail, but it was [%s]", job.Status)
+	}
+	if !strings.Contains(job.Stderr, "A container named [job_42_unnamed] is already running") {
+		t.Errorf("Expected stderr to describe the conflict, got [%s]", job.Stderr)
+	}
+	if len(d.Created) != 0 || len(d.Removed) != 0 {
+		t.Errorf("Expected the running container to be left alone, got created %v and removed %v", d.Created, d.Removed)
+	}
+}
+
+func TestExecuteRecordsContainerSize(t *testing.T) {
+	d := &MockDockerClient{ImageSize: 512 << 20}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if len(d.Inspected) != 1 || d.Inspected[0] != "cloudpipe/runner-py2" {
+		t.Errorf("Expected the default image to be inspected, got %v", d.Inspected)
+	}
+	if job.ContainerSize != 512<<20 {
+		t.Errorf("Expected the image's virtual size to be recorded, got [%d]", job.ContainerSize)
+	}
+}
+
+func TestExecuteRecordsReturnCode(t *testing.T) {
+	d := &MockDockerClient{ExitStatus: 42}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "exit 42", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.ReturnCode != "42" {
+		t.Errorf("Expected return code [42], got [%s]", job.ReturnCode)
+	}
+	if job.Status != StatusError {
+		t.Errorf("Expected status [%s], got [%s]", StatusError, job.Status)
+	}
+	if code := completionFields(job)["return code"]; code != "42" {
+		t.Errorf("Expected the return code to be logged, got [%v]", code)
+	}
+}
+
+func TestExecuteRunsExpandedCommand(t *testing.T) {
+	d := &MockDockerClient{}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job: Job{
+			Command:      "cat {{.Tags.input}}",
+			Tags:         map[string]string{"input": "data.csv"},
+			Multicore:    1,
+			ResultSource: "stdout",
+			ResultType:   ResultBinary,
+		},
+		ExpandedCommand: "cat data.csv",
+		JID:             42,
+		Status:          StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if len(d.Created) != 1 {
+		t.Fatalf("Expected one container to be created, got %d", len(d.Created))
+	}
+	expectedCmd := []string{"/bin/bash", "-c", "cat data.csv"}
+	if cmd := d.Created[0].Config.Cmd; !reflect.DeepEqual(cmd, expectedCmd) {
+		t.Errorf("Expected container command %v, got %v", expectedCmd, cmd)
+	}
+}
+
+// cpuSample builds a stats sample with cumulative container and system CPU times, in nanoseconds,
+// for a host with the given number of CPUs.
+func cpuSample(preTotal, total, preSystem, system uint64, cpus int) *docker.Stats {
+	stats := &docker.Stats{}
+	stats.PreCPUStats.CPUUsage.TotalUsage = preTotal
+	stats.PreCPUStats.SystemCPUUsage = preSystem
+	stats.CPUStats.CPUUsage.TotalUsage = total
+	stats.CPUStats.CPUUsage.PercpuUsage = make([]uint64, cpus)
+	stats.CPUStats.SystemCPUUsage = system
+	return stats
+}
+
+func TestCPUPercent(t *testing.T) {
+	cases := []struct {
+		stats    *docker.Stats
+		expected float64
+	}{
+		// 200ms of container CPU time over 2s of system CPU time on 4 CPUs.
+		{cpuSample(100e6, 300e6, 1e9, 3e9, 4), 40.0},
+		// A single-threaded container saturating one of two CPUs.
+		{cpuSample(0, 1e9, 0, 2e9, 2), 100.0},
+		// No time has passed since the previous sample.
+		{cpuSample(100e6, 100e6, 1e9, 1e9, 4), 0},
+	}
+
+	for _, each := range cases {
+		if actual := cpuPercent(each.stats); actual != each.expected {
+			t.Errorf("Expected CPU percentage [%f], got [%f]", each.expected, actual)
+		}
+	}
+}
+
+func TestExecuteRecordsCPUPercent(t *testing.T) {
+	d := &MockDockerClient{
+		Samples: []*docker.Stats{
+			cpuSample(0, 100e6, 0, 1e9, 4),
+			cpuSample(100e6, 300e6, 1e9, 3e9, 4),
+		},
+	}
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2"},
+		Storage:  NullStorage{},
+		Docker:   d,
+	}
+	job := &SubmittedJob{
+		Job:    Job{Command: "id", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		JID:    42,
+		Status: StatusProcessing,
+	}
+
+	Execute(c, job)
+
+	if job.Collected.CPUPercent != 40.0 {
+		t.Errorf("Expected the last sample's CPU percentage to be recorded, got [%f]", job.Collected.CPUPercent)
+	}
+}
+
+func TestRefreshImagePullPolicy(t *testing.T) {
+	cases := []struct {
+		policy   string
+		present  bool
+		expected int
+	}{
+		{PullAlways, true, 3},
+		{PullAlways, false, 3},
+		{PullIfNotPresent, true, 0},
+		{PullIfNotPresent, false, 1},
+		{PullNever, false, 0},
+	}
+
+	for _, each := range cases {
+		d := &MockDockerClient{
+			LocalImages:  map[string]bool{"cloudpipe/runner-py2:latest": each.present},
+			RemoteImages: map[string]bool{"cloudpipe/runner-py2:latest": true},
+		}
+		c := &Context{
+			Settings: Settings{Image: "cloudpipe/runner-py2:latest", ImagePullPolicy: each.policy},
+			Docker:   d,
+		}
+
+		for i := 0; i < 3; i++ {
+			RefreshImage(c)
+		}
+
+		if len(d.Pulled) != each.expected {
+			t.Errorf("Expected [%d] pulls with policy [%s] when present is %v, got [%d]", each.expected, each.policy, each.present, len(d.Pulled))
+		}
+	}
+}
+
+func TestRunnerWaitsForRunningJobs(t *testing.T) {
+	s := insertJobs(&MemoryStorage{}, SubmittedJob{
+		Job:    Job{Command: "sleep 1", Multicore: 1, ResultSource: "stdout", ResultType: ResultBinary},
+		Status: StatusQueued,
+	})
+	claimed := make(chan struct{})
+	s.OnClaimJob = func(job SubmittedJob) { close(claimed) }
+	c := &Context{
+		Settings: Settings{Image: "cloudpipe/runner-py2", Poll: 1},
+		Storage:  s,
+		Docker:   &MockDockerClient{Runtime: 50 * time.Millisecond},
+	}
+
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		Runner(c, stop)
+		close(stopped)
+	}()
+
+	<-claimed
+	close(stop)
+
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Expected the runner to stop within 3 seconds")
+	}
+
+	// Every in-flight job has finished, so the WaitGroup must already be at zero.
+	c.InFlight.Wait()
+
+	jobs, _ := s.ListJobs(JobQuery{JIDs: []uint64{1}})
+	if status := jobs[0].Status; status != StatusDone {
+		t.Errorf("Expected the running job to finish before the runner stopped, but it was [%s]", status)
+	}
+}
+
+func TestCacheExpiry(t *testing.T) {
+	c := &Context{Settings: Settings{CacheTTL: 60}}
+	finished := StoredTime(1000)
+
+	cases := []struct {
+		job      SubmittedJob
+		expected StoredTime
+	}{
+		{SubmittedJob{FinishedAt: finished}, 0},
+		{SubmittedJob{Job: Job{CacheKey: "abc"}, FinishedAt: finished}, finished.Add(60 * time.Second)},
+		{SubmittedJob{Job: Job{CacheKey: "abc", ResultTTL: 5}, FinishedAt: finished}, finished.Add(5 * time.Second)},
+	}
+	for _, each := range cases {
+		if actual := cacheExpiry(c, &each.job); actual != each.expected {
+			t.Errorf("Expected expiry [%d] for %+v, got [%d]", each.expected, each.job.Job, actual)
+		}
+	}
+
+	// Without a default TTL, results only expire if the job asks them to.
+	c.CacheTTL = 0
+	job := SubmittedJob{Job: Job{CacheKey: "abc"}, FinishedAt: finished}
+	if actual := cacheExpiry(c, &job); actual != 0 {
+		t.Errorf("Expected no expiry, got [%d]", actual)
+	}
+}
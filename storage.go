@@ -1,26 +1,170 @@
 package main
 
 import (
+	"errors"
+	"time"
+
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	log "github.com/Sirupsen/logrus"
 )
 
+// ErrNotFound is returned by Storage methods that act on a specific object that doesn't exist.
+var ErrNotFound = mgo.ErrNotFound
+
+// ErrAccountExists is returned by CreateAccount if an account with the same name already exists.
+var ErrAccountExists = errors.New("an account with that name already exists")
+
+// ErrQuotaExceeded is returned by InsertJobWithinQuota if the job's account already has as many jobs
+// waiting to run as its quota allows.
+var ErrQuotaExceeded = errors.New("the account has too many queued jobs")
+
+// quotaStatuses lists the statuses of the jobs that count against an account's MaxQueuedJobs. Jobs
+// that are waiting on their dependencies haven't started yet either, so they count too.
+var quotaStatuses = []string{StatusWaiting, StatusQueued}
+
+// ErrIdempotencyKeyExists is returned by ReserveIdempotencyKey if an unexpired record already holds
+// the key.
+var ErrIdempotencyKeyExists = errors.New("that idempotency key has already been used")
+
 // Storage enumerates interactions with the storage engine, and allows us to interject in-memory
 // substitutes for testing.
 type Storage interface {
 	Bootstrap() error
+	MigrateSchema() error
+	SchemaVersion() (int, error)
+	LockMigrations(owner string) (bool, error)
+	UnlockMigrations(owner string) error
+	Ping() error
 
 	InsertJob(SubmittedJob) (uint64, error)
+	InsertJobWithinQuota(job SubmittedJob, maxQueued int) (uint64, error)
 	ListJobs(JobQuery) ([]SubmittedJob, error)
+	GetJobByName(accountName, name string) (*SubmittedJob, error)
+	FindCachedJob(accountName, cacheKey string) (*SubmittedJob, error)
+	GetIdempotencyKey(accountName, key string, now time.Time) (*IdempotencyKey, error)
+	ReserveIdempotencyKey(record IdempotencyKey, now time.Time) error
+	SaveIdempotencyKey(IdempotencyKey) error
+	ReleaseIdempotencyKey(accountName, key string) error
+	CountJobs(JobQuery) (int, error)
+	CountJobsByStatus(accountName string) (map[string]int, error)
+	CountJobsByAccount(statuses []string) ([]AccountJobCount, error)
+	ListRuns(accountName string, after RunCursor, limit int) ([]RunSummary, error)
+	GetRunSummary(accountName, runID string) (RunSummary, error)
+	GetQueueDepths() (map[string]int64, error)
 	JobKillRequested(id uint64) (bool, error)
-	ClaimJob() (*SubmittedJob, error)
+	JobRunner(id uint64) (string, error)
+	ClaimJob(skipAccounts []string, now StoredTime) (*SubmittedJob, error)
+	ReclaimJob(job SubmittedJob, runner string, startedAt StoredTime) (*SubmittedJob, error)
 	UpdateJob(*SubmittedJob) error
+	CancelJobs(query JobQuery) (int, error)
+	ArchiveJob(job SubmittedJob) error
 
 	GetAccount(name string) (*Account, error)
+	GetAPIKeyHash(name string) (string, error)
+	CreateAccount(account Account, apiKey string) error
 	UpdateAccountAdmin(name string, admin bool) error
-	UpdateAccountUsage(name string, runtime int64) error
+	UpdateAccountSuspended(name string, suspended bool) error
+	UpdateAccountActive(name string, active bool) error
+	UpdateAccountQuota(name string, maxQueuedJobs, maxConcurrentJobs int) error
+	UpdateAccountExpiry(name string, expiresAt *StoredTime) error
+	UpdateAccountUsage(name string, runtime int64, finished bool) error
+	AdjustAccountCredits(name string, delta int64) error
+
+	ListConfigMaps(owner string) ([]ConfigMap, error)
+	SaveConfigMap(ConfigMap) error
+
+	GetVolume(name string) (*Volume, error)
+}
+
+// Volume is a named directory on the Docker host that jobs may mount by listing it in "vol".
+type Volume struct {
+	Name          string `json:"name" bson:"name"`
+	HostPath      string `json:"host_path" bson:"host_path"`
+	ContainerPath string `json:"container_path" bson:"container_path"`
+}
+
+// AccountJobCount is the number of an account's jobs that are in a single status, along with the time
+// that the oldest of them was submitted.
+type AccountJobCount struct {
+	Account         string
+	Status          string
+	Count           int
+	OldestCreatedAt StoredTime
+}
+
+// IdempotencyKey records the job that was created by a submission with a client-provided idempotency
+// key, until ExpiresAt. A JID of zero marks a key that has been reserved by a submission that hasn't
+// created its job yet.
+type IdempotencyKey struct {
+	Account   string    `bson:"account"`
+	Key       string    `bson:"key"`
+	JID       uint64    `bson:"jid"`
+	ExpiresAt time.Time `bson:"expires_at"`
+}
+
+// RunCursor marks a position in an account's list of runs. Runs are listed by the millisecond that
+// their first job was submitted, which is the precision that times are reported at, and then by run
+// ID. A cursor names the last run that a client has seen, and lists the runs after it.
+type RunCursor struct {
+	CreatedAt StoredTime
+	RunID     string
+}
+
+// RunSummary aggregates the jobs in a run. CreatedAt is the time that the run's first job was
+// submitted, StartedAt is the time that its first job started running, and FinishedAt is the time
+// that its last job finished. FinishedAt is nil until every job in the run has completed.
+type RunSummary struct {
+	RunID string
+
+	TotalJobs int
+	Completed int
+	Failed    int
+
+	CreatedAt  StoredTime
+	StartedAt  *StoredTime
+	FinishedAt *StoredTime
+
+	Statuses map[string]int
+}
+
+// add counts count jobs with a status toward the run, along with the earliest creation and start
+// times and the latest finish time among them. Zero start and finish times are ignored.
+func (s *RunSummary) add(status string, count int, createdAt, startedAt, finishedAt StoredTime) {
+	if s.Statuses == nil {
+		s.Statuses = make(map[string]int)
+	}
+	s.Statuses[status] += count
+	s.TotalJobs += count
+	if IsCompleted(status) {
+		s.Completed += count
+		if status != StatusDone {
+			s.Failed += count
+		}
+	}
+
+	if s.CreatedAt == 0 || createdAt.Before(s.CreatedAt) {
+		s.CreatedAt = createdAt
+	}
+	if startedAt != 0 && (s.StartedAt == nil || startedAt.Before(*s.StartedAt)) {
+		s.StartedAt = &startedAt
+	}
+	if finishedAt != 0 && (s.FinishedAt == nil || finishedAt.After(*s.FinishedAt)) {
+		s.FinishedAt = &finishedAt
+	}
+}
+
+// finish clears FinishedAt once every job has been counted, unless the whole run has completed.
+func (s *RunSummary) finish() {
+	if s.Completed < s.TotalJobs {
+		s.FinishedAt = nil
+	}
+}
+
+// Bind returns the Docker bind specification that mounts this volume within a container.
+func (v Volume) Bind() string {
+	return v.HostPath + ":" + v.ContainerPath
 }
 
 // JobQuery specifies (all optional) query parameters for fetching jobs.
@@ -31,9 +175,49 @@ type JobQuery struct {
 	Names    []string
 	Statuses []string
 
-	Limit  int
-	Before uint64
-	After  uint64
+	// Tags restricts results to jobs that have every one of these tag key/value pairs.
+	Tags map[string]string
+
+	// CreatedSince and CreatedUntil restrict results to jobs that were submitted at or after, and at or
+	// before, these times.
+	CreatedSince StoredTime
+	CreatedUntil StoredTime
+
+	// RunID restricts results to the jobs in a single run.
+	RunID string
+
+	// ScheduledUntil restricts results to jobs that aren't scheduled, or are scheduled to run at or
+	// before this time.
+	ScheduledUntil StoredTime
+
+	Limit int
+
+	// Offset skips this many matching jobs before results are returned.
+	Offset int
+
+	// BeforeJID and AfterJID are exclusive cursor bounds on the JIDs of returned jobs. Results are
+	// ordered by JID, so a page can be continued by passing the last JID seen as AfterJID. When only
+	// BeforeJID is set, the page holds the jobs immediately preceding it instead of the oldest ones.
+	BeforeJID uint64
+	AfterJID  uint64
+}
+
+// descending returns true if the query pages backwards from BeforeJID. Storage implementations
+// select its jobs in descending JID order, then reverse the page with reverseJobs.
+func (query JobQuery) descending() bool {
+	return query.BeforeJID != 0 && query.AfterJID == 0
+}
+
+// reverseJobs reverses a slice of jobs in place.
+func reverseJobs(jobs []SubmittedJob) {
+	for i, j := 0, len(jobs)-1; i < j; i, j = i+1, j-1 {
+		jobs[i], jobs[j] = jobs[j], jobs[i]
+	}
+}
+
+// inBounds returns true if a JID falls within the query's BeforeJID and AfterJID cursor bounds.
+func (query JobQuery) inBounds(jid uint64) bool {
+	return (query.BeforeJID == 0 || jid < query.BeforeJID) && (query.AfterJID == 0 || jid > query.AfterJID)
 }
 
 // MongoStorage is a Storage implementation that connects to a real MongoDB cluster.
@@ -54,14 +238,38 @@ func (storage *MongoStorage) jobs() *mgo.Collection {
 	return storage.Database.C("jobs")
 }
 
+func (storage *MongoStorage) deadJobs() *mgo.Collection {
+	return storage.Database.C("dead_jobs")
+}
+
 func (storage *MongoStorage) accounts() *mgo.Collection {
 	return storage.Database.C("accounts")
 }
 
+func (storage *MongoStorage) configMaps() *mgo.Collection {
+	return storage.Database.C("configmaps")
+}
+
+func (storage *MongoStorage) volumes() *mgo.Collection {
+	return storage.Database.C("volumes")
+}
+
 func (storage *MongoStorage) root() *mgo.Collection {
 	return storage.Database.C("root")
 }
 
+func (storage *MongoStorage) schemaVersions() *mgo.Collection {
+	return storage.Database.C("schema_versions")
+}
+
+func (storage *MongoStorage) locks() *mgo.Collection {
+	return storage.Database.C("locks")
+}
+
+func (storage *MongoStorage) idempotencyKeys() *mgo.Collection {
+	return storage.Database.C("idempotency_keys")
+}
+
 // MongoRoot contains global metadata, counters and statistics used by various storage functions.
 // Exactly one instance of MongoRoot should exist in the "root" collection.
 type MongoRoot struct {
@@ -88,6 +296,227 @@ func (storage *MongoStorage) Bootstrap() error {
 	return nil
 }
 
+// Ping checks that the MongoDB cluster is reachable.
+func (storage *MongoStorage) Ping() error {
+	return storage.Database.Session.Ping()
+}
+
+// schemaMigration is a versioned change to existing documents, so that documents written by older
+// releases match the current models.
+type schemaMigration struct {
+	Version     int
+	Description string
+	Apply       func(storage *MongoStorage) error
+}
+
+// schemaMigrations lists every migration in the order that they must be applied. Append new
+// migrations to the end with the next version number.
+var schemaMigrations = []schemaMigration{
+	{
+		Version:     1,
+		Description: "Backfill retry_count on jobs that predate retries.",
+		Apply: func(storage *MongoStorage) error {
+			return storage.backfillJobs("retry_count", 0)
+		},
+	},
+	{
+		Version:     2,
+		Description: "Backfill the default preemption priority on jobs that predate preemption.",
+		Apply: func(storage *MongoStorage) error {
+			return storage.backfillJobs("job.preemption_priority", 0)
+		},
+	},
+	{
+		Version:     3,
+		Description: "Index job.cache_key for cached result lookups.",
+		Apply: func(storage *MongoStorage) error {
+			return storage.jobs().EnsureIndex(mgo.Index{
+				Key:    []string{"account", "job.cache_key", "-_id"},
+				Sparse: true,
+			})
+		},
+	},
+	{
+		Version:     4,
+		Description: "Index idempotency_keys, expiring each key at its expires_at.",
+		Apply: func(storage *MongoStorage) error {
+			err := storage.idempotencyKeys().EnsureIndex(mgo.Index{
+				Key:    []string{"account", "key"},
+				Unique: true,
+			})
+			if err != nil {
+				return err
+			}
+
+			// MongoDB's TTL monitor removes documents some time after the expiry, so reads still
+			// check expires_at themselves.
+			return storage.idempotencyKeys().EnsureIndex(mgo.Index{
+				Key:         []string{"expires_at"},
+				ExpireAfter: time.Second,
+			})
+		},
+	},
+	{
+		Version:     5,
+		Description: "Store API key hashes on accounts.",
+		Apply: func(storage *MongoStorage) error {
+			// Accounts without an api_key_hash are left alone, so there's nothing to backfill. This
+			// keeps the versions in step with the PostgreSQL migration that adds the column.
+			return nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "Mark accounts that predate deactivation as active.",
+		Apply: func(storage *MongoStorage) error {
+			return storage.backfillAccounts("active", true)
+		},
+	},
+	{
+		Version:     7,
+		Description: "Index job.run_id for run lookups.",
+		Apply: func(storage *MongoStorage) error {
+			return storage.jobs().EnsureIndex(mgo.Index{
+				Key:    []string{"account", "job.run_id"},
+				Sparse: true,
+			})
+		},
+	},
+	{
+		Version:     8,
+		Description: "Backfill an unlimited queued job quota on accounts that predate quotas.",
+		Apply: func(storage *MongoStorage) error {
+			return storage.backfillAccounts("max_queued_jobs", 0)
+		},
+	},
+}
+
+// LatestSchemaVersion returns the version that the schema will have once every migration has been
+// applied.
+func LatestSchemaVersion() int {
+	if len(schemaMigrations) == 0 {
+		return 0
+	}
+	return schemaMigrations[len(schemaMigrations)-1].Version
+}
+
+// schemaVersionRecord marks a migration as applied in the "schema_versions" collection.
+type schemaVersionRecord struct {
+	Version   int        `bson:"_id"`
+	AppliedAt StoredTime `bson:"applied_at"`
+}
+
+// backfillJobs sets a field on every job that's missing it.
+func (storage *MongoStorage) backfillJobs(field string, value interface{}) error {
+	return backfill(storage.jobs(), field, value)
+}
+
+// backfillAccounts sets a field on every account that's missing it.
+func (storage *MongoStorage) backfillAccounts(field string, value interface{}) error {
+	return backfill(storage.accounts(), field, value)
+}
+
+// backfill sets a field on every document in a collection that's missing it.
+func backfill(collection *mgo.Collection, field string, value interface{}) error {
+	_, err := collection.UpdateAll(
+		bson.M{field: bson.M{"$exists": false}},
+		bson.M{"$set": bson.M{field: value}},
+	)
+	return err
+}
+
+// SchemaVersion returns the version of the most recent migration that has been applied, or zero if
+// none have.
+func (storage *MongoStorage) SchemaVersion() (int, error) {
+	var latest schemaVersionRecord
+	err := storage.schemaVersions().Find(nil).Sort("-_id").One(&latest)
+	if err == mgo.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return latest.Version, nil
+}
+
+// MigrateSchema applies each migration that's newer than the current schema version, in order.
+func (storage *MongoStorage) MigrateSchema() error {
+	current, err := storage.SchemaVersion()
+	if err != nil {
+		return err
+	}
+
+	for _, migration := range schemaMigrations {
+		if migration.Version <= current {
+			continue
+		}
+
+		fields := log.Fields{
+			"version":     migration.Version,
+			"description": migration.Description,
+		}
+		if err := migration.Apply(storage); err != nil {
+			fields["error"] = err
+			log.WithFields(fields).Error("Unable to apply a schema migration.")
+			return err
+		}
+
+		record := schemaVersionRecord{Version: migration.Version, AppliedAt: StoreTime(time.Now())}
+		if _, err := storage.schemaVersions().UpsertId(record.Version, record); err != nil {
+			return err
+		}
+		log.WithFields(fields).Info("Applied a schema migration.")
+	}
+	return nil
+}
+
+// migrationLockID identifies the advisory lock that's held while schema migrations are applied.
+const migrationLockID = "schema_migration"
+
+// migrationLockTTL is how long the migration lock may be held before it's considered abandoned by a
+// process that died mid-migration, and may be taken over by another owner.
+const migrationLockTTL = time.Hour
+
+// LockMigrations acquires the advisory lock on schema migrations for owner. It returns false if
+// another owner already holds it. A lock that's older than migrationLockTTL is taken over.
+func (storage *MongoStorage) LockMigrations(owner string) (bool, error) {
+	now := time.Now()
+	err := storage.locks().Insert(bson.M{
+		"_id":       migrationLockID,
+		"owner":     owner,
+		"locked_at": StoreTime(now),
+	})
+	if err == nil {
+		return true, nil
+	}
+	if !mgo.IsDup(err) {
+		return false, err
+	}
+
+	err = storage.locks().Update(
+		bson.M{"_id": migrationLockID, "locked_at": bson.M{"$lt": StoreTime(now.Add(-migrationLockTTL))}},
+		bson.M{"$set": bson.M{"owner": owner, "locked_at": StoreTime(now)}},
+	)
+	if err == mgo.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	log.WithFields(log.Fields{"owner": owner}).Warn("Took over an abandoned schema migration lock.")
+	return true, nil
+}
+
+// UnlockMigrations releases the advisory lock on schema migrations if owner holds it.
+func (storage *MongoStorage) UnlockMigrations(owner string) error {
+	err := storage.locks().Remove(bson.M{"_id": migrationLockID, "owner": owner})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
 // Job storage
 
 // InsertJob appends a job to the queue and returns a newly allocated job ID.
@@ -110,42 +539,72 @@ func (storage *MongoStorage) InsertJob(job SubmittedJob) (uint64, error) {
 	return job.JID, nil
 }
 
-// ListJobs queries jobs that have been submitted to the cluster.
-func (storage *MongoStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
-	q := bson.M{"account": query.AccountName}
+// InsertJobWithinQuota inserts a job unless its account would then have more than maxQueued jobs
+// waiting to run, in which case ErrQuotaExceeded is returned. The job is inserted before the
+// account's jobs are counted, so that of several concurrent submissions, the last to count sees all
+// of the others. Concurrent submissions may all be refused near the quota, but can't overshoot it.
+func (storage *MongoStorage) InsertJobWithinQuota(job SubmittedJob, maxQueued int) (uint64, error) {
+	jid, err := storage.InsertJob(job)
+	if err != nil {
+		return 0, err
+	}
+
+	queued, err := storage.jobs().Find(bson.M{
+		"account": job.Account,
+		"status":  bson.M{"$in": quotaStatuses},
+	}).Count()
+	if err == nil && queued > maxQueued {
+		err = ErrQuotaExceeded
+	}
+	if err != nil {
+		if removeErr := storage.jobs().RemoveId(jid); removeErr != nil {
+			return 0, removeErr
+		}
+		return 0, err
+	}
+	return jid, nil
+}
+
+// selector builds the Mongo selector that matches a JobQuery, ignoring its Limit and Offset. It returns false if
+// the query can't match any jobs at all.
+func (query JobQuery) selector() (bson.M, bool) {
+	q := bson.M{}
+	if query.AccountName != "" {
+		q["account"] = query.AccountName
+	}
 
 	switch len(query.JIDs) {
 	case 0:
-		if query.Before != 0 {
-			q["_id"] = bson.M{"$lt": query.Before}
+		bounds := bson.M{}
+		if query.BeforeJID != 0 {
+			bounds["$lt"] = query.BeforeJID
 		}
-
-		if query.After != 0 {
-			q["_id"] = bson.M{"$gte": query.After}
+		if query.AfterJID != 0 {
+			bounds["$gt"] = query.AfterJID
+		}
+		if len(bounds) > 0 {
+			q["_id"] = bounds
 		}
 	case 1:
 		only := query.JIDs[0]
-		if query.Before != 0 && only >= query.Before {
-			return []SubmittedJob{}, nil
-		}
-		if query.After != 0 && only < query.After {
-			return []SubmittedJob{}, nil
+		if !query.inBounds(only) {
+			return nil, false
 		}
 
 		q["_id"] = query.JIDs[0]
 	default:
 		var filtered []uint64
 
-		if query.Before != 0 || query.After != 0 {
+		if query.BeforeJID != 0 || query.AfterJID != 0 {
 			filtered = make([]uint64, 0, len(query.JIDs))
 			for _, jid := range query.JIDs {
-				if (query.Before == 0 || jid < query.Before) && (query.After == 0 || jid >= query.After) {
+				if query.inBounds(jid) {
 					filtered = append(filtered, jid)
 				}
 			}
 
 			if len(filtered) == 0 {
-				return []SubmittedJob{}, nil
+				return nil, false
 			}
 		} else {
 			filtered = query.JIDs
@@ -170,13 +629,328 @@ func (storage *MongoStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
 		q["status"] = bson.M{"$in": query.Statuses}
 	}
 
+	for key, value := range query.Tags {
+		q["job.tags."+key] = value
+	}
+
+	if !query.CreatedSince.IsZero() || !query.CreatedUntil.IsZero() {
+		createdAt := bson.M{}
+		if !query.CreatedSince.IsZero() {
+			createdAt["$gte"] = query.CreatedSince
+		}
+		if !query.CreatedUntil.IsZero() {
+			createdAt["$lte"] = query.CreatedUntil
+		}
+		q["created_at"] = createdAt
+	}
+
+	if query.RunID != "" {
+		q["job.run_id"] = query.RunID
+	}
+
+	if !query.ScheduledUntil.IsZero() {
+		q["$or"] = []bson.M{
+			{"job.scheduled_at": bson.M{"$exists": false}},
+			{"job.scheduled_at": bson.M{"$lte": query.ScheduledUntil}},
+		}
+	}
+
+	return q, true
+}
+
+// ListJobs queries jobs that have been submitted to the cluster. Jobs from all accounts are returned
+// if the query's AccountName is empty.
+func (storage *MongoStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
+	q, ok := query.selector()
+	if !ok {
+		return []SubmittedJob{}, nil
+	}
+
+	order := "_id"
+	if query.descending() {
+		order = "-_id"
+	}
+
 	var result []SubmittedJob
-	if err := storage.jobs().Find(q).Limit(query.Limit).All(&result); err != nil {
+	if err := storage.jobs().Find(q).Sort(order).Skip(query.Offset).Limit(query.Limit).All(&result); err != nil {
 		return nil, err
 	}
+	if query.descending() {
+		reverseJobs(result)
+	}
 	return result, nil
 }
 
+// GetJobByName returns the most recently submitted job with a given name that belongs to an account.
+// Archived jobs are ignored. ErrNotFound is returned if there isn't one.
+func (storage *MongoStorage) GetJobByName(accountName, name string) (*SubmittedJob, error) {
+	var job SubmittedJob
+	err := storage.jobs().Find(bson.M{"account": accountName, "job.name": name}).Sort("-_id").One(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// FindCachedJob returns an account's most recent successfully completed job with a cache key whose
+// result hasn't expired. ErrNotFound is returned if there isn't one.
+func (storage *MongoStorage) FindCachedJob(accountName, cacheKey string) (*SubmittedJob, error) {
+	var job SubmittedJob
+	err := storage.jobs().Find(bson.M{
+		"account":       accountName,
+		"job.cache_key": cacheKey,
+		"status":        StatusDone,
+		"$or": []bson.M{
+			{"cache_expires_at": bson.M{"$exists": false}},
+			{"cache_expires_at": bson.M{"$gt": StoreTime(time.Now())}},
+		},
+	}).Sort("-_id").One(&job)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetIdempotencyKey returns the record of an account's idempotency key that is unexpired as of now.
+// ErrNotFound is returned if there isn't one.
+func (storage *MongoStorage) GetIdempotencyKey(accountName, key string, now time.Time) (*IdempotencyKey, error) {
+	var record IdempotencyKey
+	err := storage.idempotencyKeys().Find(bson.M{
+		"account":    accountName,
+		"key":        key,
+		"expires_at": bson.M{"$gt": now},
+	}).One(&record)
+	if err != nil {
+		return nil, err
+	}
+	return &record, nil
+}
+
+// ReserveIdempotencyKey records an idempotency key before its job is created, replacing any record
+// that expired before now. The unique index on the key makes the reservation atomic, so that only
+// one of several concurrent submissions with the same key can hold it. ErrIdempotencyKeyExists is
+// returned if an unexpired record already holds the key.
+func (storage *MongoStorage) ReserveIdempotencyKey(record IdempotencyKey, now time.Time) error {
+	err := storage.idempotencyKeys().Insert(&record)
+	if !mgo.IsDup(err) {
+		return err
+	}
+
+	err = storage.idempotencyKeys().Update(
+		bson.M{"account": record.Account, "key": record.Key, "expires_at": bson.M{"$lte": now}},
+		&record,
+	)
+	if err == mgo.ErrNotFound {
+		return ErrIdempotencyKeyExists
+	}
+	return err
+}
+
+// SaveIdempotencyKey records the job created for an idempotency key, replacing any expired record.
+func (storage *MongoStorage) SaveIdempotencyKey(record IdempotencyKey) error {
+	_, err := storage.idempotencyKeys().Upsert(bson.M{"account": record.Account, "key": record.Key}, &record)
+	return err
+}
+
+// ReleaseIdempotencyKey discards a reservation whose submission failed, so that the key may be used
+// again. Keys that already record a job are left alone.
+func (storage *MongoStorage) ReleaseIdempotencyKey(accountName, key string) error {
+	err := storage.idempotencyKeys().Remove(bson.M{"account": accountName, "key": key, "jid": 0})
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// CountJobs counts the jobs that match a query, ignoring its Limit and Offset.
+func (storage *MongoStorage) CountJobs(query JobQuery) (int, error) {
+	q, ok := query.selector()
+	if !ok {
+		return 0, nil
+	}
+
+	return storage.jobs().Find(q).Count()
+}
+
+// CountJobsByStatus counts the jobs submitted by an account in each status. Jobs from all accounts
+// are counted if accountName is empty. Statuses without any jobs are omitted.
+func (storage *MongoStorage) CountJobsByStatus(accountName string) (map[string]int, error) {
+	var match bson.M
+	if accountName != "" {
+		match = bson.M{"account": accountName}
+	}
+
+	results, err := storage.countByStatus(match)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(results))
+	for _, result := range results {
+		counts[result.Status] = int(result.Count)
+	}
+	return counts, nil
+}
+
+// CountJobsByAccount counts each account's jobs in each of statuses, in a single aggregation. Results
+// are ordered by account, then status. Accounts without any jobs in statuses are omitted.
+func (storage *MongoStorage) CountJobsByAccount(statuses []string) ([]AccountJobCount, error) {
+	pipeline := []bson.M{
+		{"$match": bson.M{"status": bson.M{"$in": statuses}}},
+		{"$group": bson.M{
+			"_id":    bson.M{"account": "$account", "status": "$status"},
+			"count":  bson.M{"$sum": 1},
+			"oldest": bson.M{"$min": "$created_at"},
+		}},
+		{"$sort": bson.D{{Name: "_id.account", Value: 1}, {Name: "_id.status", Value: 1}}},
+	}
+
+	var results []struct {
+		ID struct {
+			Account string `bson:"account"`
+			Status  string `bson:"status"`
+		} `bson:"_id"`
+		Count  int        `bson:"count"`
+		Oldest StoredTime `bson:"oldest"`
+	}
+	if err := storage.jobs().Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+
+	counts := make([]AccountJobCount, len(results))
+	for i, result := range results {
+		counts[i] = AccountJobCount{
+			Account:         result.ID.Account,
+			Status:          result.ID.Status,
+			Count:           result.Count,
+			OldestCreatedAt: result.Oldest,
+		}
+	}
+	return counts, nil
+}
+
+// ListRuns summarizes an account's runs, in the order that their first jobs were submitted. Only the
+// runs that follow the cursor after are included, and at most limit runs are returned.
+func (storage *MongoStorage) ListRuns(accountName string, after RunCursor, limit int) ([]RunSummary, error) {
+	createdMs := after.CreatedAt.Truncate(time.Millisecond)
+	return storage.summarizeRuns(
+		bson.M{"account": accountName, "job.run_id": bson.M{"$exists": true}},
+		bson.M{"$project": bson.M{
+			"created_at": 1,
+			"statuses":   1,
+			"created_ms": bson.M{"$subtract": []interface{}{
+				"$created_at", bson.M{"$mod": []interface{}{"$created_at", int64(time.Millisecond)}},
+			}},
+		}},
+		bson.M{"$match": bson.M{"$or": []bson.M{
+			{"created_ms": bson.M{"$gt": createdMs}},
+			{"created_ms": createdMs, "_id": bson.M{"$gt": after.RunID}},
+		}}},
+		bson.M{"$sort": bson.D{{Name: "created_ms", Value: 1}, {Name: "_id", Value: 1}}},
+		bson.M{"$limit": limit},
+	)
+}
+
+// GetRunSummary summarizes a single run of an account's jobs. ErrNotFound is returned if the run
+// has no jobs.
+func (storage *MongoStorage) GetRunSummary(accountName, runID string) (RunSummary, error) {
+	runs, err := storage.summarizeRuns(bson.M{"account": accountName, "job.run_id": runID})
+	if err != nil {
+		return RunSummary{}, err
+	}
+	if len(runs) == 0 {
+		return RunSummary{}, ErrNotFound
+	}
+	return runs[0], nil
+}
+
+// summarizeRuns aggregates the jobs that match a selector into one summary per run. Any further
+// pipeline stages are applied to the per-run documents, which have the run ID as their _id and the
+// run's earliest created_at.
+func (storage *MongoStorage) summarizeRuns(match bson.M, stages ...bson.M) ([]RunSummary, error) {
+	pipeline := []bson.M{
+		{"$match": match},
+		{"$group": bson.M{
+			"_id":        bson.M{"run_id": "$job.run_id", "status": "$status"},
+			"count":      bson.M{"$sum": 1},
+			"created_at": bson.M{"$min": "$created_at"},
+			// Jobs that haven't started have a zero started_at, which $min would otherwise prefer.
+			"started_at":  bson.M{"$min": bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{"$started_at", 0}}, "$started_at", nil}}},
+			"finished_at": bson.M{"$max": "$finished_at"},
+		}},
+		{"$group": bson.M{
+			"_id":        "$_id.run_id",
+			"created_at": bson.M{"$min": "$created_at"},
+			"statuses": bson.M{"$push": bson.M{
+				"status":      "$_id.status",
+				"count":       "$count",
+				"created_at":  "$created_at",
+				"started_at":  "$started_at",
+				"finished_at": "$finished_at",
+			}},
+		}},
+	}
+	pipeline = append(pipeline, stages...)
+
+	var results []struct {
+		RunID    string `bson:"_id"`
+		Statuses []struct {
+			Status     string     `bson:"status"`
+			Count      int        `bson:"count"`
+			CreatedAt  StoredTime `bson:"created_at"`
+			StartedAt  StoredTime `bson:"started_at"`
+			FinishedAt StoredTime `bson:"finished_at"`
+		} `bson:"statuses"`
+	}
+	if err := storage.jobs().Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+
+	runs := make([]RunSummary, len(results))
+	for i, result := range results {
+		runs[i].RunID = result.RunID
+		for _, each := range result.Statuses {
+			runs[i].add(each.Status, each.Count, each.CreatedAt, each.StartedAt, each.FinishedAt)
+		}
+		runs[i].finish()
+	}
+	return runs, nil
+}
+
+// GetQueueDepths counts the jobs in each status across all accounts.
+func (storage *MongoStorage) GetQueueDepths() (map[string]int64, error) {
+	results, err := storage.countByStatus(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	depths := make(map[string]int64, len(results))
+	for _, result := range results {
+		depths[result.Status] = result.Count
+	}
+	return depths, nil
+}
+
+type statusCount struct {
+	Status string `bson:"_id"`
+	Count  int64  `bson:"count"`
+}
+
+// countByStatus groups the jobs that match a selector by status. A nil selector matches every job.
+func (storage *MongoStorage) countByStatus(match bson.M) ([]statusCount, error) {
+	pipeline := []bson.M{}
+	if match != nil {
+		pipeline = append(pipeline, bson.M{"$match": match})
+	}
+	pipeline = append(pipeline, bson.M{"$group": bson.M{"_id": "$status", "count": bson.M{"$sum": 1}}})
+
+	var results []statusCount
+	if err := storage.jobs().Pipe(pipeline).All(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
 // JobKillRequested returns true if a request has been submitted to kill the job with with provided
 // JID, and false otherwise.
 func (storage *MongoStorage) JobKillRequested(id uint64) (bool, error) {
@@ -185,11 +959,28 @@ func (storage *MongoStorage) JobKillRequested(id uint64) (bool, error) {
 	return result.KillRequested, err
 }
 
-// ClaimJob atomically searches for the oldest pending SubmittedJob, marks it as StatusProcessing,
-// and returns it. nil is returned if no SubmittedJobs are available.
-func (storage *MongoStorage) ClaimJob() (*SubmittedJob, error) {
+// JobRunner returns the RunnerID of the runner that most recently claimed the job with the provided
+// ID, or an empty string if it hasn't been claimed.
+func (storage *MongoStorage) JobRunner(id uint64) (string, error) {
+	var result SubmittedJob
+	err := storage.jobs().FindId(id).Select(bson.M{"runner": 1}).One(&result)
+	return result.Runner, err
+}
+
+// ClaimJob atomically searches for the oldest pending SubmittedJob that doesn't belong to one of
+// skipAccounts and isn't scheduled to run after now, marks it as StatusProcessing, and returns it.
+// nil is returned if no SubmittedJobs are available.
+func (storage *MongoStorage) ClaimJob(skipAccounts []string, now StoredTime) (*SubmittedJob, error) {
+	q, _ := JobQuery{Statuses: []string{StatusQueued}, ScheduledUntil: now}.selector()
+	if len(skipAccounts) > 0 {
+		q["account"] = bson.M{"$nin": skipAccounts}
+	}
+
+	// The status filter and the update are applied by a single findAndModify, so concurrent runners
+	// can't claim the same job: whichever loses the race no longer sees it as queued, and claims the
+	// next job instead.
 	var job SubmittedJob
-	_, err := storage.jobs().Find(bson.M{"status": StatusQueued}).Sort("created_at").Apply(mgo.Change{
+	_, err := storage.jobs().Find(q).Sort("created_at").Apply(mgo.Change{
 		Update:    bson.M{"$set": bson.M{"status": StatusProcessing}},
 		ReturnNew: true,
 	}, &job)
@@ -204,15 +995,84 @@ func (storage *MongoStorage) ClaimJob() (*SubmittedJob, error) {
 	return &job, nil
 }
 
+// ReclaimJob atomically hands a running job over to runner, restamping its StartedAt, as long as the
+// job is still running and hasn't been restarted since it was loaded. nil is returned if it has.
+func (storage *MongoStorage) ReclaimJob(job SubmittedJob, runner string, startedAt StoredTime) (*SubmittedJob, error) {
+	q := bson.M{"_id": job.JID, "status": StatusProcessing, "started_at": job.StartedAt}
+
+	var out SubmittedJob
+	_, err := storage.jobs().Find(q).Apply(mgo.Change{
+		Update:    bson.M{"$set": bson.M{"runner": runner, "started_at": startedAt}},
+		ReturnNew: true,
+	}, &out)
+
+	if err == mgo.ErrNotFound {
+		// Another runner got to it first, or the job finished.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &out, nil
+}
+
 // UpdateJob updates the state of a job in the database to match any changes made to the model.
 func (storage *MongoStorage) UpdateJob(job *SubmittedJob) error {
+	update := bson.M{"$set": job}
+	if job.PullProgress == nil {
+		// An empty PullProgress is omitted from the $set, so remove any progress from an earlier pull.
+		update["$unset"] = bson.M{"pull_progress": ""}
+	}
+
 	var out SubmittedJob
 	_, err := storage.jobs().FindId(job.JID).Apply(mgo.Change{
-		Update: bson.M{"$set": job},
+		Update: update,
 	}, &out)
 	return err
 }
 
+// CancelJobs flags every job that matches a query and hasn't finished to be killed, ignoring the
+// query's Statuses. Jobs that haven't started are killed outright, and running jobs are left for
+// their runners to stop. Each update is conditioned on the job's status, so a job that finishes in
+// the meantime is left alone. It returns the number of jobs that were flagged.
+func (storage *MongoStorage) CancelJobs(query JobQuery) (int, error) {
+	query.Statuses = []string{StatusWaiting, StatusQueued}
+	pending, ok := query.selector()
+	if !ok {
+		return 0, nil
+	}
+	killed, err := storage.jobs().UpdateAll(pending, bson.M{
+		"$set": bson.M{"status": StatusKilled, "kill_requested": true},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	query.Statuses = []string{StatusProcessing}
+	running, _ := query.selector()
+	flagged, err := storage.jobs().UpdateAll(running, bson.M{
+		"$set": bson.M{"kill_requested": true},
+	})
+	if err != nil {
+		return killed.Updated, err
+	}
+	return killed.Updated + flagged.Updated, nil
+}
+
+// ArchiveJob moves a job from the active jobs collection into the "dead_jobs" collection. It's safe
+// to archive the same job more than once.
+func (storage *MongoStorage) ArchiveJob(job SubmittedJob) error {
+	if _, err := storage.deadJobs().UpsertId(job.JID, job); err != nil {
+		return err
+	}
+
+	err := storage.jobs().RemoveId(job.JID)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
 // Account storage
 
 // GetAccount loads an account by its unique account name, creating it if it doesn't already exist.
@@ -229,6 +1089,27 @@ func (storage *MongoStorage) GetAccount(name string) (*Account, error) {
 	return &out, nil
 }
 
+// GetAPIKeyHash returns the hash of the API key that was assigned to an account when it was created,
+// without creating the account. It's empty for accounts that are authenticated elsewhere, and
+// ErrNotFound is returned if there's no such account.
+func (storage *MongoStorage) GetAPIKeyHash(name string) (string, error) {
+	var out Account
+	err := storage.accounts().FindId(name).Select(bson.M{"api_key_hash": 1}).One(&out)
+	return out.APIKeyHash, err
+}
+
+// CreateAccount creates a new account with an API key, which is stored as a hash. ErrAccountExists is
+// returned if an account with the same name already exists.
+func (storage *MongoStorage) CreateAccount(account Account, apiKey string) error {
+	account.APIKeyHash = HashAPIKey(apiKey)
+
+	err := storage.accounts().Insert(account)
+	if mgo.IsDup(err) {
+		return ErrAccountExists
+	}
+	return err
+}
+
 // UpdateAccountAdmin flags or unflags an account as an administrator.
 func (storage *MongoStorage) UpdateAccountAdmin(name string, admin bool) error {
 	return storage.accounts().UpdateId(name, bson.M{
@@ -236,18 +1117,92 @@ func (storage *MongoStorage) UpdateAccountAdmin(name string, admin bool) error {
 	})
 }
 
-// UpdateAccountUsage updates an account to take a new job into account.
-func (storage *MongoStorage) UpdateAccountUsage(name string, runtime int64) error {
+// UpdateAccountSuspended suspends or reinstates an account.
+func (storage *MongoStorage) UpdateAccountSuspended(name string, suspended bool) error {
 	return storage.accounts().UpdateId(name, bson.M{
-		"$inc": bson.M{
-			"total_runtime": runtime,
-			"total_jobs":    1,
-		},
+		"$set": bson.M{"suspended": suspended},
+	})
+}
+
+// UpdateAccountActive deactivates or reactivates an account.
+func (storage *MongoStorage) UpdateAccountActive(name string, active bool) error {
+	return storage.accounts().UpdateId(name, bson.M{
+		"$set": bson.M{"active": active},
+	})
+}
+
+// UpdateAccountQuota sets the number of jobs that an account may have queued and running at once.
+func (storage *MongoStorage) UpdateAccountQuota(name string, maxQueuedJobs, maxConcurrentJobs int) error {
+	return storage.accounts().UpdateId(name, bson.M{
+		"$set": bson.M{"max_queued_jobs": maxQueuedJobs, "max_concurrent_jobs": maxConcurrentJobs},
+	})
+}
+
+// UpdateAccountExpiry sets or clears the time at which an account expires.
+func (storage *MongoStorage) UpdateAccountExpiry(name string, expiresAt *StoredTime) error {
+	if expiresAt == nil {
+		return storage.accounts().UpdateId(name, bson.M{
+			"$unset": bson.M{"expires_at": ""},
+		})
+	}
+
+	return storage.accounts().UpdateId(name, bson.M{
+		"$set": bson.M{"expires_at": *expiresAt},
 	})
 }
 
+// UpdateAccountUsage adds a job's runtime to an account's usage. Only finished jobs are counted
+// towards its total jobs.
+func (storage *MongoStorage) UpdateAccountUsage(name string, runtime int64, finished bool) error {
+	inc := bson.M{"total_runtime": runtime}
+	if finished {
+		inc["total_jobs"] = 1
+	}
+	return storage.accounts().UpdateId(name, bson.M{"$inc": inc})
+}
+
+// AdjustAccountCredits adds a (possibly negative) number of credits to an account's balance.
+func (storage *MongoStorage) AdjustAccountCredits(name string, delta int64) error {
+	return storage.accounts().UpdateId(name, bson.M{
+		"$inc": bson.M{"credits": delta},
+	})
+}
+
+// Config map storage
+
+// ListConfigMaps returns all of the config maps owned by an account.
+func (storage *MongoStorage) ListConfigMaps(owner string) ([]ConfigMap, error) {
+	var result []ConfigMap
+	if err := storage.configMaps().Find(bson.M{"owner": owner}).Sort("name").All(&result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SaveConfigMap creates a config map, or replaces the data of an existing config map with the same
+// owner and name.
+func (storage *MongoStorage) SaveConfigMap(m ConfigMap) error {
+	_, err := storage.configMaps().Upsert(bson.M{"owner": m.Owner, "name": m.Name}, m)
+	return err
+}
+
+// GetVolume looks up a registered volume by name. ErrNotFound is returned if no volume with that
+// name has been registered.
+func (storage *MongoStorage) GetVolume(name string) (*Volume, error) {
+	var out Volume
+	if err := storage.volumes().Find(bson.M{"name": name}).One(&out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
 // NullStorage is a useful embeddable struct that can be used to mock selected storage calls without
 // needing to stub out all of the ones you don't care about.
+//
+// Its methods never panic or fail. Writes are no-ops, counts are zero, collections are empty rather
+// than nil, and lookups of a single job, key, run, or volume return ErrNotFound. GetAccount is the
+// exception: it returns a zero-initialized Account with the requested name, so that authentication
+// succeeds. ClaimJob and ReclaimJob return nil, as if there were no jobs to run.
 type NullStorage struct{}
 
 // Ensure that NullStorage adheres to the Storage interface.
@@ -258,6 +1213,31 @@ func (storage NullStorage) Bootstrap() error {
 	return nil
 }
 
+// MigrateSchema is a no-op.
+func (storage NullStorage) MigrateSchema() error {
+	return nil
+}
+
+// SchemaVersion always returns zero.
+func (storage NullStorage) SchemaVersion() (int, error) {
+	return 0, nil
+}
+
+// LockMigrations always acquires the lock.
+func (storage NullStorage) LockMigrations(owner string) (bool, error) {
+	return true, nil
+}
+
+// UnlockMigrations is a no-op.
+func (storage NullStorage) UnlockMigrations(owner string) error {
+	return nil
+}
+
+// Ping always succeeds.
+func (storage NullStorage) Ping() error {
+	return nil
+}
+
 // InsertJob is a no-op.
 func (storage NullStorage) InsertJob(job SubmittedJob) (uint64, error) {
 	return 0, nil
@@ -268,32 +1248,167 @@ func (storage NullStorage) ListJobs(query JobQuery) ([]SubmittedJob, error) {
 	return []SubmittedJob{}, nil
 }
 
+// InsertJobWithinQuota is a no-op.
+func (storage NullStorage) InsertJobWithinQuota(job SubmittedJob, maxQueued int) (uint64, error) {
+	return 0, nil
+}
+
+// GetJobByName always returns ErrNotFound.
+func (storage NullStorage) GetJobByName(accountName, name string) (*SubmittedJob, error) {
+	return nil, ErrNotFound
+}
+
+// FindCachedJob always returns ErrNotFound.
+func (storage NullStorage) FindCachedJob(accountName, cacheKey string) (*SubmittedJob, error) {
+	return nil, ErrNotFound
+}
+
+// GetIdempotencyKey always returns ErrNotFound.
+func (storage NullStorage) GetIdempotencyKey(accountName, key string, now time.Time) (*IdempotencyKey, error) {
+	return nil, ErrNotFound
+}
+
+// ReserveIdempotencyKey is a no-op.
+func (storage NullStorage) ReserveIdempotencyKey(record IdempotencyKey, now time.Time) error {
+	return nil
+}
+
+// SaveIdempotencyKey is a no-op.
+func (storage NullStorage) SaveIdempotencyKey(record IdempotencyKey) error {
+	return nil
+}
+
+// ReleaseIdempotencyKey is a no-op.
+func (storage NullStorage) ReleaseIdempotencyKey(accountName, key string) error {
+	return nil
+}
+
+// CountJobs always returns zero.
+func (storage NullStorage) CountJobs(query JobQuery) (int, error) {
+	return 0, nil
+}
+
+// CountJobsByAccount returns no counts.
+func (storage NullStorage) CountJobsByAccount(statuses []string) ([]AccountJobCount, error) {
+	return nil, nil
+}
+
+// CountJobsByStatus returns an empty map.
+func (storage NullStorage) CountJobsByStatus(accountName string) (map[string]int, error) {
+	return map[string]int{}, nil
+}
+
+// ListRuns returns no runs.
+func (storage NullStorage) ListRuns(accountName string, after RunCursor, limit int) ([]RunSummary, error) {
+	return []RunSummary{}, nil
+}
+
+// GetRunSummary always returns ErrNotFound.
+func (storage NullStorage) GetRunSummary(accountName, runID string) (RunSummary, error) {
+	return RunSummary{}, ErrNotFound
+}
+
+// GetQueueDepths returns an empty map.
+func (storage NullStorage) GetQueueDepths() (map[string]int64, error) {
+	return map[string]int64{}, nil
+}
+
 // JobKillRequested always returns false.
 func (storage NullStorage) JobKillRequested(id uint64) (bool, error) {
 	return false, nil
 }
 
 // ClaimJob always returns nil.
-func (storage NullStorage) ClaimJob() (*SubmittedJob, error) {
+func (storage NullStorage) ClaimJob(skipAccounts []string, now StoredTime) (*SubmittedJob, error) {
+	return nil, nil
+}
+
+// ReclaimJob always returns nil.
+func (storage NullStorage) ReclaimJob(job SubmittedJob, runner string, startedAt StoredTime) (*SubmittedJob, error) {
 	return nil, nil
 }
 
+// JobRunner always returns an empty string.
+func (storage NullStorage) JobRunner(id uint64) (string, error) {
+	return "", nil
+}
+
 // UpdateJob is a no-op.
 func (storage NullStorage) UpdateJob(job *SubmittedJob) error {
 	return nil
 }
 
+// CancelJobs cancels no jobs.
+func (storage NullStorage) CancelJobs(query JobQuery) (int, error) {
+	return 0, nil
+}
+
+// ArchiveJob is a no-op.
+func (storage NullStorage) ArchiveJob(job SubmittedJob) error {
+	return nil
+}
+
 // GetAccount returns a fake, zero-initialized Account.
 func (storage NullStorage) GetAccount(name string) (*Account, error) {
 	return &Account{Name: name}, nil
 }
 
+// GetAPIKeyHash always returns ErrNotFound.
+func (storage NullStorage) GetAPIKeyHash(name string) (string, error) {
+	return "", ErrNotFound
+}
+
+// CreateAccount is a no-op.
+func (storage NullStorage) CreateAccount(account Account, apiKey string) error {
+	return nil
+}
+
 // UpdateAccountAdmin is a no-op.
 func (storage NullStorage) UpdateAccountAdmin(name string, admin bool) error {
 	return nil
 }
 
+// UpdateAccountSuspended is a no-op.
+func (storage NullStorage) UpdateAccountSuspended(name string, suspended bool) error {
+	return nil
+}
+
+// UpdateAccountActive is a no-op.
+func (storage NullStorage) UpdateAccountActive(name string, active bool) error {
+	return nil
+}
+
+// UpdateAccountQuota is a no-op.
+func (storage NullStorage) UpdateAccountQuota(name string, maxQueuedJobs, maxConcurrentJobs int) error {
+	return nil
+}
+
+// UpdateAccountExpiry is a no-op.
+func (storage NullStorage) UpdateAccountExpiry(name string, expiresAt *StoredTime) error {
+	return nil
+}
+
 // UpdateAccountUsage is a no-op.
-func (storage NullStorage) UpdateAccountUsage(name string, runtime int64) error {
+func (storage NullStorage) UpdateAccountUsage(name string, runtime int64, finished bool) error {
 	return nil
 }
+
+// AdjustAccountCredits is a no-op.
+func (storage NullStorage) AdjustAccountCredits(name string, delta int64) error {
+	return nil
+}
+
+// ListConfigMaps returns an empty collection.
+func (storage NullStorage) ListConfigMaps(owner string) ([]ConfigMap, error) {
+	return []ConfigMap{}, nil
+}
+
+// SaveConfigMap is a no-op.
+func (storage NullStorage) SaveConfigMap(m ConfigMap) error {
+	return nil
+}
+
+// GetVolume always returns ErrNotFound.
+func (storage NullStorage) GetVolume(name string) (*Volume, error) {
+	return nil, ErrNotFound
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// copyProgressInterval is the number of jobs copied between progress reports.
+const copyProgressInterval = 1000
+
+// CopyOptions controls how CopyJobs moves jobs between storage engines.
+type CopyOptions struct {
+	// BatchSize is the number of jobs read from the source storage at a time.
+	BatchSize int
+
+	// DryRun reports the jobs that would be copied without writing them to the destination.
+	DryRun bool
+}
+
+// CopyJobs reads every active job from source, in JID order, and inserts it into destination. It
+// returns the number of jobs copied, or that would have been copied during a dry run.
+func CopyJobs(source, destination Storage, options CopyOptions) (int, error) {
+	if options.BatchSize < 1 {
+		return 0, fmt.Errorf("invalid batch size [%d]", options.BatchSize)
+	}
+
+	copied := 0
+	var after uint64
+	for {
+		batch, err := source.ListJobs(JobQuery{AfterJID: after, Limit: options.BatchSize})
+		if err != nil {
+			return copied, err
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		if options.DryRun {
+			log.WithFields(log.Fields{
+				"jobs":      len(batch),
+				"first jid": batch[0].JID,
+				"last jid":  batch[len(batch)-1].JID,
+			}).Info("Would copy jobs.")
+		}
+
+		for _, job := range batch {
+			if !options.DryRun {
+				if _, err := destination.InsertJob(job); err != nil {
+					log.WithFields(log.Fields{
+						"jid":   job.JID,
+						"error": err,
+					}).Error("Unable to copy a job.")
+					return copied, err
+				}
+			}
+			copied++
+
+			if copied%copyProgressInterval == 0 {
+				log.WithFields(log.Fields{
+					"jobs copied": copied,
+					"last jid":    job.JID,
+					"dry run":     options.DryRun,
+				}).Info("Copying jobs.")
+			}
+		}
+
+		after = batch[len(batch)-1].JID
+		if len(batch) < options.BatchSize {
+			break
+		}
+	}
+
+	log.WithFields(log.Fields{
+		"jobs copied": copied,
+		"dry run":     options.DryRun,
+	}).Info("Finished copying jobs.")
+	return copied, nil
+}
+
+// migrateCommand copies jobs from the configured MongoDB cluster into the configured PostgreSQL
+// database. It's run as "cloudpipe migrate [--dry-run] [--batch-size N]".
+func migrateCommand(args []string) error {
+	c := &Context{}
+	if err := c.Load(); err != nil {
+		return err
+	}
+
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Log the jobs that would be copied without writing them.")
+	batchSize := flags.Int("batch-size", 100, "Number of jobs to read from MongoDB at a time.")
+	flags.StringVar(&c.MongoURL, "mongo-url", c.MongoURL, "MongoDB cluster to copy jobs from.")
+	flags.StringVar(&c.PostgresDSN, "postgres-dsn", c.PostgresDSN, "PostgreSQL database to copy jobs into.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if c.PostgresDSN == "" {
+		return fmt.Errorf("a PostgreSQL DSN is required: set PIPE_POSTGRESDSN or --postgres-dsn")
+	}
+
+	source, err := NewMongoStorage(c)
+	if err != nil {
+		return err
+	}
+
+	destination, err := NewPostgresStorage(c)
+	if err != nil {
+		return err
+	}
+	if !*dryRun {
+		if err := destination.Bootstrap(); err != nil {
+			return err
+		}
+		if err := MigrateSchemaLocked(destination, c.clock()); err != nil {
+			return err
+		}
+	}
+
+	_, err = CopyJobs(source, destination, CopyOptions{BatchSize: *batchSize, DryRun: *dryRun})
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import "testing"
+
+func sourceJobs(n int) *MemoryStorage {
+	s := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+	for i := 0; i < n; i++ {
+		s.InsertJob(SubmittedJob{Job: Job{Command: "id"}, Status: StatusQueued})
+	}
+	return s
+}
+
+func TestCopyJobs(t *testing.T) {
+	source := sourceJobs(2500)
+	destination := &MemoryStorage{}
+
+	for _, batchSize := range []int{100, 1000, 2500, 3000} {
+		destination.Reset()
+
+		copied, err := CopyJobs(source, destination, CopyOptions{BatchSize: batchSize})
+		if err != nil {
+			t.Fatalf("Unexpected error with batch size [%d]: %v", batchSize, err)
+		}
+		if copied != 2500 {
+			t.Errorf("Expected 2500 jobs to be copied with batch size [%d], got %d", batchSize, copied)
+		}
+		if len(destination.Jobs) != 2500 {
+			t.Errorf("Expected 2500 jobs in the destination with batch size [%d], got %d", batchSize, len(destination.Jobs))
+		}
+		if job := destination.Jobs[2500]; job == nil || job.Command != "id" || job.Status != StatusQueued {
+			t.Errorf("Unexpected copied job with batch size [%d]: %+v", batchSize, job)
+		}
+	}
+}
+
+func TestCopyJobsDryRun(t *testing.T) {
+	source := sourceJobs(250)
+	destination := &MemoryStorage{Jobs: make(map[uint64]*SubmittedJob)}
+
+	copied, err := CopyJobs(source, destination, CopyOptions{BatchSize: 100, DryRun: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if copied != 250 {
+		t.Errorf("Expected 250 jobs to be reported, got %d", copied)
+	}
+	if len(destination.Jobs) != 0 {
+		t.Errorf("Expected a dry run not to write any jobs, but %d were written", len(destination.Jobs))
+	}
+}
+
+func TestCopyJobsInvalidBatchSize(t *testing.T) {
+	if _, err := CopyJobs(sourceJobs(1), NullStorage{}, CopyOptions{}); err == nil {
+		t.Error("Expected a zero batch size to be rejected")
+	}
+}
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// mongoCollections lists every collection that MongoStorage writes to.
+var mongoCollections = []string{
+	"jobs", "dead_jobs", "accounts", "configmaps", "volumes", "root", "schema_versions", "locks",
+	"idempotency_keys",
+}
+
+// TruncateCollection removes every document from a collection. It's defined in a test file so that
+// it's only compiled into test binaries.
+func (storage *MongoStorage) TruncateCollection(name string) error {
+	_, err := storage.Database.C(name).RemoveAll(nil)
+	return err
+}
+
+// testMongoDatabase is the name of the scratch database that tests against TEST_MONGO_URL use. It's
+// unique to this test binary so that running the tests never touches the "pipe" database or one
+// that another test run is using.
+var testMongoDatabase = fmt.Sprintf("pipe_test_%d_%d", os.Getpid(), time.Now().UnixNano())
+
+// TestMain drops the scratch MongoDB database once the tests have finished, if TEST_MONGO_URL is
+// configured.
+func TestMain(m *testing.M) {
+	code := m.Run()
+
+	if url := os.Getenv("TEST_MONGO_URL"); url != "" {
+		session, err := mgo.Dial(url)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to connect to MongoDB at [%s]: %v\n", url, err)
+			os.Exit(1)
+		}
+		if err := session.DB(testMongoDatabase).DropDatabase(); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to drop the [%s] database: %v\n", testMongoDatabase, err)
+			os.Exit(1)
+		}
+		session.Close()
+	}
+
+	os.Exit(code)
+}
+
+// mongoStorage connects to the MongoDB server at TEST_MONGO_URL, empties the scratch database, and
+// migrates it to the latest schema. The test is skipped if TEST_MONGO_URL isn't set.
+func mongoStorage(t *testing.T) *MongoStorage {
+	url := os.Getenv("TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("TEST_MONGO_URL is not set.")
+	}
+
+	session, err := mgo.Dial(url)
+	if err != nil {
+		t.Fatalf("Unable to connect to MongoDB: %v", err)
+	}
+	s := &MongoStorage{Database: session.DB(testMongoDatabase)}
+
+	for _, name := range mongoCollections {
+		if err := s.TruncateCollection(name); err != nil {
+			t.Fatalf("Unable to truncate the [%s] collection: %v", name, err)
+		}
+	}
+	if err := s.Bootstrap(); err != nil {
+		t.Fatalf("Unable to bootstrap: %v", err)
+	}
+	if err := s.MigrateSchema(); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+	return s
+}
+
+func TestMongoMigrateSchema(t *testing.T) {
+	s := mongoStorage(t)
+
+	version, err := s.SchemaVersion()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if version != LatestSchemaVersion() {
+		t.Errorf("Expected schema version [%d], got [%d]", LatestSchemaVersion(), version)
+	}
+}
+
+func TestMongoMigrateSchemaBackfills(t *testing.T) {
+	s := mongoStorage(t)
+
+	if err := s.jobs().Insert(bson.M{"_id": 1, "account": "alice", "job": bson.M{"cmd": "id"}}); err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	if err := s.accounts().Insert(bson.M{"_id": "alice"}); err != nil {
+		t.Fatalf("Unable to insert an account: %v", err)
+	}
+	if _, err := s.schemaVersions().RemoveAll(nil); err != nil {
+		t.Fatalf("Unable to reset the schema version: %v", err)
+	}
+	if err := s.MigrateSchema(); err != nil {
+		t.Fatalf("Unable to migrate: %v", err)
+	}
+
+	var job, account bson.M
+	if err := s.jobs().FindId(1).One(&job); err != nil {
+		t.Fatalf("Unable to load the job: %v", err)
+	}
+	if job["retry_count"] != 0 || job["job"].(bson.M)["preemption_priority"] != 0 {
+		t.Errorf("Expected the job's retry count and priority to be backfilled, got %v", job)
+	}
+	if err := s.accounts().FindId("alice").One(&account); err != nil {
+		t.Fatalf("Unable to load the account: %v", err)
+	}
+	if account["active"] != true || account["max_queued_jobs"] != 0 {
+		t.Errorf("Expected the account's active flag and quota to be backfilled, got %v", account)
+	}
+}
+
+func TestSchemaMigrationsAreSequential(t *testing.T) {
+	for i, migration := range schemaMigrations {
+		if migration.Version != i+1 {
+			t.Errorf("Expected migration %d to have version [%d], got [%d]", i, i+1, migration.Version)
+		}
+		if migration.Apply == nil {
+			t.Errorf("Expected migration [%d] to have an Apply function", migration.Version)
+		}
+	}
+}
+
+func TestNullStorageReturnsEmptyValues(t *testing.T) {
+	s := NullStorage{}
+
+	if jobs, err := s.ListJobs(JobQuery{}); err != nil || jobs == nil || len(jobs) != 0 {
+		t.Errorf("Expected an empty job list, got %v and %v", jobs, err)
+	}
+	if runs, err := s.ListRuns("alice", RunCursor{}, 10); err != nil || runs == nil || len(runs) != 0 {
+		t.Errorf("Expected an empty run list, got %v and %v", runs, err)
+	}
+	if maps, err := s.ListConfigMaps("alice"); err != nil || maps == nil || len(maps) != 0 {
+		t.Errorf("Expected an empty config map list, got %v and %v", maps, err)
+	}
+	if counts, err := s.CountJobsByStatus("alice"); err != nil || counts == nil || len(counts) != 0 {
+		t.Errorf("Expected empty status counts, got %v and %v", counts, err)
+	}
+	if depths, err := s.GetQueueDepths(); err != nil || depths == nil || len(depths) != 0 {
+		t.Errorf("Expected empty queue depths, got %v and %v", depths, err)
+	}
+
+	if job, err := s.ClaimJob(nil, StoreTime(time.Now())); err != nil || job != nil {
+		t.Errorf("Expected no job to be claimed, got %v and %v", job, err)
+	}
+	if _, err := s.GetJobByName("alice", "missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.GetVolume("missing"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if account, err := s.GetAccount("alice"); err != nil || account.Name != "alice" {
+		t.Errorf("Expected a zero-valued account, got %+v and %v", account, err)
+	}
+}
+
+func TestMongoUpdateJobClearsPullProgress(t *testing.T) {
+	s := mongoStorage(t)
+
+	jid, err := s.InsertJob(SubmittedJob{Job: Job{Command: "id"}, Account: "alice", Status: StatusProcessing})
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+
+	job := SubmittedJob{Job: Job{Command: "id"}, JID: jid, Account: "alice", Status: StatusProcessing}
+	job.PullProgress = map[string]string{"abc123": "Downloading"}
+	if err := s.UpdateJob(&job); err != nil {
+		t.Fatalf("Unable to update the job: %v", err)
+	}
+	job.PullProgress = nil
+	if err := s.UpdateJob(&job); err != nil {
+		t.Fatalf("Unable to update the job: %v", err)
+	}
+
+	jobs, err := s.ListJobs(JobQuery{AccountName: "alice"})
+	if err != nil {
+		t.Fatalf("Unable to list jobs: %v", err)
+	}
+	if len(jobs) != 1 || jobs[0].PullProgress != nil {
+		t.Errorf("Expected the pull progress to be cleared, got %+v", jobs)
+	}
+}
+
+func TestMongoLockMigrations(t *testing.T) {
+	s := mongoStorage(t)
+
+	if locked, err := s.LockMigrations("one"); err != nil || !locked {
+		t.Fatalf("Expected to acquire the lock, got %v, %v", locked, err)
+	}
+	if locked, err := s.LockMigrations("two"); err != nil || locked {
+		t.Fatalf("Expected the lock to be held, got %v, %v", locked, err)
+	}
+	if err := s.UnlockMigrations("one"); err != nil {
+		t.Fatalf("Unable to release the lock: %v", err)
+	}
+	if locked, err := s.LockMigrations("two"); err != nil || !locked {
+		t.Errorf("Expected to acquire the released lock, got %v, %v", locked, err)
+	}
+}
+
+func TestMongoLockMigrationsTakesOverAbandonedLock(t *testing.T) {
+	s := mongoStorage(t)
+
+	err := s.locks().Insert(bson.M{
+		"_id":       migrationLockID,
+		"owner":     "crashed",
+		"locked_at": StoreTime(time.Now().Add(-2 * migrationLockTTL)),
+	})
+	if err != nil {
+		t.Fatalf("Unable to insert an abandoned lock: %v", err)
+	}
+
+	if locked, err := s.LockMigrations("one"); err != nil || !locked {
+		t.Fatalf("Expected to take over the abandoned lock, got %v, %v", locked, err)
+	}
+	if locked, err := s.LockMigrations("two"); err != nil || locked {
+		t.Errorf("Expected the fresh lock to be held, got %v, %v", locked, err)
+	}
+}
+
+func TestJobQuerySelectorWithoutAccount(t *testing.T) {
+	q, ok := JobQuery{Statuses: []string{StatusWaiting}}.selector()
+	if !ok {
+		t.Fatal("Expected the query to match some jobs")
+	}
+	if _, ok := q["account"]; ok {
+		t.Errorf("Expected a query without an account to match every account, got %v", q)
+	}
+}
+
+func TestMongoPromote(t *testing.T) {
+	s := mongoStorage(t)
+	c := &Context{Storage: s}
+
+	parent, err := s.InsertJob(SubmittedJob{Job: Job{Command: "id"}, Account: "alice", Status: StatusDone})
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	dependsOn := strconv.FormatUint(parent, 10)
+	if _, err := s.InsertJob(SubmittedJob{
+		Job:     Job{Command: "id", DependsOn: &dependsOn},
+		Account: "alice",
+		Status:  StatusWaiting,
+	}); err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+
+	Promote(c)
+
+	waiting, err := s.CountJobs(JobQuery{Statuses: []string{StatusWaiting}})
+	if err != nil {
+		t.Fatalf("Unable to count jobs: %v", err)
+	}
+	queued, err := s.CountJobs(JobQuery{AccountName: "alice", Statuses: []string{StatusQueued}})
+	if err != nil {
+		t.Fatalf("Unable to count jobs: %v", err)
+	}
+	if waiting != 0 || queued != 1 {
+		t.Errorf("Expected the waiting job to be queued, got %d waiting and %d queued", waiting, queued)
+	}
+}
+
+func TestMongoClaimJobSkipsScheduledJobs(t *testing.T) {
+	s := mongoStorage(t)
+	now := StoreTime(time.Date(2015, 3, 14, 9, 26, 53, 0, time.UTC))
+
+	// The future job is older, so it would be claimed first if its schedule were ignored.
+	if _, err := s.InsertJob(SubmittedJob{
+		Job:       Job{Command: "echo later", ScheduledAt: now.Add(time.Hour)},
+		Account:   "alice",
+		Status:    StatusQueued,
+		CreatedAt: 100,
+	}); err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+	runnableJID, err := s.InsertJob(SubmittedJob{
+		Job:       Job{Command: "echo now", ScheduledAt: now},
+		Account:   "alice",
+		Status:    StatusQueued,
+		CreatedAt: 200,
+	})
+	if err != nil {
+		t.Fatalf("Unable to insert a job: %v", err)
+	}
+
+	claimed, err := s.ClaimJob(nil, now)
+	if err != nil {
+		t.Fatalf("Unable to claim a job: %v", err)
+	}
+	if claimed == nil || claimed.JID != runnableJID {
+		t.Fatalf("Expected the runnable job to be claimed, got %+v", claimed)
+	}
+
+	claimed, err = s.ClaimJob(nil, now)
+	if err != nil {
+		t.Fatalf("Unable to claim a job: %v", err)
+	}
+	if claimed != nil {
+		t.Errorf("Expected the future job not to be claimed, got %+v", claimed)
+	}
+}
+
+func TestMongoCountJobsByAccount(t *testing.T) {
+	s := mongoStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true"}, Account: "bob", Status: StatusProcessing, CreatedAt: 30},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusProcessing, CreatedAt: 20},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusProcessing, CreatedAt: 10},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusQueued, CreatedAt: 40},
+		{Job: Job{Command: "true"}, Account: "alice", Status: StatusDone, CreatedAt: 5},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	counts, err := s.CountJobsByAccount([]string{StatusQueued, StatusProcessing})
+	if err != nil {
+		t.Fatalf("Unable to count jobs: %v", err)
+	}
+	expected := []AccountJobCount{
+		{Account: "alice", Status: StatusProcessing, Count: 2, OldestCreatedAt: 10},
+		{Account: "alice", Status: StatusQueued, Count: 1, OldestCreatedAt: 40},
+		{Account: "bob", Status: StatusProcessing, Count: 1, OldestCreatedAt: 30},
+	}
+	if !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Unexpected counts: %+v", counts)
+	}
+}
+
+func TestMongoReserveIdempotencyKey(t *testing.T) {
+	s := mongoStorage(t)
+	now := time.Now()
+
+	expired := IdempotencyKey{Account: "alice", Key: "k", JID: 1, ExpiresAt: now.Add(-time.Hour)}
+	if err := s.SaveIdempotencyKey(expired); err != nil {
+		t.Fatalf("Unable to save an idempotency key: %v", err)
+	}
+
+	reservation := IdempotencyKey{Account: "alice", Key: "k", ExpiresAt: now.Add(time.Hour)}
+	if err := s.ReserveIdempotencyKey(reservation, now); err != nil {
+		t.Fatalf("Unable to reserve over an expired key: %v", err)
+	}
+	if err := s.ReserveIdempotencyKey(reservation, now); err != ErrIdempotencyKeyExists {
+		t.Errorf("Expected ErrIdempotencyKeyExists for a reserved key, got %v", err)
+	}
+
+	if err := s.ReleaseIdempotencyKey("alice", "k"); err != nil {
+		t.Fatalf("Unable to release an idempotency key: %v", err)
+	}
+	if err := s.ReserveIdempotencyKey(reservation, now); err != nil {
+		t.Errorf("Expected to reserve a released key, got %v", err)
+	}
+}
+
+func TestMongoInsertJobWithinQuota(t *testing.T) {
+	s := mongoStorage(t)
+
+	job := SubmittedJob{Job: Job{Command: "true"}, Account: "alice", Status: StatusQueued}
+	for i := 0; i < 2; i++ {
+		if _, err := s.InsertJobWithinQuota(job, 2); err != nil {
+			t.Fatalf("Unable to insert job %d within the quota: %v", i, err)
+		}
+	}
+	if _, err := s.InsertJobWithinQuota(job, 2); err != ErrQuotaExceeded {
+		t.Fatalf("Expected ErrQuotaExceeded, got %v", err)
+	}
+	if count, _ := s.CountJobs(JobQuery{AccountName: "alice"}); count != 2 {
+		t.Errorf("Expected the refused job to be removed, but alice has %d jobs", count)
+	}
+
+	job.Account = "bob"
+	if _, err := s.InsertJobWithinQuota(job, 2); err != nil {
+		t.Errorf("Expected another account's job to be inserted, got %v", err)
+	}
+}
+
+func TestMongoListRuns(t *testing.T) {
+	s := mongoStorage(t)
+
+	ms := StoredTime(time.Millisecond)
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true", RunID: "weekly"}, Account: "alice", Status: StatusDone, CreatedAt: 10*ms + 900},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusDone, CreatedAt: 10*ms + 100},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusQueued, CreatedAt: 30 * ms},
+		{Job: Job{Command: "true", RunID: "hourly"}, Account: "alice", Status: StatusDone, CreatedAt: 20 * ms},
+		{Job: Job{Command: "true", RunID: "daily"}, Account: "bob", Status: StatusDone, CreatedAt: 1},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	runs, err := s.ListRuns("alice", RunCursor{}, 2)
+	if err != nil {
+		t.Fatalf("Unable to list runs: %v", err)
+	}
+	if len(runs) != 2 || runs[0].RunID != "nightly" || runs[1].RunID != "weekly" {
+		t.Fatalf("Unexpected first page: %+v", runs)
+	}
+	if runs[0].CreatedAt != 10*ms+100 || runs[0].TotalJobs != 2 || runs[0].Completed != 1 {
+		t.Errorf("Unexpected run summary: %+v", runs[0])
+	}
+
+	// Runs in the cursor's millisecond that sort after its run ID are still listed.
+	runs, err = s.ListRuns("alice", RunCursor{CreatedAt: 10 * ms, RunID: "nightly"}, 2)
+	if err != nil {
+		t.Fatalf("Unable to list runs: %v", err)
+	}
+	if len(runs) != 2 || runs[0].RunID != "weekly" || runs[1].RunID != "hourly" {
+		t.Errorf("Unexpected second page: %+v", runs)
+	}
+}
+
+func TestMongoCancelJobs(t *testing.T) {
+	s := mongoStorage(t)
+
+	for _, job := range []SubmittedJob{
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusQueued},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusProcessing},
+		{Job: Job{Command: "true", RunID: "nightly"}, Account: "alice", Status: StatusDone},
+		{Job: Job{Command: "true", RunID: "weekly"}, Account: "alice", Status: StatusQueued},
+	} {
+		if _, err := s.InsertJob(job); err != nil {
+			t.Fatalf("Unable to insert a job: %v", err)
+		}
+	}
+
+	cancelled, err := s.CancelJobs(JobQuery{AccountName: "alice", RunID: "nightly"})
+	if err != nil {
+		t.Fatalf("Unable to cancel jobs: %v", err)
+	}
+	if cancelled != 2 {
+		t.Errorf("Expected two jobs to be cancelled, got %d", cancelled)
+	}
+
+	jobs, err := s.ListJobs(JobQuery{AccountName: "alice"})
+	if err != nil {
+		t.Fatalf("Unable to list jobs: %v", err)
+	}
+	expected := []struct {
+		status string
+		killed bool
+	}{
+		{StatusKilled, true}, {StatusProcessing, true}, {StatusDone, false}, {StatusQueued, false},
+	}
+	for i, job := range jobs {
+		if job.Status != expected[i].status || job.KillRequested != expected[i].killed {
+			t.Errorf("Unexpected job [%d]: [%s] kill requested [%v]", job.JID, job.Status, job.KillRequested)
+		}
+	}
+}
+
+func TestMongoGetAPIKeyHash(t *testing.T) {
+	s := mongoStorage(t)
+
+	if err := s.CreateAccount(Account{Name: "alice"}, "s3cret"); err != nil {
+		t.Fatalf("Unable to create an account: %v", err)
+	}
+	if hash, err := s.GetAPIKeyHash("alice"); err != nil || hash != HashAPIKey("s3cret") {
+		t.Errorf("Unexpected API key hash: [%s], %v", hash, err)
+	}
+
+	if _, err := s.GetAccount("bob"); err != nil {
+		t.Fatalf("Unable to load an account: %v", err)
+	}
+	if hash, err := s.GetAPIKeyHash("bob"); err != nil || hash != "" {
+		t.Errorf("Expected no hash for an account without one, got [%s], %v", hash, err)
+	}
+	if _, err := s.GetAPIKeyHash("carol"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing account, got %v", err)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import "sync"
+
+// outputBufferSize is the number of chunks that may be waiting for a slow subscriber before further
+// chunks are dropped.
+const outputBufferSize = 64
+
+// OutputChunk is a piece of output written by a running job to one of its streams.
+type OutputChunk struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// OutputBroker delivers output from running jobs to any subscribers that are watching them, keyed by
+// JID. A nil OutputBroker silently discards everything, so contexts built without one still work.
+type OutputBroker struct {
+	lock        sync.Mutex
+	subscribers map[uint64][]chan OutputChunk
+}
+
+// NewOutputBroker creates an OutputBroker without any subscribers.
+func NewOutputBroker() *OutputBroker {
+	return &OutputBroker{subscribers: make(map[uint64][]chan OutputChunk)}
+}
+
+// Subscribe begins receiving output from a job. The returned channel is closed once the job
+// completes. Call the returned function to stop receiving output early.
+func (b *OutputBroker) Subscribe(jid uint64) (<-chan OutputChunk, func()) {
+	ch := make(chan OutputChunk, outputBufferSize)
+	if b == nil {
+		close(ch)
+		return ch, func() {}
+	}
+
+	b.lock.Lock()
+	b.subscribers[jid] = append(b.subscribers[jid], ch)
+	b.lock.Unlock()
+
+	unsubscribe := func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+
+		subs := b.subscribers[jid]
+		for i, each := range subs {
+			if each == ch {
+				b.subscribers[jid] = append(subs[:i], subs[i+1:]...)
+				close(ch)
+				break
+			}
+		}
+		if len(b.subscribers[jid]) == 0 {
+			delete(b.subscribers, jid)
+		}
+	}
+	return ch, unsubscribe
+}
+
+// Publish delivers a chunk of output to each of a job's subscribers. Subscribers that have fallen
+// too far behind miss the chunk rather than blocking the job.
+func (b *OutputBroker) Publish(jid uint64, chunk OutputChunk) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, ch := range b.subscribers[jid] {
+		select {
+		case ch <- chunk:
+		default:
+		}
+	}
+}
+
+// Close closes the channels of all of a job's subscribers. It's called when the job completes.
+func (b *OutputBroker) Close(jid uint64) {
+	if b == nil {
+		return
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for _, ch := range b.subscribers[jid] {
+		close(ch)
+	}
+	delete(b.subscribers, jid)
+}
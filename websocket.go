@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// webSocketCloseTimeout is how long a server waits to send a close frame before it gives up and
+// closes the connection anyway.
+const webSocketCloseTimeout = time.Second
+
+// WebSocket is the server side of a WebSocket connection. It only supports sending text messages.
+// Anything else the client sends is read and discarded, so that pings are answered and a close from
+// the client is noticed.
+type WebSocket struct {
+	conn   *websocket.Conn
+	closed chan struct{}
+}
+
+// webSocketOriginAllowed returns true if a WebSocket handshake may be accepted from a request's
+// Origin. Clients that aren't browsers don't send one, and are always allowed. Browsers are only
+// allowed from the configured AllowedOrigins, so that other sites can't use a visitor's credentials
+// to read job output.
+func webSocketOriginAllowed(c *Context, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	return origin == "" || originAllowed(c.AllowedOrigins, origin)
+}
+
+// UpgradeWebSocket performs a WebSocket handshake on an incoming request and takes over its
+// connection. If the request isn't a valid WebSocket handshake from an allowed origin, an error is
+// reported to w on behalf of account and nil is returned.
+func UpgradeWebSocket(c *Context, w http.ResponseWriter, r *http.Request, account *Account) *WebSocket {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool { return webSocketOriginAllowed(c, r) },
+		Error: func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+			APIError{
+				Code:    CodeWebSocketRequired,
+				Message: fmt.Sprintf("Unable to open a WebSocket: %v", reason),
+				Hint:    "Connect to this endpoint with a WebSocket client, from an allowed origin.",
+				Retry:   false,
+			}.Log(account).Report(status, w)
+		},
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil
+	}
+
+	ws := &WebSocket{conn: conn, closed: make(chan struct{})}
+	go ws.readIncoming()
+	return ws
+}
+
+// readIncoming reads and discards messages from the client until the connection is closed. Reading
+// is what answers pings and close frames.
+func (ws *WebSocket) readIncoming() {
+	defer close(ws.closed)
+	for {
+		if _, _, err := ws.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+// Closed returns a channel that's closed once the client disconnects.
+func (ws *WebSocket) Closed() <-chan struct{} {
+	return ws.closed
+}
+
+// WriteText sends a text message to the client.
+func (ws *WebSocket) WriteText(message []byte) error {
+	return ws.conn.WriteMessage(websocket.TextMessage, message)
+}
+
+// Close sends a normal close frame and closes the underlying connection.
+func (ws *WebSocket) Close() error {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	ws.conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(webSocketCloseTimeout))
+	return ws.conn.Close()
+}